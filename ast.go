@@ -7,14 +7,17 @@ import (
 
 type Ast struct {
 	//Path  string
-	Ln     int
-	Col    int
-	S      string
-	Name   string
-	Token  string
-	Nodes  []*Ast
-	Parent *Ast
-	Data   interface{}
+	Ln      int
+	Col     int
+	Pos     int // Byte offset in the input
+	S       string
+	Name    string
+	Token   string
+	Nodes   []*Ast
+	Parent  *Ast
+	Data    interface{}
+	Error   bool   // Produced by a recovery expression
+	Capture string // Label of the expression that produced the node, such as lhs in lhs:EXPR
 }
 
 func (ast *Ast) String() string {
@@ -25,17 +28,21 @@ func astToS(ast *Ast, s string, level int) string {
 	for i := 0; i < level; i++ {
 		s = s + "  "
 	}
+	name := ast.Name
+	if len(ast.Capture) > 0 {
+		name = ast.Capture + ":" + name
+	}
 	if len(ast.Token) > 0 {
 		if ast.Data != nil {
-			s = fmt.Sprintf("%s- %s (%s) [%v]\n", s, ast.Name, strconv.Quote(ast.Token), ast.Data)
+			s = fmt.Sprintf("%s- %s (%s) [%v]\n", s, name, strconv.Quote(ast.Token), ast.Data)
 		} else {
-			s = fmt.Sprintf("%s- %s (%s)\n", s, ast.Name, strconv.Quote(ast.Token))
+			s = fmt.Sprintf("%s- %s (%s)\n", s, name, strconv.Quote(ast.Token))
 		}
 	} else {
 		if ast.Data != nil {
-			s = fmt.Sprintf("%s+ %s [%v]\n", s, ast.Name, ast.Data)
+			s = fmt.Sprintf("%s+ %s [%v]\n", s, name, ast.Data)
 		} else {
-			s = fmt.Sprintf("%s+ %s\n", s, ast.Name)
+			s = fmt.Sprintf("%s+ %s\n", s, name)
 		}
 	}
 	for _, node := range ast.Nodes {
@@ -47,22 +54,25 @@ func astToS(ast *Ast, s string, level int) string {
 func (p *Parser) EnableAst() (err error) {
 	for name, rule := range p.Grammar {
 		nm := name
+		rec := rule.Recovery
 		if rule.isToken() {
 			rule.Action = func(v *Values, d Any) (Any, error) {
-				ln, col := lineInfo(v.SS, v.Pos)
-				ast := &Ast{Ln: ln, Col: col, S: v.S, Name: nm, Token: v.Token()}
+				ln, col := v.LineInfo()
+				ast := &Ast{Ln: ln, Col: col, Pos: v.Pos, S: v.S, Name: nm, Token: v.Token(), Error: rec}
 				return ast, nil
 			}
 		} else {
 			rule.Action = func(v *Values, d Any) (Any, error) {
-				ln, col := lineInfo(v.SS, v.Pos)
+				ln, col := v.LineInfo()
 
 				var nodes []*Ast
-				for _, val := range v.Vs {
-					nodes = append(nodes, val.(*Ast))
+				for i, val := range v.Vs {
+					node := val.(*Ast)
+					node.Capture = v.captureName(i)
+					nodes = append(nodes, node)
 				}
 
-				ast := &Ast{Ln: ln, Col: col, S: v.S, Name: nm, Nodes: nodes}
+				ast := &Ast{Ln: ln, Col: col, Pos: v.Pos, S: v.S, Name: nm, Nodes: nodes, Error: rec}
 				for _, node := range nodes {
 					node.Parent = ast
 				}
@@ -76,9 +86,9 @@ func (p *Parser) EnableAst() (err error) {
 }
 
 func (p *Parser) ParseAndGetAst(s string, d Any) (ast *Ast, err *Error) {
-	if val, err := p.ParseAndGetValue(s, d); err == nil {
-		ast = val.(*Ast)
-	}
+	var val Any
+	val, err = p.ParseAndGetValue(s, d)
+	ast, _ = val.(*Ast)
 	return
 }
 
@@ -98,19 +108,26 @@ func (o *AstOptimizer) Optimize(org *Ast, par *Ast) *Ast {
 		}
 	}
 
-	if opt && len(org.Nodes) == 1 {
+	if opt && len(org.Nodes) == 1 && !org.Error {
 		chl := o.Optimize(org.Nodes[0], par)
+		if len(org.Capture) > 0 {
+			// The node takes the place of its parent
+			chl.Capture = org.Capture
+		}
 		return chl
 	}
 
 	ast := &Ast{
-		Ln:     org.Ln,
-		Col:    org.Col,
-		S:      org.S,
-		Name:   org.Name,
-		Token:  org.Token,
-		Parent: par,
-		Data:   org.Data,
+		Ln:      org.Ln,
+		Col:     org.Col,
+		Pos:     org.Pos,
+		S:       org.S,
+		Name:    org.Name,
+		Token:   org.Token,
+		Parent:  par,
+		Data:    org.Data,
+		Error:   org.Error,
+		Capture: org.Capture,
 	}
 	for _, node := range org.Nodes {
 		chl := o.Optimize(node, ast)
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/yhirose/go-peg"
+)
+
+var diagramUsageMessage = `usage: peglint diagram [-o dir] [grammar path]
+
+peglint diagram writes railroad diagrams of the rules of a given PEG grammar file. Each rule gets a NAME.svg diagram and a NAME.html page with its definition and diagram, where referenced rules link to their pages. index.html lists all rules.
+
+The -o 'dir' specifies the output directory. The default is the current directory.
+`
+
+func diagramMain(args []string) {
+	fs := flag.NewFlagSet("diagram", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, diagramUsageMessage)
+		os.Exit(1)
+	}
+	outDir := fs.String("o", ".", "output directory")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+	}
+
+	dat, err := ioutil.ReadFile(fs.Arg(0))
+	check(err)
+
+	parser, perr := peg.NewParser(string(dat))
+	pcheck(perr)
+
+	check(os.MkdirAll(*outDir, 0755))
+
+	files := peg.DiagramPages(parser)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		check(ioutil.WriteFile(filepath.Join(*outDir, name), files[name], 0644))
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/yhirose/go-peg"
+)
+
+var fmtUsageMessage = `usage: peglint fmt [-width n] [-l] [grammar path ...]
+
+peglint fmt rewrites the given PEG grammar files in the canonical style. Arrows are aligned, literals and character classes are written with the same quotes and escapes, choices longer than the line width get one alternative per line, and comments stay with their rules. Without a path, it formats standard input to standard output.
+
+The -width 'n' specifies the line width above which choices are wrapped. The default is 80.
+
+The -l flag lists the files whose formatting differs instead of rewriting them.
+`
+
+func fmtMain(args []string) {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, fmtUsageMessage)
+		os.Exit(1)
+	}
+	width := fs.Int("width", 80, "line width")
+	list := fs.Bool("l", false, "list files whose formatting differs")
+	fs.Parse(args)
+
+	opts := peg.FormatOptions{Width: *width}
+
+	if fs.NArg() == 0 {
+		dat, err := ioutil.ReadAll(os.Stdin)
+		check(err)
+		out, perr := peg.Format(string(dat), opts)
+		pcheck(perr)
+		os.Stdout.Write(out)
+		return
+	}
+
+	for _, path := range fs.Args() {
+		dat, err := ioutil.ReadFile(path)
+		check(err)
+		out, perr := peg.Format(string(dat), opts)
+		if perr != nil {
+			fmt.Fprintln(os.Stderr, path)
+			pcheck(perr)
+		}
+		if bytes.Equal(dat, out) {
+			continue
+		}
+		if *list {
+			fmt.Println(path)
+			continue
+		}
+		check(ioutil.WriteFile(path, out, 0644))
+	}
+}
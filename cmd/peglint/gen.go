@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/yhirose/go-peg"
+)
+
+var genUsageMessage = `usage: peglint gen [-package name] [-prefix name] [-o path] [grammar path]
+
+peglint gen generates Go source of a standalone parser for a given PEG grammar file. The generated parser only depends on the github.com/yhirose/go-peg/pegrt package.
+
+The -package 'name' specifies the package name of the generated file. The default is 'main'.
+
+The -prefix 'name' specifies the prefix of the generated type names. The parser type is named 'nameParser'.
+
+The -o 'path' specifies the output file path. The default is standard output.
+`
+
+func genMain(args []string) {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, genUsageMessage)
+		os.Exit(1)
+	}
+	pkg := fs.String("package", "main", "package name")
+	prefix := fs.String("prefix", "", "type name prefix")
+	outPath := fs.String("o", "", "output file path")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+	}
+
+	dat, err := ioutil.ReadFile(fs.Arg(0))
+	check(err)
+
+	src, perr := peg.Generate(string(dat), peg.GenOptions{Package: *pkg, Prefix: *prefix})
+	pcheck(perr)
+
+	if *outPath == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	check(ioutil.WriteFile(*outPath, src, 0644))
+}
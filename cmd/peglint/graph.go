@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/yhirose/go-peg"
+)
+
+var graphUsageMessage = `usage: peglint graph [-format dot|json] [-o path] [grammar path]
+
+peglint graph exports the rule reference graph of a given PEG grammar file, including macro references and the %recover rules of labels. It marks the start rule, %whitespace, %word, rules unreachable from them, and strongly connected components of mutually recursive rules.
+
+The -format 'dot|json' specifies the output format. 'dot' is the Graphviz DOT language, and 'json' lists the nodes, edges and strongly connected components. The default is 'dot'.
+
+The -o 'path' specifies the output file path. The default is standard output.
+`
+
+func graphMain(args []string) {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, graphUsageMessage)
+		os.Exit(1)
+	}
+	format := fs.String("format", "dot", "output format")
+	outPath := fs.String("o", "", "output file path")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+	}
+
+	dat, err := ioutil.ReadFile(fs.Arg(0))
+	check(err)
+
+	parser, perr := peg.NewParser(string(dat))
+	pcheck(perr)
+
+	g := parser.Graph()
+
+	var out []byte
+	switch *format {
+	case "dot":
+		out = []byte(g.Dot())
+	case "json":
+		out, err = json.MarshalIndent(g, "", "  ")
+		check(err)
+		out = append(out, '\n')
+	default:
+		fs.Usage()
+	}
+
+	if *outPath == "" {
+		os.Stdout.Write(out)
+		return
+	}
+	check(ioutil.WriteFile(*outPath, out, 0644))
+}
@@ -10,29 +10,47 @@ import (
 	"github.com/yhirose/go-peg"
 )
 
-var usageMessage = `usage: peglint [-ast] [-opt] [-trace] [-f path] [-s string] [grammar path]
+var usageMessage = `usage: peglint [-lint] [-ast] [-opt] [-packrat] [-trace] [-f path] [-s string] [grammar path]
+       peglint gen [-package name] [-prefix name] [-o path] [grammar path]
+       peglint fmt [-width n] [-l] [grammar path ...]
+       peglint diagram [-o dir] [grammar path]
+       peglint graph [-format dot|json] [-o path] [grammar path]
 
 peglint checks syntax of a given PEG grammar file and reports errors. If the check is successful and a user gives a source file for the grammar, it will also check syntax of the source file.
 
+The -lint flag also reports warnings about rules that can't be reached from the start rule, alternatives shadowed by an earlier literal, repetitions of expressions that can match empty input, and %binop operators that the binary operator rule never produces. peglint exits with status 1 if there are warnings.
+
 The -ast flag prints the AST (abstract syntax tree) of the source file.
 
 The -opt flag prints the optimized AST (abstract syntax tree) of the source file.
 
+The -packrat flag enables packrat parsing and prints memoization statistics on standard error.
+
 The -trace flag can be used with the source file. It prints names of rules and operators that the PEG parser detects on standard error.
 
 The -f 'path' specifies a file path to the source text.
 
 The -s 'string' specifies the source text.
+
+The gen command generates Go source of a standalone parser. Run 'peglint gen -h' for details.
+
+The fmt command rewrites grammar files in the canonical style. Run 'peglint fmt -h' for details.
+
+The diagram command writes railroad diagrams of the rules. Run 'peglint diagram -h' for details.
+
+The graph command exports the rule reference graph. Run 'peglint graph -h' for details.
 `
 
 func usage() {
-	fmt.Fprintf(os.Stderr, usageMessage)
+	fmt.Fprint(os.Stderr, usageMessage)
 	os.Exit(1)
 }
 
 var (
+	lintFlag       = flag.Bool("lint", false, "report grammar warnings")
 	astFlag        = flag.Bool("ast", false, "show ast")
 	optFlag        = flag.Bool("opt", false, "show optimized ast")
+	packratFlag    = flag.Bool("packrat", false, "enable packrat parsing")
 	traceFlag      = flag.Bool("trace", false, "show trace message")
 	sourceFilePath = flag.String("f", "", "source file path")
 	sourceString   = flag.String("s", "", "source string")
@@ -87,6 +105,23 @@ func SetupTracer(p *peg.Parser) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gen":
+			genMain(os.Args[2:])
+			return
+		case "fmt":
+			fmtMain(os.Args[2:])
+			return
+		case "diagram":
+			diagramMain(os.Args[2:])
+			return
+		case "graph":
+			graphMain(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Usage = usage
 	flag.Parse()
 	args := flag.Args()
@@ -98,6 +133,19 @@ func main() {
 	dat, err := ioutil.ReadFile(args[0])
 	check(err)
 
+	// Warnings come first, as some of them are errors for NewParser
+	if *lintFlag {
+		warnings, perr := peg.Lint(string(dat))
+		pcheck(perr)
+		for _, w := range warnings {
+			fmt.Println(w)
+		}
+		if len(warnings) > 0 {
+			// Deferred first so that it runs after the profile is written
+			defer os.Exit(1)
+		}
+	}
+
 	parser, perr := peg.NewParser(string(dat))
 	pcheck(perr)
 
@@ -128,6 +176,13 @@ func main() {
 			parser.EnableAst()
 		}
 
+		if *packratFlag {
+			parser.EnablePackratParsing()
+			parser.PackratStats = func(stats peg.PackratStats) {
+				fmt.Fprintf(os.Stderr, "packrat: %d hits, %d misses\n", stats.Hits, stats.Misses)
+			}
+		}
+
 		if *profPath != "" {
 			f, err := os.Create(*profPath)
 			check(err)
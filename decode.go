@@ -0,0 +1,175 @@
+package peg
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Error of Ast.Decode
+type DecodeError struct {
+	Ln   int
+	Col  int
+	Pos  int // Byte offset of the node in the input
+	Rule string
+	Msg  string
+	Err  error // Error of the conversion or of DecodeAst
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%d:%d %s: %s", e.Ln, e.Col, e.Rule, e.Msg)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Type that decodes itself from an AST node
+type AstDecoder interface {
+	DecodeAst(ast *Ast) error
+}
+
+var astDecoderType = reflect.TypeOf((*AstDecoder)(nil)).Elem()
+var astType = reflect.TypeOf((*Ast)(nil))
+
+// Fill the value that out points to from the AST, as encoding/json fills
+// values from JSON. Struct fields tagged with a rule name, such as
+// `peg:"NUMBER"`, are decoded from the child nodes of that rule: slice fields
+// get all of them, and other fields get the only one or stay as they are when
+// the rule didn't match. Other slices get all child nodes. Strings, numbers
+// and booleans are converted from the token of a node, or from its text if it
+// isn't a token. *Ast values get the node itself, and AstDecoder types decode
+// themselves.
+func (ast *Ast) Decode(out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("peg: Decode of non-pointer %v", reflect.TypeOf(out))
+	}
+	return decodeAst(ast, rv.Elem())
+}
+
+// Error at a node, caused by err if it isn't nil
+func decodeError(ast *Ast, err error, format string, a ...interface{}) error {
+	return &DecodeError{Ln: ast.Ln, Col: ast.Col, Pos: ast.Pos, Rule: ast.Name, Msg: fmt.Sprintf(format, a...), Err: err}
+}
+
+// Token of a node, or its text
+func astText(ast *Ast) string {
+	if len(ast.Nodes) == 0 && len(ast.Token) > 0 {
+		return ast.Token
+	}
+	return ast.S
+}
+
+func decodeAst(ast *Ast, rv reflect.Value) error {
+	if rv.Type() == astType {
+		rv.Set(reflect.ValueOf(ast))
+		return nil
+	}
+	if rv.CanAddr() && rv.Addr().Type().Implements(astDecoderType) {
+		if err := rv.Addr().Interface().(AstDecoder).DecodeAst(ast); err != nil {
+			if _, ok := err.(*DecodeError); ok {
+				return err
+			}
+			return decodeError(ast, err, "%s", err)
+		}
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return decodeAst(ast, rv.Elem())
+
+	case reflect.Struct:
+		return decodeStruct(ast, rv)
+
+	case reflect.Slice:
+		return decodeSlice(ast.Nodes, rv)
+
+	case reflect.String:
+		rv.SetString(astText(ast))
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(astText(ast))
+		if err != nil {
+			return decodeError(ast, err, "cannot convert %q to %v", astText(ast), rv.Type())
+		}
+		rv.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(astText(ast), 10, rv.Type().Bits())
+		if err != nil {
+			return decodeError(ast, err, "cannot convert %q to %v", astText(ast), rv.Type())
+		}
+		rv.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(astText(ast), 10, rv.Type().Bits())
+		if err != nil {
+			return decodeError(ast, err, "cannot convert %q to %v", astText(ast), rv.Type())
+		}
+		rv.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(astText(ast), rv.Type().Bits())
+		if err != nil {
+			return decodeError(ast, err, "cannot convert %q to %v", astText(ast), rv.Type())
+		}
+		rv.SetFloat(f)
+
+	default:
+		return decodeError(ast, nil, "cannot decode into %v", rv.Type())
+	}
+	return nil
+}
+
+func decodeSlice(nodes []*Ast, rv reflect.Value) error {
+	s := reflect.MakeSlice(rv.Type(), len(nodes), len(nodes))
+	for i, node := range nodes {
+		if err := decodeAst(node, s.Index(i)); err != nil {
+			return err
+		}
+	}
+	rv.Set(s)
+	return nil
+}
+
+func decodeStruct(ast *Ast, rv reflect.Value) error {
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("peg")
+		if len(name) == 0 || name == "-" || len(f.PkgPath) > 0 {
+			continue
+		}
+
+		var nodes []*Ast
+		for _, node := range ast.Nodes {
+			if node.Name == name {
+				nodes = append(nodes, node)
+			}
+		}
+
+		fv := rv.Field(i)
+		if fv.Kind() == reflect.Slice && !reflect.PtrTo(fv.Type()).Implements(astDecoderType) {
+			if err := decodeSlice(nodes, fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch len(nodes) {
+		case 0:
+		case 1:
+			if err := decodeAst(nodes[0], fv); err != nil {
+				return err
+			}
+		default:
+			return decodeError(nodes[1], nil, "%s matched %d times for field %s", name, len(nodes), f.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package peg
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type decodeColor int
+
+var errUnknownColor = errors.New("unknown color")
+
+func (c *decodeColor) DecodeAst(ast *Ast) error {
+	switch ast.Token {
+	case "#red":
+		*c = 1
+	case "#blue":
+		*c = 2
+	default:
+		return fmt.Errorf("%w %q", errUnknownColor, ast.Token)
+	}
+	return nil
+}
+
+type decodeItem struct {
+	Name   string      `peg:"NAME"`
+	Value  *int        `peg:"NUMBER"`
+	Ratio  float64     `peg:"FLOAT"`
+	Flag   bool        `peg:"BOOL"`
+	Color  decodeColor `peg:"COLOR"`
+	Tags   []string    `peg:"TAG"`
+	Node   *Ast        `peg:"NAME"`
+	Ignore string      `peg:"-"`
+	Other  string
+	Child  *decodeChild `peg:"CHILD"`
+}
+
+type decodeChild struct {
+	Sizes []uint8 `peg:"NUMBER"`
+}
+
+func newDecodeParser(t *testing.T) *Parser {
+	parser, err := NewParser(`
+        LIST   <- ITEM (',' ITEM)*
+        ITEM   <- NAME '=' (FLOAT / NUMBER / BOOL / COLOR / CHILD)? TAG*
+        CHILD  <- '(' NUMBER* ')'
+        NAME   <- < [a-z]+ >
+        NUMBER <- < '-'? [0-9]+ >
+        FLOAT  <- < [0-9]+ '.' [0-9]+ >
+        BOOL   <- < 'true' / 'false' >
+        COLOR  <- < '#' [a-z]+ >
+        TAG    <- < '@' [a-z]+ >
+        %whitespace <- [ \t]*
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.EnableAst()
+	return parser
+}
+
+func TestDecode(t *testing.T) {
+	parser := newDecodeParser(t)
+
+	ast, perr := parser.ParseAndGetAst("a = 12 @x @y, b = 0.5, c = true, d = #blue, e = (1 2 3), f =", nil)
+	assert(t, perr == nil)
+
+	var items []decodeItem
+	err := ast.Decode(&items)
+	assert(t, err == nil)
+	assert(t, len(items) == 6)
+
+	assert(t, items[0].Name == "a" && *items[0].Value == 12 && strings.Join(items[0].Tags, " ") == "@x @y")
+	assert(t, items[0].Node.Name == "NAME" && items[0].Node.Token == "a")
+	assert(t, items[1].Ratio == 0.5 && items[1].Value == nil && items[1].Tags != nil && len(items[1].Tags) == 0)
+	assert(t, items[2].Flag)
+	assert(t, items[3].Color == 2)
+	assert(t, items[4].Child != nil && len(items[4].Child.Sizes) == 3 && items[4].Child.Sizes[2] == 3)
+	assert(t, items[5].Name == "f" && items[5].Child == nil)
+
+	// Structs are filled from the child nodes of a node
+	var item decodeItem
+	err = ast.Nodes[0].Decode(&item)
+	assert(t, err == nil && item.Name == "a")
+
+	var n int
+	err = ast.Nodes[0].Nodes[1].Decode(&n)
+	assert(t, err == nil && n == 12)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	parser := newDecodeParser(t)
+
+	decode := func(s string, out interface{}) string {
+		ast, perr := parser.ParseAndGetAst(s, nil)
+		assert(t, perr == nil)
+		if err := ast.Decode(out); err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+
+	var items []decodeItem
+	assert(t, decode("a = 1, b = (1 256)", &items) == "1:15 NUMBER: cannot convert \"256\" to uint8")
+	assert(t, decode("a = 1, b = #green", &items) == "1:12 COLOR: unknown color \"#green\"")
+
+	var one []struct {
+		Name string `peg:"NAME"`
+	}
+	assert(t, decode("a = 1", &one) == "")
+
+	var numbers []struct {
+		Number int `peg:"NUMBER"`
+	}
+	assert(t, decode("a = 99999999999999999999", &numbers) == "1:5 NUMBER: cannot convert \"99999999999999999999\" to int")
+
+	var names []struct {
+		Name chan int `peg:"NAME"`
+	}
+	assert(t, decode("a = 1", &names) == "1:1 NAME: cannot decode into chan int")
+
+	var twice struct {
+		Item decodeItem `peg:"ITEM"`
+	}
+	assert(t, decode("a = 1, b = 2", &twice) == "1:8 ITEM: ITEM matched 2 times for field Item")
+
+	ast, _ := parser.ParseAndGetAst("a = 1", nil)
+	assert(t, ast.Decode(items) != nil)
+}
+
+func TestDecodeErrorCause(t *testing.T) {
+	parser := newDecodeParser(t)
+
+	decode := func(s string, out interface{}) *DecodeError {
+		ast, perr := parser.ParseAndGetAst(s, nil)
+		assert(t, perr == nil)
+		var derr *DecodeError
+		assert(t, errors.As(ast.Decode(out), &derr))
+		return derr
+	}
+
+	var items []decodeItem
+	err := decode("a = 1, b = (1 256)", &items)
+	assert(t, err.Pos == 14 && err.Ln == 1 && err.Col == 15)
+	assert(t, errors.Is(err, strconv.ErrRange))
+
+	err = decode("a = 1,  b = #green", &items)
+	assert(t, err.Pos == 12 && err.Col == 13)
+	assert(t, errors.Is(err, errUnknownColor))
+
+	var names []struct {
+		Name chan int `peg:"NAME"`
+	}
+	err = decode("a = 1", &names)
+	assert(t, err.Pos == 0 && err.Err == nil)
+}
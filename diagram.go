@@ -0,0 +1,471 @@
+package peg
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Railroad diagram layout, in pixels
+const (
+	railCharWidth = 8
+	railBoxHeight = 22
+	railBoxPad    = 10
+	railGap       = 10
+	railArc       = 10
+	railVGap      = 8
+	railLabel     = 14
+	railMargin    = 20
+)
+
+// Node of a railroad diagram. It is entered on the left and left on the
+// right at the height of its main line, with up pixels above the line and
+// down pixels below it.
+type railNode interface {
+	size() (w, up, down int)
+	draw(b *strings.Builder, x, y int)
+}
+
+func railLine(b *strings.Builder, x, y, w int) {
+	if w > 0 {
+		fmt.Fprintf(b, `<path d="M%d %dh%d"/>`+"\n", x, y, w)
+	}
+}
+
+// Terminal, rule reference or other box with text
+type railBox struct {
+	text  string
+	class string
+	href  string
+}
+
+func (n *railBox) size() (int, int, int) {
+	return utf8.RuneCountInString(n.text)*railCharWidth + 2*railBoxPad, railBoxHeight / 2, railBoxHeight / 2
+}
+
+func (n *railBox) draw(b *strings.Builder, x, y int) {
+	w, up, _ := n.size()
+	if len(n.href) > 0 {
+		fmt.Fprintf(b, `<a href="%s">`, html.EscapeString(n.href))
+	}
+	rx := 0
+	if n.class == "terminal" {
+		rx = up
+	}
+	fmt.Fprintf(b, `<g class="%s"><rect x="%d" y="%d" width="%d" height="%d" rx="%d"/>`, n.class, x, y-up, w, railBoxHeight, rx)
+	fmt.Fprintf(b, `<text x="%d" y="%d">%s</text></g>`, x+w/2, y+4, html.EscapeString(n.text))
+	if len(n.href) > 0 {
+		b.WriteString(`</a>`)
+	}
+	b.WriteString("\n")
+}
+
+// Items one after another
+type railSequence struct {
+	items []railNode
+}
+
+func (n *railSequence) size() (w, up, down int) {
+	for i, item := range n.items {
+		iw, iup, idown := item.size()
+		if i > 0 {
+			w += railGap
+		}
+		w += iw
+		up = maxInt(up, iup)
+		down = maxInt(down, idown)
+	}
+	return
+}
+
+func (n *railSequence) draw(b *strings.Builder, x, y int) {
+	for i, item := range n.items {
+		if i > 0 {
+			railLine(b, x, y, railGap)
+			x += railGap
+		}
+		item.draw(b, x, y)
+		w, _, _ := item.size()
+		x += w
+	}
+}
+
+// Alternatives, the first one on the main line and the others below it
+type railChoice struct {
+	items []railNode
+}
+
+func (n *railChoice) layout() (inner int, offsets []int) {
+	offsets = make([]int, len(n.items))
+	prevDown := 0
+	for i, item := range n.items {
+		w, up, down := item.size()
+		inner = maxInt(inner, w)
+		if i > 0 {
+			offsets[i] = maxInt(offsets[i-1]+prevDown+railVGap+up, 2*railArc)
+		}
+		prevDown = down
+	}
+	return
+}
+
+func (n *railChoice) size() (int, int, int) {
+	inner, offsets := n.layout()
+	_, up, _ := n.items[0].size()
+	_, _, down := n.items[len(n.items)-1].size()
+	return inner + 4*railArc, up, offsets[len(offsets)-1] + down
+}
+
+func (n *railChoice) draw(b *strings.Builder, x, y int) {
+	inner, offsets := n.layout()
+	r := railArc
+	for i, item := range n.items {
+		w, _, _ := item.size()
+		iy := y + offsets[i]
+		if i == 0 {
+			railLine(b, x, y, 2*r)
+		} else {
+			fmt.Fprintf(b, `<path d="M%d %da%d %d 0 0 1 %d %dV%da%d %d 0 0 0 %d %d"/>`+"\n", x, y, r, r, r, r, iy-r, r, r, r, r)
+		}
+		item.draw(b, x+2*r, iy)
+		railLine(b, x+2*r+w, iy, inner-w)
+		if i == 0 {
+			railLine(b, x+2*r+inner, y, 2*r)
+		} else {
+			fmt.Fprintf(b, `<path d="M%d %da%d %d 0 0 0 %d %dV%da%d %d 0 0 1 %d %d"/>`+"\n", x+2*r+inner, iy, r, r, r, -r, y+r, r, r, r, -r)
+		}
+	}
+}
+
+// Item that repeats, with the way back below it
+type railLoop struct {
+	item railNode
+}
+
+func (n *railLoop) back() int {
+	_, _, down := n.item.size()
+	return maxInt(down+railVGap, 2*railArc)
+}
+
+func (n *railLoop) size() (int, int, int) {
+	w, up, _ := n.item.size()
+	return w + 4*railArc, up, n.back()
+}
+
+func (n *railLoop) draw(b *strings.Builder, x, y int) {
+	w, _, _ := n.item.size()
+	r := railArc
+	railLine(b, x, y, 2*r)
+	n.item.draw(b, x+2*r, y)
+	railLine(b, x+2*r+w, y, 2*r)
+	ly := y + n.back()
+	fmt.Fprintf(b, `<path d="M%d %da%d %d 0 0 1 %d %dV%da%d %d 0 0 1 %d %dH%da%d %d 0 0 1 %d %dV%da%d %d 0 0 1 %d %d"/>`+"\n",
+		x+2*r+w, y, r, r, r, r, ly-r, r, r, -r, r, x+2*r, r, r, -r, -r, y+r, r, r, r, -r)
+}
+
+// Item in a dashed box with a label, such as a predicate or a token
+type railGroup struct {
+	item  railNode
+	label string
+	class string
+}
+
+func (n *railGroup) size() (int, int, int) {
+	w, up, down := n.item.size()
+	w = maxInt(w, utf8.RuneCountInString(n.label)*railCharWidth)
+	return w + 2*railBoxPad, up + railBoxPad + railLabel, down + railBoxPad
+}
+
+func (n *railGroup) draw(b *strings.Builder, x, y int) {
+	w, up, down := n.size()
+	iw, _, _ := n.item.size()
+	fmt.Fprintf(b, `<g class="%s"><rect x="%d" y="%d" width="%d" height="%d"/>`, n.class, x, y-up, w, up+down)
+	fmt.Fprintf(b, `<text x="%d" y="%d">%s</text></g>`+"\n", x+4, y-up+railLabel-2, html.EscapeString(n.label))
+	railLine(b, x, y, railBoxPad)
+	n.item.draw(b, x+railBoxPad, y)
+	railLine(b, x+railBoxPad+iw, y, w-railBoxPad-iw)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// diagramBuilder
+type diagramBuilder struct {
+	*visitorBase
+	href func(name string) string
+	refs []string
+	node railNode
+}
+
+func (v *diagramBuilder) build(ope operator) railNode {
+	ope.accept(v)
+	return v.node
+}
+
+func (v *diagramBuilder) box(text string, class string) {
+	v.node = &railBox{text: text, class: class}
+}
+
+func (v *diagramBuilder) group(ope operator, label string, class string) {
+	v.node = &railGroup{item: v.build(ope), label: label, class: class}
+}
+
+// Link of a referenced rule
+func (v *diagramBuilder) link(name string) string {
+	found := false
+	for _, ref := range v.refs {
+		found = found || ref == name
+	}
+	if !found {
+		v.refs = append(v.refs, name)
+	}
+	if v.href == nil {
+		return ""
+	}
+	return v.href(name)
+}
+
+func (v *diagramBuilder) visitSequence(ope *sequence) {
+	n := &railSequence{}
+	for _, o := range ope.opes {
+		n.items = append(n.items, v.build(o))
+	}
+	if len(n.items) == 1 {
+		v.node = n.items[0]
+		return
+	}
+	v.node = n
+}
+func (v *diagramBuilder) visitPrioritizedChoice(ope *prioritizedChoice) {
+	if len(ope.opes) == 0 {
+		v.box("fail", "special")
+		return
+	}
+
+	// Flattened alternatives are grouped again to keep their choice
+	n := &railChoice{}
+	for i := 0; i < len(ope.opes); {
+		j := i + 1
+		for j < len(ope.opes) && ope.choice(j) == ope.choice(i) {
+			j++
+		}
+		if j-i > 1 {
+			n.items = append(n.items, v.build(ChoCore(ope.opes[i:j])))
+		} else {
+			n.items = append(n.items, v.build(ope.opes[i]))
+		}
+		i = j
+	}
+	if len(n.items) == 1 {
+		v.node = n.items[0]
+		return
+	}
+	v.node = n
+}
+func (v *diagramBuilder) visitZeroOrMore(ope *zeroOrMore) {
+	v.node = &railChoice{items: []railNode{&railLoop{item: v.build(ope.ope)}, &railSequence{}}}
+}
+func (v *diagramBuilder) visitOneOrMore(ope *oneOrMore) {
+	v.node = &railLoop{item: v.build(ope.ope)}
+}
+func (v *diagramBuilder) visitOption(ope *option) {
+	v.node = &railChoice{items: []railNode{v.build(ope.ope), &railSequence{}}}
+}
+func (v *diagramBuilder) visitAndPredicate(ope *andPredicate) {
+	v.group(ope.ope, "& followed by", "predicate")
+}
+func (v *diagramBuilder) visitNotPredicate(ope *notPredicate) {
+	v.group(ope.ope, "! not followed by", "predicate")
+}
+func (v *diagramBuilder) visitLiteralString(ope *literalString) {
+	// A merged literal is drawn as the literals it was merged from
+	if len(ope.parts) > 0 {
+		n := &railSequence{}
+		for _, part := range ope.parts {
+			n.items = append(n.items, v.build(part))
+		}
+		v.node = n
+		return
+	}
+	v.box(formatOperator(ope), "terminal")
+}
+func (v *diagramBuilder) visitCharacterClass(ope *characterClass) {
+	v.box(formatOperator(ope), "terminal")
+}
+func (v *diagramBuilder) visitAnyCharacter(ope *anyCharacter) {
+	v.box("any character", "terminal")
+}
+func (v *diagramBuilder) visitTokenBoundary(ope *tokenBoundary) {
+	v.group(ope.ope, "< token >", "token")
+}
+func (v *diagramBuilder) visitIgnore(ope *ignore) {
+	v.group(ope.ope, "~ ignored", "ignore")
+}
+func (v *diagramBuilder) visitUser(ope *user) {
+	v.box(userOperatorName, "special")
+}
+func (v *diagramBuilder) visitReference(ope *reference) {
+	if ope.rule == nil {
+		v.box(ope.name, "parameter")
+		return
+	}
+	if len(ope.args) > 0 {
+		// Each argument is drawn in a box labeled with its parameter
+		n := &railSequence{items: []railNode{&railBox{text: ope.name, class: "macro", href: v.link(ope.name)}}}
+		for i, arg := range ope.args {
+			label := fmt.Sprintf("#%d", i+1)
+			if i < len(ope.rule.Parameters) {
+				label = ope.rule.Parameters[i]
+			}
+			n.items = append(n.items, &railGroup{item: v.build(arg), label: label, class: "argument"})
+		}
+		v.node = n
+		return
+	}
+	v.node = &railBox{text: ope.name, class: "nonterminal", href: v.link(ope.name)}
+}
+func (v *diagramBuilder) visitRule(ope *Rule) {
+	v.node = &railBox{text: ope.Name, class: "nonterminal", href: v.link(ope.Name)}
+}
+func (v *diagramBuilder) visitWhitespace(ope *whitespace) {
+	ope.ope.accept(v)
+}
+func (v *diagramBuilder) visitExpression(ope *expression) {
+	// Expression parsing is set up from the %expr option
+	atom := v.build(ope.labeled(0, ope.atom))
+	binop := v.build(ope.labeled(1, ope.binop))
+	loop := &railLoop{item: &railSequence{items: []railNode{binop, v.build(ope.labeled(2, ope.atom))}}}
+	v.node = &railSequence{items: []railNode{atom, &railChoice{items: []railNode{loop, &railSequence{}}}}}
+}
+func (v *diagramBuilder) visitCut(ope *cut) {
+	v.box("↑", "special")
+}
+func (v *diagramBuilder) visitThrow(ope *throw) {
+	v.group(ope.ope, "^"+ope.label, "throw")
+}
+func (v *diagramBuilder) visitCapture(ope *capture) {
+	v.group(ope.ope, ope.name+":", "capture")
+}
+
+// Railroad diagram options
+type DiagramOptions struct {
+	Href func(name string) string // Link of a referenced rule, or "" for none
+}
+
+const diagramStyle = `svg.railroad { background-color: #fff; }
+svg.railroad path { stroke: #333; stroke-width: 2; fill: none; }
+svg.railroad rect { stroke: #333; stroke-width: 2; fill: #fff; }
+svg.railroad text { font: 13px monospace; text-anchor: middle; }
+svg.railroad .terminal rect { fill: #efe; }
+svg.railroad .nonterminal rect, svg.railroad .macro rect { fill: #eef; }
+svg.railroad .macro rect { stroke-width: 3; }
+svg.railroad .parameter text { font-style: italic; }
+svg.railroad .special rect { fill: #fed; }
+svg.railroad a text { fill: #06c; text-decoration: underline; }
+svg.railroad g.predicate rect, svg.railroad g.token rect, svg.railroad g.ignore rect,
+svg.railroad g.throw rect, svg.railroad g.argument rect, svg.railroad g.capture rect { stroke: #999; stroke-width: 1; stroke-dasharray: 4 3; fill: none; }
+svg.railroad g.predicate text, svg.railroad g.token text, svg.railroad g.ignore text,
+svg.railroad g.throw text, svg.railroad g.argument text, svg.railroad g.capture text { font-size: 11px; fill: #666; text-anchor: start; }
+`
+
+// Railroad diagram of a rule as a standalone SVG document
+func Diagram(r *Rule, opts DiagramOptions) []byte {
+	v := &diagramBuilder{href: opts.Href}
+	return []byte(v.svg(r))
+}
+
+func (v *diagramBuilder) svg(r *Rule) string {
+	node := v.build(r.Ope)
+	w, up, down := node.size()
+	width := w + 2*railMargin + 2*railGap
+	height := up + down + 2*railMargin
+	x, y := railMargin, railMargin+up
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" class="railroad" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n", width, height, width, height)
+	fmt.Fprintf(&b, "<style>\n%s</style>\n", diagramStyle)
+
+	// Start and end of the rule
+	fmt.Fprintf(&b, `<path d="M%d %dv%dM%d %dv%d"/>`+"\n", x, y-railArc, 2*railArc, x+4, y-railArc, 2*railArc)
+	railLine(&b, x, y, railGap)
+	node.draw(&b, x+railGap, y)
+	railLine(&b, x+railGap+w, y, railGap)
+	x += w + 2*railGap
+	fmt.Fprintf(&b, `<path d="M%d %dv%dM%d %dv%d"/>`+"\n", x-4, y-railArc, 2*railArc, x, y-railArc, 2*railArc)
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+// Link to the diagram page of a rule, which is named NAME.html or NAME.svg
+func diagramLink(name string, ext string) string {
+	return url.PathEscape(name) + ext
+}
+
+// Railroad diagram pages of a grammar, by file name. Each rule has a NAME.svg
+// diagram and a NAME.html page with its definition and diagram, where
+// referenced rules link to their pages. index.html lists the rules.
+func DiagramPages(p *Parser) map[string][]byte {
+	rules := p.sortedRules()
+	files := make(map[string][]byte)
+
+	svgs := make(map[*Rule]string)
+	refs := make(map[*Rule][]string)
+	usedBy := make(map[string][]string)
+	for _, r := range rules {
+		v := &diagramBuilder{href: func(name string) string { return diagramLink(name, ".svg") }}
+		files[r.Name+".svg"] = []byte(v.svg(r))
+
+		v = &diagramBuilder{href: func(name string) string { return diagramLink(name, ".html") }}
+		svgs[r] = v.svg(r)
+		refs[r] = v.refs
+		for _, name := range v.refs {
+			usedBy[name] = append(usedBy[name], r.Name)
+		}
+	}
+
+	for _, r := range rules {
+		var b strings.Builder
+		writeDiagramHeader(&b, r.Name)
+		b.WriteString(`<p><a href="index.html">Rules</a></p>` + "\n")
+		fmt.Fprintf(&b, "<h1>%s</h1>\n", html.EscapeString(r.Name))
+		fmt.Fprintf(&b, "<pre>%s</pre>\n", html.EscapeString(r.String()))
+		b.WriteString(svgs[r])
+		writeDiagramLinks(&b, "References", refs[r])
+		writeDiagramLinks(&b, "Referenced by", usedBy[r.Name])
+		b.WriteString("</body>\n</html>\n")
+		files[r.Name+".html"] = []byte(b.String())
+	}
+
+	var b strings.Builder
+	writeDiagramHeader(&b, "Rules")
+	b.WriteString("<h1>Rules</h1>\n<ul>\n")
+	for _, r := range rules {
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(diagramLink(r.Name, ".html")), html.EscapeString(r.definitionName()))
+	}
+	b.WriteString("</ul>\n</body>\n</html>\n")
+	files["index.html"] = []byte(b.String())
+	return files
+}
+
+func writeDiagramHeader(b *strings.Builder, title string) {
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\"/>\n")
+	fmt.Fprintf(b, "<title>%s</title>\n", html.EscapeString(title))
+	b.WriteString("</head>\n<body>\n")
+}
+
+func writeDiagramLinks(b *strings.Builder, title string, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "<h2>%s</h2>\n<ul>\n", title)
+	for _, name := range names {
+		fmt.Fprintf(b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(diagramLink(name, ".html")), html.EscapeString(name))
+	}
+	b.WriteString("</ul>\n")
+}
@@ -0,0 +1,114 @@
+package peg
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Check that a document is well-formed, and collect its classes and links
+func parseDiagram(t *testing.T, doc []byte) (classes map[string]int, links []string) {
+	classes = make(map[string]int)
+	d := xml.NewDecoder(strings.NewReader(string(doc)))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%s\n%s", err, doc)
+		}
+		if e, ok := tok.(xml.StartElement); ok {
+			for _, a := range e.Attr {
+				switch a.Name.Local {
+				case "class":
+					classes[a.Value]++
+				case "href":
+					links = append(links, a.Value)
+				}
+			}
+		}
+	}
+	return
+}
+
+func TestDiagram(t *testing.T) {
+	parser, err := NewParser(`
+        START     <- (STATEMENT ↑)* !.
+        STATEMENT <- 'if' &'(' LIST(EXPR, ',') ';'^semi / ~SP? EXPR
+        LIST(I, D) <- I (D I)*
+        EXPR      <- < [0-9]+ > / 'a' 'b' / . / 'x' ('y' / 'z')
+        ~SP       <- [ \t]+
+    `)
+	assert(t, err == nil)
+
+	href := func(name string) string { return "#" + name }
+	svg := Diagram(parser.Grammar["STATEMENT"], DiagramOptions{Href: href})
+	classes, links := parseDiagram(t, svg)
+	assert(t, strings.HasPrefix(string(svg), `<svg xmlns="http://www.w3.org/2000/svg" class="railroad"`))
+	assert(t, classes["terminal"] == 4)
+	assert(t, classes["predicate"] == 1)
+	assert(t, classes["macro"] == 1)
+	assert(t, classes["argument"] == 2)
+	assert(t, classes["throw"] == 1)
+	assert(t, classes["nonterminal"] == 3)
+	assert(t, strings.Join(links, " ") == "#LIST #EXPR #SP #EXPR")
+
+	// The diagram of a macro shows its parameters
+	classes, links = parseDiagram(t, Diagram(parser.Grammar["LIST"], DiagramOptions{}))
+	assert(t, classes["parameter"] == 3 && len(links) == 0)
+
+	// Merged literals are drawn as written
+	classes, _ = parseDiagram(t, Diagram(parser.Grammar["EXPR"], DiagramOptions{}))
+	assert(t, classes["token"] == 1)
+	assert(t, classes["terminal"] == 7)
+
+	classes, _ = parseDiagram(t, Diagram(parser.Grammar["START"], DiagramOptions{}))
+	assert(t, classes["special"] == 1 && classes["predicate"] == 1)
+
+	classes, _ = parseDiagram(t, Diagram(parser.Grammar["SP"], DiagramOptions{}))
+	assert(t, classes["terminal"] == 1)
+
+	parser, err = NewParser(`PAIR <- key:[a-z]+ '=' value:[0-9]+`)
+	assert(t, err == nil)
+	svg = Diagram(parser.Grammar["PAIR"], DiagramOptions{})
+	classes, _ = parseDiagram(t, svg)
+	assert(t, classes["capture"] == 2 && strings.Contains(string(svg), ">key:</text>"))
+}
+
+func TestDiagramPages(t *testing.T) {
+	parser, err := NewParser(`
+        S <- A B / C
+        A <- 'a' C
+        B <- 'b'
+        C <- 'c'
+        %whitespace <- [ ]*
+    `)
+	assert(t, err == nil)
+
+	files := DiagramPages(parser)
+	assert(t, len(files) == 11 && files["%whitespace.html"] != nil)
+	for name, doc := range files {
+		if strings.HasSuffix(name, ".html") || strings.HasSuffix(name, ".svg") {
+			parseDiagram(t, doc)
+		}
+	}
+
+	// The index lists the start rule first
+	_, links := parseDiagram(t, files["index.html"])
+	assert(t, strings.Join(links, " ") == "S.html A.html B.html C.html %25whitespace.html")
+
+	// Pages link to the rules they reference and the rules referencing them
+	page := string(files["A.html"])
+	assert(t, strings.Contains(page, "<pre>A ← &#39;a&#39; C</pre>"))
+	_, links = parseDiagram(t, files["A.html"])
+	assert(t, strings.Join(links, " ") == "index.html C.html C.html S.html")
+
+	_, links = parseDiagram(t, files["C.html"])
+	assert(t, strings.Join(links, " ") == "index.html S.html A.html")
+
+	// Standalone diagrams link to each other
+	_, links = parseDiagram(t, files["S.svg"])
+	assert(t, strings.Join(links, " ") == "A.svg B.svg C.svg")
+}
@@ -18,43 +18,45 @@ type expression struct {
 	binop  operator
 	bopinf BinOpeInfo
 	action *Action
+	labels [3]string // Labels of the left atom, the operator and the right atom
 }
 
-func (o *expression) parseExpr(s string, p int, v *Values, c *context, d Any, minPrec int) (l int) {
-	l = o.atom.parse(s, p, v, c, d)
+func (o *expression) parseExpr(p int, v *Values, c *context, d Any, minPrec int) (l int) {
+	l = o.atom.parse(p, v, c, d)
 	if fail(l) {
 		return
 	}
 
-	var tok string
-	r := o.binop.(*reference).rule
-	action := r.Action
-	r.Action = func(v *Values, d Any) (val Any, err error) {
-		tok = v.Token()
-		if action != nil {
-			val, err = action(v, d)
-		} else if len(v.Vs) > 0 {
-			val = v.Vs[0]
-		}
-		return val, err
-	}
-	defer func() { r.Action = action }()
-
-	saveErrorPos := c.errorPos
+	saveError := c.errorState()
+	saveCut := c.cut
+	c.pushBacktrack(p + l)
+	defer func() {
+		c.cut = saveCut
+		c.popBacktrack()
+	}()
 
-	for p+l < len(s) {
+	for !c.in.atEnd(p + l) {
 		saveVs := v.Vs
 		saveTs := v.Ts
+		saveErrors := len(c.errors)
+		c.cut = false
+		c.setBacktrack(p + l)
 
 		chv := c.push()
-		chl := o.binop.parse(s, p+l, chv, c, d)
+		chl := o.binop.parse(p+l, chv, c, d)
 		c.pop()
 
 		if fail(chl) {
-			c.errorPos = saveErrorPos
+			if c.committed() {
+				l = -1
+				return
+			}
+			c.errors = c.errors[:saveErrors]
+			c.restoreError(saveError)
 			break
 		}
 
+		tok := c.lastToken
 		inf, ok := o.bopinf[tok]
 		if !ok || inf.level < minPrec {
 			break
@@ -69,13 +71,18 @@ func (o *expression) parseExpr(s string, p int, v *Values, c *context, d Any, mi
 		}
 
 		chv = c.push()
-		chl = o.parseExpr(s, p+l, chv, c, d, nextMinPrec)
+		chl = o.parseExpr(p+l, chv, c, d, nextMinPrec)
 		c.pop()
 
 		if fail(chl) {
+			if c.committed() {
+				l = -1
+				return
+			}
 			v.Vs = saveVs
 			v.Ts = saveTs
-			c.errorPos = saveErrorPos
+			c.errors = c.errors[:saveErrors]
+			c.restoreError(saveError)
 			break
 		}
 
@@ -84,19 +91,23 @@ func (o *expression) parseExpr(s string, p int, v *Values, c *context, d Any, mi
 
 		var val Any
 		if *o.action != nil {
-			v.S = s[p : p+l]
+			// Operations span rules, so a stream doesn't keep their text
+			if !c.in.stream() {
+				v.S = c.in.substr(p, p+l)
+			}
 			v.Pos = p
 
+			v.captures = o.captures()
+
 			var err error
-			if val, err = (*o.action)(v, d); err != nil {
+			if val, err = (*o.action).call(v, d); err != nil {
 				if c.messagePos < p {
-					c.messagePos = p
-					c.message = err.Error()
+					c.setMessage(p, err.Error(), err)
 				}
 				l = -1
 				v.Vs = saveVs
 				v.Ts = saveTs
-				c.errorPos = saveErrorPos
+				c.restoreError(saveError)
 				break
 			}
 		} else if len(v.Vs) > 0 {
@@ -104,13 +115,32 @@ func (o *expression) parseExpr(s string, p int, v *Values, c *context, d Any, mi
 		}
 
 		v.Vs = []Any{val}
+		v.captures = nil
 	}
 
 	return
 }
 
-func (o *expression) parseCore(s string, p int, v *Values, c *context, d Any) (l int) {
-	l = o.parseExpr(s, p, v, c, d, 0)
+// Labels of the values that the action is invoked with
+func (o *expression) captures() (captures []captureRange) {
+	for i, name := range o.labels {
+		if len(name) > 0 {
+			captures = append(captures, captureRange{name, i, i + 1, nil})
+		}
+	}
+	return
+}
+
+// Operand i written with its label
+func (o *expression) labeled(i int, ope operator) operator {
+	if len(o.labels[i]) > 0 {
+		return Cap(ope, o.labels[i])
+	}
+	return ope
+}
+
+func (o *expression) parseCore(p int, v *Values, c *context, d Any) (l int) {
+	l = o.parseExpr(p, v, c, d, 0)
 	return
 }
 
@@ -126,22 +156,34 @@ func Exp(atom operator, binop operator, bopinf BinOpeInfo, action *Action) opera
 
 func EnableExpressionParsing(p *Parser, name string, bopinf BinOpeInfo) *Error {
 	if r, ok := p.Grammar[name]; ok {
+		var labels [3]string
 		seq := r.Ope.(*sequence)
-		atom := seq.opes[0].(*reference)
+		atom := uncapture(seq.opes[0], &labels[0]).(*reference)
 		opes := seq.opes[1].(*zeroOrMore).ope.(*sequence).opes
-		atom1 := opes[1].(*reference)
-		binop := opes[0].(*reference)
+		binop := uncapture(opes[0], &labels[1]).(*reference)
+		atom1 := uncapture(opes[1], &labels[2]).(*reference)
 
 		if atom.name != atom1.name {
-			err := &Error{}
-			ln, col := lineInfo(r.SS, r.Pos)
-			msg := "expression syntax error"
-			err.Details = append(err.Details, ErrorDetail{ln, col, msg})
-			return err
+			return addGrammarError(nil, r.SS, r.Pos, name, "expression syntax error")
+		}
+
+		if br, ok := p.Grammar[binop.name]; ok {
+			br.binop = true
 		}
 
-		r.Ope = Exp(atom, binop, bopinf, &r.Action)
+		exp := Exp(atom, binop, bopinf, &r.Action).(*expression)
+		exp.labels = labels
+		r.Ope = exp
 		r.disableAction = true
 	}
 	return nil
 }
+
+// Operand of a labeled expression
+func uncapture(ope operator, label *string) operator {
+	if o, ok := ope.(*capture); ok {
+		*label = o.name
+		return o.ope
+	}
+	return ope
+}
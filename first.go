@@ -0,0 +1,411 @@
+package peg
+
+import (
+	"math/bits"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Set of bytes
+type byteSet [4]uint64
+
+func (s *byteSet) add(b byte) {
+	s[b>>6] |= 1 << (b & 63)
+}
+
+func (s *byteSet) addRange(lo byte, hi byte) {
+	for b := int(lo); b <= int(hi); b++ {
+		s.add(byte(b))
+	}
+}
+
+func (s *byteSet) union(t byteSet) {
+	for i := range s {
+		s[i] |= t[i]
+	}
+}
+
+func (s *byteSet) has(b byte) bool {
+	return s[b>>6]&(1<<(b&63)) != 0
+}
+
+// First byte of the UTF-8 encoding of a rune
+func leadByte(r rune) byte {
+	switch {
+	case r < 0x80:
+		return byte(r)
+	case r < 0x800:
+		return byte(0xC0 | r>>6)
+	case r < 0x10000:
+		return byte(0xE0 | r>>12)
+	}
+	return byte(0xF0 | r>>18)
+}
+
+// Bytes that start runes in [lo, hi]
+func (s *byteSet) addRunes(lo rune, hi rune) {
+	if hi > unicode.MaxRune {
+		hi = unicode.MaxRune
+	}
+	if lo > hi {
+		return
+	}
+	s.addRange(leadByte(lo), leadByte(hi))
+
+	// Invalid UTF-8 is decoded as RuneError
+	if lo <= utf8.RuneError && utf8.RuneError <= hi {
+		s.addRange(0x80, 0xFF)
+	}
+}
+
+// What an operator can start with, and what it reports when it fails on
+// anything else without consuming input
+type firstInfo struct {
+	pure     bool // Fails without side effects other than expected items and rule handlers
+	nullable bool // Succeeds without consuming input
+	first    byteSet
+	expected []string
+	rule     string // Rule that reports the first expected item, if not the current one
+	rules    []*Rule
+}
+
+// firstSet
+type firstSet struct {
+	*visitorBase
+	args  [][]operator
+	rules map[*Rule]*firstInfo
+	depth int
+	info  firstInfo
+}
+
+func newFirstSet() *firstSet {
+	return &firstSet{rules: make(map[*Rule]*firstInfo)}
+}
+
+func (v *firstSet) analyze(ope operator) firstInfo {
+	v.info = firstInfo{}
+	ope.accept(v)
+	return v.info
+}
+
+func (v *firstSet) visitSequence(ope *sequence) {
+	info := firstInfo{pure: true, nullable: true}
+	for _, o := range ope.opes {
+		e := v.analyze(o)
+		if !e.pure {
+			v.info = firstInfo{}
+			return
+		}
+		info.first.union(e.first)
+		info.rules = append(info.rules, e.rules...)
+		if !e.nullable {
+			info.nullable = false
+			info.expected = e.expected
+			info.rule = e.rule
+			break
+		}
+	}
+	v.info = info
+}
+func (v *firstSet) visitPrioritizedChoice(ope *prioritizedChoice) {
+	// A choice that succeeds without consuming input sets the choice of its values
+	info := firstInfo{pure: true}
+	for i, o := range ope.opes {
+		e := v.analyze(o)
+		if !e.pure || e.nullable {
+			v.info = firstInfo{}
+			return
+		}
+		if i == 0 {
+			info.rule = e.rule
+		}
+		info.first.union(e.first)
+		info.expected = append(info.expected, e.expected...)
+		info.rules = append(info.rules, e.rules...)
+	}
+	v.info = info
+}
+func (v *firstSet) visitZeroOrMore(ope *zeroOrMore) {
+	v.optional(ope.ope)
+}
+func (v *firstSet) visitOneOrMore(ope *oneOrMore) {
+	v.transparent(ope.ope)
+}
+func (v *firstSet) visitOption(ope *option) {
+	v.optional(ope.ope)
+}
+
+// A failing repetition or option restores the error state
+func (v *firstSet) optional(ope operator) {
+	e := v.analyze(ope)
+	if !e.pure || e.nullable {
+		v.info = firstInfo{}
+		return
+	}
+	v.info = firstInfo{pure: true, nullable: true, first: e.first, rules: e.rules}
+}
+
+// Operators that fail the same way as their operand
+func (v *firstSet) transparent(ope operator) {
+	e := v.analyze(ope)
+	if !e.pure || e.nullable {
+		v.info = firstInfo{}
+		return
+	}
+	v.info = e
+}
+
+func (v *firstSet) visitLiteralString(ope *literalString) {
+	// An empty literal only skips whitespace
+	if len(ope.lit) == 0 {
+		return
+	}
+
+	info := firstInfo{pure: true}
+	if ope.ignoreCase {
+		r, _ := utf8.DecodeRuneInString(ope.lit)
+		info.first.addRunes(r, r)
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			info.first.addRunes(f, f)
+		}
+	} else {
+		info.first.add(ope.lit[0])
+	}
+
+	// A merged literal reports the first part that isn't empty
+	lit := ope
+	for _, part := range ope.parts {
+		if len(part.lit) > 0 {
+			lit = part
+			break
+		}
+	}
+	info.expected = []string{lit.describe()}
+	v.info = info
+}
+func (v *firstSet) visitCharacterClass(ope *characterClass) {
+	info := firstInfo{pure: true, expected: []string{ope.describe()}}
+	if ope.negated {
+		info.first.addRange(0, 0xFF)
+	} else {
+		for _, rg := range ope.ranges {
+			info.first.addRunes(rg.lo, rg.hi)
+		}
+		for _, rg := range ope.bytes {
+			info.first.addRange(byte(rg.lo), byte(rg.hi))
+		}
+	}
+	v.info = info
+}
+func (v *firstSet) visitAnyCharacter(ope *anyCharacter) {
+	info := firstInfo{pure: true, expected: []string{"any character"}}
+	info.first.addRange(0, 0xFF)
+	v.info = info
+}
+func (v *firstSet) visitTokenBoundary(ope *tokenBoundary) {
+	// Whitespace after an empty token makes it succeed
+	v.transparent(ope.ope)
+}
+func (v *firstSet) visitIgnore(ope *ignore) {
+	v.transparent(ope.ope)
+}
+func (v *firstSet) visitReference(ope *reference) {
+	if ope.rule == nil {
+		// Arguments are analyzed where the macro is referenced
+		if len(v.args) == 0 {
+			return
+		}
+		args := v.args[len(v.args)-1]
+		v.args = v.args[:len(v.args)-1]
+		v.info = v.analyze(args[ope.iarg])
+		v.args = append(v.args, args)
+		return
+	}
+
+	if ope.rule.Parameters != nil {
+		// Macros are expanded for each reference, so recursion is cut off
+		if v.depth > 16 {
+			return
+		}
+		v.depth++
+		v.args = append(v.args, ope.args)
+		v.info = v.analyze(ope.rule.Ope)
+		v.args = v.args[:len(v.args)-1]
+		v.depth--
+		return
+	}
+
+	v.info = v.definition(ope.rule)
+}
+func (v *firstSet) visitRule(ope *Rule) {
+	if ope.Parameters != nil {
+		return
+	}
+	v.info = v.definition(ope)
+}
+func (v *firstSet) visitCapture(ope *capture) {
+	ope.ope.accept(v)
+}
+func (v *firstSet) visitExpression(ope *expression) {
+	v.transparent(ope.atom)
+}
+
+func (v *firstSet) definition(r *Rule) firstInfo {
+	if info, ok := v.rules[r]; ok {
+		return *info
+	}
+
+	// Recursion without consuming input is left recursion
+	info := &firstInfo{}
+	v.rules[r] = info
+	if r.LeftRecursive {
+		return *info
+	}
+
+	args := v.args
+	v.args = nil
+	e := v.analyze(r.Ope)
+	v.args = args
+
+	// A rule that succeeds calls its action
+	if e.pure && !e.nullable {
+		*info = e
+		info.rules = append([]*Rule{r}, e.rules...)
+		if len(info.rule) == 0 {
+			info.rule = r.Name
+		}
+
+		// Token rules are reported by name instead of their internals
+		if len(r.Name) > 0 && r.hasTokenBoundary() {
+			info.expected = []string{r.Name}
+			info.rule = r.Name
+		}
+	}
+	return *info
+}
+
+// First byte jump table of a choice
+type firstTable struct {
+	skip         [257]uint64 // Alternatives that fail on each byte, and at the end of input
+	expected     [][]string
+	expectedRule []string
+	rules        [][]*Rule
+}
+
+func newFirstTable(fs *firstSet, ope *prioritizedChoice) *firstTable {
+	t := &firstTable{
+		expected:     make([][]string, len(ope.opes)),
+		expectedRule: make([]string, len(ope.opes)),
+		rules:        make([][]*Rule, len(ope.opes)),
+	}
+	found := false
+	for id, o := range ope.opes {
+		if id >= 64 {
+			break
+		}
+		info := fs.analyze(o)
+		if !info.pure || info.nullable {
+			continue
+		}
+		bit := uint64(1) << uint(id)
+		for b := 0; b < 256; b++ {
+			if !info.first.has(byte(b)) {
+				t.skip[b] |= bit
+			}
+		}
+		t.skip[256] |= bit
+		t.expected[id] = info.expected
+		t.expectedRule[id] = info.rule
+
+		seen := make(map[*Rule]bool)
+		for _, r := range info.rules {
+			if !seen[r] {
+				seen[r] = true
+				t.rules[id] = append(t.rules[id], r)
+			}
+		}
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	return t
+}
+
+// Alternatives that fail on the byte at p
+func (t *firstTable) match(c *context, p int) uint64 {
+	b := 256
+	if !c.in.atEnd(p) {
+		b = int(c.in.byteAt(p))
+	}
+	skip := t.skip[b]
+
+	// Handlers are set after the table is built, and they must still be called
+	for s := skip; s != 0; s &= s - 1 {
+		id := bits.TrailingZeros64(s)
+		for _, r := range t.rules[id] {
+			if r.Enter != nil || r.Leave != nil || r.Message != nil {
+				skip &^= 1 << uint(id)
+				break
+			}
+		}
+	}
+	return skip
+}
+
+// Report an alternative that fails
+func (t *firstTable) expect(c *context, p int, id int) {
+	saveRule := c.rule
+	if len(t.expectedRule[id]) > 0 {
+		c.rule = t.expectedRule[id]
+	}
+	for _, item := range t.expected[id] {
+		c.addExpected(p, item)
+	}
+	c.rule = saveRule
+}
+
+// firstTableBuilder
+type firstTableBuilder struct {
+	*visitorBase
+	fs *firstSet
+}
+
+func (v *firstTableBuilder) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *firstTableBuilder) visitPrioritizedChoice(ope *prioritizedChoice) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+	if ope.index == nil {
+		ope.first = newFirstTable(v.fs, ope)
+	}
+}
+func (v *firstTableBuilder) visitZeroOrMore(ope *zeroOrMore)       { ope.ope.accept(v) }
+func (v *firstTableBuilder) visitOneOrMore(ope *oneOrMore)         { ope.ope.accept(v) }
+func (v *firstTableBuilder) visitOption(ope *option)               { ope.ope.accept(v) }
+func (v *firstTableBuilder) visitAndPredicate(ope *andPredicate)   { ope.ope.accept(v) }
+func (v *firstTableBuilder) visitNotPredicate(ope *notPredicate)   { ope.ope.accept(v) }
+func (v *firstTableBuilder) visitTokenBoundary(ope *tokenBoundary) { ope.ope.accept(v) }
+func (v *firstTableBuilder) visitIgnore(ope *ignore)               { ope.ope.accept(v) }
+func (v *firstTableBuilder) visitWhitespace(ope *whitespace)       { ope.ope.accept(v) }
+func (v *firstTableBuilder) visitThrow(ope *throw)                 { ope.ope.accept(v) }
+func (v *firstTableBuilder) visitCapture(ope *capture)             { ope.ope.accept(v) }
+func (v *firstTableBuilder) visitReference(ope *reference) {
+	for _, arg := range ope.args {
+		arg.accept(v)
+	}
+}
+
+// Build the jump tables of choices that aren't indexed
+func buildFirstTables(grammar map[string]*Rule) {
+	v := &firstTableBuilder{fs: newFirstSet()}
+	for _, r := range grammar {
+		if r.Parameters == nil {
+			r.Ope.accept(v)
+		}
+	}
+}
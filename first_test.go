@@ -0,0 +1,97 @@
+package peg
+
+import (
+	"testing"
+)
+
+func TestFirstTable(t *testing.T) {
+	parser, _ := NewParser(`
+        S      <- IF / NUMBER / &'x' ID / ID / OPT / 'z'? 'q' NUMBER
+        IF     <- 'if' ' '
+        NUMBER <- < [0-9]+ >
+        ID     <- [a-z]+
+        OPT    <- 'o'?
+    `)
+
+	cho := parser.Grammar["S"].Ope.(*prioritizedChoice)
+	assert(t, cho.index == nil && cho.first != nil)
+
+	skip := cho.first.skip
+	assert(t, skip['i'] == 1<<1|1<<5)
+	assert(t, skip['5'] == 1<<0|1<<3|1<<5)
+	assert(t, skip['z'] == 1<<0|1<<1)
+	assert(t, skip['q'] == 1<<0|1<<1)
+	assert(t, skip[256] == 1<<0|1<<1|1<<3|1<<5)
+
+	// Predicates and empty alternatives are always tried
+	assert(t, skip['?'] == 1<<0|1<<1|1<<3|1<<5)
+
+	assert(t, len(cho.first.expected[1]) == 1 && cho.first.expected[1][0] == "NUMBER")
+	assert(t, len(cho.first.expected[5]) == 1 && cho.first.expected[5][0] == "'q'")
+}
+
+func TestFirstTableWithPackrat(t *testing.T) {
+	parser, _ := NewParser(`
+        S      <- (IF / NUMBER)*
+        IF     <- 'if' SP NUMBER
+        NUMBER <- < [0-9]+ > SP
+        SP     <- ' '*
+    `)
+	parser.EnablePackratParsing()
+
+	// IF isn't tried at the numbers, so it has no memo entries there
+	var stats PackratStats
+	parser.PackratStats = func(s PackratStats) { stats = s }
+	assert(t, parser.Parse("5 6 if 7", nil) == nil && stats.Misses == 5)
+	assert(t, parser.Compile().Parse("5 6 if 7", nil) == nil && stats.Misses == 5)
+}
+
+func TestFirstTableParserMatches(t *testing.T) {
+	grammar := `
+        PROGRAM    <- STATEMENT PROGRAM / !.
+        STATEMENT  <- IF / WHILE / ASSIGN / CALL / BLOCK / EMPTY
+        IF         <- 'if'i EXPR BLOCK ('else' BLOCK)?
+        WHILE      <- 'while' EXPR BLOCK
+        ASSIGN     <- ID '=' EXPR ';'
+        CALL       <- ID LIST('(', EXPR, ',', ')') ';'
+        BLOCK      <- '{' STATEMENT* '}'
+        EMPTY      <- ';'
+        EXPR       <- ATOM (OP ATOM)*
+        ATOM       <- NUMBER / STRING / ID / 'é' / [α-ω]+ / '(' EXPR ')'
+        OP         <- < [-+*/<>] >
+        ID         <- !KEYWORD < [a-z] [a-z0-9]* >
+        KEYWORD    <- ('if' / 'else' / 'while') ![a-z0-9]
+        NUMBER     <- < [0-9]+ >
+        STRING     <- < '"' (!'"' .)* '"' >
+        LIST(O, I, D, C) <- O (I (D I)*)? C
+        %whitespace <- [ \t\n]*
+    `
+	inputs := []string{
+		"",
+		"x = 1 + 2; f(x, y); if x < 1 { y = 2; } else { ; }",
+		"IF x {} while (x) { x = x - 1; }",
+		"x = \"a\" + é + αβ;",
+		"x = ;",
+		"f(1, );",
+		"while { }",
+		"if x { y = 1 } ?",
+		"x = 1 +",
+		"f(x y);",
+		"x = \xff;",
+		"x = ω",
+	}
+
+	checkOptimizedParser(t, grammar, inputs, nil)
+	checkOptimizedParser(t, grammar, inputs, traceActions("STATEMENT", "ASSIGN", "CALL", "EXPR", "ATOM", "ID"))
+	checkOptimizedParser(t, grammar, inputs, func(p *Parser) { p.EnableAst() })
+	checkOptimizedParser(t, grammar, inputs, func(p *Parser) { p.EnablePackratParsing() })
+
+	// Handlers set after the grammar is optimized are called
+	checkOptimizedParser(t, grammar, inputs, func(p *Parser) {
+		p.Grammar["NUMBER"].Enter = func(d Any) {
+			trace := d.(*[]string)
+			*trace = append(*trace, "enter NUMBER")
+		}
+		p.Grammar["STRING"].Message = func() string { return "string expected" }
+	})
+}
@@ -0,0 +1,617 @@
+package peg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Binding strength of operators in PEG text
+const (
+	precChoice = iota
+	precSequence
+	precPrefix
+	precSuffix
+	precPrimary
+)
+
+// Name of user operators, which have no PEG syntax
+const userOperatorName = "%user"
+
+// formatter
+type formatter struct {
+	*visitorBase
+	b    strings.Builder
+	prec int
+}
+
+func formatOperator(ope operator) string {
+	v := &formatter{}
+	v.format(ope, precChoice)
+	return v.b.String()
+}
+
+// Write an operator, in parentheses if it binds looser than prec
+func (v *formatter) format(ope operator, prec int) {
+	if precedence(ope) < prec {
+		v.b.WriteString("(")
+		v.format(ope, precChoice)
+		v.b.WriteString(")")
+		return
+	}
+	savePrec := v.prec
+	v.prec = prec
+	ope.accept(v)
+	v.prec = savePrec
+}
+
+func precedence(ope operator) int {
+	switch o := ope.(type) {
+	case *prioritizedChoice:
+		if len(o.opes) == 1 {
+			return precedence(o.opes[0])
+		}
+		if len(o.opes) > 1 {
+			return precChoice
+		}
+	case *sequence:
+		if len(o.opes) == 1 {
+			return precedence(o.opes[0])
+		}
+		if len(o.opes) > 1 {
+			return precSequence
+		}
+	case *literalString:
+		if len(o.parts) > 0 {
+			return precSequence
+		}
+	case *expression:
+		return precSequence
+	case *andPredicate, *notPredicate, *capture:
+		return precPrefix
+	case *zeroOrMore, *oneOrMore, *option, *throw:
+		return precSuffix
+	case *whitespace:
+		return precedence(o.ope)
+	}
+	return precPrimary
+}
+
+func (v *formatter) visitSequence(ope *sequence) {
+	if len(ope.opes) == 0 {
+		v.b.WriteString("()")
+		return
+	}
+	for i, o := range ope.opes {
+		if i > 0 {
+			v.b.WriteString(" ")
+		}
+		v.format(o, precPrefix)
+	}
+}
+func (v *formatter) visitPrioritizedChoice(ope *prioritizedChoice) {
+	if len(ope.opes) == 0 {
+		// Nothing matches a choice without alternatives
+		v.b.WriteString("!''")
+		return
+	}
+
+	v.b.WriteString(strings.Join(formatAlternatives(ope), " / "))
+}
+
+func formatAlternatives(ope *prioritizedChoice) (alts []string) {
+	// Flattened alternatives are grouped again to keep their choice
+	for i := 0; i < len(ope.opes); {
+		j := i + 1
+		for j < len(ope.opes) && ope.choice(j) == ope.choice(i) {
+			j++
+		}
+		if j-i > 1 {
+			group := ChoCore(ope.opes[i:j]).(*prioritizedChoice)
+			alts = append(alts, "("+strings.Join(formatAlternatives(group), " / ")+")")
+		} else {
+			v := &formatter{}
+			v.format(ope.opes[i], precSequence)
+			alts = append(alts, v.b.String())
+		}
+		i = j
+	}
+	return
+}
+func (v *formatter) visitZeroOrMore(ope *zeroOrMore) {
+	v.format(ope.ope, precPrimary)
+	v.b.WriteString("*")
+}
+func (v *formatter) visitOneOrMore(ope *oneOrMore) {
+	v.format(ope.ope, precPrimary)
+	v.b.WriteString("+")
+}
+func (v *formatter) visitOption(ope *option) {
+	v.format(ope.ope, precPrimary)
+	v.b.WriteString("?")
+}
+func (v *formatter) visitAndPredicate(ope *andPredicate) {
+	v.b.WriteString("&")
+	v.format(ope.ope, precSuffix)
+}
+func (v *formatter) visitNotPredicate(ope *notPredicate) {
+	v.b.WriteString("!")
+	v.format(ope.ope, precSuffix)
+}
+func (v *formatter) visitLiteralString(ope *literalString) {
+	// Merged literals are written as they were
+	if len(ope.parts) > 0 {
+		for i, part := range ope.parts {
+			if i > 0 {
+				v.b.WriteString(" ")
+			}
+			v.visitLiteralString(part)
+		}
+		return
+	}
+	v.b.WriteString("'")
+	writeEscaped(&v.b, ope.lit, "'")
+	v.b.WriteString("'")
+	if ope.ignoreCase {
+		v.b.WriteString("i")
+	}
+}
+func (v *formatter) visitCharacterClass(ope *characterClass) {
+	v.b.WriteString("[")
+	chars := ope.chars
+	if ope.negated {
+		v.b.WriteString("^")
+	} else if strings.HasPrefix(chars, "^") {
+		v.b.WriteString(`\^`)
+		chars = chars[1:]
+	}
+	writeEscaped(&v.b, chars, "]")
+	v.b.WriteString("]")
+}
+func (v *formatter) visitAnyCharacter(ope *anyCharacter) {
+	v.b.WriteString(".")
+}
+func (v *formatter) visitTokenBoundary(ope *tokenBoundary) {
+	v.b.WriteString("< ")
+	v.format(ope.ope, precChoice)
+	v.b.WriteString(" >")
+}
+func (v *formatter) visitIgnore(ope *ignore) {
+	v.b.WriteString("~")
+	v.format(ope.ope, precPrimary)
+}
+func (v *formatter) visitUser(ope *user) {
+	v.b.WriteString(userOperatorName)
+}
+func (v *formatter) visitReference(ope *reference) {
+	v.b.WriteString(ope.name)
+	if len(ope.args) > 0 {
+		v.b.WriteString("(")
+		for i, arg := range ope.args {
+			if i > 0 {
+				v.b.WriteString(", ")
+			}
+			v.format(arg, precChoice)
+		}
+		v.b.WriteString(")")
+	}
+}
+func (v *formatter) visitRule(ope *Rule) {
+	v.b.WriteString(ope.Name)
+}
+func (v *formatter) visitWhitespace(ope *whitespace) {
+	v.format(ope.ope, v.prec)
+}
+func (v *formatter) visitExpression(ope *expression) {
+	// Expression parsing is set up from the %expr option
+	v.format(ope.labeled(0, ope.atom), precPrefix)
+	v.b.WriteString(" (")
+	v.format(ope.labeled(1, ope.binop), precPrefix)
+	v.b.WriteString(" ")
+	v.format(ope.labeled(2, ope.atom), precPrefix)
+	v.b.WriteString(")*")
+}
+func (v *formatter) visitCut(ope *cut) {
+	v.b.WriteString("↑")
+}
+func (v *formatter) visitThrow(ope *throw) {
+	switch ope.ope.(type) {
+	case *zeroOrMore, *oneOrMore, *option:
+		v.format(ope.ope, precSuffix)
+	default:
+		v.format(ope.ope, precPrimary)
+	}
+	v.b.WriteString("^")
+	v.b.WriteString(ope.label)
+}
+func (v *formatter) visitCapture(ope *capture) {
+	v.b.WriteString(ope.name)
+	v.b.WriteString(":")
+	if _, ok := ope.ope.(*capture); ok {
+		v.format(ope.ope, precSuffix)
+	} else {
+		v.format(ope.ope, precPrefix)
+	}
+}
+
+// Write a string in the escapes of literals and character classes
+func writeEscaped(b *strings.Builder, s string, quote string) {
+	afterHex := false
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		hex := afterHex
+		afterHex = false
+		switch {
+		case r == utf8.RuneError && size == 1:
+			// Hex escapes take as many digits as follow them
+			fmt.Fprintf(b, `\x%02x`, s[i])
+			afterHex = true
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\\' || strings.ContainsRune(quote, r):
+			b.WriteString(`\`)
+			b.WriteRune(r)
+		case !unicode.IsPrint(r) || (hex && isHexDigit(r)):
+			fmt.Fprintf(b, `\u{%x}`, r)
+		default:
+			b.WriteRune(r)
+		}
+		i += size
+	}
+}
+
+func isHexDigit(r rune) bool {
+	return '0' <= r && r <= '9' || 'a' <= r && r <= 'f' || 'A' <= r && r <= 'F'
+}
+
+func (o *opeBase) String() string {
+	return formatOperator(o.derived)
+}
+
+// Definition of the rule
+func (r *Rule) String() string {
+	return r.definitionName() + " ← " + formatOperator(r.Ope)
+}
+
+// Left-hand side of the definition
+func (r *Rule) definitionName() string {
+	var b strings.Builder
+	switch {
+	case r.Recovery:
+		fmt.Fprintf(&b, "%s(%s)", RecoverMacroName, r.Name)
+	case r.Ignore:
+		b.WriteString("~" + r.Name)
+	default:
+		b.WriteString(r.Name)
+	}
+	if len(r.Parameters) > 0 {
+		b.WriteString("(" + strings.Join(r.Parameters, ", ") + ")")
+	}
+	return b.String()
+}
+
+// Grammar in PEG text, which NewParser turns into an equivalent parser.
+// Rules that are only a user operator are left out, since they are given to
+// NewParserWithUserRules again.
+func (p *Parser) String() string {
+	var b strings.Builder
+	for _, r := range p.sortedRules() {
+		if _, ok := r.Ope.(*user); !ok {
+			b.WriteString(r.String())
+			b.WriteString("\n")
+		}
+	}
+
+	if len(p.options) > 0 {
+		var names []string
+		for name := range p.options {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		b.WriteString("---\n")
+		for _, name := range names {
+			for _, val := range p.options[name] {
+				fmt.Fprintf(&b, "%s = %s\n", name, val)
+			}
+		}
+	}
+	return b.String()
+}
+
+// Rules in the order of the grammar text. The start rule comes first, and
+// user rules come after the grammar text.
+func (p *Parser) sortedRules() []*Rule {
+	var rules []*Rule
+	for _, r := range p.Grammar {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		if (a.Name == p.start) != (b.Name == p.start) {
+			return a.Name == p.start
+		}
+		if (len(a.SS) == 0) != (len(b.SS) == 0) {
+			return len(b.SS) == 0
+		}
+		if a.Pos != b.Pos {
+			return a.Pos < b.Pos
+		}
+		return a.Name < b.Name
+	})
+	return rules
+}
+
+// Grammar formatting options
+type FormatOptions struct {
+	Width int // Line width above which choices are wrapped, 80 by default
+}
+
+// Definition, option or separator in a grammar file
+type formatItem struct {
+	pos      int
+	head     string      // Rule name with parameters, option name or separator
+	sep      string      // Arrow of a definition or '=' of an option
+	alts     []formatAlt // Alternatives of a definition or value of an option
+	leading  []string    // Comments above the item, and blank lines between them
+	trailing string      // Comment at the end of the last line
+	blank    bool        // Blank line before the item
+}
+
+// Alternative of a choice with the comments written around it
+type formatAlt struct {
+	text     string
+	pos      int
+	leading  []string
+	trailing string
+}
+
+// Format grammar text in the canonical style. Arrows and option values are
+// aligned in blocks of lines without blank lines between them, and choices
+// longer than the line width get one alternative per line. Comments stay
+// with the definition, alternative or option they are written in or above.
+func Format(grammar string, opts FormatOptions) ([]byte, *Error) {
+	data := newData()
+	if _, _, err := rStart.Parse(grammar, data); err != nil {
+		return nil, grammarSyntaxError(err)
+	}
+	if err := duplicateError(grammar, data.duplicates); err != nil {
+		return nil, err
+	}
+	if opts.Width <= 0 {
+		opts.Width = 80
+	}
+
+	var items []*formatItem
+	for _, r := range data.grammar {
+		item := &formatItem{pos: r.Pos, head: r.definitionName(), sep: "←"}
+		if cho, ok := r.Ope.(*prioritizedChoice); ok && len(cho.opes) > 1 {
+			for i, text := range formatAlternatives(cho) {
+				item.alts = append(item.alts, formatAlt{text: text, pos: data.positions[cho.opes[i]]})
+			}
+		} else {
+			item.alts = []formatAlt{{text: formatOperator(r.Ope), pos: r.Pos}}
+		}
+		items = append(items, item)
+	}
+	if data.separator >= 0 {
+		items = append(items, &formatItem{pos: data.separator, head: "---"})
+	}
+	for _, o := range data.optionDefs {
+		items = append(items, &formatItem{pos: o.pos, head: o.name, sep: "=", alts: []formatAlt{{text: o.value, pos: o.pos}}})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].pos < items[j].pos })
+
+	f := &grammarFormatter{src: grammar, width: opts.Width, commentText: data.comments}
+	for pos := range data.comments {
+		f.comments = append(f.comments, pos)
+	}
+	sort.Ints(f.comments)
+	footer := f.attachComments(items)
+
+	var b strings.Builder
+	for i := 0; i < len(items); {
+		// Items are aligned in blocks of the same kind
+		j := i + 1
+		for j < len(items) && !items[j].blank && items[j].sep == items[i].sep && len(items[j].sep) > 0 {
+			j++
+		}
+		width := 0
+		for _, item := range items[i:j] {
+			if n := utf8.RuneCountInString(item.head); n > width {
+				width = n
+			}
+		}
+		for _, item := range items[i:j] {
+			if item.blank {
+				b.WriteString("\n")
+			}
+			writeComments(&b, "", item.leading)
+			f.writeItem(&b, item, width)
+		}
+		i = j
+	}
+	writeComments(&b, "", footer)
+	return []byte(b.String()), nil
+}
+
+// Grammar text with the positions of its comments
+type grammarFormatter struct {
+	src         string
+	width       int
+	comments    []int
+	commentText map[int]string
+}
+
+// Attach each comment to an item, and return the comments after the last one
+func (f *grammarFormatter) attachComments(items []*formatItem) (footer []string) {
+	next := 0
+	prevEnd := -1
+	for i := 0; i <= len(items); i++ {
+		start := len(f.src)
+		if i < len(items) {
+			start = items[i].pos
+		}
+
+		// Comments between the previous item and this one
+		var leading []string
+		from := prevEnd
+		for ; next < len(f.comments) && f.comments[next] < start; next++ {
+			pos := f.comments[next]
+			text := f.commentText[pos]
+			switch {
+			case i > 0 && pos < prevEnd:
+				items[i-1].attachInner(f, pos, text)
+			case i > 0 && !strings.Contains(f.src[prevEnd:pos], "\n"):
+				items[i-1].trailing = text
+			default:
+				if from >= 0 && f.hasBlankLine(from, pos) {
+					leading = append(leading, "")
+				}
+				leading = append(leading, text)
+				from = pos
+			}
+		}
+		if from >= 0 && f.hasBlankLine(from, start) {
+			if len(leading) == 0 && i < len(items) {
+				items[i].blank = true
+			} else {
+				leading = append(leading, "")
+			}
+		}
+
+		// A blank line before the comments separates the item from the previous one
+		if len(leading) > 0 && len(leading[0]) == 0 && i < len(items) {
+			leading = leading[1:]
+			items[i].blank = true
+		}
+		if i < len(items) {
+			items[i].leading = leading
+			prevEnd = f.codeEnd(i, items)
+		} else {
+			footer = leading
+		}
+	}
+	return
+}
+
+// Attach a comment inside a definition to the alternative it is written at
+func (item *formatItem) attachInner(f *grammarFormatter, pos int, text string) {
+	k := 0
+	for k+1 < len(item.alts) && item.alts[k+1].pos <= pos {
+		k++
+	}
+	if k == 0 && pos < item.alts[0].pos || len(item.alts) == 1 {
+		item.leading = append(item.leading, text)
+		return
+	}
+
+	// A comment after code on its line ends that line
+	line := f.src[strings.LastIndex(f.src[:pos], "\n")+1 : pos]
+	if len(strings.TrimSpace(line)) > 0 || k+1 == len(item.alts) {
+		item.alts[k].trailing = text
+	} else {
+		item.alts[k+1].leading = append(item.alts[k+1].leading, text)
+	}
+}
+
+// End of the text of an item without the spaces and comments after it
+func (f *grammarFormatter) codeEnd(i int, items []*formatItem) int {
+	end := len(f.src)
+	if i+1 < len(items) {
+		end = items[i+1].pos
+	}
+	for end > items[i].pos {
+		ch := f.src[end-1]
+		if ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n' {
+			end--
+			continue
+		}
+
+		// Comments run to the end of their line
+		k := sort.SearchInts(f.comments, end) - 1
+		if k >= 0 && f.comments[k] >= items[i].pos && f.comments[k]+len(f.commentText[f.comments[k]]) >= end {
+			end = f.comments[k]
+			continue
+		}
+		break
+	}
+	return end
+}
+
+// Whether a line between two positions has nothing but spaces
+func (f *grammarFormatter) hasBlankLine(from int, to int) bool {
+	lines := strings.Split(f.src[from:to], "\n")
+	if len(lines) < 3 {
+		return false
+	}
+	for _, line := range lines[1 : len(lines)-1] {
+		if len(strings.TrimSpace(line)) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *grammarFormatter) writeItem(b *strings.Builder, item *formatItem, width int) {
+	head := item.head
+	if len(item.sep) > 0 {
+		head += strings.Repeat(" ", width-utf8.RuneCountInString(head))
+		head += " " + item.sep + " "
+	}
+
+	// Choices are wrapped when they are too long or have comments inside
+	wrap := false
+	var texts []string
+	for _, alt := range item.alts {
+		texts = append(texts, alt.text)
+		if len(alt.leading) > 0 || len(alt.trailing) > 0 {
+			wrap = true
+		}
+	}
+	line := head + strings.Join(texts, " / ")
+	if len(item.alts) < 2 || !wrap && utf8.RuneCountInString(line) <= f.width {
+		writeLine(b, line, item.trailing)
+		return
+	}
+
+	// One alternative per line, with the slashes under the arrow
+	indent := strings.Repeat(" ", width+1)
+	for i, alt := range item.alts {
+		trailing := alt.trailing
+		if i+1 == len(item.alts) {
+			trailing = item.trailing
+		}
+		if i == 0 {
+			writeLine(b, head+alt.text, trailing)
+			continue
+		}
+		writeComments(b, indent, alt.leading)
+		writeLine(b, indent+"/ "+alt.text, trailing)
+	}
+}
+
+func writeLine(b *strings.Builder, line string, comment string) {
+	b.WriteString(strings.TrimRight(line, " "))
+	if len(comment) > 0 {
+		b.WriteString(" " + comment)
+	}
+	b.WriteString("\n")
+}
+
+// Blank lines are kept as empty comments
+func writeComments(b *strings.Builder, indent string, comments []string) {
+	for _, c := range comments {
+		if len(c) == 0 {
+			b.WriteString("\n")
+		} else {
+			b.WriteString(indent + c + "\n")
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package peg
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestFormatOperators(t *testing.T) {
+	tests := []struct {
+		ope  operator
+		want string
+	}{
+		{Seq(Lit("a"), Cho(Lit("b"), Lit("c")), Zom(Seq(Lit("d"), Dot()))), `'a' ('b' / 'c') ('d' .)*`},
+		{Cho(Seq(Lit("a"), Lit("b")), Seq()), `'a' 'b' / ()`},
+		{Npd(Apd(Opt(Lit("a")))), `!(&'a'?)`},
+		{Oom(Npd(Cls("0-9"))), `(![0-9])+`},
+		{Thr(Zom(Lit("a")), "x", nil), `'a'*^x`},
+		{Opt(Thr(Lit("a"), "x", nil)), `('a'^x)?`},
+		{Tok(Seq(Cls("a-z"), Zom(Cls("a-z0-9_")))), `< [a-z] [a-z0-9_]* >`},
+		{Seq(Ign(Ref("SP", nil, 0)), Ref("LIST", []operator{Lit(","), Cho(Lit("a"), Lit("b"))}, 0), Cut()), `~SP LIST(',', 'a' / 'b') ↑`},
+		{Seq(LitI("abc"), Lit("it's \\ \n\t\x01é")), `'abc'i 'it\'s \\ \n\t\u{1}é'`},
+		{Lit("\xffa\xfe!"), `'\xff\u{61}\xfe!'`},
+		{Seq(Cls("]^\\-"), Cls("^a"), NCls("^a")), `[\]^\\-] [\^a] [^^a]`},
+		{Cho(), `!''`},
+		{Seq(Cap(Ref("A", nil, 0), "x"), Npd(Cap(Lit("b"), "y")), Cap(Cap(Zom(Lit("c")), "z"), "w")), `x:A !(y:'b') w:(z:'c'*)`},
+		{Zom(Cap(Lit("a"), "x")), `(x:'a')*`},
+	}
+
+	for _, test := range tests {
+		if got := test.ope.String(); got != test.want {
+			t.Errorf("got %s, want %s", got, test.want)
+		}
+	}
+}
+
+func TestFormatEscapesRoundTrip(t *testing.T) {
+	for _, s := range []string{"it's \\ \n\r\t\x01\x7fé", "\xffa\xfe!", "\x00 "} {
+		parser, err := NewParser("A <- " + Lit(s).String())
+		assert(t, err == nil)
+		assert(t, parser.Grammar["A"].Ope.(*literalString).lit == s)
+	}
+
+	for _, s := range []string{"]^\\-a", "^\n-\x7f", "\\\\"} {
+		parser, err := NewParser("A <- " + Seq(Cls(s), NCls(s)).String())
+		assert(t, err == nil)
+		seq := parser.Grammar["A"].Ope.(*sequence)
+		assert(t, seq.opes[0].(*characterClass).chars == s)
+		assert(t, !seq.opes[0].(*characterClass).negated)
+		assert(t, seq.opes[1].(*characterClass).chars == s)
+		assert(t, seq.opes[1].(*characterClass).negated)
+	}
+}
+
+func TestFormatRule(t *testing.T) {
+	parser, _ := NewParser(`
+        START          <- LIST(ITEM, ',') ';'^semi
+        LIST(I, D)     <- I (D I)*
+        ~ITEM          <- < [a-z]+ >
+        %recover(semi) <- (!';' .)*
+    `)
+
+	g := parser.Grammar
+	assert(t, g["START"].String() == "START ← LIST(ITEM, ',') ';'^semi")
+	assert(t, g["LIST"].String() == "LIST(I, D) ← I (D I)*")
+	assert(t, g["ITEM"].String() == "~ITEM ← < [a-z]+ >")
+	assert(t, g["semi"].String() == "%recover(semi) ← (!';' .)*")
+}
+
+// Print a grammar, parse it again and print it once more
+func checkRoundTrip(t *testing.T, grammar string, inputs []string) {
+	unoptimized := grammar + "\n---\n%optimize = false\n"
+	if strings.Contains(grammar, "\n---") {
+		unoptimized = grammar + "\n%optimize = false\n"
+	}
+
+	for _, s := range []string{grammar, unoptimized} {
+		parser, err := NewParser(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text := parser.String()
+
+		reparsed, err := NewParser(text)
+		if err != nil {
+			t.Fatalf("%s\n%s", err, text)
+		}
+		if again := reparsed.String(); again != text {
+			t.Errorf("got\n%s\nexpected\n%s", again, text)
+		}
+
+		parser.EnableAst()
+		reparsed.EnableAst()
+		compareParsers(t, reparsed, parser, inputs)
+	}
+}
+
+func TestParserStringRoundTrip(t *testing.T) {
+	calc, err := ioutil.ReadFile("internal/calc/calc.peg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRoundTrip(t, string(calc), []string{
+		"let x = 1 + 2 * 3; print sum [x, neg x];",
+		"LET y = 1 print y;",
+		"print (1 + 2;",
+	})
+
+	checkRoundTrip(t, `
+        S       <- (KEYWORD / OP / ('x' / 'y') / STRING / CHAR / ↑ SEP)*
+        KEYWORD <- ('if' / 'then' / ('else' / 'elif')) ![a-z]
+        OP      <- '=' '=' / '=' / &'<' '<' '-'? / '\\'
+        STRING  <- '"' < (!'"' .)* > '"'
+        CHAR    <- < '\'' [^'\]\\\n] '\'' >
+        SEP     <- [;,] / '' [.]
+        %whitespace <- [ \t]*
+    `, []string{
+		"if x == y then 'a' else \"b\"",
+		"x <- y <; elif \\",
+		"'ab'",
+		"then .",
+	})
+}
+
+func TestParserStringUserRules(t *testing.T) {
+	rules := map[string]operator{
+		"NAME":    Usr(func(s string, p int, v *Values, d Any) int { return len(s) - p }),
+		"~PREFIX": Seq(Lit("@"), Opt(Cls("0-9"))),
+	}
+	parser, err := NewParserWithUserRules(`ROOT <- PREFIX NAME`, rules)
+	assert(t, err == nil)
+
+	text := parser.String()
+	assert(t, text == "ROOT ← PREFIX NAME\n~PREFIX ← '@' [0-9]?\n")
+
+	delete(rules, "~PREFIX")
+	reparsed, err := NewParserWithUserRules(text, rules)
+	assert(t, err == nil)
+	compareParsers(t, reparsed, parser, []string{"@1abc", "@", "x"})
+}
+
+func TestFormat(t *testing.T) {
+	src := `# Header comment
+
+# About LIST
+LIST<-ITEM ("," ITEM)* # trailing
+ITEM <- NUMBER   # number
+     # a name
+     / NAME
+     / "\x41\t"
+NUMBER <- < [0-9]+ >  
+
+
+# Macros
+~T(X) <- X _
+%recover(semi) <- (!";" .)*
+~_ <- [ \t]*
+# Options
+---
+%whitespace_not_used = true # comment
+%x = 1
+
+# footer
+`
+	want := `# Header comment
+
+# About LIST
+LIST   ← ITEM (',' ITEM)* # trailing
+ITEM   ← NUMBER # number
+       # a name
+       / NAME
+       / 'A\t'
+NUMBER ← < [0-9]+ >
+
+# Macros
+~T(X)          ← X _
+%recover(semi) ← (!';' .)*
+~_             ← [ \t]*
+# Options
+---
+%whitespace_not_used = true # comment
+%x                   = 1
+
+# footer
+`
+
+	out, err := Format(src, FormatOptions{})
+	assert(t, err == nil)
+	if string(out) != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+
+	again, err := Format(string(out), FormatOptions{})
+	assert(t, err == nil)
+	assert(t, string(again) == string(out))
+
+	// The formatted grammar is the same grammar
+	p1, _ := NewParserWithUserRules(src, map[string]operator{"NAME": Lit("n")})
+	p2, _ := NewParserWithUserRules(string(out), map[string]operator{"NAME": Lit("n")})
+	assert(t, p1.String() == p2.String())
+}
+
+func TestFormatWrapsLongChoices(t *testing.T) {
+	src := `S <- 'alpha' / 'beta' / ('gamma' / 'delta') / 'epsilon'`
+
+	out, _ := Format(src, FormatOptions{})
+	assert(t, string(out) == "S ← 'alpha' / 'beta' / ('gamma' / 'delta') / 'epsilon'\n")
+
+	out, _ = Format(src, FormatOptions{Width: 40})
+	assert(t, string(out) == `S ← 'alpha'
+  / 'beta'
+  / ('gamma' / 'delta')
+  / 'epsilon'
+`)
+}
+
+func TestFormatErrors(t *testing.T) {
+	_, err := Format("A <- 'a'\nA <- 'b'\n", FormatOptions{})
+	assert(t, err != nil && err.Details[0].Msg == "'A' is already defined.")
+
+	_, err = Format("A <- 'a\n", FormatOptions{})
+	assert(t, err != nil)
+
+	// References are not checked
+	out, err := Format("A <- B", FormatOptions{})
+	assert(t, err == nil && string(out) == "A ← B\n")
+}
@@ -0,0 +1,569 @@
+package peg
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Code generation options
+type GenOptions struct {
+	Package string // Package name of the generated file
+	Prefix  string // Prefix of the generated type names
+}
+
+const runtimeImportPath = "github.com/yhirose/go-peg/pegrt"
+
+// Generate Go source of a standalone parser that only depends on the pegrt
+// package. Each rule and expression is a method that calls the primitives of
+// the runtime, so the grammar is neither parsed nor interpreted at run time.
+func Generate(grammar string, opts GenOptions) ([]byte, *Error) {
+	// The generated methods follow the grammar as written
+	parser, err := newParser(grammar, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.Package) == 0 {
+		opts.Package = "main"
+	}
+
+	g := &generator{
+		s:         grammar,
+		grammar:   parser.Grammar,
+		prefix:    opts.Prefix,
+		index:     make(map[*Rule]int),
+		funcName:  make(map[*Rule]string),
+		used:      make(map[string]bool),
+		classVar:  make(map[string]string),
+		instances: make(map[string]string),
+		expanded:  make(map[*Rule]int),
+	}
+
+	// Rules in the order of definitions. Macros are generated for each of
+	// their instances.
+	var rules []*Rule
+	for _, r := range parser.Grammar {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Pos < rules[j].Pos
+	})
+
+	for _, r := range rules {
+		if r.LeftRecursive {
+			msg := "'" + r.Name + "' is left recursive and cannot be generated."
+			g.err = addGrammarError(g.err, grammar, r.Pos, r.Name, msg)
+		}
+		if r.Parameters == nil {
+			g.index[r] = len(g.rules)
+			g.rules = append(g.rules, r)
+			g.funcName[r] = g.methodName("rule" + goIdentifier(r.Name))
+		}
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+
+	src := g.generate(opts.Package, parser)
+	if g.err != nil {
+		return nil, sortGrammarError(g.err)
+	}
+	out, ferr := format.Source(src)
+	if ferr != nil {
+		return nil, &Error{Kind: GrammarError, Details: []ErrorDetail{{Ln: 1, Col: 1, Msg: ferr.Error(), Kind: GrammarError, Err: ferr}}}
+	}
+	return out, nil
+}
+
+// Generator state
+type generator struct {
+	s        string
+	grammar  map[string]*Rule
+	prefix   string
+	rules    []*Rule // Rules that are not macros
+	index    map[*Rule]int
+	funcName map[*Rule]string
+	used     map[string]bool // Names of the methods
+	methods  [][]byte        // Methods in the order that they are generated
+	exprs    int             // Number of expression methods
+	classes  []string
+	classVar map[string]string // Variables of the character classes by description
+	current  *Rule             // Rule being generated
+	err      *Error
+
+	instances map[string]string // Methods of the macro instances by rule and arguments
+	expanded  map[*Rule]int     // Number of instances of a macro
+	pending   []*macroMethod    // Macro instances that are not generated yet
+	args      []operator        // Arguments of the macro instance being generated
+	depth     int               // Depth of the parameters being expanded
+}
+
+// Macro instance of a generated parser
+type macroMethod struct {
+	rule *Rule
+	args []operator
+	name string
+}
+
+func (g *generator) typeName() string {
+	return g.prefix + "Parser"
+}
+
+// Unexported names are prefixed so that several parsers can share a package
+func (g *generator) varName(name string) string {
+	if len(g.prefix) == 0 {
+		return name
+	}
+	return strings.ToLower(g.prefix[:1]) + g.prefix[1:] + strings.ToUpper(name[:1]) + name[1:]
+}
+
+func (g *generator) methodName(name string) string {
+	for g.used[name] {
+		name += "_"
+	}
+	g.used[name] = true
+	return name
+}
+
+func (g *generator) generate(pkg string, parser *Parser) []byte {
+	for _, r := range g.rules {
+		g.generateRule(r)
+	}
+	for len(g.pending) > 0 {
+		m := g.pending[0]
+		g.pending = g.pending[1:]
+		g.generateMacro(m)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by peg.Generate. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	fmt.Fprintf(&b, "import %q\n\n", runtimeImportPath)
+
+	if len(g.classes) > 0 {
+		fmt.Fprintf(&b, "var (\n")
+		for i, cls := range g.classes {
+			fmt.Fprintf(&b, "%s = %s\n", g.varName(fmt.Sprintf("class%d", i)), cls)
+		}
+		fmt.Fprintf(&b, ")\n\n")
+	}
+
+	typeName := g.typeName()
+	fmt.Fprintf(&b, "// %s\n", typeName)
+	fmt.Fprintf(&b, "type %s struct {\n", typeName)
+	fmt.Fprintf(&b, "Grammar map[string]*pegrt.Rule\n")
+	fmt.Fprintf(&b, "rules [%d]pegrt.Rule\n", len(g.rules))
+	fmt.Fprintf(&b, "}\n\n")
+
+	fmt.Fprintf(&b, "func New%s() *%s {\n", typeName, typeName)
+	fmt.Fprintf(&b, "g := &%s{}\n", typeName)
+	for i, r := range g.rules {
+		fmt.Fprintf(&b, "g.rules[%d] = pegrt.Rule{Name: %q", i, r.Name)
+		if r.Ignore {
+			fmt.Fprintf(&b, ", Ignore: true")
+		}
+		if len(r.Name) > 0 && r.hasTokenBoundary() {
+			fmt.Fprintf(&b, ", TokenRule: true")
+		}
+		if exp, ok := r.Ope.(*expression); ok {
+			fmt.Fprintf(&b, ", BinOps: %s", binOps(exp.bopinf))
+			if exp.labels != [3]string{} {
+				fmt.Fprintf(&b, ", Labels: %#v", exp.labels)
+			}
+		}
+		fmt.Fprintf(&b, "}\n")
+	}
+	fmt.Fprintf(&b, "g.Grammar = map[string]*pegrt.Rule{\n")
+	for i, r := range g.rules {
+		fmt.Fprintf(&b, "%q: &g.rules[%d],\n", r.Name, i)
+	}
+	fmt.Fprintf(&b, "}\n")
+	fmt.Fprintf(&b, "return g\n")
+	fmt.Fprintf(&b, "}\n\n")
+
+	whitespace, word := "nil", "nil"
+	if r, ok := g.grammar[WhitespceRuleName]; ok {
+		whitespace = "g." + g.funcName[r]
+	}
+	if r, ok := g.grammar[WordRuleName]; ok {
+		word = "g." + g.funcName[r]
+	}
+	start := g.grammar[parser.start]
+
+	fmt.Fprintf(&b, "func (g *%s) Parse(s string, d pegrt.Any) (err *pegrt.Error) {\n", typeName)
+	fmt.Fprintf(&b, "_, err = g.ParseAndGetValue(s, d)\n")
+	fmt.Fprintf(&b, "return\n")
+	fmt.Fprintf(&b, "}\n\n")
+	fmt.Fprintf(&b, "func (g *%s) ParseAndGetValue(s string, d pegrt.Any) (val pegrt.Any, err *pegrt.Error) {\n", typeName)
+	fmt.Fprintf(&b, "return pegrt.Parse(s, d, &g.rules[%d], g.%s, %s, %s)\n", g.index[start], g.funcName[start], whitespace, word)
+	fmt.Fprintf(&b, "}\n\n")
+	fmt.Fprintf(&b, "func (g *%s) ParseErr(s string, d pegrt.Any) error {\n", typeName)
+	fmt.Fprintf(&b, "return g.Parse(s, d).Err()\n")
+	fmt.Fprintf(&b, "}\n\n")
+	fmt.Fprintf(&b, "func (g *%s) ParseAndGetValueErr(s string, d pegrt.Any) (pegrt.Any, error) {\n", typeName)
+	fmt.Fprintf(&b, "val, err := g.ParseAndGetValue(s, d)\n")
+	fmt.Fprintf(&b, "return val, err.Err()\n")
+	fmt.Fprintf(&b, "}\n\n")
+
+	for _, m := range g.methods {
+		b.Write(m)
+	}
+	return b.Bytes()
+}
+
+// Methods are written in pre-order, so a method is reserved before the
+// methods of its operands are generated
+func (g *generator) method(comment string, name string, body func(b *bytes.Buffer)) {
+	i := len(g.methods)
+	g.methods = append(g.methods, nil)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// %s\n", comment)
+	fmt.Fprintf(&b, "func (g *%s) %s(c *pegrt.Context, p int, v *pegrt.Values) int {\n", g.typeName(), name)
+	body(&b)
+	fmt.Fprintf(&b, "}\n\n")
+	g.methods[i] = b.Bytes()
+}
+
+func (g *generator) generateRule(r *Rule) {
+	g.current = r
+	g.args = nil
+	g.method(r.Name, g.funcName[r], func(b *bytes.Buffer) {
+		fmt.Fprintf(b, "f := c.Enter(&g.rules[%d], p)\n", g.index[r])
+		code, _ := g.code(r.Ope, "p", "f.Values")
+		fmt.Fprintf(b, "return c.Leave(&f, p, v, %s)\n", code)
+	})
+}
+
+// A macro instance is parsed into the values of its reference
+func (g *generator) generateMacro(m *macroMethod) {
+	g.current = m.rule
+	g.args = m.args
+	g.depth = 0
+
+	var args []string
+	for _, arg := range m.args {
+		args = append(args, formatOperator(arg))
+	}
+	comment := m.rule.Name + "(" + strings.Join(args, ", ") + ")"
+
+	g.method(comment, m.name, func(b *bytes.Buffer) {
+		fmt.Fprintf(b, "cut := c.BeginMacro()\n")
+		code, _ := g.code(m.rule.Ope, "p", "v")
+		fmt.Fprintf(b, "return c.EndMacro(cut, %s)\n", code)
+	})
+}
+
+// Go expression that parses an operator at pos into the values vs, and
+// whether it uses the values
+func (g *generator) code(ope operator, pos string, vs string) (string, bool) {
+	v := &codeGenerator{g: g, pos: pos, vs: vs}
+	ope.accept(v)
+	return v.code, v.values
+}
+
+// Method of an operand, whose call is the code of the operator
+func (v *codeGenerator) expr(ope operator, body func(b *bytes.Buffer)) {
+	name := v.g.methodName(fmt.Sprintf("expr%d", v.g.exprs))
+	v.g.exprs++
+	v.g.method(formatOperator(ope), name, body)
+	v.call(name)
+}
+
+func (v *codeGenerator) call(name string) {
+	v.code = fmt.Sprintf("g.%s(c, %s, %s)", name, v.pos, v.vs)
+	v.values = true
+}
+
+// Variable of a character class, which is shared by the classes that are
+// written the same
+func (g *generator) class(ope *characterClass) string {
+	desc := ope.describe()
+	if name, ok := g.classVar[desc]; ok {
+		return name
+	}
+	ranges := func(rgs []runeRange, format string) string {
+		var items []string
+		for _, rg := range rgs {
+			items = append(items, fmt.Sprintf("{Lo: "+format+", Hi: "+format+"}", rg.lo, rg.hi))
+		}
+		return "[]pegrt.Range{" + strings.Join(items, ", ") + "}"
+	}
+
+	cls := fmt.Sprintf("pegrt.Class{Desc: %q, Ranges: %s", desc, ranges(ope.ranges, "%q"))
+	if ope.bytes != nil {
+		cls += ", Bytes: " + ranges(ope.bytes, "0x%02x")
+	}
+	if ope.negated {
+		cls += ", Negated: true"
+	}
+	cls += "}"
+
+	name := g.varName(fmt.Sprintf("class%d", len(g.classes)))
+	g.classes = append(g.classes, cls)
+	g.classVar[desc] = name
+	return name
+}
+
+// Method of the instance of a macro with the arguments
+func (g *generator) macro(r *Rule, args []operator, pos int) string {
+	key := fmt.Sprintf("%p", r)
+	for _, arg := range args {
+		key += fmt.Sprintf(" %p", arg)
+	}
+
+	name, ok := g.instances[key]
+	if !ok {
+		if g.expanded[r] == maxMacroInstances {
+			g.unsupported(pos, "'"+r.Name+"' has too many instances to be generated.")
+			return ""
+		}
+		g.expanded[r]++
+		name = g.methodName("rule" + goIdentifier(r.Name))
+		g.instances[key] = name
+		g.pending = append(g.pending, &macroMethod{r, args, name})
+	}
+	return name
+}
+
+// Argument of a macro reference, as the interpreter substitutes it
+func (g *generator) substitute(arg operator, params []string) operator {
+	v := &findReference{args: g.args, params: params}
+	arg.accept(v)
+	if formatOperator(v.ope) == formatOperator(arg) {
+		return arg
+	}
+	return v.ope
+}
+
+func (g *generator) unsupported(pos int, msg string) {
+	g.err = addGrammarError(g.err, g.s, pos, g.current.Name, msg)
+}
+
+// Binary operators of a %expr rule in the order of the operators
+func binOps(info BinOpeInfo) string {
+	var ops []string
+	for op := range info {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	assoc := []string{"pegrt.AssocNone", "pegrt.AssocLeft", "pegrt.AssocRight"}
+	var items []string
+	for _, op := range ops {
+		items = append(items, fmt.Sprintf("%q: {Level: %d, Assoc: %s}", op, info[op].level, assoc[info[op].assoc]))
+	}
+	return "map[string]pegrt.BinOp{" + strings.Join(items, ", ") + "}"
+}
+
+// Rule names such as '%whitespace' are not Go identifiers
+func goIdentifier(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// codeGenerator
+type codeGenerator struct {
+	g      *generator
+	pos    string // Position of the operator
+	vs     string // Values that the operator parses into
+	code   string
+	values bool
+}
+
+func (v *codeGenerator) visitSequence(ope *sequence) {
+	v.expr(ope, func(b *bytes.Buffer) {
+		if len(ope.opes) == 0 {
+			fmt.Fprintf(b, "return 0\n")
+			return
+		}
+		for i, o := range ope.opes {
+			if i == 0 {
+				code, _ := v.g.code(o, "p", "v")
+				fmt.Fprintf(b, "l := %s\n", code)
+				fmt.Fprintf(b, "if l < 0 {\nreturn -1\n}\n")
+			} else {
+				code, _ := v.g.code(o, "p+l", "v")
+				if i == 1 {
+					fmt.Fprintf(b, "n := %s\n", code)
+				} else {
+					fmt.Fprintf(b, "n = %s\n", code)
+				}
+				fmt.Fprintf(b, "if n < 0 {\nreturn -1\n}\n")
+				fmt.Fprintf(b, "l += n\n")
+			}
+		}
+		fmt.Fprintf(b, "return l\n")
+	})
+}
+func (v *codeGenerator) visitPrioritizedChoice(ope *prioritizedChoice) {
+	v.expr(ope, func(b *bytes.Buffer) {
+		fmt.Fprintf(b, "m := c.BeginChoice(v)\n")
+		for i, o := range ope.opes {
+			code, _ := v.g.code(o, "p", "v")
+			fmt.Fprintf(b, "if n := %s; c.Alternative(&m, v, %d, n) {\nreturn n\n}\n", code, ope.choice(i))
+		}
+		fmt.Fprintf(b, "return c.EndChoice(&m, v)\n")
+	})
+}
+
+// Iterations after the first one of a repetition from p+l
+func (v *codeGenerator) repeat(b *bytes.Buffer, ope operator) {
+	code, _ := v.g.code(ope, "p+l", "v")
+	fmt.Fprintf(b, "m := c.BeginRepeat()\n")
+	fmt.Fprintf(b, "for c.Iterate(&m, v, p+l) {\n")
+	fmt.Fprintf(b, "n := c.Iterated(&m, v, %s)\n", code)
+	fmt.Fprintf(b, "if n <= 0 {\nbreak\n}\n")
+	fmt.Fprintf(b, "l += n\n")
+	fmt.Fprintf(b, "}\n")
+	fmt.Fprintf(b, "return c.EndRepeat(&m, l)\n")
+}
+func (v *codeGenerator) visitZeroOrMore(ope *zeroOrMore) {
+	v.expr(ope, func(b *bytes.Buffer) {
+		fmt.Fprintf(b, "l := 0\n")
+		v.repeat(b, ope.ope)
+	})
+}
+func (v *codeGenerator) visitOneOrMore(ope *oneOrMore) {
+	v.expr(ope, func(b *bytes.Buffer) {
+		code, _ := v.g.code(ope.ope, "p", "v")
+		fmt.Fprintf(b, "l := %s\n", code)
+		fmt.Fprintf(b, "if l < 0 {\nreturn -1\n}\n")
+		v.repeat(b, ope.ope)
+	})
+}
+func (v *codeGenerator) visitOption(ope *option) {
+	v.expr(ope, func(b *bytes.Buffer) {
+		code, _ := v.g.code(ope.ope, "p", "v")
+		fmt.Fprintf(b, "m := c.BeginOption(v)\n")
+		fmt.Fprintf(b, "return c.Option(&m, v, %s)\n", code)
+	})
+}
+func (v *codeGenerator) visitAndPredicate(ope *andPredicate) {
+	v.expr(ope, func(b *bytes.Buffer) {
+		code, _ := v.g.code(ope.ope, "p", "m.Values")
+		fmt.Fprintf(b, "m := c.BeginPredicate()\n")
+		fmt.Fprintf(b, "return c.And(&m, %s)\n", code)
+	})
+}
+func (v *codeGenerator) visitNotPredicate(ope *notPredicate) {
+	v.expr(ope, func(b *bytes.Buffer) {
+		code, _ := v.g.code(ope.ope, "p", "m.Values")
+		fmt.Fprintf(b, "m := c.BeginPredicate()\n")
+		fmt.Fprintf(b, "return c.Not(&m, p, %s)\n", code)
+	})
+}
+func (v *codeGenerator) visitLiteralString(ope *literalString) {
+	if ope.ignoreCase {
+		v.code = fmt.Sprintf("c.LitI(%s, %q)", v.pos, ope.lit)
+	} else {
+		v.code = fmt.Sprintf("c.Lit(%s, %q)", v.pos, ope.lit)
+	}
+}
+func (v *codeGenerator) visitCharacterClass(ope *characterClass) {
+	v.code = fmt.Sprintf("c.Class(%s, &%s)", v.pos, v.g.class(ope))
+}
+func (v *codeGenerator) visitAnyCharacter(ope *anyCharacter) {
+	v.code = fmt.Sprintf("c.Dot(%s)", v.pos)
+}
+func (v *codeGenerator) visitTokenBoundary(ope *tokenBoundary) {
+	v.expr(ope, func(b *bytes.Buffer) {
+		code, _ := v.g.code(ope.ope, "p", "v")
+		fmt.Fprintf(b, "c.BeginToken()\n")
+		fmt.Fprintf(b, "return c.EndToken(p, v, %s)\n", code)
+	})
+}
+func (v *codeGenerator) visitIgnore(ope *ignore) {
+	// An operand without values has none to drop
+	code, values := v.g.code(ope.ope, v.pos, "c.Push()")
+	if values {
+		code = "c.Ignore(" + code + ")"
+	}
+	v.code, v.values = code, values
+}
+func (v *codeGenerator) visitUser(ope *user) {
+	// Only grammar text is generated, which cannot contain user rules
+	panic("peg: user rules cannot be generated")
+}
+func (v *codeGenerator) visitReference(ope *reference) {
+	g := v.g
+	switch {
+	case ope.rule == nil:
+		// Parameter of the macro instance
+		if ope.iarg >= len(g.args) || g.depth == maxMacroInstances {
+			g.unsupported(ope.pos, "'"+ope.name+"' is expanded too deeply to be generated.")
+			v.code = "-1"
+			return
+		}
+		g.depth++
+		v.code, v.values = g.code(g.args[ope.iarg], v.pos, v.vs)
+		g.depth--
+	case ope.rule.Parameters == nil:
+		v.call(g.funcName[ope.rule])
+	default:
+		var args []operator
+		for _, arg := range ope.args {
+			args = append(args, g.substitute(arg, ope.rule.Parameters))
+		}
+		v.call(g.macro(ope.rule, args, ope.pos))
+	}
+}
+func (v *codeGenerator) visitRule(ope *Rule) {
+	if ope.Parameters != nil {
+		v.call(v.g.macro(ope, v.g.args, ope.Pos))
+		return
+	}
+	v.call(v.g.funcName[ope])
+}
+func (v *codeGenerator) visitWhitespace(ope *whitespace) {
+	// Whitespace is skipped by the runtime and is not in the rules
+	panic("peg: whitespace operators cannot be generated")
+}
+func (v *codeGenerator) visitExpression(ope *expression) {
+	// The %expr rule, whose operands are rules
+	g := v.g
+	atom, binop := ope.atom.(*reference).rule, ope.binop.(*reference).rule
+	if atom.Parameters != nil || binop.Parameters != nil {
+		g.unsupported(g.current.Pos, "the operands of '"+g.current.Name+"' cannot be macros to be generated.")
+		v.code = "-1"
+		return
+	}
+	v.code = fmt.Sprintf("c.Expression(%s, %s, &g.rules[%d], g.%s, g.%s)", v.pos, v.vs, g.index[g.current], g.funcName[atom], g.funcName[binop])
+	v.values = true
+}
+func (v *codeGenerator) visitCut(ope *cut) {
+	v.code = "c.Cut()"
+}
+func (v *codeGenerator) visitThrow(ope *throw) {
+	v.expr(ope, func(b *bytes.Buffer) {
+		code, _ := v.g.code(ope.ope, "p", "v")
+		fmt.Fprintf(b, "m := c.BeginThrow(v)\n")
+		r, ok := ope.recovery.(*Rule)
+		if !ok {
+			fmt.Fprintf(b, "n, _ := c.Throw(&m, v, p, %q, nil, %s)\n", ope.label, code)
+			fmt.Fprintf(b, "return n\n")
+			return
+		}
+		fmt.Fprintf(b, "n, recovered := c.Throw(&m, v, p, %q, &g.rules[%d], %s)\n", ope.label, v.g.index[r], code)
+		fmt.Fprintf(b, "if recovered {\nreturn g.%s(c, p, v)\n}\n", v.g.funcName[r])
+		fmt.Fprintf(b, "return n\n")
+	})
+}
+func (v *codeGenerator) visitCapture(ope *capture) {
+	v.expr(ope, func(b *bytes.Buffer) {
+		code, _ := v.g.code(ope.ope, "p", "v")
+		fmt.Fprintf(b, "begin := len(v.Vs)\n")
+		fmt.Fprintf(b, "return c.Capture(v, %q, %t, begin, p, %s)\n", ope.name, ope.text, code)
+	})
+}
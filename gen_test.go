@@ -0,0 +1,78 @@
+package peg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestGenerateIsUpToDate(t *testing.T) {
+	grammar, err := ioutil.ReadFile("internal/calc/calc.peg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("internal/calc/calc.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, perr := Generate(string(grammar), GenOptions{Package: "calc", Prefix: "Calc"})
+	assert(t, perr == nil)
+	assert(t, bytes.Equal(got, want))
+}
+
+func TestGenerateOptions(t *testing.T) {
+	src, err := Generate(`
+		LIST     <- ITEM (',' ITEM)*
+		ITEM     <- [0-9]+
+	`, GenOptions{Package: "list", Prefix: "List"})
+	assert(t, err == nil)
+
+	s := string(src)
+	assert(t, strings.Contains(s, "package list\n"))
+	assert(t, strings.Contains(s, "type ListParser struct"))
+	assert(t, strings.Contains(s, "func NewListParser() *ListParser"))
+	assert(t, strings.Contains(s, "func (g *ListParser) ruleITEM(c *pegrt.Context, p int, v *pegrt.Values) int"))
+	assert(t, strings.Contains(s, "listClass0 = pegrt.Class{Desc: \"[0-9]\""))
+	assert(t, strings.Contains(s, "import \"github.com/yhirose/go-peg/pegrt\""))
+
+	src, err = Generate(`ITEM <- [0-9]+`, GenOptions{})
+	assert(t, err == nil)
+	assert(t, strings.Contains(string(src), "package main\n"))
+	assert(t, strings.Contains(string(src), "type Parser struct"))
+}
+
+func TestGenerateErrors(t *testing.T) {
+	_, err := Generate(`A <- B`, GenOptions{})
+	assert(t, err != nil)
+	assert(t, err.Details[0].Msg == "'B' is not defined.")
+}
+
+func TestGenerateLeftRecursion(t *testing.T) {
+	_, err := Generate(`
+		A <- A 'a' / 'a'
+		---
+		%left_recursion = true
+	`, GenOptions{})
+	assert(t, err != nil)
+	assert(t, err.Details[0].Msg == "'A' is left recursive and cannot be generated.")
+}
+
+func TestGenerateMacroInstances(t *testing.T) {
+	// Each instance is a method, so arguments that grow are not generated
+	_, err := Generate(`
+		A    <- M('x')
+		M(X) <- X / 'y' M(('z' X))
+	`, GenOptions{})
+	assert(t, err != nil)
+	assert(t, err.Details[0].Msg == "'M' has too many instances to be generated.")
+
+	src, err := Generate(`
+		A       <- LIST('a') LIST('b')
+		LIST(I) <- I (',' I)*
+	`, GenOptions{})
+	assert(t, err == nil)
+	assert(t, strings.Contains(string(src), "// LIST('a')\nfunc (g *Parser) ruleLIST(c *pegrt.Context, p int, v *pegrt.Values) int"))
+	assert(t, strings.Contains(string(src), "// LIST('b')\nfunc (g *Parser) ruleLIST_(c *pegrt.Context, p int, v *pegrt.Values) int"))
+}
@@ -0,0 +1,288 @@
+package peg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Rule in a reference graph
+type GraphNode struct {
+	Name        string `json:"name"`
+	Start       bool   `json:"start,omitempty"`
+	Whitespace  bool   `json:"whitespace,omitempty"`
+	Word        bool   `json:"word,omitempty"`
+	Macro       bool   `json:"macro,omitempty"`
+	Recovery    bool   `json:"recovery,omitempty"`
+	Unreachable bool   `json:"unreachable,omitempty"`
+	SCC         int    `json:"scc"` // Index in Graph.SCCs, or -1
+}
+
+// Reference from a rule to another
+type GraphEdge struct {
+	From           string   `json:"from"`
+	To             string   `json:"to"`
+	Recovery       bool     `json:"recovery,omitempty"`       // ^label with a %recover rule
+	Instantiations []string `json:"instantiations,omitempty"` // Macro references with their arguments
+}
+
+// Rule reference graph. Rules are in the order of the grammar text, and
+// strongly connected components are the groups of mutually recursive rules
+// and the rules that reference themselves.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+	SCCs  [][]string  `json:"sccs"`
+}
+
+// graphBuilder
+type graphBuilder struct {
+	params []string
+	from   string
+	edges  []GraphEdge
+	index  map[string]int
+}
+
+func (v *graphBuilder) addEdge(to string, recovery bool, instantiation string) {
+	key := to
+	if recovery {
+		key = "^" + to
+	}
+	i, ok := v.index[key]
+	if !ok {
+		i = len(v.edges)
+		v.index[key] = i
+		v.edges = append(v.edges, GraphEdge{From: v.from, To: to, Recovery: recovery})
+	}
+	if len(instantiation) > 0 {
+		e := &v.edges[i]
+		for _, s := range e.Instantiations {
+			if s == instantiation {
+				return
+			}
+		}
+		e.Instantiations = append(e.Instantiations, instantiation)
+	}
+}
+
+func (v *graphBuilder) build(r *Rule) {
+	r.Ope.accept(&referenceWalker{reference: v.reference, rule: v.rule, throw: v.throw})
+}
+
+func (v *graphBuilder) reference(ope *reference) {
+	if isParameter(v.params, ope.name) {
+		return
+	}
+	instantiation := ""
+	if len(ope.args) > 0 {
+		instantiation = formatOperator(ope)
+	}
+	v.addEdge(ope.name, false, instantiation)
+}
+
+func (v *graphBuilder) rule(ope *Rule) { v.addEdge(ope.Name, false, "") }
+
+func (v *graphBuilder) throw(ope *throw) {
+	if ope.recovery != nil {
+		v.addEdge(ope.label, true, "")
+	}
+}
+
+// Rule reference graph of the grammar, including macro references and the
+// %recover rules of ^labels. The start rule, %whitespace and %word are where
+// parsing begins, and rules that can't be reached from them are marked as
+// unreachable.
+func (p *Parser) Graph() *Graph {
+	g := &Graph{Edges: []GraphEdge{}, SCCs: [][]string{}}
+	rules := p.sortedRules()
+	ids := make(map[string]int)
+	for i, r := range rules {
+		ids[r.Name] = i
+		g.Nodes = append(g.Nodes, GraphNode{
+			Name:       r.Name,
+			Start:      r.Name == p.start,
+			Whitespace: r.Name == WhitespceRuleName,
+			Word:       r.Name == WordRuleName,
+			Macro:      r.Parameters != nil,
+			Recovery:   r.Recovery,
+			SCC:        -1,
+		})
+	}
+
+	succ := make([][]int, len(rules))
+	for i, r := range rules {
+		v := &graphBuilder{params: r.Parameters, from: r.Name, index: make(map[string]int)}
+		v.build(r)
+		g.Edges = append(g.Edges, v.edges...)
+		for _, e := range v.edges {
+			if j, ok := ids[e.To]; ok {
+				succ[i] = append(succ[i], j)
+			}
+		}
+	}
+
+	// Reachability
+	reached := make([]bool, len(rules))
+	var reach func(i int)
+	reach = func(i int) {
+		if reached[i] {
+			return
+		}
+		reached[i] = true
+		for _, j := range succ[i] {
+			reach(j)
+		}
+	}
+	for _, name := range []string{p.start, WhitespceRuleName, WordRuleName} {
+		if i, ok := ids[name]; ok {
+			reach(i)
+		}
+	}
+	for i := range g.Nodes {
+		g.Nodes[i].Unreachable = !reached[i]
+	}
+
+	// Components are in the order of their first rule
+	var sccs [][]int
+	for _, scc := range stronglyConnected(succ) {
+		if len(scc) > 1 || hasInt(succ[scc[0]], scc[0]) {
+			sort.Ints(scc)
+			sccs = append(sccs, scc)
+		}
+	}
+	sort.Slice(sccs, func(i, j int) bool { return sccs[i][0] < sccs[j][0] })
+	for _, scc := range sccs {
+		var names []string
+		for _, i := range scc {
+			g.Nodes[i].SCC = len(g.SCCs)
+			names = append(names, rules[i].Name)
+		}
+		g.SCCs = append(g.SCCs, names)
+	}
+	return g
+}
+
+// Tarjan's algorithm. Components come in reverse topological order.
+func stronglyConnected(succ [][]int) (sccs [][]int) {
+	index := make([]int, len(succ))
+	low := make([]int, len(succ))
+	onStack := make([]bool, len(succ))
+	var stack []int
+	next := 1
+
+	var visit func(i int)
+	visit = func(i int) {
+		index[i] = next
+		low[i] = next
+		next++
+		stack = append(stack, i)
+		onStack[i] = true
+		for _, j := range succ[i] {
+			if index[j] == 0 {
+				visit(j)
+				if low[j] < low[i] {
+					low[i] = low[j]
+				}
+			} else if onStack[j] && index[j] < low[i] {
+				low[i] = index[j]
+			}
+		}
+		if low[i] == index[i] {
+			var scc []int
+			for {
+				j := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[j] = false
+				scc = append(scc, j)
+				if j == i {
+					break
+				}
+			}
+			sccs = append(sccs, scc)
+		}
+	}
+	for i := range succ {
+		if index[i] == 0 {
+			visit(i)
+		}
+	}
+	return
+}
+
+func hasInt(a []int, x int) bool {
+	for _, y := range a {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+// Graph in the Graphviz DOT language. The start rule has a double border,
+// %whitespace and %word are dashed, unreachable rules are gray, macros are
+// rounded, and strongly connected components are clusters.
+func (g *Graph) Dot() string {
+	var b strings.Builder
+	b.WriteString("digraph grammar {\n")
+	b.WriteString("  node [shape=box];\n")
+
+	writeNode := func(indent string, n GraphNode) {
+		var attrs []string
+		if n.Start {
+			attrs = append(attrs, "peripheries=2")
+		}
+		var styles []string
+		if n.Whitespace || n.Word {
+			styles = append(styles, "dashed")
+		}
+		if n.Macro {
+			styles = append(styles, "rounded")
+		}
+		if len(styles) > 0 {
+			attrs = append(attrs, "style="+dotQuote(strings.Join(styles, ",")))
+		}
+		if n.Unreachable {
+			attrs = append(attrs, "color=gray", "fontcolor=gray")
+		}
+		b.WriteString(indent + dotQuote(n.Name))
+		if len(attrs) > 0 {
+			b.WriteString(" [" + strings.Join(attrs, ", ") + "]")
+		}
+		b.WriteString(";\n")
+	}
+
+	for i := range g.SCCs {
+		fmt.Fprintf(&b, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(&b, "    label=\"SCC %d\";\n", i+1)
+		for _, n := range g.Nodes {
+			if n.SCC == i {
+				writeNode("    ", n)
+			}
+		}
+		b.WriteString("  }\n")
+	}
+	for _, n := range g.Nodes {
+		if n.SCC == -1 {
+			writeNode("  ", n)
+		}
+	}
+
+	for _, e := range g.Edges {
+		b.WriteString("  " + dotQuote(e.From) + " -> " + dotQuote(e.To))
+		switch {
+		case e.Recovery:
+			b.WriteString(" [style=dotted, label=" + dotQuote("^"+e.To) + "]")
+		case len(e.Instantiations) > 0:
+			b.WriteString(" [label=" + dotQuote(strings.Join(e.Instantiations, "\n")) + "]")
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Quoted DOT string
+func dotQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,95 @@
+package peg
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestGraph(t *testing.T) {
+	parser, err := NewParser(`
+        S          <- LIST(EXPR, ',') / LIST(ID, ';') ';'^semi
+        EXPR       <- TERM ('+' TERM)*
+        TERM       <- ID / '(' EXPR ')'
+        ID         <- < [a-z]+ > / ID '.'
+        LIST(I, D) <- I (D I)*
+        UNUSED     <- ID LATER
+        LATER      <- UNUSED?
+        %recover(semi) <- (!';' .)*
+        %whitespace <- [ \t]*
+        %word      <- ID
+        ---
+        %left_recursion = true
+    `)
+	assert(t, err == nil)
+
+	g := parser.Graph()
+
+	var names []string
+	for _, n := range g.Nodes {
+		names = append(names, n.Name)
+	}
+	assert(t, strings.Join(names, " ") == "S EXPR TERM ID LIST UNUSED LATER semi %whitespace %word")
+
+	nodes := make(map[string]GraphNode)
+	for _, n := range g.Nodes {
+		nodes[n.Name] = n
+	}
+	assert(t, nodes["S"].Start && !nodes["EXPR"].Start)
+	assert(t, nodes["%whitespace"].Whitespace && nodes["%word"].Word)
+	assert(t, nodes["LIST"].Macro && nodes["semi"].Recovery)
+	assert(t, nodes["UNUSED"].Unreachable && nodes["LATER"].Unreachable)
+	assert(t, !nodes["semi"].Unreachable && !nodes["%word"].Unreachable)
+
+	assert(t, len(g.SCCs) == 3)
+	assert(t, strings.Join(g.SCCs[0], " ") == "EXPR TERM")
+	assert(t, strings.Join(g.SCCs[1], " ") == "ID")
+	assert(t, strings.Join(g.SCCs[2], " ") == "UNUSED LATER")
+	assert(t, nodes["TERM"].SCC == 0 && nodes["ID"].SCC == 1 && nodes["S"].SCC == -1)
+
+	var edges []string
+	for _, e := range g.Edges {
+		s := e.From + "->" + e.To
+		if e.Recovery {
+			s += "^"
+		}
+		if len(e.Instantiations) > 0 {
+			s += "[" + strings.Join(e.Instantiations, "|") + "]"
+		}
+		edges = append(edges, s)
+	}
+	assert(t, strings.Join(edges, " ") == "S->LIST[LIST(EXPR, ',')|LIST(ID, ';')] S->EXPR S->ID S->semi^ "+
+		"EXPR->TERM TERM->ID TERM->EXPR ID->ID UNUSED->ID UNUSED->LATER LATER->UNUSED %word->ID")
+
+	out, jerr := json.Marshal(g)
+	assert(t, jerr == nil)
+	assert(t, strings.Contains(string(out), `{"name":"S","start":true,"scc":-1}`))
+
+	dot := g.Dot()
+	assert(t, strings.HasPrefix(dot, "digraph grammar {\n"))
+	assert(t, strings.Contains(dot, "  \"S\" [peripheries=2];\n"))
+	assert(t, strings.Contains(dot, "    \"UNUSED\" [color=gray, fontcolor=gray];\n"))
+	assert(t, strings.Contains(dot, "  \"LIST\" [style=\"rounded\"];\n"))
+	assert(t, strings.Contains(dot, "  \"%whitespace\" [style=\"dashed\"];\n"))
+	assert(t, strings.Contains(dot, "  subgraph cluster_0 {\n    label=\"SCC 1\";\n    \"EXPR\";\n    \"TERM\";\n  }\n"))
+	assert(t, strings.Contains(dot, `  "S" -> "LIST" [label="LIST(EXPR, ',')\nLIST(ID, ';')"];`))
+	assert(t, strings.Contains(dot, `  "S" -> "semi" [style=dotted, label="^semi"];`))
+}
+
+func TestGraphExpression(t *testing.T) {
+	parser, err := NewParser(`
+        EXPR  <- ATOM (BINOP ATOM)*
+        ATOM  <- < [0-9]+ > / '"' < (!'"' .)* > '"'
+        BINOP <- < [-+] >
+        ---
+        %expr  = EXPR
+        %binop = L + -
+    `)
+	assert(t, err == nil)
+
+	g := parser.Graph()
+	assert(t, len(g.Edges) == 2 && g.Edges[0].To == "ATOM" && g.Edges[1].To == "BINOP")
+	assert(t, len(g.SCCs) == 0)
+
+	assert(t, dotQuote("a\"b\\c\n") == `"a\"b\\c\n"`)
+}
@@ -0,0 +1,183 @@
+package peg
+
+import (
+	"io"
+	"sort"
+	"unicode/utf8"
+)
+
+const readSize = 64 * 1024
+
+// Input
+type input struct {
+	text string // Whole input of a string
+	buf  []byte // Buffered input of a stream starting at base
+	base int
+	r    io.Reader
+	err  error
+	eof  bool
+
+	onDiscard func(base int)
+
+	// Positions that backtrack points or pending tokens may still refer to
+	pins []int
+
+	// Line index of the buffered input
+	lines     int   // Number of newlines before base
+	lineStart int   // Offset of the line containing base
+	newlines  []int // Offsets of newlines in buf
+}
+
+func newStringInput(s string) *input {
+	return &input{text: s, eof: true}
+}
+
+func newReaderInput(r io.Reader) *input {
+	return &input{r: r}
+}
+
+func (in *input) stream() bool {
+	return in.r != nil
+}
+
+func (in *input) end() int {
+	if in.stream() {
+		return in.base + len(in.buf)
+	}
+	return len(in.text)
+}
+
+// Make input in [p, end) available if it exists
+func (in *input) fill(p int, end int) bool {
+	for end > in.end() && !in.eof {
+		in.read(p)
+	}
+	return end <= in.end()
+}
+
+func (in *input) atEnd(p int) bool {
+	return !in.fill(p, p+1)
+}
+
+func (in *input) byteAt(p int) byte {
+	if in.stream() {
+		return in.buf[p-in.base]
+	}
+	return in.text[p]
+}
+
+func (in *input) decodeRune(p int) (rune, int) {
+	if in.stream() {
+		in.fill(p, p+utf8.UTFMax)
+		return utf8.DecodeRune(in.buf[p-in.base:])
+	}
+	return utf8.DecodeRuneInString(in.text[p:])
+}
+
+func (in *input) substr(p int, q int) string {
+	if in.stream() {
+		return string(in.buf[p-in.base : q-in.base])
+	}
+	return in.text[p:q]
+}
+
+// Buffered input from an offset
+func (in *input) window(p int) string {
+	if in.stream() {
+		return string(in.buf[p-in.base:])
+	}
+	return in.text[p:]
+}
+
+// Nothing is discarded from a string, so pins are only kept for streams
+func (in *input) pin(p int) {
+	if in.stream() {
+		in.pins = append(in.pins, p)
+	}
+}
+
+func (in *input) unpin() {
+	if in.stream() {
+		in.pins = in.pins[:len(in.pins)-1]
+	}
+}
+
+func (in *input) setPin(p int) {
+	if in.stream() {
+		in.pins[len(in.pins)-1] = p
+	}
+}
+
+func (in *input) read(p int) {
+	// Pins are pushed in order, so the first one is the lowest
+	keep := p
+	if len(in.pins) > 0 && in.pins[0] < keep {
+		keep = in.pins[0]
+	}
+	if keep > in.end() {
+		keep = in.end()
+	}
+
+	// Discard once it frees at least half of the buffer
+	if n := keep - in.base; n > 0 && n >= len(in.buf)/2 {
+		i := sort.SearchInts(in.newlines, keep)
+		if i > 0 {
+			in.lines += i
+			in.lineStart = in.newlines[i-1] + 1
+			in.newlines = in.newlines[:copy(in.newlines, in.newlines[i:])]
+		}
+		in.buf = in.buf[:copy(in.buf, in.buf[n:])]
+		in.base = keep
+		if in.onDiscard != nil {
+			in.onDiscard(keep)
+		}
+	}
+
+	if cap(in.buf)-len(in.buf) < readSize {
+		buf := make([]byte, len(in.buf), 2*cap(in.buf)+readSize)
+		copy(buf, in.buf)
+		in.buf = buf
+	}
+
+	end := in.end()
+	n, err := in.r.Read(in.buf[len(in.buf):cap(in.buf)])
+	if err != nil {
+		in.eof = true
+		if err != io.EOF {
+			in.err = err
+		}
+	}
+	for i, ch := range in.buf[len(in.buf) : len(in.buf)+n] {
+		if ch == '\n' {
+			in.newlines = append(in.newlines, end+i)
+		}
+	}
+	in.buf = in.buf[:len(in.buf)+n]
+}
+
+// Line and column of a buffered offset
+func (in *input) lineInfo(p int) (ln int, col int) {
+	if !in.stream() {
+		return lineInfo(in.text, p)
+	}
+	i := sort.SearchInts(in.newlines, p)
+	ln = in.lines + i + 1
+	start := in.lineStart
+	if i > 0 {
+		start = in.newlines[i-1] + 1
+	}
+	col = p - start + 1
+	return
+}
+
+// Description of the character at an offset for error messages
+func (in *input) found(p int) string {
+	if p < in.base {
+		return ""
+	}
+	if in.atEnd(p) {
+		return "end of input"
+	}
+	r, _ := in.decodeRune(p)
+	return "'" + escapeString(string(r)) + "'"
+}
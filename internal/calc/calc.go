@@ -0,0 +1,613 @@
+// Code generated by peg.Generate. DO NOT EDIT.
+
+package calc
+
+import "github.com/yhirose/go-peg/pegrt"
+
+var (
+	calcClass0 = pegrt.Class{Desc: "[-+/*]", Ranges: []pegrt.Range{{Lo: '-', Hi: '-'}, {Lo: '+', Hi: '+'}, {Lo: '/', Hi: '/'}, {Lo: '*', Hi: '*'}}}
+	calcClass1 = pegrt.Class{Desc: "[0-9]", Ranges: []pegrt.Range{{Lo: '0', Hi: '9'}}}
+	calcClass2 = pegrt.Class{Desc: "[a-z_]", Ranges: []pegrt.Range{{Lo: 'a', Hi: 'z'}, {Lo: '_', Hi: '_'}}}
+	calcClass3 = pegrt.Class{Desc: "[a-z_0-9]", Ranges: []pegrt.Range{{Lo: 'a', Hi: 'z'}, {Lo: '_', Hi: '_'}, {Lo: '0', Hi: '9'}}}
+	calcClass4 = pegrt.Class{Desc: "[^\\n]", Ranges: []pegrt.Range{{Lo: '\n', Hi: '\n'}}, Negated: true}
+	calcClass5 = pegrt.Class{Desc: "[ \\t\\r\\n]", Ranges: []pegrt.Range{{Lo: ' ', Hi: ' '}, {Lo: '\t', Hi: '\t'}, {Lo: '\r', Hi: '\r'}, {Lo: '\n', Hi: '\n'}}}
+)
+
+// CalcParser
+type CalcParser struct {
+	Grammar map[string]*pegrt.Rule
+	rules   [12]pegrt.Rule
+}
+
+func NewCalcParser() *CalcParser {
+	g := &CalcParser{}
+	g.rules[0] = pegrt.Rule{Name: "PROGRAM"}
+	g.rules[1] = pegrt.Rule{Name: "STATEMENT"}
+	g.rules[2] = pegrt.Rule{Name: "EXPRESSION", BinOps: map[string]pegrt.BinOp{"*": {Level: 2, Assoc: pegrt.AssocLeft}, "+": {Level: 1, Assoc: pegrt.AssocLeft}, "-": {Level: 1, Assoc: pegrt.AssocLeft}, "/": {Level: 2, Assoc: pegrt.AssocLeft}}, Labels: [3]string{"lhs", "op", "rhs"}}
+	g.rules[3] = pegrt.Rule{Name: "ATOM"}
+	g.rules[4] = pegrt.Rule{Name: "BINOP", TokenRule: true}
+	g.rules[5] = pegrt.Rule{Name: "NUMBER", TokenRule: true}
+	g.rules[6] = pegrt.Rule{Name: "IDENT", TokenRule: true}
+	g.rules[7] = pegrt.Rule{Name: "KEYWORD"}
+	g.rules[8] = pegrt.Rule{Name: "COMMENT", Ignore: true}
+	g.rules[9] = pegrt.Rule{Name: "%whitespace"}
+	g.rules[10] = pegrt.Rule{Name: "%word"}
+	g.rules[11] = pegrt.Rule{Name: "semicolon"}
+	g.Grammar = map[string]*pegrt.Rule{
+		"PROGRAM":     &g.rules[0],
+		"STATEMENT":   &g.rules[1],
+		"EXPRESSION":  &g.rules[2],
+		"ATOM":        &g.rules[3],
+		"BINOP":       &g.rules[4],
+		"NUMBER":      &g.rules[5],
+		"IDENT":       &g.rules[6],
+		"KEYWORD":     &g.rules[7],
+		"COMMENT":     &g.rules[8],
+		"%whitespace": &g.rules[9],
+		"%word":       &g.rules[10],
+		"semicolon":   &g.rules[11],
+	}
+	return g
+}
+
+func (g *CalcParser) Parse(s string, d pegrt.Any) (err *pegrt.Error) {
+	_, err = g.ParseAndGetValue(s, d)
+	return
+}
+
+func (g *CalcParser) ParseAndGetValue(s string, d pegrt.Any) (val pegrt.Any, err *pegrt.Error) {
+	return pegrt.Parse(s, d, &g.rules[0], g.rulePROGRAM, g.rule_whitespace, g.rule_word)
+}
+
+func (g *CalcParser) ParseErr(s string, d pegrt.Any) error {
+	return g.Parse(s, d).Err()
+}
+
+func (g *CalcParser) ParseAndGetValueErr(s string, d pegrt.Any) (pegrt.Any, error) {
+	val, err := g.ParseAndGetValue(s, d)
+	return val, err.Err()
+}
+
+// PROGRAM
+func (g *CalcParser) rulePROGRAM(c *pegrt.Context, p int, v *pegrt.Values) int {
+	f := c.Enter(&g.rules[0], p)
+	return c.Leave(&f, p, v, g.expr0(c, p, f.Values))
+}
+
+// STATEMENT*
+func (g *CalcParser) expr0(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := 0
+	m := c.BeginRepeat()
+	for c.Iterate(&m, v, p+l) {
+		n := c.Iterated(&m, v, g.ruleSTATEMENT(c, p+l, v))
+		if n <= 0 {
+			break
+		}
+		l += n
+	}
+	return c.EndRepeat(&m, l)
+}
+
+// STATEMENT
+func (g *CalcParser) ruleSTATEMENT(c *pegrt.Context, p int, v *pegrt.Values) int {
+	f := c.Enter(&g.rules[1], p)
+	return c.Leave(&f, p, v, g.expr1(c, p, f.Values))
+}
+
+// 'let'i ↑ name:IDENT '=' value:EXPRESSION ';'^semicolon / 'print' value:EXPRESSION ';'^semicolon
+func (g *CalcParser) expr1(c *pegrt.Context, p int, v *pegrt.Values) int {
+	m := c.BeginChoice(v)
+	if n := g.expr2(c, p, v); c.Alternative(&m, v, 0, n) {
+		return n
+	}
+	if n := g.expr6(c, p, v); c.Alternative(&m, v, 1, n) {
+		return n
+	}
+	return c.EndChoice(&m, v)
+}
+
+// 'let'i ↑ name:IDENT '=' value:EXPRESSION ';'^semicolon
+func (g *CalcParser) expr2(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := c.LitI(p, "let")
+	if l < 0 {
+		return -1
+	}
+	n := c.Cut()
+	if n < 0 {
+		return -1
+	}
+	l += n
+	n = g.expr3(c, p+l, v)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	n = c.Lit(p+l, "=")
+	if n < 0 {
+		return -1
+	}
+	l += n
+	n = g.expr4(c, p+l, v)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	n = g.expr5(c, p+l, v)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	return l
+}
+
+// name:IDENT
+func (g *CalcParser) expr3(c *pegrt.Context, p int, v *pegrt.Values) int {
+	begin := len(v.Vs)
+	return c.Capture(v, "name", false, begin, p, g.ruleIDENT(c, p, v))
+}
+
+// value:EXPRESSION
+func (g *CalcParser) expr4(c *pegrt.Context, p int, v *pegrt.Values) int {
+	begin := len(v.Vs)
+	return c.Capture(v, "value", false, begin, p, g.ruleEXPRESSION(c, p, v))
+}
+
+// ';'^semicolon
+func (g *CalcParser) expr5(c *pegrt.Context, p int, v *pegrt.Values) int {
+	m := c.BeginThrow(v)
+	n, recovered := c.Throw(&m, v, p, "semicolon", &g.rules[11], c.Lit(p, ";"))
+	if recovered {
+		return g.rulesemicolon(c, p, v)
+	}
+	return n
+}
+
+// 'print' value:EXPRESSION ';'^semicolon
+func (g *CalcParser) expr6(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := c.Lit(p, "print")
+	if l < 0 {
+		return -1
+	}
+	n := g.expr7(c, p+l, v)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	n = g.expr8(c, p+l, v)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	return l
+}
+
+// value:EXPRESSION
+func (g *CalcParser) expr7(c *pegrt.Context, p int, v *pegrt.Values) int {
+	begin := len(v.Vs)
+	return c.Capture(v, "value", false, begin, p, g.ruleEXPRESSION(c, p, v))
+}
+
+// ';'^semicolon
+func (g *CalcParser) expr8(c *pegrt.Context, p int, v *pegrt.Values) int {
+	m := c.BeginThrow(v)
+	n, recovered := c.Throw(&m, v, p, "semicolon", &g.rules[11], c.Lit(p, ";"))
+	if recovered {
+		return g.rulesemicolon(c, p, v)
+	}
+	return n
+}
+
+// EXPRESSION
+func (g *CalcParser) ruleEXPRESSION(c *pegrt.Context, p int, v *pegrt.Values) int {
+	f := c.Enter(&g.rules[2], p)
+	return c.Leave(&f, p, v, c.Expression(p, f.Values, &g.rules[2], g.ruleATOM, g.ruleBINOP))
+}
+
+// ATOM
+func (g *CalcParser) ruleATOM(c *pegrt.Context, p int, v *pegrt.Values) int {
+	f := c.Enter(&g.rules[3], p)
+	return c.Leave(&f, p, v, g.expr9(c, p, f.Values))
+}
+
+// NUMBER / 'neg' ATOM / 'sum' LIST(EXPRESSION, ',') / '(' EXPRESSION ')' / IDENT
+func (g *CalcParser) expr9(c *pegrt.Context, p int, v *pegrt.Values) int {
+	m := c.BeginChoice(v)
+	if n := g.ruleNUMBER(c, p, v); c.Alternative(&m, v, 0, n) {
+		return n
+	}
+	if n := g.expr10(c, p, v); c.Alternative(&m, v, 1, n) {
+		return n
+	}
+	if n := g.expr11(c, p, v); c.Alternative(&m, v, 2, n) {
+		return n
+	}
+	if n := g.expr12(c, p, v); c.Alternative(&m, v, 3, n) {
+		return n
+	}
+	if n := g.ruleIDENT(c, p, v); c.Alternative(&m, v, 4, n) {
+		return n
+	}
+	return c.EndChoice(&m, v)
+}
+
+// 'neg' ATOM
+func (g *CalcParser) expr10(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := c.Lit(p, "neg")
+	if l < 0 {
+		return -1
+	}
+	n := g.ruleATOM(c, p+l, v)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	return l
+}
+
+// 'sum' LIST(EXPRESSION, ',')
+func (g *CalcParser) expr11(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := c.Lit(p, "sum")
+	if l < 0 {
+		return -1
+	}
+	n := g.ruleLIST(c, p+l, v)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	return l
+}
+
+// '(' EXPRESSION ')'
+func (g *CalcParser) expr12(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := c.Lit(p, "(")
+	if l < 0 {
+		return -1
+	}
+	n := g.ruleEXPRESSION(c, p+l, v)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	n = c.Lit(p+l, ")")
+	if n < 0 {
+		return -1
+	}
+	l += n
+	return l
+}
+
+// BINOP
+func (g *CalcParser) ruleBINOP(c *pegrt.Context, p int, v *pegrt.Values) int {
+	f := c.Enter(&g.rules[4], p)
+	return c.Leave(&f, p, v, g.expr13(c, p, f.Values))
+}
+
+// < [-+/*] >
+func (g *CalcParser) expr13(c *pegrt.Context, p int, v *pegrt.Values) int {
+	c.BeginToken()
+	return c.EndToken(p, v, c.Class(p, &calcClass0))
+}
+
+// NUMBER
+func (g *CalcParser) ruleNUMBER(c *pegrt.Context, p int, v *pegrt.Values) int {
+	f := c.Enter(&g.rules[5], p)
+	return c.Leave(&f, p, v, g.expr14(c, p, f.Values))
+}
+
+// < [0-9]+ >
+func (g *CalcParser) expr14(c *pegrt.Context, p int, v *pegrt.Values) int {
+	c.BeginToken()
+	return c.EndToken(p, v, g.expr15(c, p, v))
+}
+
+// [0-9]+
+func (g *CalcParser) expr15(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := c.Class(p, &calcClass1)
+	if l < 0 {
+		return -1
+	}
+	m := c.BeginRepeat()
+	for c.Iterate(&m, v, p+l) {
+		n := c.Iterated(&m, v, c.Class(p+l, &calcClass1))
+		if n <= 0 {
+			break
+		}
+		l += n
+	}
+	return c.EndRepeat(&m, l)
+}
+
+// IDENT
+func (g *CalcParser) ruleIDENT(c *pegrt.Context, p int, v *pegrt.Values) int {
+	f := c.Enter(&g.rules[6], p)
+	return c.Leave(&f, p, v, g.expr16(c, p, f.Values))
+}
+
+// < !KEYWORD [a-z_] [a-z_0-9]* >
+func (g *CalcParser) expr16(c *pegrt.Context, p int, v *pegrt.Values) int {
+	c.BeginToken()
+	return c.EndToken(p, v, g.expr17(c, p, v))
+}
+
+// !KEYWORD [a-z_] [a-z_0-9]*
+func (g *CalcParser) expr17(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := g.expr18(c, p, v)
+	if l < 0 {
+		return -1
+	}
+	n := c.Class(p+l, &calcClass2)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	n = g.expr19(c, p+l, v)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	return l
+}
+
+// !KEYWORD
+func (g *CalcParser) expr18(c *pegrt.Context, p int, v *pegrt.Values) int {
+	m := c.BeginPredicate()
+	return c.Not(&m, p, g.ruleKEYWORD(c, p, m.Values))
+}
+
+// [a-z_0-9]*
+func (g *CalcParser) expr19(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := 0
+	m := c.BeginRepeat()
+	for c.Iterate(&m, v, p+l) {
+		n := c.Iterated(&m, v, c.Class(p+l, &calcClass3))
+		if n <= 0 {
+			break
+		}
+		l += n
+	}
+	return c.EndRepeat(&m, l)
+}
+
+// KEYWORD
+func (g *CalcParser) ruleKEYWORD(c *pegrt.Context, p int, v *pegrt.Values) int {
+	f := c.Enter(&g.rules[7], p)
+	return c.Leave(&f, p, v, g.expr20(c, p, f.Values))
+}
+
+// ('let'i / 'print' / 'neg' / 'sum') ![a-z_0-9]
+func (g *CalcParser) expr20(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := g.expr21(c, p, v)
+	if l < 0 {
+		return -1
+	}
+	n := g.expr22(c, p+l, v)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	return l
+}
+
+// 'let'i / 'print' / 'neg' / 'sum'
+func (g *CalcParser) expr21(c *pegrt.Context, p int, v *pegrt.Values) int {
+	m := c.BeginChoice(v)
+	if n := c.LitI(p, "let"); c.Alternative(&m, v, 0, n) {
+		return n
+	}
+	if n := c.Lit(p, "print"); c.Alternative(&m, v, 1, n) {
+		return n
+	}
+	if n := c.Lit(p, "neg"); c.Alternative(&m, v, 2, n) {
+		return n
+	}
+	if n := c.Lit(p, "sum"); c.Alternative(&m, v, 3, n) {
+		return n
+	}
+	return c.EndChoice(&m, v)
+}
+
+// ![a-z_0-9]
+func (g *CalcParser) expr22(c *pegrt.Context, p int, v *pegrt.Values) int {
+	m := c.BeginPredicate()
+	return c.Not(&m, p, c.Class(p, &calcClass3))
+}
+
+// COMMENT
+func (g *CalcParser) ruleCOMMENT(c *pegrt.Context, p int, v *pegrt.Values) int {
+	f := c.Enter(&g.rules[8], p)
+	return c.Leave(&f, p, v, g.expr23(c, p, f.Values))
+}
+
+// '#' [^\n]*
+func (g *CalcParser) expr23(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := c.Lit(p, "#")
+	if l < 0 {
+		return -1
+	}
+	n := g.expr24(c, p+l, v)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	return l
+}
+
+// [^\n]*
+func (g *CalcParser) expr24(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := 0
+	m := c.BeginRepeat()
+	for c.Iterate(&m, v, p+l) {
+		n := c.Iterated(&m, v, c.Class(p+l, &calcClass4))
+		if n <= 0 {
+			break
+		}
+		l += n
+	}
+	return c.EndRepeat(&m, l)
+}
+
+// %whitespace
+func (g *CalcParser) rule_whitespace(c *pegrt.Context, p int, v *pegrt.Values) int {
+	f := c.Enter(&g.rules[9], p)
+	return c.Leave(&f, p, v, g.expr25(c, p, f.Values))
+}
+
+// ([ \t\r\n] / COMMENT)*
+func (g *CalcParser) expr25(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := 0
+	m := c.BeginRepeat()
+	for c.Iterate(&m, v, p+l) {
+		n := c.Iterated(&m, v, g.expr26(c, p+l, v))
+		if n <= 0 {
+			break
+		}
+		l += n
+	}
+	return c.EndRepeat(&m, l)
+}
+
+// [ \t\r\n] / COMMENT
+func (g *CalcParser) expr26(c *pegrt.Context, p int, v *pegrt.Values) int {
+	m := c.BeginChoice(v)
+	if n := c.Class(p, &calcClass5); c.Alternative(&m, v, 0, n) {
+		return n
+	}
+	if n := g.ruleCOMMENT(c, p, v); c.Alternative(&m, v, 1, n) {
+		return n
+	}
+	return c.EndChoice(&m, v)
+}
+
+// %word
+func (g *CalcParser) rule_word(c *pegrt.Context, p int, v *pegrt.Values) int {
+	f := c.Enter(&g.rules[10], p)
+	return c.Leave(&f, p, v, g.expr27(c, p, f.Values))
+}
+
+// [a-z_0-9]+
+func (g *CalcParser) expr27(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := c.Class(p, &calcClass3)
+	if l < 0 {
+		return -1
+	}
+	m := c.BeginRepeat()
+	for c.Iterate(&m, v, p+l) {
+		n := c.Iterated(&m, v, c.Class(p+l, &calcClass3))
+		if n <= 0 {
+			break
+		}
+		l += n
+	}
+	return c.EndRepeat(&m, l)
+}
+
+// semicolon
+func (g *CalcParser) rulesemicolon(c *pegrt.Context, p int, v *pegrt.Values) int {
+	f := c.Enter(&g.rules[11], p)
+	return c.Leave(&f, p, v, g.expr28(c, p, f.Values))
+}
+
+// (!('let'i / 'print') .)*
+func (g *CalcParser) expr28(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := 0
+	m := c.BeginRepeat()
+	for c.Iterate(&m, v, p+l) {
+		n := c.Iterated(&m, v, g.expr29(c, p+l, v))
+		if n <= 0 {
+			break
+		}
+		l += n
+	}
+	return c.EndRepeat(&m, l)
+}
+
+// !('let'i / 'print') .
+func (g *CalcParser) expr29(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := g.expr30(c, p, v)
+	if l < 0 {
+		return -1
+	}
+	n := c.Dot(p + l)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	return l
+}
+
+// !('let'i / 'print')
+func (g *CalcParser) expr30(c *pegrt.Context, p int, v *pegrt.Values) int {
+	m := c.BeginPredicate()
+	return c.Not(&m, p, g.expr31(c, p, m.Values))
+}
+
+// 'let'i / 'print'
+func (g *CalcParser) expr31(c *pegrt.Context, p int, v *pegrt.Values) int {
+	m := c.BeginChoice(v)
+	if n := c.LitI(p, "let"); c.Alternative(&m, v, 0, n) {
+		return n
+	}
+	if n := c.Lit(p, "print"); c.Alternative(&m, v, 1, n) {
+		return n
+	}
+	return c.EndChoice(&m, v)
+}
+
+// LIST(EXPRESSION, ',')
+func (g *CalcParser) ruleLIST(c *pegrt.Context, p int, v *pegrt.Values) int {
+	cut := c.BeginMacro()
+	return c.EndMacro(cut, g.expr32(c, p, v))
+}
+
+// '[' I (D I)* ']'
+func (g *CalcParser) expr32(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := c.Lit(p, "[")
+	if l < 0 {
+		return -1
+	}
+	n := g.ruleEXPRESSION(c, p+l, v)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	n = g.expr33(c, p+l, v)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	n = c.Lit(p+l, "]")
+	if n < 0 {
+		return -1
+	}
+	l += n
+	return l
+}
+
+// (D I)*
+func (g *CalcParser) expr33(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := 0
+	m := c.BeginRepeat()
+	for c.Iterate(&m, v, p+l) {
+		n := c.Iterated(&m, v, g.expr34(c, p+l, v))
+		if n <= 0 {
+			break
+		}
+		l += n
+	}
+	return c.EndRepeat(&m, l)
+}
+
+// D I
+func (g *CalcParser) expr34(c *pegrt.Context, p int, v *pegrt.Values) int {
+	l := c.Lit(p, ",")
+	if l < 0 {
+		return -1
+	}
+	n := g.ruleEXPRESSION(c, p+l, v)
+	if n < 0 {
+		return -1
+	}
+	l += n
+	return l
+}
@@ -0,0 +1,261 @@
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/yhirose/go-peg"
+	"github.com/yhirose/go-peg/pegrt"
+)
+
+// Semantic values of the interpreter and of the generated parser, which the
+// actions are written against
+type values struct {
+	vs     []interface{}
+	choice int
+	token  string
+	get    func(name string) interface{}
+}
+
+type action func(v values, env map[string]int) (interface{}, error)
+
+var actions = map[string]action{
+	"PROGRAM": func(v values, env map[string]int) (interface{}, error) {
+		return len(v.vs), nil
+	},
+	"STATEMENT": func(v values, env map[string]int) (interface{}, error) {
+		if v.choice == 0 {
+			env[v.get("name").(string)] = v.get("value").(int)
+		} else {
+			env["_"] = v.get("value").(int)
+		}
+		return nil, nil
+	},
+	"EXPRESSION": func(v values, env map[string]int) (interface{}, error) {
+		val := v.get("lhs").(int)
+		if len(v.vs) > 1 {
+			rhs := v.get("rhs").(int)
+			switch v.get("op").(string) {
+			case "+":
+				val += rhs
+			case "-":
+				val -= rhs
+			case "*":
+				val *= rhs
+			case "/":
+				if rhs == 0 {
+					return nil, fmt.Errorf("division by zero")
+				}
+				val /= rhs
+			}
+		}
+		return val, nil
+	},
+	"ATOM": func(v values, env map[string]int) (interface{}, error) {
+		switch v.choice {
+		case 1:
+			return -v.vs[0].(int), nil
+		case 2:
+			sum := 0
+			for _, x := range v.vs {
+				sum += x.(int)
+			}
+			return sum, nil
+		case 4:
+			val, ok := env[v.vs[0].(string)]
+			if !ok {
+				return nil, fmt.Errorf("undefined variable")
+			}
+			return val, nil
+		}
+		return v.vs[0], nil
+	},
+	"BINOP": func(v values, env map[string]int) (interface{}, error) {
+		return v.token, nil
+	},
+	"NUMBER": func(v values, env map[string]int) (interface{}, error) {
+		return strconv.Atoi(v.token)
+	},
+	"IDENT": func(v values, env map[string]int) (interface{}, error) {
+		return v.token, nil
+	},
+}
+
+func newInterpreter(t *testing.T) *peg.Parser {
+	dat, err := ioutil.ReadFile("calc.peg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser, perr := peg.NewParser(string(dat))
+	if perr != nil {
+		t.Fatal(perr)
+	}
+	for name, fn := range actions {
+		fn := fn
+		parser.Grammar[name].Action = func(v *peg.Values, d peg.Any) (peg.Any, error) {
+			vs := make([]interface{}, len(v.Vs))
+			for i, x := range v.Vs {
+				vs[i] = x
+			}
+			get := func(name string) interface{} { return v.Get(name) }
+			return fn(values{vs, v.Choice, v.Token(), get}, d.(map[string]int))
+		}
+	}
+	parser.Grammar["semicolon"].Message = func() string { return "missing ';'" }
+	return parser
+}
+
+func newGenerated() *CalcParser {
+	parser := NewCalcParser()
+	for name, fn := range actions {
+		fn := fn
+		parser.Grammar[name].Action = func(v *pegrt.Values, d pegrt.Any) (pegrt.Any, error) {
+			vs := make([]interface{}, len(v.Vs))
+			for i, x := range v.Vs {
+				vs[i] = x
+			}
+			get := func(name string) interface{} { return v.Get(name) }
+			return fn(values{vs, v.Choice, v.Token(), get}, d.(map[string]int))
+		}
+	}
+	parser.Grammar["semicolon"].Message = func() string { return "missing ';'" }
+	return parser
+}
+
+var inputs = []string{
+	"",
+	"print 1;",
+	"print 1+2*3*(4-5+6)/7-8;",
+	"let x = 3; print x * x;",
+	"LET x = 3; Let y = neg x; print sum [x, y, 10];",
+	"# comment\nlet a = 1;\n# another\nprint a + 1;\n",
+	"print letter;",
+	"let letter = 2; print letter;",
+	"print neg neg 5;",
+	"print 1 / 0;",
+	"print undefined;",
+	"print 1 +;",
+	"print (1 + 2;",
+	"let = 1;",
+	"let x = 1 print x;",
+	"let x = 1 let y = 2 print x + y;",
+	"print sum [1, 2,];",
+	"print 1; ?",
+	"printx 1;",
+	"let 1x = 2;",
+	"print 10 - 2 - 3 * 4 / 2;",
+}
+
+type result struct {
+	Val     interface{}
+	Env     map[string]int
+	Details []detail
+}
+
+// Error detail of both parsers
+type detail struct {
+	Ln, Col, Pos    int
+	Msg, Label      string
+	Expected        []string
+	Rule, Kind, Err string
+}
+
+func newDetail(d pegrt.ErrorDetail, kind fmt.Stringer) detail {
+	var err string
+	if d.Err != nil {
+		err = d.Err.Error()
+	}
+	return detail{d.Ln, d.Col, d.Pos, d.Msg, d.Label, d.Expected, d.Rule, kind.String(), err}
+}
+
+func TestGeneratedParserMatchesInterpreter(t *testing.T) {
+	interpreter := newInterpreter(t)
+	generated := newGenerated()
+
+	for _, input := range inputs {
+		var want, got result
+
+		want.Env = make(map[string]int)
+		val, err := interpreter.ParseAndGetValue(input, want.Env)
+		want.Val = val
+		if err != nil {
+			for _, d := range err.Details {
+				rd := pegrt.ErrorDetail{Ln: d.Ln, Col: d.Col, Msg: d.Msg, Label: d.Label, Expected: d.Expected, Pos: d.Pos, Rule: d.Rule, Err: d.Err}
+				want.Details = append(want.Details, newDetail(rd, d.Kind))
+			}
+		}
+
+		got.Env = make(map[string]int)
+		val, gerr := generated.ParseAndGetValue(input, got.Env)
+		got.Val = val
+		if gerr != nil {
+			for _, d := range gerr.Details {
+				got.Details = append(got.Details, newDetail(d, d.Kind))
+			}
+		}
+
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("%q:\nwant %+v\n got %+v", input, want, got)
+		}
+	}
+}
+
+func TestGeneratedParser(t *testing.T) {
+	parser := newGenerated()
+
+	env := make(map[string]int)
+	val, err := parser.ParseAndGetValue("let x = 6; print x * 7;", env)
+	if err != nil || val != 2 || env["_"] != 42 {
+		t.Errorf("got %v, %v, %v", val, err, env)
+	}
+
+	err = parser.Parse("let x = 1 print x;", make(map[string]int))
+	if err == nil || len(err.Details) != 1 {
+		t.Fatalf("got %v", err)
+	}
+	d := err.Details[0]
+	if d.Ln != 1 || d.Col != 11 || d.Msg != "missing ';'" || d.Label != "semicolon" {
+		t.Errorf("got %+v", d)
+	}
+	if len(d.Expected) != 1 || d.Expected[0] != "';'" {
+		t.Errorf("got %v", d.Expected)
+	}
+}
+
+func TestGeneratedValueAccessors(t *testing.T) {
+	parser := newGenerated()
+	parser.Grammar["NUMBER"].Action = func(v *pegrt.Values, d pegrt.Any) (pegrt.Any, error) {
+		tok := v.ToToken(0)
+		if tok.Pos != 6 {
+			t.Errorf("got %+v", tok)
+		}
+		return strconv.Atoi(tok.S)
+	}
+	parser.Grammar["PROGRAM"].Action = func(v *pegrt.Values, d pegrt.Any) (pegrt.Any, error) {
+		return v.ToStr(0), nil
+	}
+
+	err := parser.Parse("print 1;", make(map[string]int))
+	if err == nil || err.Error() != "1:1 value 0 is <nil>, not string" {
+		t.Errorf("got %v", err)
+	}
+
+	// The error of the accessor is the original error of the action
+	var verr *pegrt.ValueError
+	if err := parser.ParseErr("print 1;", make(map[string]int)); !errors.As(err, &verr) {
+		t.Errorf("got %v", err)
+	}
+	d := err.Details[0]
+	if d.Pos != 0 || d.Rule != "PROGRAM" || d.Kind != pegrt.ActionError {
+		t.Errorf("got %+v", d)
+	}
+
+	parser.Grammar["PROGRAM"].Action = nil
+	if err := parser.ParseErr("print 1;", make(map[string]int)); err != nil {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,4 @@
+// Package calc is a parser generated from calc.peg to test the generator.
+package calc
+
+//go:generate peglint gen -package calc -prefix Calc -o calc.go calc.peg
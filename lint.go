@@ -0,0 +1,211 @@
+package peg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Lint warning
+type Warning struct {
+	Ln  int
+	Col int
+	Msg string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%d:%d %s", w.Ln, w.Col, w.Msg)
+}
+
+// Check a grammar for rules that can't be reached from the start rule,
+// alternatives shadowed by an earlier literal, repetitions of expressions that
+// can match empty input, which NewParser rejects, and %binop operators that
+// the binary operator rule never produces. Warnings are in the order of the
+// grammar text.
+func Lint(s string) ([]Warning, *Error) {
+	return LintWithUserRules(s, nil)
+}
+
+func LintWithUserRules(s string, rules map[string]operator) ([]Warning, *Error) {
+	data := newData()
+	data.lint = true
+	p, err := parseGrammar(s, data, rules, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &linter{data: data}
+	l.unreachable(p)
+	for _, r := range p.sortedRules() {
+		if len(r.SS) == 0 {
+			continue
+		}
+		v := &shadowChecker{linter: l, word: data.grammar[WordRuleName]}
+		r.Ope.accept(v)
+	}
+	l.emptyLoops(p)
+	l.binops(p)
+
+	sort.SliceStable(l.warnings, func(i, j int) bool { return l.warnings[i].pos < l.warnings[j].pos })
+	var warnings []Warning
+	for _, w := range l.warnings {
+		ln, col := lineInfo(s, w.pos)
+		warnings = append(warnings, Warning{Ln: ln, Col: col, Msg: w.msg})
+	}
+	return warnings, nil
+}
+
+// linter
+type linter struct {
+	data     *data
+	warnings []lintWarning
+}
+
+type lintWarning struct {
+	pos int
+	msg string
+}
+
+func (l *linter) warn(pos int, msg string) {
+	l.warnings = append(l.warnings, lintWarning{pos, msg})
+}
+
+func (l *linter) unreachable(p *Parser) {
+	for _, n := range p.Graph().Nodes {
+		r := p.Grammar[n.Name]
+		if n.Unreachable && len(r.SS) > 0 {
+			l.warn(r.Pos, "'"+n.Name+"' is not reachable from the start rule.")
+		}
+	}
+}
+
+func (l *linter) emptyLoops(p *Parser) {
+	v := newDetectEmptyLoop()
+	for _, r := range p.sortedRules() {
+		if len(r.SS) == 0 {
+			continue
+		}
+		for _, ope := range v.find(r.Ope) {
+			l.warn(l.data.loopPos(ope), emptyLoopMessage(ope))
+		}
+	}
+}
+
+// Operators of %binop that the binary operator rule of %expr doesn't match as
+// a whole token
+func (l *linter) binops(p *Parser) {
+	name, _ := getExpressionParsingOptions(l.data.options)
+	r, ok := p.Grammar[name]
+	if !ok {
+		return
+	}
+	exp, ok := r.Ope.(*expression)
+	if !ok {
+		return
+	}
+
+	for _, def := range l.data.optionDefs {
+		if def.name != OptBinaryOperator {
+			continue
+		}
+		flds := strings.Split(def.value, " ")
+		for _, op := range flds[1:] {
+			c := newStringContext(op)
+			n := exp.binop.parse(0, &Values{}, c, nil)
+			if n != len(op) || c.lastToken != op {
+				l.warn(def.pos, "'"+op+"' in "+OptBinaryOperator+" is never produced by "+formatOperator(exp.binop)+".")
+			}
+		}
+	}
+}
+
+// shadowChecker
+type shadowChecker struct {
+	*visitorBase
+	*linter
+	word *Rule
+}
+
+func (v *shadowChecker) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *shadowChecker) visitPrioritizedChoice(ope *prioritizedChoice) {
+	for j, o := range ope.opes {
+		o.accept(v)
+		lit := leadingLiteral(o)
+		if lit == nil {
+			continue
+		}
+		for _, prev := range ope.opes[:j] {
+			if v.shadows(prev, lit) {
+				v.warn(v.data.positions[o], "alternative "+formatOperator(o)+" is shadowed by "+formatOperator(prev)+".")
+				break
+			}
+		}
+	}
+}
+func (v *shadowChecker) visitZeroOrMore(ope *zeroOrMore)       { ope.ope.accept(v) }
+func (v *shadowChecker) visitOneOrMore(ope *oneOrMore)         { ope.ope.accept(v) }
+func (v *shadowChecker) visitOption(ope *option)               { ope.ope.accept(v) }
+func (v *shadowChecker) visitAndPredicate(ope *andPredicate)   { ope.ope.accept(v) }
+func (v *shadowChecker) visitNotPredicate(ope *notPredicate)   { ope.ope.accept(v) }
+func (v *shadowChecker) visitTokenBoundary(ope *tokenBoundary) { ope.ope.accept(v) }
+func (v *shadowChecker) visitIgnore(ope *ignore)               { ope.ope.accept(v) }
+func (v *shadowChecker) visitReference(ope *reference) {
+	for _, arg := range ope.args {
+		arg.accept(v)
+	}
+}
+func (v *shadowChecker) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
+func (v *shadowChecker) visitThrow(ope *throw)           { ope.ope.accept(v) }
+func (v *shadowChecker) visitCapture(ope *capture)       { ope.ope.accept(v) }
+
+// Whether an alternative always matches input that starts with lit
+func (v *shadowChecker) shadows(prev operator, lit *literalString) bool {
+	p, ok := unwrapLiteral(prev).(*literalString)
+	if !ok || len(p.lit) > len(lit.lit) {
+		return false
+	}
+
+	// A literal that is a word must not be followed by a word character
+	if v.word != nil && len(p.lit) > 0 {
+		c := newStringContext(p.lit)
+		if success(v.word.parse(0, &Values{}, c, nil)) {
+			return false
+		}
+	}
+
+	prefix := lit.lit[:len(p.lit)]
+	if p.ignoreCase {
+		return strings.EqualFold(prefix, p.lit)
+	}
+	return !lit.ignoreCase && prefix == p.lit
+}
+
+// Literal that input must start with to match an alternative
+func leadingLiteral(ope operator) *literalString {
+	ope = unwrapLiteral(ope)
+	if seq, ok := ope.(*sequence); ok && len(seq.opes) > 0 {
+		ope = unwrapLiteral(seq.opes[0])
+	}
+	lit, _ := ope.(*literalString)
+	return lit
+}
+
+// Operators that match what their operand matches
+func unwrapLiteral(ope operator) operator {
+	for {
+		switch o := ope.(type) {
+		case *tokenBoundary:
+			ope = o.ope
+		case *ignore:
+			ope = o.ope
+		case *capture:
+			ope = o.ope
+		default:
+			return ope
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package peg
+
+import (
+	"testing"
+)
+
+func checkLint(t *testing.T, grammar string, want []string) {
+	warnings, err := Lint(grammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != len(want) {
+		t.Fatalf("got %v, want %v", warnings, want)
+	}
+	for i, w := range warnings {
+		if w.String() != want[i] {
+			t.Errorf("got %s, want %s", w, want[i])
+		}
+	}
+}
+
+func TestLintUnreachable(t *testing.T) {
+	checkLint(t, `START <- A
+A <- 'a' ';'^semi
+B <- C
+C <- 'c' B?
+%recover(semi) <- (!';' .)*
+%recover(other) <- .
+%whitespace <- SP*
+SP <- ' '
+`, []string{
+		"3:1 'B' is not reachable from the start rule.",
+		"4:1 'C' is not reachable from the start rule.",
+		"6:1 'other' is not reachable from the start rule.",
+	})
+}
+
+func TestLintShadowedAlternatives(t *testing.T) {
+	checkLint(t, `START <- 'a' / 'ab' / 'b' / ('c' / 'cd') / < 'e' > / 'ef' 'g' / 'x'i / 'XY' / A
+A <- 'a' / 'A'i / 'a' / 'ab'i / 'b' / 'B'i
+`, []string{
+		"1:16 alternative 'ab' is shadowed by 'a'.",
+		"1:36 alternative 'cd' is shadowed by 'c'.",
+		"1:54 alternative 'ef' 'g' is shadowed by < 'e' >.",
+		"1:72 alternative 'XY' is shadowed by 'x'i.",
+		"2:19 alternative 'a' is shadowed by 'a'.",
+		"2:25 alternative 'ab'i is shadowed by 'A'i.",
+	})
+
+	// A literal that is a word doesn't match the start of a longer word
+	checkLint(t, `START <- 'if' / 'ifx' / '+' / '+='
+%word <- [a-z]+
+`, []string{
+		"1:31 alternative '+=' is shadowed by '+'.",
+	})
+}
+
+func TestLintEmptyLoops(t *testing.T) {
+	checkLint(t, `S <- ('a'?)* (B / C)+ LIST('x', '') LIST('', 'y')* LIST(C, 'x') PAIR('', '')
+B <- 'b'*
+C <- 'c' (&'d')*
+LIST(I, D) <- I (D I)* ('' '')+
+PAIR(X, Y) <- (X Y)*
+`, []string{
+		"1:6 the repeated expression in ('a'?)* can match empty input.",
+		"1:14 the repeated expression in (B / C)+ can match empty input.",
+		"1:37 the repeated expression in LIST('', 'y')* can match empty input.",
+		"1:65 the repeated expression in PAIR('', '') can match empty input.",
+		"3:10 the repeated expression in (&'d')* can match empty input.",
+		"4:24 the repeated expression in ('' '')+ can match empty input.",
+	})
+}
+
+func TestLintBinops(t *testing.T) {
+	checkLint(t, `EXPR <- ATOM (BINOP ATOM)*
+ATOM <- [0-9]+
+BINOP <- < [-+*/] > / < '*' '*' >
+---
+%expr = EXPR
+%binop = L + - %
+%binop = R ** /
+`, []string{
+		"6:1 '%' in %binop is never produced by BINOP.",
+		"7:1 '**' in %binop is never produced by BINOP.",
+	})
+
+	// Operators and literals are checked with left recursive rules too
+	checkLint(t, `EXPR <- ATOM (BINOP ATOM)*
+ATOM <- [0-9]+ / '#' / '#!'
+BINOP <- < OP >
+OP <- OP '=' / [-+]
+%word <- W
+W <- W [a-z] / [a-z]
+---
+%expr = EXPR
+%binop = L + -= *
+%left_recursion = true
+`, []string{
+		"2:24 alternative '#!' is shadowed by '#'.",
+		"9:1 '*' in %binop is never produced by BINOP.",
+	})
+}
+
+func TestLintErrors(t *testing.T) {
+	_, err := Lint(`A <- B`)
+	assert(t, err != nil && err.Details[0].Msg == "'B' is not defined.")
+
+	warnings, err := LintWithUserRules(`A <- B`, map[string]operator{"B": Lit("b"), "C": Lit("c")})
+	assert(t, err == nil && len(warnings) == 0)
+}
@@ -1,8 +1,12 @@
 package peg
 
 import (
+	gocontext "context"
+	"fmt"
 	"reflect"
-	"sync"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
 )
 
 func success(l int) bool {
@@ -13,6 +17,11 @@ func fail(l int) bool {
 	return l == -1
 }
 
+func escapeString(s string) string {
+	q := strconv.Quote(s)
+	return q[1 : len(q)-1]
+}
+
 // Any
 type Any interface {
 }
@@ -23,7 +32,7 @@ type Token struct {
 	S   string
 }
 
-// Semantic values
+// Semantic values. With a stream, SS is empty and S is only set for token rules.
 type Values struct {
 	SS     string
 	Vs     []Any
@@ -31,26 +40,137 @@ type Values struct {
 	S      string
 	Choice int
 	Ts     []Token
+
+	in       *input
+	captures []captureRange
+}
+
+// Values of a labeled expression
+type captureRange struct {
+	name  string
+	begin int
+	end   int
+	token *Token // Text matched by an expression without values
+}
+
+// Label the values from begin, or the text from p if an expression without
+// rules produced none. An empty match, such as an optional, records nothing.
+func (v *Values) capture(o *capture, begin int, p int, l int, in *input) {
+	if len(v.Vs) > begin {
+		v.captures = append(v.captures, captureRange{o.name, begin, len(v.Vs), nil})
+	} else if o.text && l > 0 {
+		v.captures = append(v.captures, captureRange{o.name, begin, begin, &Token{p, in.substr(p, p+l)}})
+	}
 }
 
 func (v *Values) Len() int {
 	return len(v.Vs)
 }
 
-func (v *Values) ToStr(i int) string {
-	return v.Vs[i].(string)
+// Error of reading a value or a token that isn't there or has another type.
+// The To accessors panic with it, and the panic fails the action with a
+// syntax error at the rule instead of crashing.
+type ValueError struct {
+	Index int
+	Msg   string
 }
 
-func (v *Values) ToInt(i int) int {
-	return v.Vs[i].(int)
+func (e *ValueError) Error() string {
+	return e.Msg
 }
 
-func (v *Values) ToBool(i int) bool {
-	return v.Vs[i].(bool)
+// Value at i as a T
+func Get[T any](v *Values, i int) (T, error) {
+	var val T
+	if i < 0 || i >= len(v.Vs) {
+		return val, &ValueError{i, fmt.Sprintf("value %d is out of range (%d values)", i, len(v.Vs))}
+	}
+	val, ok := v.Vs[i].(T)
+	if !ok {
+		want := reflect.TypeOf((*T)(nil)).Elem()
+		return val, &ValueError{i, fmt.Sprintf("value %d is %T, not %v", i, v.Vs[i], want)}
+	}
+	return val, nil
 }
 
-func (v *Values) ToOpe(i int) operator {
-	return v.Vs[i].(operator)
+func must[T any](val T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+func (v *Values) StrAt(i int) (string, error)    { return Get[string](v, i) }
+func (v *Values) IntAt(i int) (int, error)       { return Get[int](v, i) }
+func (v *Values) BoolAt(i int) (bool, error)     { return Get[bool](v, i) }
+func (v *Values) FloatAt(i int) (float64, error) { return Get[float64](v, i) }
+func (v *Values) RuneAt(i int) (rune, error)     { return Get[rune](v, i) }
+func (v *Values) AstAt(i int) (*Ast, error)      { return Get[*Ast](v, i) }
+
+// Token at i, with its position in the input
+func (v *Values) TokenAt(i int) (Token, error) {
+	if i < 0 || i >= len(v.Ts) {
+		return Token{}, &ValueError{i, fmt.Sprintf("token %d is out of range (%d tokens)", i, len(v.Ts))}
+	}
+	return v.Ts[i], nil
+}
+
+func (v *Values) ToStr(i int) string    { return must(v.StrAt(i)) }
+func (v *Values) ToInt(i int) int       { return must(v.IntAt(i)) }
+func (v *Values) ToBool(i int) bool     { return must(v.BoolAt(i)) }
+func (v *Values) ToFloat(i int) float64 { return must(v.FloatAt(i)) }
+func (v *Values) ToRune(i int) rune     { return must(v.RuneAt(i)) }
+func (v *Values) ToAst(i int) *Ast      { return must(v.AstAt(i)) }
+func (v *Values) ToToken(i int) Token   { return must(v.TokenAt(i)) }
+func (v *Values) ToOpe(i int) operator  { return must(Get[operator](v, i)) }
+
+// Value of an expression labeled with name, such as lhs:EXPR. Several values,
+// from a repetition or a label used more than once, are returned as []Any.
+func (v *Values) Get(name string) Any {
+	var vs []Any
+	for _, r := range v.captures {
+		if r.name == name {
+			if r.token != nil {
+				vs = append(vs, *r.token)
+			} else {
+				vs = append(vs, v.Vs[r.begin:r.end]...)
+			}
+		}
+	}
+	switch len(vs) {
+	case 0:
+		return nil
+	case 1:
+		return vs[0]
+	}
+	return vs
+}
+
+// Whether an expression labeled with name produced a value or matched text
+func (v *Values) Has(name string) bool {
+	for _, r := range v.captures {
+		if r.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Innermost label of the i-th value
+func (v *Values) captureName(i int) string {
+	for _, r := range v.captures {
+		if r.begin <= i && i < r.end {
+			return r.name
+		}
+	}
+	return ""
+}
+
+// Labels of the values of chv, which are appended to v
+func (v *Values) appendCaptures(chv *Values) {
+	for _, r := range chv.captures {
+		v.captures = append(v.captures, captureRange{r.name, r.begin + len(v.Vs), r.end + len(v.Vs), r.token})
+	}
 }
 
 func (v *Values) Token() string {
@@ -60,38 +180,178 @@ func (v *Values) Token() string {
 	return v.S
 }
 
+// Line and column of Pos
+func (v *Values) LineInfo() (ln int, col int) {
+	if v.in != nil && v.in.stream() {
+		return v.in.lineInfo(v.Pos)
+	}
+	return lineInfo(v.SS, v.Pos)
+}
+
 // Context
 type context struct {
-	s string
+	s  string
+	in *input
 
-	errorPos   int
-	messagePos int
-	message    string
+	rule string // Rule being parsed
+
+	errorPos    int
+	errorLoc    location
+	errorRule   string
+	expected    []string
+	messagePos  int
+	messageLoc  location
+	messageRule string
+	messageErr  error
+	message     string
 
 	svStack   []Values
 	argsStack [][]operator
 
-	inToken bool
+	inToken     bool
+	inTokenRule int
 
 	whitespaceOpe operator
 	inWhitespace  bool
 
 	wordOpe operator
+	isWord  map[*literalString]bool
+	word    *context // Context of the word checks, made by the first one
+	notWord operator
+
+	lastToken string
+
+	packrat        bool
+	memo           map[memoKey]*memoEntry
+	packratStats   PackratStats
+	packratStatsFn func(stats PackratStats)
+
+	seeds      map[memoKey]*seedEntry
+	seedDepth  int
+	heads      map[memoKey]*recursionHead
+	recursions *leftRecursion
+
+	inline []bool // Slots of Parser.inlined that are parsed inline
+
+	cut        bool
+	backtracks []int
+	memoFloor  int
+
+	errors    []errorRecord
+	label     string
+	labelPos  int
+	labelLoc  location
+	labelRule string
+
+	ctx       gocontext.Context
+	limits    Limits
+	depth     int
+	steps     int
+	abort     *errorRecord
+	abortKind ErrorKind
 
 	tracerEnter func(name string, s string, v *Values, d Any, p int)
 	tracerLeave func(name string, s string, v *Values, d Any, p int, l int)
 }
 
+// Error positions in a stream are resolved before the input is discarded
+type location struct {
+	ln    int
+	col   int
+	found string
+}
+
+func (c *context) locate(p int) location {
+	if !c.in.stream() || p < 0 {
+		return location{}
+	}
+	ln, col := c.in.lineInfo(p)
+	return location{ln, col, c.in.found(p)}
+}
+
+// Message of the current rule, with the error of its action if it failed
+func (c *context) setMessage(p int, msg string, err error) {
+	c.messagePos = p
+	c.messageLoc = c.locate(p)
+	c.messageRule = c.rule
+	c.messageErr = err
+	c.message = msg
+}
+
 func (c *context) setErrorPos(p int) {
 	if c.errorPos < p {
 		c.errorPos = p
+		c.errorLoc = c.locate(p)
+		c.errorRule = c.rule
+		c.expected = nil
+	}
+}
+
+// Record what was expected at the furthest error position
+func (c *context) addExpected(p int, item string) {
+	if c.inTokenRule > 0 || c.inWhitespace {
+		c.setErrorPos(p)
+		return
 	}
+	if c.errorPos < p {
+		c.errorPos = p
+		c.errorLoc = c.locate(p)
+		c.errorRule = c.rule
+		c.expected = []string{item}
+	} else if c.errorPos == p {
+		for _, e := range c.expected {
+			if e == item {
+				return
+			}
+		}
+		c.expected = append(c.expected, item)
+	}
+}
+
+// Error state
+type errorState struct {
+	pos      int
+	loc      location
+	rule     string
+	expected []string
+}
+
+func (c *context) errorState() errorState {
+	return errorState{c.errorPos, c.errorLoc, c.errorRule, c.expected}
+}
+
+func (c *context) restoreError(e errorState) {
+	c.errorPos = e.pos
+	c.errorLoc = e.loc
+	c.errorRule = e.rule
+	c.expected = e.expected
+}
+
+func (c *context) mergeError(e errorState) {
+	if c.errorPos < e.pos {
+		c.restoreError(e)
+	} else if c.errorPos == e.pos {
+		for _, item := range e.expected {
+			c.addExpected(e.pos, item)
+		}
+	}
+}
+
+// Whether a reference with the inline slot i parses its rule inline
+func (c *context) inlined(i int) bool {
+	return i > 0 && i <= len(c.inline) && c.inline[i-1]
 }
 
 func (c *context) push() *Values {
-	v := Values{SS: c.s}
-	c.svStack = append(c.svStack, v)
-	return &c.svStack[len(c.svStack)-1]
+	n := len(c.svStack)
+	if n < cap(c.svStack) {
+		c.svStack = c.svStack[:n+1]
+	} else {
+		c.svStack = append(c.svStack, Values{})
+	}
+	v := &c.svStack[n]
+	*v = Values{SS: c.s, in: c.in}
+	return v
 }
 
 func (c *context) pop() {
@@ -113,16 +373,75 @@ func (c *context) topArg() []operator {
 	return c.argsStack[len(c.argsStack)-1]
 }
 
+// Backtrack points also keep the input from being discarded
+func (c *context) pushBacktrack(p int) {
+	c.backtracks = append(c.backtracks, p)
+	c.in.pin(p)
+}
+
+func (c *context) popBacktrack() {
+	c.backtracks = c.backtracks[:len(c.backtracks)-1]
+	c.in.unpin()
+}
+
+func (c *context) setBacktrack(p int) {
+	c.backtracks[len(c.backtracks)-1] = p
+	c.in.setPin(p)
+}
+
+// A cut, a labeled failure or an aborted parse must not be backtracked
+func (c *context) committed() bool {
+	return c.cut || len(c.label) > 0 || c.abort != nil
+}
+
+// Number of operator invocations between checks for cancellation
+const cancelCheckInterval = 256
+
+// Abort the parse if it is canceled or exceeds a limit
+func (c *context) checkLimits(p int) bool {
+	if c.abort != nil {
+		return false
+	}
+	c.steps++
+	switch {
+	case c.limits.MaxDepth > 0 && c.depth > c.limits.MaxDepth:
+		c.setAbort(p, DepthLimitError, "maximum recursion depth exceeded", nil)
+	case c.limits.MaxSteps > 0 && c.steps > c.limits.MaxSteps:
+		c.setAbort(p, StepLimitError, "maximum number of steps exceeded", nil)
+	case c.limits.MaxValues > 0 && len(c.svStack) > c.limits.MaxValues:
+		c.setAbort(p, ValueLimitError, "maximum value stack size exceeded", nil)
+	case c.ctx != nil && (c.steps-1)%cancelCheckInterval == 0 && c.ctx.Err() != nil:
+		c.setAbort(p, CanceledError, c.ctx.Err().Error(), c.ctx.Err())
+	}
+	return c.abort == nil
+}
+
+func (c *context) setAbort(p int, kind ErrorKind, msg string, err error) {
+	c.abort = &errorRecord{pos: p, loc: c.locate(p), msg: msg, rule: c.rule, kind: kind, err: err}
+	c.abortKind = kind
+}
+
 // parse
-func parse(o operator, s string, p int, v *Values, c *context, d Any) (l int) {
+func parse(o operator, p int, v *Values, c *context, d Any) (l int) {
+	if !c.checkLimits(p) {
+		return -1
+	}
+
 	if c.tracerEnter != nil {
-		c.tracerEnter(o.Label(), s, v, d, p)
+		c.tracerEnter(o.Label(), c.s, v, d, p)
 	}
 
-	l = o.parseCore(s, p, v, c, d)
+	c.depth++
+	l = o.parseCore(p, v, c, d)
+	c.depth--
+
+	// Nothing succeeds once the parse is aborted
+	if c.abort != nil {
+		l = -1
+	}
 
 	if c.tracerLeave != nil {
-		c.tracerLeave(o.Label(), s, v, d, p, l)
+		c.tracerLeave(o.Label(), c.s, v, d, p, l)
 	}
 	return
 }
@@ -130,8 +449,9 @@ func parse(o operator, s string, p int, v *Values, c *context, d Any) (l int) {
 // Operator
 type operator interface {
 	Label() string
-	parse(s string, p int, v *Values, c *context, d Any) int
-	parseCore(s string, p int, v *Values, c *context, d Any) int
+	String() string
+	parse(p int, v *Values, c *context, d Any) int
+	parseCore(p int, v *Values, c *context, d Any) int
 	accept(v visitor)
 }
 
@@ -144,8 +464,8 @@ func (o *opeBase) Label() string {
 	return reflect.TypeOf(o.derived).String()[5:]
 }
 
-func (o *opeBase) parse(s string, p int, v *Values, c *context, d Any) int {
-	return parse(o.derived, s, p, v, c, d)
+func (o *opeBase) parse(p int, v *Values, c *context, d Any) int {
+	return parse(o.derived, p, v, c, d)
 }
 
 // Sequence
@@ -154,10 +474,10 @@ type sequence struct {
 	opes []operator
 }
 
-func (o *sequence) parseCore(s string, p int, v *Values, c *context, d Any) (l int) {
+func (o *sequence) parseCore(p int, v *Values, c *context, d Any) (l int) {
 	l = 0
 	for _, ope := range o.opes {
-		chl := ope.parse(s, p+l, v, c, d)
+		chl := ope.parse(p+l, v, c, d)
 		if fail(chl) {
 			l = -1
 			return
@@ -174,29 +494,86 @@ func (o *sequence) accept(v visitor) {
 // Prioritized Choice
 type prioritizedChoice struct {
 	opeBase
-	opes []operator
+	opes    []operator
+	choices []int        // Choice of each alternative before nested choices were flattened
+	index   *choiceIndex // Alternatives that can match at a position
+	first   *firstTable  // Alternatives that can start with each byte
 }
 
-func (o *prioritizedChoice) parseCore(s string, p int, v *Values, c *context, d Any) (l int) {
+func (o *prioritizedChoice) parseCore(p int, v *Values, c *context, d Any) (l int) {
+	saveCut := c.cut
+	c.pushBacktrack(p)
+	defer func() {
+		c.cut = saveCut
+		c.popBacktrack()
+	}()
+
+	// Alternatives that can't match only report what they expected
+	skip := o.skip(c, p)
+
 	id := 0
+	saveErrors := len(c.errors)
 	for _, ope := range o.opes {
+		if id < 64 && skip&(1<<uint(id)) != 0 {
+			o.expect(c, p, id)
+			id++
+			continue
+		}
+		c.cut = false
 		chv := c.push()
-		l = ope.parse(s, p, chv, c, d)
+		l = ope.parse(p, chv, c, d)
 		c.pop()
 		if success(l) {
+			v.appendCaptures(chv)
 			v.Vs = append(v.Vs, chv.Vs...)
 			v.Pos = chv.Pos
 			v.S = chv.S
-			v.Choice = id
+			v.Choice = o.choice(id)
 			v.Ts = append(v.Ts, chv.Ts...)
 			return
 		}
+		c.errors = c.errors[:saveErrors]
+		if c.committed() {
+			break
+		}
 		id++
 	}
 	l = -1
 	return
 }
 
+// Alternatives that fail at p without being tried
+func (o *prioritizedChoice) skip(c *context, p int) uint64 {
+	if c.tracerEnter != nil || c.tracerLeave != nil {
+		return 0
+	}
+	if o.index != nil {
+		return ^o.index.match(c.in, p)
+	}
+
+	// A skipped rule isn't memoized, which only costs the packrat memo an
+	// entry of a failure
+	if o.first != nil {
+		return o.first.match(c, p)
+	}
+	return 0
+}
+
+func (o *prioritizedChoice) expect(c *context, p int, id int) {
+	if o.index != nil {
+		o.index.expect(c, p, id)
+	} else {
+		o.first.expect(c, p, id)
+	}
+}
+
+func (o *prioritizedChoice) choice(id int) int {
+	if o.choices != nil {
+		return o.choices[id]
+	}
+	return id
+}
+
 func (o *prioritizedChoice) accept(v visitor) {
 	v.visitPrioritizedChoice(o)
 }
@@ -207,20 +584,42 @@ type zeroOrMore struct {
 	ope operator
 }
 
-func (o *zeroOrMore) parseCore(s string, p int, v *Values, c *context, d Any) (l int) {
-	saveErrorPos := c.errorPos
+func (o *zeroOrMore) parseCore(p int, v *Values, c *context, d Any) (l int) {
+	saveError := c.errorState()
+	saveCut := c.cut
+	c.pushBacktrack(p)
+	defer func() {
+		c.cut = saveCut
+		c.popBacktrack()
+	}()
+
 	l = 0
-	for p+l < len(s) {
+	for !c.in.atEnd(p + l) {
 		saveVs := v.Vs
 		saveTs := v.Ts
-		chl := o.ope.parse(s, p+l, v, c, d)
+		saveCaptures := v.captures
+		saveErrors := len(c.errors)
+		c.cut = false
+		c.setBacktrack(p + l)
+		chl := o.ope.parse(p+l, v, c, d)
 		if fail(chl) {
+			if c.committed() {
+				l = -1
+				return
+			}
 			v.Vs = saveVs
 			v.Ts = saveTs
-			c.errorPos = saveErrorPos
+			v.captures = saveCaptures
+			c.errors = c.errors[:saveErrors]
+			c.restoreError(saveError)
 			break
 		}
 		l += chl
+
+		// An iteration that consumes nothing would repeat forever
+		if chl == 0 {
+			break
+		}
 	}
 	return
 }
@@ -235,23 +634,45 @@ type oneOrMore struct {
 	ope operator
 }
 
-func (o *oneOrMore) parseCore(s string, p int, v *Values, c *context, d Any) (l int) {
-	l = o.ope.parse(s, p, v, c, d)
+func (o *oneOrMore) parseCore(p int, v *Values, c *context, d Any) (l int) {
+	l = o.ope.parse(p, v, c, d)
 	if fail(l) {
 		return
 	}
-	saveErrorPos := c.errorPos
-	for p+l < len(s) {
+	saveError := c.errorState()
+	saveCut := c.cut
+	c.pushBacktrack(p + l)
+	defer func() {
+		c.cut = saveCut
+		c.popBacktrack()
+	}()
+
+	for !c.in.atEnd(p + l) {
 		saveVs := v.Vs
 		saveTs := v.Ts
-		chl := o.ope.parse(s, p+l, v, c, d)
+		saveCaptures := v.captures
+		saveErrors := len(c.errors)
+		c.cut = false
+		c.setBacktrack(p + l)
+		chl := o.ope.parse(p+l, v, c, d)
 		if fail(chl) {
+			if c.committed() {
+				l = -1
+				return
+			}
 			v.Vs = saveVs
 			v.Ts = saveTs
-			c.errorPos = saveErrorPos
+			v.captures = saveCaptures
+			c.errors = c.errors[:saveErrors]
+			c.restoreError(saveError)
 			break
 		}
 		l += chl
+
+		// An iteration that consumes nothing would repeat forever
+		if chl == 0 {
+			break
+		}
 	}
 	return
 }
@@ -266,17 +687,26 @@ type option struct {
 	ope operator
 }
 
-func (o *option) parseCore(s string, p int, v *Values, c *context, d Any) (l int) {
-	saveErrorPos := c.errorPos
+func (o *option) parseCore(p int, v *Values, c *context, d Any) (l int) {
+	saveError := c.errorState()
 	saveVs := v.Vs
 	saveTs := v.Ts
-	l = o.ope.parse(s, p, v, c, d)
-	if fail(l) {
+	saveCaptures := v.captures
+	saveErrors := len(c.errors)
+	saveCut := c.cut
+	c.cut = false
+	c.pushBacktrack(p)
+	l = o.ope.parse(p, v, c, d)
+	c.popBacktrack()
+	if fail(l) && !c.committed() {
 		v.Vs = saveVs
 		v.Ts = saveTs
-		c.errorPos = saveErrorPos
+		v.captures = saveCaptures
+		c.errors = c.errors[:saveErrors]
+		c.restoreError(saveError)
 		l = 0
 	}
+	c.cut = saveCut
 	return
 }
 
@@ -290,10 +720,17 @@ type andPredicate struct {
 	ope operator
 }
 
-func (o *andPredicate) parseCore(s string, p int, v *Values, c *context, d Any) (l int) {
+func (o *andPredicate) parseCore(p int, v *Values, c *context, d Any) (l int) {
+	saveCut := c.cut
+	saveErrors := len(c.errors)
+	c.pushBacktrack(p)
 	chv := c.push()
-	chl := o.ope.parse(s, p, chv, c, d)
+	chl := o.ope.parse(p, chv, c, d)
 	c.pop()
+	c.popBacktrack()
+	c.cut = saveCut
+	c.errors = c.errors[:saveErrors]
+	c.label = ""
 
 	if success(chl) {
 		l = 0
@@ -313,18 +750,25 @@ type notPredicate struct {
 	ope operator
 }
 
-func (o *notPredicate) parseCore(s string, p int, v *Values, c *context, d Any) (l int) {
-	saveErrorPos := c.errorPos
+func (o *notPredicate) parseCore(p int, v *Values, c *context, d Any) (l int) {
+	saveError := c.errorState()
+	saveCut := c.cut
+	saveErrors := len(c.errors)
 
+	c.pushBacktrack(p)
 	chv := c.push()
-	chl := o.ope.parse(s, p, chv, c, d)
+	chl := o.ope.parse(p, chv, c, d)
 	c.pop()
+	c.popBacktrack()
+	c.cut = saveCut
+	c.errors = c.errors[:saveErrors]
+	c.label = ""
 
 	if success(chl) {
 		c.setErrorPos(p)
 		l = -1
 	} else {
-		c.errorPos = saveErrorPos
+		c.restoreError(saveError)
 		l = 0
 	}
 	return
@@ -337,39 +781,69 @@ func (o *notPredicate) accept(v visitor) {
 // Literal String
 type literalString struct {
 	opeBase
-	lit        string
-	initIsWord sync.Once
-	isWord     bool
+	lit         string
+	ignoreCase  bool
+	parts       []*literalString // Adjacent literals merged into this one
+	description string           // What a failure reports
 }
 
-func (o *literalString) parseCore(s string, p int, v *Values, c *context, d Any) int {
+// Failures are frequent, so the description is only made once
+func newLiteral(lit string, ignoreCase bool) *literalString {
+	o := &literalString{lit: lit, ignoreCase: ignoreCase}
+	o.derived = o
+	o.description = "'" + escapeString(lit) + "'"
+	if ignoreCase {
+		o.description += "i"
+	}
+	return o
+}
+
+func (o *literalString) match(in *input, p int) int {
 	l := 0
-	for ; l < len(o.lit); l++ {
-		if p+l == len(s) || s[p+l] != o.lit[l] {
-			c.setErrorPos(p)
-			return -1
+	if o.ignoreCase {
+		for _, lr := range o.lit {
+			if in.atEnd(p + l) {
+				return -1
+			}
+			r, size := in.decodeRune(p + l)
+			if !equalFold(lr, r) {
+				return -1
+			}
+			l += size
+		}
+	} else {
+		in.fill(p, p+len(o.lit))
+		for ; l < len(o.lit); l++ {
+			if p+l == in.end() || in.byteAt(p+l) != o.lit[l] {
+				return -1
+			}
 		}
 	}
+	return l
+}
 
-	// Word check
-	o.initIsWord.Do(func() {
-		if c.wordOpe != nil {
-			len := c.wordOpe.parse(o.lit, 0, &Values{}, &context{s: s}, nil)
-			o.isWord = success(len)
-		}
-	})
-	if o.isWord {
-		len := Npd(c.wordOpe).parse(s, p+l, v, &context{s: s}, nil)
-		if fail(len) {
-			return -1
+func equalFold(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	for f := unicode.SimpleFold(a); f != a; f = unicode.SimpleFold(f) {
+		if f == b {
+			return true
 		}
-		l += len
+	}
+	return false
+}
+
+func (o *literalString) parseCore(p int, v *Values, c *context, d Any) int {
+	l := o.parseWord(p, v, c)
+	if fail(l) {
+		return -1
 	}
 
 	// Skip whiltespace
 	if c.inToken == false {
 		if c.whitespaceOpe != nil {
-			len := c.whitespaceOpe.parse(s, p+l, v, c, d)
+			len := c.whitespaceOpe.parse(p+l, v, c, d)
 			if fail(len) {
 				return -1
 			}
@@ -379,6 +853,72 @@ func (o *literalString) parseCore(s string, p int, v *Values, c *context, d Any)
 	return l
 }
 
+// Match the literal and check that a word doesn't go on after it
+func (o *literalString) parseWord(p int, v *Values, c *context) int {
+	l := o.match(c.in, p)
+	if fail(l) {
+		o.expect(c, p)
+		return -1
+	}
+
+	// Word check
+	if c.wordOpe != nil && c.literalIsWord(o) {
+		w := c.wordContext()
+		len := w.notWord.parse(p+l, v, w, nil)
+		if fail(len) {
+			return -1
+		}
+		l += len
+	}
+	return l
+}
+
+// Word checks don't report errors to the parse, so they get a context of
+// their own that is reused
+func (c *context) wordContext() *context {
+	if c.word == nil {
+		c.word = &context{
+			s:       c.s,
+			in:      c.in,
+			notWord: Npd(c.wordOpe),
+			seeds:   make(map[memoKey]*seedEntry),
+			heads:   make(map[memoKey]*recursionHead),
+		}
+	}
+	return c.word
+}
+
+// Whether a literal matches %word depends on the start rule, so it is cached per parse
+func (c *context) literalIsWord(o *literalString) bool {
+	isWord, ok := c.isWord[o]
+	if !ok {
+		len := c.wordOpe.parse(0, &Values{}, newStringContext(o.lit), nil)
+		isWord = success(len)
+		if c.isWord == nil {
+			c.isWord = make(map[*literalString]bool)
+		}
+		c.isWord[o] = isWord
+	}
+	return isWord
+}
+
+// A merged literal reports the part that failed
+func (o *literalString) expect(c *context, p int) {
+	for _, part := range o.parts {
+		l := part.match(c.in, p)
+		if fail(l) {
+			c.addExpected(p, part.describe())
+			return
+		}
+		p += l
+	}
+	c.addExpected(p, o.describe())
+}
+
+func (o *literalString) describe() string {
+	return o.description
+}
+
 func (o *literalString) accept(v visitor) {
 	v.visitLiteralString(o)
 }
@@ -386,38 +926,117 @@ func (o *literalString) accept(v visitor) {
 // Character Class
 type characterClass struct {
 	opeBase
-	chars string
-}
+	chars       string
+	ranges      []runeRange
+	bytes       []runeRange
+	negated     bool
+	description string // What a failure reports
+}
+
+type runeRange struct {
+	lo rune
+	hi rune
+}
+
+// Ranges of characters and of bytes in a class. A byte that isn't part of a
+// UTF-8 encoded character, such as '\xff', matches that byte, and so does an
+// ASCII character in a range with such a byte. A range between a byte and any
+// other character is an error and is left out.
+func parseRanges(chars string) (ranges []runeRange, bytes []runeRange, err error) {
+	type item struct {
+		r    rune
+		byte bool
+	}
+	text := func(it item) string {
+		if it.byte {
+			return escapeString(string([]byte{byte(it.r)}))
+		}
+		return escapeString(string(it.r))
+	}
 
-func (o *characterClass) parseCore(s string, p int, v *Values, c *context, d Any) (l int) {
-	// TODO: UTF8 support
-	if len(s)-p < 1 {
-		c.setErrorPos(p)
-		l = -1
-		return
+	var items []item
+	for i := 0; i < len(chars); {
+		r, size := utf8.DecodeRuneInString(chars[i:])
+		if r == utf8.RuneError && size == 1 {
+			items = append(items, item{rune(chars[i]), true})
+		} else {
+			items = append(items, item{r, false})
+		}
+		i += size
 	}
-	ch := s[p]
+
 	i := 0
-	for i < len(o.chars) {
-		if i+2 < len(o.chars) && o.chars[i+1] == '-' {
-			if o.chars[i] <= ch && ch <= o.chars[i+2] {
-				l = 1
-				return
-			}
+	for i < len(items) {
+		lo, hi := items[i], items[i]
+		if i+2 < len(items) && items[i+1] == (item{'-', false}) {
+			hi = items[i+2]
 			i += 3
 		} else {
-			if o.chars[i] == ch {
-				l = 1
-				return
-			}
 			i++
 		}
+		switch {
+		case !lo.byte && !hi.byte:
+			ranges = append(ranges, runeRange{lo.r, hi.r})
+		case (lo.byte || lo.r < utf8.RuneSelf) && (hi.byte || hi.r < utf8.RuneSelf):
+			bytes = append(bytes, runeRange{lo.r, hi.r})
+		case err == nil:
+			err = fmt.Errorf("the range '%s-%s' is between a byte and a character.", text(lo), text(hi))
+		}
 	}
-	c.setErrorPos(p)
-	l = -1
 	return
 }
 
+func (o *characterClass) parseCore(p int, v *Values, c *context, d Any) (l int) {
+	l = o.match(c.in, p)
+	if fail(l) {
+		c.addExpected(p, o.describe())
+	}
+	return
+}
+
+// Length of the character at p if it is in the class
+func (o *characterClass) match(in *input, p int) int {
+	if in.atEnd(p) {
+		return -1
+	}
+	if o.bytes != nil && o.containsByte(in.byteAt(p)) {
+		if o.negated {
+			return -1
+		}
+		return 1
+	}
+	ch, size := in.decodeRune(p)
+	if o.contains(ch) {
+		return size
+	}
+	return -1
+}
+
+// Whether a rune is in the class. Bytes of the class are not included.
+func (o *characterClass) contains(ch rune) bool {
+	matched := false
+	for _, rg := range o.ranges {
+		if rg.lo <= ch && ch <= rg.hi {
+			matched = true
+			break
+		}
+	}
+	return matched != o.negated
+}
+
+func (o *characterClass) containsByte(b byte) bool {
+	for _, rg := range o.bytes {
+		if rg.lo <= rune(b) && rune(b) <= rg.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *characterClass) describe() string {
+	return o.description
+}
+
 func (o *characterClass) accept(v visitor) {
 	v.visitCharacterClass(o)
 }
@@ -427,14 +1046,13 @@ type anyCharacter struct {
 	opeBase
 }
 
-func (o *anyCharacter) parseCore(s string, p int, v *Values, c *context, d Any) (l int) {
-	// TODO: UTF8 support
-	if len(s)-p < 1 {
-		c.setErrorPos(p)
+func (o *anyCharacter) parseCore(p int, v *Values, c *context, d Any) (l int) {
+	if c.in.atEnd(p) {
+		c.addExpected(p, "any character")
 		l = -1
 		return
 	}
-	l = 1
+	_, l = c.in.decodeRune(p)
 	return
 }
 
@@ -448,16 +1066,20 @@ type tokenBoundary struct {
 	ope operator
 }
 
-func (o *tokenBoundary) parseCore(s string, p int, v *Values, c *context, d Any) int {
+func (o *tokenBoundary) parseCore(p int, v *Values, c *context, d Any) int {
+	c.in.pin(p)
 	c.inToken = true
-	l := o.ope.parse(s, p, v, c, d)
+	l := o.ope.parse(p, v, c, d)
 	c.inToken = false
 	if success(l) {
-		v.Ts = append(v.Ts, Token{p, s[p : p+l]})
+		v.Ts = append(v.Ts, Token{p, c.in.substr(p, p+l)})
+	}
+	c.in.unpin()
+	if success(l) {
 
 		// Skip whiltespace
 		if c.whitespaceOpe != nil {
-			len := c.whitespaceOpe.parse(s, p+l, v, c, d)
+			len := c.whitespaceOpe.parse(p+l, v, c, d)
 			if fail(len) {
 				return -1
 			}
@@ -477,9 +1099,9 @@ type ignore struct {
 	ope operator
 }
 
-func (o *ignore) parseCore(s string, p int, v *Values, c *context, d Any) int {
+func (o *ignore) parseCore(p int, v *Values, c *context, d Any) int {
 	chv := c.push()
-	l := o.ope.parse(s, p, chv, c, d)
+	l := o.ope.parse(p, chv, c, d)
 	c.pop()
 	return l
 }
@@ -494,8 +1116,13 @@ type user struct {
 	fn func(s string, p int, v *Values, d Any) int
 }
 
-func (o *user) parseCore(s string, p int, v *Values, c *context, d Any) int {
-	return o.fn(s, p, v, d)
+func (o *user) parseCore(p int, v *Values, c *context, d Any) int {
+	if c.in.stream() {
+		// Only the buffered input is visible in a stream
+		c.in.fill(p, p+readSize)
+		return o.fn(c.in.window(c.in.base), p-c.in.base, v, d)
+	}
+	return o.fn(c.s, p, v, d)
 }
 
 func (o *user) accept(v visitor) {
@@ -511,14 +1138,20 @@ type reference struct {
 	iargs []int
 	pos   int
 	rule  *Rule
+
+	inline int // Slot of a trivial rule in Parser.inlined plus one, or 0
 }
 
-func (o *reference) parseCore(s string, p int, v *Values, c *context, d Any) (l int) {
+func (o *reference) parseCore(p int, v *Values, c *context, d Any) (l int) {
 	if o.rule != nil {
 		// Reference rule
 		if o.rule.Parameters == nil {
 			// Definition
-			l = o.rule.parse(s, p, v, c, d)
+			if c.inlined(o.inline) {
+				l = o.rule.parseInline(p, v, c, d)
+			} else {
+				l = o.rule.parse(p, v, c, d)
+			}
 		} else {
 			// Macro
 			vis := &findReference{
@@ -534,13 +1167,13 @@ func (o *reference) parseCore(s string, p int, v *Values, c *context, d Any) (l
 			}
 
 			c.pushArgs(args)
-			l = o.rule.parse(s, p, v, c, d)
+			l = o.rule.parse(p, v, c, d)
 			c.popArgs()
 		}
 	} else {
 		// Reference parameter in macro
 		args := c.topArg()
-		l = args[o.iarg].parse(s, p, v, c, d)
+		l = args[o.iarg].parse(p, v, c, d)
 	}
 	return
 }
@@ -549,18 +1182,126 @@ func (o *reference) accept(v visitor) {
 	v.visitReference(o)
 }
 
+// Cut
+type cut struct {
+	opeBase
+}
+
+func (o *cut) parseCore(p int, v *Values, c *context, d Any) int {
+	c.cut = true
+	if c.packrat && len(c.seeds) == 0 {
+		// Nothing before the outermost backtrack point can be revisited. The
+		// innermost one may be a predicate, which goes back to its start even
+		// after a cut.
+		floor := p
+		if len(c.backtracks) > 0 {
+			floor = c.backtracks[0]
+		}
+		c.dropMemo(floor)
+	}
+	return 0
+}
+
+func (o *cut) accept(v visitor) {
+	v.visitCut(o)
+}
+
+// Labeled failure
+type throw struct {
+	opeBase
+	ope      operator
+	label    string
+	recovery operator
+}
+
+func (o *throw) parseCore(p int, v *Values, c *context, d Any) int {
+	saveError := c.errorState()
+	saveVs := v.Vs
+	saveTs := v.Ts
+	saveCaptures := v.captures
+	saveErrors := len(c.errors)
+
+	c.in.pin(p)
+	defer c.in.unpin()
+
+	c.restoreError(errorState{pos: -1})
+	l := o.ope.parse(p, v, c, d)
+	if success(l) || len(c.label) > 0 {
+		c.mergeError(saveError)
+		return l
+	}
+
+	inner := c.errorState()
+	if inner.pos < p {
+		inner = errorState{pos: p, loc: c.locate(p), rule: c.rule}
+	}
+	c.restoreError(saveError)
+	v.Vs = saveVs
+	v.Ts = saveTs
+	v.captures = saveCaptures
+	c.errors = c.errors[:saveErrors]
+
+	if o.recovery == nil {
+		c.label = o.label
+		c.labelPos = inner.pos
+		c.labelLoc = inner.loc
+		c.labelRule = inner.rule
+		c.mergeError(inner)
+		return -1
+	}
+
+	var msg string
+	if r, ok := o.recovery.(*Rule); ok && r.Message != nil {
+		msg = r.Message()
+	}
+	c.errors = append(c.errors, errorRecord{inner.pos, inner.loc, msg, o.label, inner.expected, inner.rule, SyntaxError, nil})
+
+	return o.recovery.parse(p, v, c, d)
+}
+
+func (o *throw) accept(v visitor) {
+	v.visitThrow(o)
+}
+
+// Labeled expression
+type capture struct {
+	opeBase
+	ope  operator
+	name string
+	text bool // The expression has no rules, so its text is kept
+}
+
+func (o *capture) parseCore(p int, v *Values, c *context, d Any) int {
+	begin := len(v.Vs)
+	if o.text {
+		c.in.pin(p)
+	}
+	l := o.ope.parse(p, v, c, d)
+	if success(l) {
+		v.capture(o, begin, p, l, c.in)
+	}
+	if o.text {
+		c.in.unpin()
+	}
+	return l
+}
+
+func (o *capture) accept(v visitor) {
+	v.visitCapture(o)
+}
+
 // Whitespace
 type whitespace struct {
 	opeBase
 	ope operator
 }
 
-func (o *whitespace) parseCore(s string, p int, v *Values, c *context, d Any) int {
+func (o *whitespace) parseCore(p int, v *Values, c *context, d Any) int {
 	if c.inWhitespace {
 		return 0
 	} else {
 		c.inWhitespace = true
-		l := o.ope.parse(s, p, v, c, d)
+		l := o.ope.parse(p, v, c, d)
 		c.inWhitespace = false
 		return l
 	}
@@ -612,12 +1353,20 @@ func Npd(ope operator) operator {
 	return o
 }
 func Lit(lit string) operator {
-	o := &literalString{lit: lit}
+	return newLiteral(lit, false)
+}
+func LitI(lit string) operator {
+	return newLiteral(lit, true)
+}
+func Cls(chars string) operator {
+	ranges, bytes, _ := parseRanges(chars)
+	o := &characterClass{chars: chars, ranges: ranges, bytes: bytes, description: "[" + escapeString(chars) + "]"}
 	o.derived = o
 	return o
 }
-func Cls(chars string) operator {
-	o := &characterClass{chars: chars}
+func NCls(chars string) operator {
+	ranges, bytes, _ := parseRanges(chars)
+	o := &characterClass{chars: chars, ranges: ranges, bytes: bytes, negated: true, description: "[^" + escapeString(chars) + "]"}
 	o.derived = o
 	return o
 }
@@ -646,6 +1395,30 @@ func Ref(ident string, args []operator, pos int) operator {
 	o.derived = o
 	return o
 }
+
+// Arguments of a macro reference for Ref
+func Args(opes ...operator) []operator {
+	return opes
+}
+func Thr(ope operator, label string, recovery operator) operator {
+	o := &throw{ope: ope, label: label, recovery: recovery}
+	o.derived = o
+	return o
+}
+func Cap(ope operator, name string) operator {
+	o := &capture{ope: ope, name: name, text: true}
+	o.derived = o
+	ope.accept(&referenceWalker{
+		reference: func(*reference) { o.text = false },
+		rule:      func(*Rule) { o.text = false },
+	})
+	return o
+}
+func Cut() operator {
+	o := &cut{}
+	o.derived = o
+	return o
+}
 func Wsp(ope operator) operator {
 	o := &whitespace{ope: Ign(ope)}
 	o.derived = o
@@ -10,8 +10,8 @@ type Cases []struct {
 func run(name string, t *testing.T, ope operator, cases Cases) {
 	for _, cs := range cases {
 		v := &Values{}
-		c := &context{}
-		if got := ope.parse(cs.input, 0, v, c, nil); got != cs.want {
+		c := &context{s: cs.input, in: newStringInput(cs.input)}
+		if got := ope.parse(0, v, c, nil); got != cs.want {
 			t.Errorf("[%s] input:%q want:%d got:%d", name, cs.input, cs.want, got)
 		}
 	}
@@ -124,6 +124,52 @@ func TestNotPredicate(t *testing.T) {
 	run("NotPredicate", t, ope, cases)
 }
 
+func TestCut(t *testing.T) {
+	ope := Cho(
+		Seq(Lit("a"), Cut(), Lit("b")),
+		Lit("ac"),
+	)
+	cases := Cases{
+		{"ab", 2},
+		{"ac", -1},
+		{"c", -1},
+	}
+	run("Cut", t, ope, cases)
+
+	ope = Seq(Zom(Seq(Lit("a"), Cut(), Lit("b"))), Lit("ac"))
+	cases = Cases{
+		{"ac", -1},
+		{"abc", -1},
+		{"ab", -1},
+	}
+	run("Cut", t, ope, cases)
+
+	ope = Seq(Opt(Seq(Lit("a"), Cut(), Lit("b"))), Lit("ac"))
+	cases = Cases{
+		{"abac", 4},
+		{"ac", -1},
+	}
+	run("Cut", t, ope, cases)
+}
+
+func TestThrow(t *testing.T) {
+	ope := Seq(Lit("a"), Thr(Lit("b"), "b", Zom(NCls(";"))), Lit(";"))
+	cases := Cases{
+		{"ab;", 3},
+		{"axx;", 4},
+		{"a;", 2},
+		{"b;", -1},
+	}
+	run("Throw", t, ope, cases)
+
+	ope = Cho(Seq(Lit("a"), Thr(Lit("b"), "b", nil)), Lit("ac"))
+	cases = Cases{
+		{"ab", 2},
+		{"ac", -1},
+	}
+	run("Throw", t, ope, cases)
+}
+
 func TestLiteralString(t *testing.T) {
 	ope := Lit("日本語")
 	cases := Cases{
@@ -136,6 +182,26 @@ func TestLiteralString(t *testing.T) {
 	run("LiteralString", t, ope, cases)
 }
 
+func TestLiteralStringIgnoreCase(t *testing.T) {
+	ope := LitI("Straße")
+	cases := Cases{
+		{"", -1},
+		{"straße", 7},
+		{"STRAẞE", 8},
+		{"strasse", -1},
+		{"ΣTRAßE", -1},
+	}
+	run("LiteralStringIgnoreCase", t, ope, cases)
+
+	ope = LitI("σ")
+	cases = Cases{
+		{"Σ", 2},
+		{"ς", 2},
+		{"s", -1},
+	}
+	run("LiteralStringIgnoreCase", t, ope, cases)
+}
+
 func TestCharacterClass(t *testing.T) {
 	ope := Cls("a-zA-Z0-9_")
 	cases := Cases{
@@ -156,14 +222,54 @@ func TestCharacterClass(t *testing.T) {
 	run("CharacterClass", t, ope, cases)
 }
 
+func TestCharacterClassUTF8(t *testing.T) {
+	ope := Cls("ぁ-んー")
+	cases := Cases{
+		{"", -1},
+		{"あ", 3},
+		{"ん", 3},
+		{"ー", 3},
+		{"ア", -1},
+		{"a", -1},
+		{"\xe3", -1},
+	}
+	run("CharacterClassUTF8", t, ope, cases)
+}
+
+func TestNegatedCharacterClass(t *testing.T) {
+	ope := NCls("ぁ-ん\n")
+	cases := Cases{
+		{"", -1},
+		{"あ", -1},
+		{"\n", -1},
+		{"ア", 3},
+		{"a", 1},
+		{"😃", 4},
+	}
+	run("NegatedCharacterClass", t, ope, cases)
+}
+
+func TestAnyCharacter(t *testing.T) {
+	ope := Dot()
+	cases := Cases{
+		{"", -1},
+		{"a", 1},
+		{"é", 2},
+		{"あ", 3},
+		{"😃", 4},
+		{"\xff", 1},
+	}
+	run("AnyCharacter", t, ope, cases)
+}
+
 func TestTokenBoundary(t *testing.T) {
 	ope := Seq(Tok(Lit("hello")), Lit(" "))
 	v := &Values{}
-	c := &context{}
 	input := "hello "
+	c := &context{s: input, in: newStringInput(input)}
 
 	want := len(input)
-	if got := ope.parse(input, 0, v, c, nil); got != want {
+	if got := ope.parse(0, v, c, nil); got != want {
 		t.Errorf("[%s] input:%q want:%d got:%d", "TokenBoundary", input, want, got)
 	}
 
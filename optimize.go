@@ -0,0 +1,393 @@
+package peg
+
+import (
+	"sort"
+	"unicode"
+)
+
+// Optimize the rules of a grammar without changing values, choices or error
+// messages. The trivial rules whose references are inlined are returned in the
+// order of their slots.
+func optimizeGrammar(grammar map[string]*Rule) (inlined []*Rule) {
+	_, whitespace := grammar[WhitespceRuleName]
+	_, word := grammar[WordRuleName]
+
+	for _, r := range grammar {
+		// Macro bodies are expanded at each call, so they are left as written
+		if r.Parameters != nil {
+			continue
+		}
+		v := &optimizer{whitespace: whitespace, word: word}
+		r.Ope = v.optimize(r.Ope)
+
+		tc := &terminalChecker{}
+		r.Ope.accept(tc)
+		r.trivial = !tc.nonTerminal && !tc.choice && !r.LeftRecursive
+	}
+
+	// Rules are analyzed after all of them are optimized
+	buildFirstTables(grammar)
+
+	// References to trivial rules get the slot of the rule, which a parse
+	// turns off if handlers were attached to the rule
+	slots := make(map[*Rule]int)
+	inline := func(ope *reference) {
+		r := ope.rule
+		if r == nil || !r.trivial {
+			return
+		}
+		if _, ok := slots[r]; !ok {
+			inlined = append(inlined, r)
+			slots[r] = len(inlined)
+		}
+		ope.inline = slots[r]
+	}
+	for _, r := range grammar {
+		r.Ope.accept(&referenceWalker{reference: inline})
+	}
+	return
+}
+
+// optimizer
+type optimizer struct {
+	*visitorBase
+	whitespace bool
+	word       bool
+	inToken    bool
+	ope        operator
+}
+
+func (v *optimizer) optimize(ope operator) operator {
+	v.ope = ope
+	ope.accept(v)
+	return v.ope
+}
+
+// Whitespace is skipped after each literal outside token boundaries, and %word
+// is checked after each literal
+func (v *optimizer) canMergeLiterals() bool {
+	return !v.word && (!v.whitespace || v.inToken)
+}
+
+func (v *optimizer) visitSequence(ope *sequence) {
+	var opes []operator
+	for _, o := range ope.opes {
+		o = v.optimize(o)
+		if seq, ok := o.(*sequence); ok {
+			opes = append(opes, seq.opes...)
+		} else {
+			opes = append(opes, o)
+		}
+	}
+	if v.canMergeLiterals() {
+		opes = mergeLiterals(opes)
+	}
+	if len(opes) == 1 {
+		v.ope = opes[0]
+		return
+	}
+	v.ope = SeqCore(opes)
+}
+func (v *optimizer) visitPrioritizedChoice(ope *prioritizedChoice) {
+	var opes []operator
+	var choices []int
+	flattened := false
+	for id, o := range ope.opes {
+		o = v.optimize(o)
+
+		// A cut in a nested choice only commits the nested choice
+		if cho, ok := o.(*prioritizedChoice); ok && !hasCut(cho) {
+			for range cho.opes {
+				choices = append(choices, ope.choice(id))
+			}
+			opes = append(opes, cho.opes...)
+			flattened = true
+			continue
+		}
+		opes = append(opes, o)
+		choices = append(choices, ope.choice(id))
+	}
+
+	cho := ChoCore(opes).(*prioritizedChoice)
+	if flattened || ope.choices != nil {
+		cho.choices = choices
+	}
+	cho.index = newChoiceIndex(opes)
+	v.ope = cho
+}
+func (v *optimizer) visitZeroOrMore(ope *zeroOrMore) {
+	v.ope = Zom(v.optimize(ope.ope))
+}
+func (v *optimizer) visitOneOrMore(ope *oneOrMore) {
+	v.ope = Oom(v.optimize(ope.ope))
+}
+func (v *optimizer) visitOption(ope *option) {
+	v.ope = Opt(v.optimize(ope.ope))
+}
+func (v *optimizer) visitAndPredicate(ope *andPredicate) {
+	v.ope = Apd(v.optimize(ope.ope))
+}
+func (v *optimizer) visitNotPredicate(ope *notPredicate) {
+	v.ope = Npd(v.optimize(ope.ope))
+}
+func (v *optimizer) visitTokenBoundary(ope *tokenBoundary) {
+	// A nested token boundary turns whitespace skipping back on when it ends
+	tc := &terminalChecker{}
+	ope.ope.accept(tc)
+
+	saveInToken := v.inToken
+	v.inToken = !tc.nonTerminal
+	v.ope = Tok(v.optimize(ope.ope))
+	v.inToken = saveInToken
+}
+func (v *optimizer) visitIgnore(ope *ignore) {
+	v.ope = Ign(v.optimize(ope.ope))
+}
+func (v *optimizer) visitThrow(ope *throw) {
+	v.ope = Thr(v.optimize(ope.ope), ope.label, ope.recovery)
+}
+func (v *optimizer) visitCapture(ope *capture) {
+	v.ope = Cap(v.optimize(ope.ope), ope.name)
+}
+
+func mergeLiterals(opes []operator) (merged []operator) {
+	for _, o := range opes {
+		if lit, ok := o.(*literalString); ok && len(merged) > 0 {
+			prev, ok := merged[len(merged)-1].(*literalString)
+			if ok && prev.ignoreCase == lit.ignoreCase {
+				merged[len(merged)-1] = joinLiterals(prev, lit)
+				continue
+			}
+		}
+		merged = append(merged, o)
+	}
+	return
+}
+
+func joinLiterals(a *literalString, b *literalString) *literalString {
+	o := newLiteral(a.lit+b.lit, a.ignoreCase)
+	for _, lit := range []*literalString{a, b} {
+		if lit.parts != nil {
+			o.parts = append(o.parts, lit.parts...)
+		} else {
+			o.parts = append(o.parts, lit)
+		}
+	}
+	return o
+}
+
+// Choice index
+type choiceIndex struct {
+	leaves []operator
+	trie   *trieNode
+	maxLen int
+	ranges []classRange
+	any    uint64
+}
+
+// Trie of literal alternatives
+type trieNode struct {
+	next map[byte]*trieNode
+	ends uint64
+}
+
+// Character class alternatives matching the runes in [lo, hi]
+type classRange struct {
+	lo   rune
+	hi   rune
+	alts uint64
+}
+
+// Index a choice of at most 64 case-sensitive literals, character classes and dots
+func newChoiceIndex(opes []operator) *choiceIndex {
+	if len(opes) < 2 || len(opes) > 64 {
+		return nil
+	}
+
+	ix := &choiceIndex{leaves: opes}
+	var classes []*characterClass
+	var classIds []int
+	for id, ope := range opes {
+		bit := uint64(1) << uint(id)
+		switch o := ope.(type) {
+		case *literalString:
+			if o.ignoreCase {
+				return nil
+			}
+			if ix.trie == nil {
+				ix.trie = &trieNode{}
+			}
+			n := ix.trie
+			for i := 0; i < len(o.lit); i++ {
+				if n.next == nil {
+					n.next = make(map[byte]*trieNode)
+				}
+				ch := o.lit[i]
+				if n.next[ch] == nil {
+					n.next[ch] = &trieNode{}
+				}
+				n = n.next[ch]
+			}
+			n.ends |= bit
+			if len(o.lit) > ix.maxLen {
+				ix.maxLen = len(o.lit)
+			}
+		case *characterClass:
+			// Bytes are not runes of the index
+			if o.bytes != nil {
+				return nil
+			}
+			classes = append(classes, o)
+			classIds = append(classIds, id)
+		case *anyCharacter:
+			ix.any |= bit
+		default:
+			return nil
+		}
+	}
+	ix.ranges = mergeClasses(classes, classIds)
+	return ix
+}
+
+// Merge character classes into disjoint ranges
+func mergeClasses(classes []*characterClass, ids []int) (ranges []classRange) {
+	if len(classes) == 0 {
+		return nil
+	}
+
+	// Membership only changes at these runes
+	points := []rune{0, unicode.MaxRune + 1}
+	for _, o := range classes {
+		for _, rg := range o.ranges {
+			if rg.lo <= rg.hi {
+				points = append(points, rg.lo, rg.hi+1)
+			}
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+
+	for i := 0; i+1 < len(points); i++ {
+		lo, hi := points[i], points[i+1]-1
+		if lo > hi {
+			continue
+		}
+		var alts uint64
+		for j, o := range classes {
+			if o.contains(lo) {
+				alts |= uint64(1) << uint(ids[j])
+			}
+		}
+		if alts == 0 {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].alts == alts && ranges[n-1].hi+1 == lo {
+			ranges[n-1].hi = hi
+		} else {
+			ranges = append(ranges, classRange{lo, hi, alts})
+		}
+	}
+	return
+}
+
+// Alternatives whose first operator matches at p
+func (ix *choiceIndex) match(in *input, p int) (alts uint64) {
+	if ix.trie != nil {
+		in.fill(p, p+ix.maxLen)
+		n := ix.trie
+		alts |= n.ends
+		for i := p; i < in.end() && n.next != nil; i++ {
+			if n = n.next[in.byteAt(i)]; n == nil {
+				break
+			}
+			alts |= n.ends
+		}
+	}
+	if (ix.ranges != nil || ix.any != 0) && !in.atEnd(p) {
+		alts |= ix.any
+		ch, _ := in.decodeRune(p)
+		i := sort.Search(len(ix.ranges), func(i int) bool { return ix.ranges[i].hi >= ch })
+		if i < len(ix.ranges) && ix.ranges[i].lo <= ch {
+			alts |= ix.ranges[i].alts
+		}
+	}
+	return
+}
+
+// Report an alternative that doesn't match
+func (ix *choiceIndex) expect(c *context, p int, id int) {
+	switch o := ix.leaves[id].(type) {
+	case *literalString:
+		o.expect(c, p)
+	case *characterClass:
+		c.addExpected(p, o.describe())
+	case *anyCharacter:
+		c.addExpected(p, "any character")
+	}
+}
+
+// terminalChecker
+type terminalChecker struct {
+	*visitorBase
+	nonTerminal bool
+	choice      bool
+}
+
+func (v *terminalChecker) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *terminalChecker) visitPrioritizedChoice(ope *prioritizedChoice) {
+	v.choice = true
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *terminalChecker) visitZeroOrMore(ope *zeroOrMore)       { ope.ope.accept(v) }
+func (v *terminalChecker) visitOneOrMore(ope *oneOrMore)         { ope.ope.accept(v) }
+func (v *terminalChecker) visitOption(ope *option)               { ope.ope.accept(v) }
+func (v *terminalChecker) visitAndPredicate(ope *andPredicate)   { ope.ope.accept(v) }
+func (v *terminalChecker) visitNotPredicate(ope *notPredicate)   { ope.ope.accept(v) }
+func (v *terminalChecker) visitTokenBoundary(ope *tokenBoundary) { v.nonTerminal = true }
+func (v *terminalChecker) visitIgnore(ope *ignore)               { v.nonTerminal = true }
+func (v *terminalChecker) visitUser(ope *user)                   { v.nonTerminal = true }
+func (v *terminalChecker) visitReference(ope *reference)         { v.nonTerminal = true }
+func (v *terminalChecker) visitRule(ope *Rule)                   { v.nonTerminal = true }
+func (v *terminalChecker) visitWhitespace(ope *whitespace)       { v.nonTerminal = true }
+func (v *terminalChecker) visitExpression(ope *expression)       { v.nonTerminal = true }
+func (v *terminalChecker) visitCut(ope *cut)                     { v.nonTerminal = true }
+func (v *terminalChecker) visitThrow(ope *throw)                 { v.nonTerminal = true }
+func (v *terminalChecker) visitCapture(ope *capture)             { v.nonTerminal = true }
+
+// cutChecker
+type cutChecker struct {
+	*visitorBase
+	hasCut bool
+}
+
+// Whether a cut in an expression can commit the enclosing choice. Cuts in
+// other rules only commit the choices of those rules.
+func hasCut(ope operator) bool {
+	v := &cutChecker{}
+	if cho, ok := ope.(*prioritizedChoice); ok {
+		for _, o := range cho.opes {
+			o.accept(v)
+		}
+	} else {
+		ope.accept(v)
+	}
+	return v.hasCut
+}
+
+func (v *cutChecker) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *cutChecker) visitOneOrMore(ope *oneOrMore)         { ope.ope.accept(v) }
+func (v *cutChecker) visitTokenBoundary(ope *tokenBoundary) { ope.ope.accept(v) }
+func (v *cutChecker) visitIgnore(ope *ignore)               { ope.ope.accept(v) }
+func (v *cutChecker) visitExpression(ope *expression)       { ope.atom.accept(v) }
+func (v *cutChecker) visitCut(ope *cut)                     { v.hasCut = true }
+func (v *cutChecker) visitCapture(ope *capture)             { ope.ope.accept(v) }
+func (v *cutChecker) visitThrow(ope *throw)                 { ope.ope.accept(v) }
@@ -0,0 +1,270 @@
+package peg
+
+import (
+	gocontext "context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOptimizeFlattenAndMerge(t *testing.T) {
+	parser, _ := NewParser(`
+        A <- 'a' ('b' / ('c' / 'd')) ('e' 'f')
+        B <- < 'x' 'y' [0-9] > 'z'
+        C <- [a-c] / [b-d] / .
+        %whitespace <- [ \t]*
+    `)
+
+	g := parser.Grammar
+
+	seq, ok := g["A"].Ope.(*sequence)
+	assert(t, ok && len(seq.opes) == 4)
+	cho, ok := seq.opes[1].(*prioritizedChoice)
+	assert(t, ok && len(cho.opes) == 3)
+	assert(t, reflect.DeepEqual(cho.choices, []int{0, 1, 1}))
+	assert(t, cho.index != nil)
+
+	// Literals outside token boundaries skip whitespace on their own
+	_, ok = seq.opes[2].(*literalString)
+	assert(t, ok)
+
+	seq, ok = g["B"].Ope.(*sequence)
+	assert(t, ok && len(seq.opes) == 2)
+	tok := seq.opes[0].(*tokenBoundary)
+	lit := tok.ope.(*sequence).opes[0].(*literalString)
+	assert(t, lit.lit == "xy" && len(lit.parts) == 2)
+
+	cho = g["C"].Ope.(*prioritizedChoice)
+	assert(t, cho.index != nil)
+	assert(t, reflect.DeepEqual(cho.index.ranges, []classRange{
+		{'a', 'a', 1}, {'b', 'c', 3}, {'d', 'd', 2},
+	}))
+	assert(t, cho.index.any == 4)
+}
+
+func TestOptimizeOption(t *testing.T) {
+	parser, _ := NewParser(`
+        A <- 'a' ('b' / 'c')
+        ---
+        %optimize = false
+    `)
+
+	cho := parser.Grammar["A"].Ope.(*sequence).opes[1].(*prioritizedChoice)
+	assert(t, cho.index == nil)
+}
+
+func TestOptimizeOptionWithRules(t *testing.T) {
+	off := map[string][]string{OptOptimize: {"false"}}
+	inputs := []string{"a1,b22,c", "a1,", "x1", "b1,a"}
+
+	// Options replace the options section of the grammar
+	grammar := `
+        LIST <- ITEM (',' ITEM)*
+        ITEM <- ('a' / 'b' / 'c') NUM?
+        ---
+        %optimize = true
+    `
+	userRules := map[string]operator{"NUM": Oom(Cls("0-9"))}
+	for _, setup := range []func(p *Parser){traceActions("LIST", "ITEM"), func(p *Parser) { p.EnableAst() }} {
+		var parsers []*Parser
+		for _, options := range []map[string][]string{nil, off} {
+			parser, err := NewParserWithOptions(grammar, userRules, options)
+			assert(t, err == nil)
+			setup(parser)
+			parsers = append(parsers, parser)
+		}
+		assert(t, parsers[0].Grammar["ITEM"].Ope.(*sequence).opes[0].(*prioritizedChoice).index != nil)
+		assert(t, parsers[1].Grammar["ITEM"].Ope.(*sequence).opes[0].(*prioritizedChoice).index == nil)
+		compareParsers(t, parsers[0], parsers[1], inputs)
+	}
+
+	// Rules are modified by the optimizer, so each parser gets its own
+	rules := func() []*Rule {
+		return []*Rule{
+			{Name: "LIST", Ope: Seq(Ref("ITEM", nil, 0), Zom(Seq(Lit(","), Ref("ITEM", nil, 0))))},
+			{Name: "ITEM", Ope: Seq(Cho(Lit("a"), Lit("b"), Lit("c")), Opt(Ref("NUM", nil, 0)))},
+			{Name: "NUM", Ope: Oom(Cls("0-9"))},
+		}
+	}
+	for _, setup := range []func(p *Parser){traceActions("LIST", "ITEM"), func(p *Parser) { p.EnableAst() }} {
+		var parsers []*Parser
+		for _, options := range []map[string][]string{nil, off} {
+			parser, err := NewParserWithRules(rules(), options)
+			assert(t, err == nil)
+			setup(parser)
+			parsers = append(parsers, parser)
+		}
+		assert(t, parsers[0].Grammar["NUM"].trivial && !parsers[1].Grammar["NUM"].trivial)
+		compareParsers(t, parsers[0], parsers[1], inputs)
+	}
+}
+
+func TestOptimizeKeepsCutInNestedChoice(t *testing.T) {
+	parser, _ := NewParser(`
+        S <- ('a' ↑ 'b' / 'a') / 'ac'
+    `)
+
+	cho := parser.Grammar["S"].Ope.(*prioritizedChoice)
+	assert(t, len(cho.opes) == 2)
+
+	assert(t, parser.Parse("ab", nil) == nil)
+	assert(t, parser.Parse("ac", nil) == nil)
+}
+
+// Parse the same inputs with and without optimization
+func checkOptimizedParser(t *testing.T, grammar string, inputs []string, setup func(p *Parser)) {
+	var parsers []*Parser
+	for _, s := range []string{grammar, grammar + "\n---\n%optimize = false\n"} {
+		parser, err := NewParser(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if setup != nil {
+			setup(parser)
+		}
+		parsers = append(parsers, parser)
+	}
+	compareParsers(t, parsers[0], parsers[1], inputs)
+}
+
+// Values, traces and errors of the first parser must match the second
+func compareParsers(t *testing.T, p *Parser, want *Parser, inputs []string) {
+	for _, s := range inputs {
+		var vals []Any
+		var errs []*Error
+		for _, parser := range []*Parser{p, want} {
+			var trace []string
+			val, err := parser.ParseAndGetValue(s, &trace)
+			if ast, ok := val.(*Ast); ok {
+				val = ast.String()
+			}
+			vals = append(vals, []Any{val, strings.Join(trace, "\n")})
+			errs = append(errs, err)
+		}
+		if !reflect.DeepEqual(vals[0], vals[1]) {
+			t.Errorf("%q:\ngot      %v\nexpected %v", s, vals[0], vals[1])
+		}
+		if !reflect.DeepEqual(errs[0], errs[1]) {
+			t.Errorf("%q:\ngot      %v\nexpected %v", s, errs[0], errs[1])
+		}
+	}
+}
+
+// Record the values each rule sees
+func traceActions(names ...string) func(p *Parser) {
+	return func(p *Parser) {
+		for _, name := range names {
+			name := name
+			p.Grammar[name].Action = func(v *Values, d Any) (Any, error) {
+				trace := d.(*[]string)
+				*trace = append(*trace, fmt.Sprintf("%s %d %v %q %v", name, v.Choice, v.Vs, v.S, v.Ts))
+				return name, nil
+			}
+		}
+	}
+}
+
+func TestOptimizedParserMatches(t *testing.T) {
+	grammar := `
+        STATEMENT  <- (KEYWORD / OP / ID / NUM / SEP)*
+        KEYWORD    <- ('if' / 'then' / ('else' / 'elif') / 'end') !ID
+        OP         <- '=' '=' / '=' / '<' '-' / '<' / '-'
+        ID         <- < [a-z] ([a-z] / [0-9] / [_])* >
+        NUM        <- < '0' 'x' [0-9a-f]+ / [0-9]+ >
+        SEP        <- ';' / ','
+        %whitespace <- [ \t]*
+    `
+	inputs := []string{
+		"",
+		"if a == b then c <- 1 elif d end",
+		"if x = 0x1f; else y - 2, end",
+		"ifx = 0x",
+		"a == = <- <",
+		"if a ?",
+		"0xg",
+		"else elif",
+	}
+
+	checkOptimizedParser(t, grammar, inputs, nil)
+	checkOptimizedParser(t, grammar, inputs, traceActions("STATEMENT", "KEYWORD", "OP", "ID", "NUM"))
+	checkOptimizedParser(t, grammar, inputs, func(p *Parser) { p.EnableAst() })
+}
+
+func TestOptimizedParserMatchesWithWord(t *testing.T) {
+	grammar := `
+        STATEMENTS <- (STATEMENT ';')*
+        STATEMENT  <- 'let'i ↑ ID '=' VALUE / 'print' ('(' VALUE ')' / VALUE) / ID
+        VALUE      <- 'true' / 'false' / 'null' / ID / [0-9]+
+        ID         <- < !('let' / 'print') [a-z]+ >
+        %whitespace <- [ \t\n]*
+        %word       <- [a-z]+
+    `
+	inputs := []string{
+		"let x = true; print (x); print null;",
+		"letx = 1;",
+		"print letter; print truex;",
+		"let = 1;",
+		"print (1;",
+		"x; y; print 12",
+	}
+
+	checkOptimizedParser(t, grammar, inputs, nil)
+	checkOptimizedParser(t, grammar, inputs, traceActions("STATEMENTS", "STATEMENT", "VALUE", "ID"))
+	checkOptimizedParser(t, grammar, inputs, func(p *Parser) { p.EnableAst() })
+}
+
+func TestOptimizeInlinesTrivialRules(t *testing.T) {
+	grammar := `
+        LIST  <- ITEM (COMMA ITEM)* END
+        ITEM  <- [a-z]+
+        COMMA <- ','
+        ~END  <- '.'
+    `
+	inputs := []string{"a,b,c.", "a,b,", "a;b."}
+
+	checkOptimizedParser(t, grammar, inputs, traceActions("LIST"))
+	checkOptimizedParser(t, grammar, inputs, traceActions("LIST", "ITEM"))
+
+	// The optimizer gives the references to trivial rules a slot
+	parser, _ := NewParser(grammar)
+	assert(t, parser.Grammar["COMMA"].trivial)
+	assert(t, len(parser.inlined) == 3)
+	slots := make(map[string]int)
+	parser.Grammar["LIST"].Ope.accept(&referenceWalker{reference: func(ope *reference) {
+		slots[ope.name] = ope.inline
+		assert(t, ope.inline > 0 && parser.inlined[ope.inline-1] == ope.rule)
+	}})
+	assert(t, len(slots) == 3)
+
+	inline := func() []bool {
+		_, c := parser.newContext(gocontext.Background(), newStringInput(""))
+		return c.inline
+	}
+	assert(t, reflect.DeepEqual(inline(), []bool{true, true, true}))
+
+	// Handlers set after the grammar is optimized are called
+
+	count := 0
+	parser.Grammar["COMMA"].Enter = func(d Any) { count++ }
+	assert(t, parser.Parse("a,b,c.", nil) == nil)
+	assert(t, count == 3)
+	assert(t, !inline()[slots["COMMA"]-1] && inline()[slots["ITEM"]-1])
+
+	parser.Grammar["ITEM"].Message = func() string { return "item expected" }
+	err := parser.Parse("a,.", nil)
+	assert(t, err != nil && err.Details[0].Msg == "item expected")
+}
+
+func TestOptimizeInlinesNothingWhenTraced(t *testing.T) {
+	parser, _ := NewParser(`
+        LIST  <- ITEM (',' ITEM)*
+        ITEM  <- [a-z]+
+    `)
+	var names []string
+	parser.TracerEnter = func(name string, s string, v *Values, d Any, p int) {
+		names = append(names, name)
+	}
+	assert(t, parser.Parse("a,b", nil) == nil)
+	assert(t, strings.Count(strings.Join(names, " "), "ITEM") == 2)
+}
@@ -0,0 +1,301 @@
+package peg
+
+// Packrat parsing statistics
+type PackratStats struct {
+	Hits   int
+	Misses int
+}
+
+// Memoization
+type memoKey struct {
+	rule         *Rule
+	pos          int
+	inToken      bool
+	inWhitespace bool
+}
+
+type memoEntry struct {
+	l           int
+	vs          []Any
+	ts          []Token
+	errState    errorState
+	messagePos  int
+	messageLoc  location
+	messageRule string
+	messageErr  error
+	message     string
+	token       string
+	errors      []errorRecord
+	label       string
+	labelPos    int
+	labelLoc    location
+	labelRule   string
+}
+
+func (c *context) setPackrat(on bool) {
+	c.packrat = on
+	c.memo = nil
+	c.in.onDiscard = nil
+	if on {
+		c.memo = make(map[memoKey]*memoEntry)
+		c.in.onDiscard = c.dropMemo
+	}
+}
+
+func (c *context) memoize(r *Rule, p int, v *Values, d Any) int {
+	key := memoKey{r, p, c.inToken, c.inWhitespace}
+	if l, ok := c.recall(key, v); ok {
+		return l
+	}
+
+	vsLen := len(v.Vs)
+	tsLen := len(v.Ts)
+	errorsLen := len(c.errors)
+
+	l := r.parseRule(p, v, c, d)
+	c.remember(key, l, v, vsLen, tsLen, errorsLen)
+	return l
+}
+
+// Replay the result of a rule that was already parsed at a position
+func (c *context) recall(key memoKey, v *Values) (int, bool) {
+	e, ok := c.memo[key]
+	if !ok {
+		c.packratStats.Misses++
+		return 0, false
+	}
+	c.packratStats.Hits++
+	v.Vs = append(v.Vs, e.vs...)
+	v.Ts = append(v.Ts, e.ts...)
+	c.mergeError(e.errState)
+	if c.messagePos < e.messagePos {
+		c.messagePos = e.messagePos
+		c.messageLoc = e.messageLoc
+		c.messageRule = e.messageRule
+		c.messageErr = e.messageErr
+		c.message = e.message
+	}
+	c.lastToken = e.token
+	c.errors = append(c.errors, e.errors...)
+	if len(e.label) > 0 {
+		c.label = e.label
+		c.labelPos = e.labelPos
+		c.labelLoc = e.labelLoc
+		c.labelRule = e.labelRule
+	}
+	return e.l, true
+}
+
+// Store the result of a rule, given the lengths of the values and the errors
+// before it was parsed
+func (c *context) remember(key memoKey, l int, v *Values, vsLen, tsLen, errorsLen int) {
+	// Results depending on a growing seed are not final yet
+	if len(c.seeds) > 0 {
+		return
+	}
+
+	c.memo[key] = &memoEntry{
+		l:           l,
+		vs:          append([]Any(nil), v.Vs[vsLen:]...),
+		ts:          append([]Token(nil), v.Ts[tsLen:]...),
+		errState:    errorState{c.errorPos, c.errorLoc, c.errorRule, append([]string(nil), c.expected...)},
+		messagePos:  c.messagePos,
+		messageLoc:  c.messageLoc,
+		messageRule: c.messageRule,
+		messageErr:  c.messageErr,
+		message:     c.message,
+		token:       c.lastToken,
+		errors:      append([]errorRecord(nil), c.errors[errorsLen:]...),
+		label:       c.label,
+		labelPos:    c.labelPos,
+		labelLoc:    c.labelLoc,
+		labelRule:   c.labelRule,
+	}
+}
+
+// Drop memo entries for positions that a cut made unreachable
+func (c *context) dropMemo(floor int) {
+	if floor <= c.memoFloor {
+		return
+	}
+	c.memoFloor = floor
+	for k := range c.memo {
+		if k.pos < floor {
+			delete(c.memo, k)
+		}
+	}
+}
+
+// Result of a left recursive rule at a position. lr is set while the rule is
+// evaluated for the first time, and while it's involved in the recursion of
+// another rule that is still growing its seed.
+type seedEntry struct {
+	*memoEntry
+	lr *leftRecursion
+}
+
+// Left recursive rule on the stack of rules evaluated for the first time
+type leftRecursion struct {
+	rule *Rule
+	head *recursionHead
+	next *leftRecursion
+}
+
+// Rule that grows the seed of a recursion at a position, the rules involved
+// in the recursion and the ones that are still to be evaluated again in the
+// current iteration
+type recursionHead struct {
+	rule     *Rule
+	involved map[*Rule]bool
+	eval     map[*Rule]bool
+	done     bool
+}
+
+// Seed growing for left recursive rules, as in Warth et al., "Packrat Parsers
+// Can Support Left Recursion". The head of a recursion grows its seed, and
+// rules involved in it are evaluated again in each iteration, so mutually
+// recursive rules give the same result wherever the cycle is entered.
+func (c *context) growSeed(r *Rule, p int, v *Values, d Any) int {
+	key := memoKey{r, p, c.inToken, c.inWhitespace}
+
+	// Results are kept until the outermost left recursive rule returns
+	c.seedDepth++
+	defer func() {
+		c.seedDepth--
+		if c.seedDepth == 0 {
+			c.seeds = make(map[memoKey]*seedEntry)
+		}
+	}()
+
+	if e, ok := c.recallSeed(key, v, d); ok {
+		if e.lr != nil {
+			c.setupRecursion(e.lr)
+		}
+		return c.applySeed(e.memoEntry, v)
+	}
+
+	c.in.pin(p)
+	defer c.in.unpin()
+
+	// The rule fails where it recurses before it has a seed
+	lr := &leftRecursion{rule: r, next: c.recursions}
+	c.recursions = lr
+	e := &seedEntry{memoEntry: &memoEntry{l: -1}, lr: lr}
+	c.seeds[key] = e
+
+	e.memoEntry = c.evalSeed(r, p, v, d)
+	c.recursions = lr.next
+
+	if lr.head == nil {
+		// The rule didn't recurse
+		e.lr = nil
+		return c.applySeed(e.memoEntry, v)
+	}
+	if lr.head.rule != r {
+		// The head grows the seed with this rule
+		return c.applySeed(e.memoEntry, v)
+	}
+	e.lr = nil
+	defer func() { lr.head.done = true }()
+	if fail(e.l) {
+		return -1
+	}
+	return c.growRecursion(key, e, lr.head, v, d)
+}
+
+// The rules on the stack above the recursion belong to its head
+func (c *context) setupRecursion(lr *leftRecursion) {
+	if lr.head == nil {
+		lr.head = &recursionHead{rule: lr.rule, involved: make(map[*Rule]bool)}
+	}
+	for s := c.recursions; s != nil && s.head != lr.head; s = s.next {
+		s.head = lr.head
+		lr.head.involved[s.rule] = true
+	}
+}
+
+// Result of a rule at a position where a seed is growing. Rules that aren't
+// part of the recursion fail there, and involved rules are evaluated once in
+// each iteration.
+func (c *context) recallSeed(key memoKey, v *Values, d Any) (*seedEntry, bool) {
+	e, ok := c.seeds[key]
+	if ok && e.lr != nil && e.lr.head != nil && e.lr.head.done {
+		// An involved rule that the head didn't evaluate again has no
+		// result for the grown seed
+		ok = false
+	}
+	h := c.heads[memoKey{nil, key.pos, key.inToken, key.inWhitespace}]
+	if h == nil {
+		return e, ok
+	}
+	if !ok && h.rule != key.rule && !h.involved[key.rule] {
+		return &seedEntry{memoEntry: &memoEntry{l: -1}}, true
+	}
+	if ok && h.eval[key.rule] {
+		// An involved rule that also recurses into itself grows its own seed
+		// on top of the seed of the head
+		delete(h.eval, key.rule)
+		e.lr = nil
+		e.memoEntry = c.evalSeed(key.rule, key.pos, v, d)
+		for success(e.l) {
+			seed := c.evalSeed(key.rule, key.pos, v, d)
+			if fail(seed.l) || seed.l <= e.l {
+				break
+			}
+			e.memoEntry = seed
+		}
+	}
+	return e, ok
+}
+
+func (c *context) growRecursion(key memoKey, e *seedEntry, h *recursionHead, v *Values, d Any) int {
+	hkey := memoKey{nil, key.pos, key.inToken, key.inWhitespace}
+	c.heads[hkey] = h
+	for {
+		h.eval = make(map[*Rule]bool, len(h.involved))
+		for r := range h.involved {
+			h.eval[r] = true
+		}
+		seed := c.evalSeed(key.rule, key.pos, v, d)
+		if fail(seed.l) || seed.l <= e.l {
+			break
+		}
+		e.memoEntry = seed
+	}
+	delete(c.heads, hkey)
+
+	// A labeled failure can't be recovered by a shorter seed
+	if len(c.label) > 0 {
+		return -1
+	}
+	return c.applySeed(e.memoEntry, v)
+}
+
+// Evaluate the definition of a rule, and take its values back out of v
+func (c *context) evalSeed(r *Rule, p int, v *Values, d Any) *memoEntry {
+	vsLen := len(v.Vs)
+	tsLen := len(v.Ts)
+	errorsLen := len(c.errors)
+
+	e := &memoEntry{l: r.parseDefinition(p, v, c, d)}
+	if success(e.l) {
+		e.vs = append([]Any(nil), v.Vs[vsLen:]...)
+		e.ts = append([]Token(nil), v.Ts[tsLen:]...)
+		e.errors = append([]errorRecord(nil), c.errors[errorsLen:]...)
+		e.token = c.lastToken
+	}
+	v.Vs = v.Vs[:vsLen]
+	v.Ts = v.Ts[:tsLen]
+	c.errors = c.errors[:errorsLen]
+	return e
+}
+
+func (c *context) applySeed(e *memoEntry, v *Values) int {
+	if success(e.l) {
+		v.Vs = append(v.Vs, e.vs...)
+		v.Ts = append(v.Ts, e.ts...)
+		c.errors = append(c.errors, e.errors...)
+		c.lastToken = e.token
+	}
+	return e.l
+}
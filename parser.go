@@ -1,12 +1,21 @@
 package peg
 
-import "strings"
+import (
+	gocontext "context"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
 
 const (
 	WhitespceRuleName = "%whitespace"
 	WordRuleName      = "%word"
 	OptExpressionRule = "%expr"
 	OptBinaryOperator = "%binop"
+	OptLeftRecursion  = "%left_recursion"
+	OptOptimize       = "%optimize"
+	RecoverMacroName  = "%recover"
 )
 
 // PEG parser generator
@@ -15,27 +24,42 @@ type duplicate struct {
 	pos  int
 }
 
+// Option as written in the options section
+type optionDef struct {
+	name  string
+	value string
+	pos   int
+}
+
 type data struct {
 	grammar    map[string]*Rule
 	start      string
 	duplicates []duplicate
 	options    map[string][]string
+	optionDefs []optionDef
+	separator  int
+	comments   map[int]string
+	positions  map[operator]int
+	lint       bool // Repetitions that can match empty input are left to Lint
 }
 
 func newData() *data {
 	return &data{
-		grammar: make(map[string]*Rule),
-		options: make(map[string][]string),
+		grammar:   make(map[string]*Rule),
+		options:   make(map[string][]string),
+		separator: -1,
+		comments:  make(map[int]string),
+		positions: make(map[operator]int),
 	}
 }
 
 var rStart, rDefinition, rExpression,
 	rSequence, rPrefix, rSuffix, rPrimary,
 	rIdentifier, rIdentCont, rIdentStart, rIdentRest,
-	rLiteral, rClass, rRange, rChar,
-	rLEFTARROW, rSLASH, rAND, rNOT, rQUESTION, rSTAR, rPLUS, rOPEN, rCLOSE, rDOT,
+	rLiteral, rIgnoreCase, rIGNORECASE, rClass, rRange, rChar,
+	rLEFTARROW, rSLASH, rAND, rNOT, rQUESTION, rSTAR, rPLUS, rOPEN, rCLOSE, rDOT, rCUT,
 	rSpacing, rComment, rSpace, rEndOfLine, rEndOfFile, rBeginTok, rEndTok,
-	rIgnore, rIGNORE,
+	rIgnore, rIGNORE, rThrow, rTHROW, rLabel, rLABEL,
 	rParameters, rArguments, rCOMMA,
 	rOption, rOptionValue, rOptionComment, rASSIGN, rSEPARATOR Rule
 
@@ -53,8 +77,8 @@ func init() {
 
 	rExpression.Ope = Seq(&rSequence, Zom(Seq(&rSLASH, &rSequence)))
 	rSequence.Ope = Zom(&rPrefix)
-	rPrefix.Ope = Seq(Opt(Cho(&rAND, &rNOT)), &rSuffix)
-	rSuffix.Ope = Seq(&rPrimary, Opt(Cho(&rQUESTION, &rSTAR, &rPLUS)))
+	rPrefix.Ope = Seq(&rLabel, Opt(Cho(&rAND, &rNOT)), &rSuffix)
+	rSuffix.Ope = Seq(&rPrimary, Opt(Cho(&rQUESTION, &rSTAR, &rPLUS)), &rThrow)
 
 	rPrimary.Ope = Cho(
 		Seq(&rIgnore, &rIdentCont, &rArguments, Npd(&rLEFTARROW)),
@@ -63,25 +87,33 @@ func init() {
 		Seq(&rBeginTok, &rExpression, &rEndTok),
 		&rLiteral,
 		&rClass,
-		&rDOT)
+		&rDOT,
+		&rCUT)
 
 	rIdentifier.Ope = Seq(&rIdentCont, &rSpacing)
 	rIdentCont.Ope = Seq(&rIdentStart, Zom(&rIdentRest))
-	rIdentStart.Ope = Cls("a-zA-Z_\x80-\xff%")
+	rIdentStart.Ope = Seq(Npd(Cho(Lit("←"), Lit("↑"))), Cls("a-zA-Z_\u0080-\U0010ffff%"))
 	rIdentRest.Ope = Cho(&rIdentStart, Cls("0-9"))
 
 	rLiteral.Ope = Cho(
-		Seq(Lit("'"), Tok(Zom(Seq(Npd(Lit("'")), &rChar))), Lit("'"), &rSpacing),
-		Seq(Lit("\""), Tok(Zom(Seq(Npd(Lit("\"")), &rChar))), Lit("\""), &rSpacing))
+		Seq(Lit("'"), Tok(Zom(Seq(Npd(Lit("'")), &rChar))), Lit("'"), &rIgnoreCase, &rSpacing),
+		Seq(Lit("\""), Tok(Zom(Seq(Npd(Lit("\"")), &rChar))), Lit("\""), &rIgnoreCase, &rSpacing))
 
-	rClass.Ope = Seq(Lit("["), Tok(Zom(Seq(Npd(Lit("]")), &rRange))), Lit("]"), &rSpacing)
+	rIgnoreCase.Ope = Opt(&rIGNORECASE)
+	rIGNORECASE.Ope = Seq(Lit("i"), Npd(&rIdentRest))
+
+	rClass.Ope = Cho(
+		Seq(Lit("[^"), Tok(Zom(Seq(Npd(Lit("]")), &rRange))), Lit("]"), &rSpacing),
+		Seq(Lit("["), Tok(Zom(Seq(Npd(Lit("]")), &rRange))), Lit("]"), &rSpacing))
 
 	rRange.Ope = Cho(Seq(&rChar, Lit("-"), &rChar), &rChar)
 	rChar.Ope = Cho(
-		Seq(Lit("\\"), Cls("nrt'\"[]\\")),
+		Seq(Lit("\\"), Cls("nrt'\"[]\\^")),
 		Seq(Lit("\\"), Cls("0-3"), Cls("0-7"), Cls("0-7")),
 		Seq(Lit("\\"), Cls("0-7"), Opt(Cls("0-7"))),
 		Seq(Lit("\\x"), Cls("0-9a-fA-F"), Opt(Cls("0-9a-fA-F"))),
+		Seq(Lit("\\u{"), Oom(Cls("0-9a-fA-F")), Lit("}")),
+		Seq(Lit("\\u"), Cls("0-9a-fA-F"), Cls("0-9a-fA-F"), Cls("0-9a-fA-F"), Cls("0-9a-fA-F")),
 		Seq(Npd(Lit("\\")), Dot()))
 
 	rLEFTARROW.Ope = Seq(Cho(Lit("<-"), Lit("←")), &rSpacing)
@@ -97,6 +129,7 @@ func init() {
 	rCLOSE.Ope = Seq(Lit(")"), &rSpacing)
 	rCLOSE.Ignore = true
 	rDOT.Ope = Seq(Lit("."), &rSpacing)
+	rCUT.Ope = Seq(Cho(Lit("↑"), Seq(Lit("^"), Npd(&rIdentStart))), &rSpacing)
 
 	rSpacing.Ope = Zom(Cho(&rSpace, &rComment))
 	rComment.Ope = Seq(Lit("#"), Zom(Seq(Npd(&rEndOfLine), Dot())), &rEndOfLine)
@@ -114,6 +147,12 @@ func init() {
 
 	rIgnore.Ope = Opt(&rIGNORE)
 
+	rTHROW.Ope = Seq(Lit("^"), &rIdentCont, &rSpacing)
+	rThrow.Ope = Opt(&rTHROW)
+
+	rLABEL.Ope = Seq(&rIdentCont, Lit(":"), &rSpacing)
+	rLabel.Ope = Opt(&rLABEL)
+
 	rParameters.Ope = Seq(&rOPEN, &rIdentifier, Zom(Seq(&rCOMMA, &rIdentifier)), &rCLOSE)
 	rArguments.Ope = Seq(&rOPEN, &rExpression, Zom(Seq(&rCOMMA, &rExpression)), &rCLOSE)
 	rCOMMA.Ope = Seq(Lit(","), &rSpacing)
@@ -144,6 +183,14 @@ func init() {
 			ope = v.ToOpe(3)
 		}
 
+		// Recovery expression for a label
+		recovery := false
+		if name == RecoverMacroName && len(params) == 1 {
+			name = params[0]
+			params = nil
+			recovery = true
+		}
+
 		data := d.(*data)
 		_, ok := data.grammar[name]
 		if ok {
@@ -156,8 +203,9 @@ func init() {
 				Pos:        v.Pos,
 				Ignore:     ignore,
 				Parameters: params,
+				Recovery:   recovery,
 			}
-			if len(data.start) == 0 {
+			if len(data.start) == 0 && !recovery {
 				data.start = name
 			}
 		}
@@ -205,15 +253,20 @@ func init() {
 			}
 			val = Seq(opes...)
 		}
+
+		// Alternatives are placed by the formatter
+		if data, ok := d.(*data); ok {
+			data.positions[val.(operator)] = v.Pos
+		}
 		return
 	}
 
 	rPrefix.Action = func(v *Values, d Any) (val Any, err error) {
-		if len(v.Vs) == 1 {
-			val = v.ToOpe(0)
+		if len(v.Vs) == 2 {
+			val = v.ToOpe(1)
 		} else {
-			tok := v.ToStr(0)
-			ope := v.ToOpe(1)
+			tok := v.ToStr(1)
+			ope := v.ToOpe(2)
 			switch tok {
 			case "&":
 				val = Apd(ope)
@@ -221,12 +274,16 @@ func init() {
 				val = Npd(ope)
 			}
 		}
+
+		if label := v.ToStr(0); len(label) > 0 {
+			val = Cap(val.(operator), label)
+		}
 		return
 	}
 
 	rSuffix.Action = func(v *Values, d Any) (val Any, err error) {
 		ope := v.ToOpe(0)
-		if len(v.Vs) == 1 {
+		if len(v.Vs) == 2 {
 			val = ope
 		} else {
 			tok := v.ToStr(1)
@@ -239,6 +296,15 @@ func init() {
 				val = Oom(ope)
 			}
 		}
+
+		// Repetitions that can match empty input are reported
+		if data, ok := d.(*data); ok && val != ope {
+			data.positions[val.(operator)] = v.Pos
+		}
+
+		if label := v.ToStr(v.Len() - 1); len(label) > 0 {
+			val = Thr(val.(operator), label, nil)
+		}
 		return
 	}
 
@@ -273,11 +339,27 @@ func init() {
 	}
 
 	rLiteral.Action = func(v *Values, d Any) (Any, error) {
-		return Lit(resolveEscapeSequence(v.Ts[0].S)), nil
+		lit := resolveEscapeSequence(v.Ts[0].S)
+		if v.ToBool(v.Len() - 2) { // IgnoreCase is followed by Spacing
+			return LitI(lit), nil
+		}
+		return Lit(lit), nil
+	}
+
+	rIgnoreCase.Action = func(v *Values, d Any) (val Any, err error) {
+		val = len(v.Vs) != 0
+		return
 	}
 
 	rClass.Action = func(v *Values, d Any) (Any, error) {
-		return Cls(resolveEscapeSequence(v.Ts[0].S)), nil
+		chars := resolveEscapeSequence(v.Ts[0].S)
+		if _, _, err := parseRanges(chars); err != nil {
+			return nil, err
+		}
+		if v.Choice == 0 {
+			return NCls(chars), nil
+		}
+		return Cls(chars), nil
 	}
 
 	rAND.Action = func(v *Values, d Any) (Any, error) {
@@ -300,21 +382,62 @@ func init() {
 		return Dot(), nil
 	}
 
+	rCUT.Action = func(v *Values, d Any) (Any, error) {
+		return Cut(), nil
+	}
+
 	rIgnore.Action = func(v *Values, d Any) (val Any, err error) {
 		val = len(v.Vs) != 0
 		return
 	}
 
+	rThrow.Action = func(v *Values, d Any) (val Any, err error) {
+		val = ""
+		if len(v.Vs) != 0 {
+			val = v.ToStr(0)
+		}
+		return
+	}
+	rTHROW.Action = func(v *Values, d Any) (Any, error) {
+		return v.ToStr(0), nil
+	}
+
+	rLabel.Action = func(v *Values, d Any) (val Any, err error) {
+		val = ""
+		if len(v.Vs) != 0 {
+			val = v.ToStr(0)
+		}
+		return
+	}
+	rLABEL.Action = func(v *Values, d Any) (Any, error) {
+		return v.ToStr(0), nil
+	}
+
 	rOption.Action = func(v *Values, d Any) (val Any, err error) {
-		options := d.(*data).options
+		data := d.(*data)
 		optName := v.ToStr(0)
 		optVal := v.ToStr(2)
-		options[optName] = append(options[optName], optVal)
+		data.options[optName] = append(data.options[optName], optVal)
+		data.optionDefs = append(data.optionDefs, optionDef{optName, optVal, v.Pos})
 		return
 	}
 	rOptionValue.Action = func(v *Values, d Any) (Any, error) {
 		return v.Token(), nil
 	}
+
+	// Comments and the separator are kept for the formatter
+	rComment.Action = func(v *Values, d Any) (val Any, err error) {
+		if data, ok := d.(*data); ok {
+			data.comments[v.Pos] = strings.TrimRight(v.S, "\r\n")
+		}
+		return
+	}
+	rSEPARATOR.Action = func(v *Values, d Any) (val Any, err error) {
+		if data, ok := d.(*data); ok {
+			data.separator = v.Pos
+		}
+		return
+	}
 }
 
 func isHex(c byte) (v int, ok bool) {
@@ -365,6 +488,26 @@ func parseOctNumber(s string, i int) (byte, int) {
 	return byte(ret), i
 }
 
+func parseUnicodeEscape(s string, i int) (rune, int) {
+	ret := 0
+	if i < len(s) && s[i] == '{' {
+		i++
+		for i < len(s) && s[i] != '}' {
+			val, _ := isHex(s[i])
+			ret = ret*16 + val
+			i++
+		}
+		i++
+	} else {
+		for n := 0; n < 4 && i < len(s); n++ {
+			val, _ := isHex(s[i])
+			ret = ret*16 + val
+			i++
+		}
+	}
+	return rune(ret), i
+}
+
 func resolveEscapeSequence(s string) string {
 	n := len(s)
 	b := make([]byte, 0, n)
@@ -396,12 +539,19 @@ func resolveEscapeSequence(s string) string {
 			case ']':
 				b = append(b, ']')
 				i++
+			case '^':
+				b = append(b, '^')
+				i++
 			case '\\':
 				b = append(b, '\\')
 				i++
 			case 'x':
 				ch, i = parseHexNumber(s, i+1)
 				b = append(b, ch)
+			case 'u':
+				var r rune
+				r, i = parseUnicodeEscape(s, i+1)
+				b = utf8.AppendRune(b, r)
 			default:
 				ch, i = parseOctNumber(s, i)
 				b = append(b, ch)
@@ -454,24 +604,64 @@ func getExpressionParsingOptions(options map[string][]string) (name string, info
 	return
 }
 
+func getOptimizeOption(options map[string][]string) bool {
+	if vs, ok := options[OptOptimize]; ok {
+		return vs[len(vs)-1] != "false"
+	}
+	return true
+}
+
+func getLeftRecursionOption(options map[string][]string) bool {
+	if vs, ok := options[OptLeftRecursion]; ok {
+		return vs[len(vs)-1] == "true"
+	}
+	return false
+}
+
 // Parser
 type Parser struct {
-	Grammar     map[string]*Rule
-	start       string
-	TracerEnter func(name string, s string, v *Values, d Any, p int)
-	TracerLeave func(name string, s string, v *Values, d Any, p int, l int)
+	Grammar      map[string]*Rule
+	start        string
+	options      map[string][]string
+	packrat      bool
+	TracerEnter  func(name string, s string, v *Values, d Any, p int)
+	TracerLeave  func(name string, s string, v *Values, d Any, p int, l int)
+	PackratStats func(stats PackratStats)
+	Limits       Limits
+
+	inlined []*Rule // Trivial rules inlined by the optimizer
 }
 
 func NewParser(s string) (p *Parser, err *Error) {
 	return NewParserWithUserRules(s, nil)
 }
 
+// NewParser with the error as an error interface, which is nil on success
+func NewParserErr(s string) (*Parser, error) {
+	p, err := NewParser(s)
+	return p, err.Err()
+}
+
 func NewParserWithUserRules(s string, rules map[string]operator) (p *Parser, err *Error) {
-	data := newData()
+	return NewParserWithOptions(s, rules, nil)
+}
 
+// NewParserWithUserRules with options that replace the values of the options
+// section of the grammar, such as OptOptimize set to "false" to keep the
+// operators as written
+func NewParserWithOptions(s string, rules map[string]operator, options map[string][]string) (p *Parser, err *Error) {
+	return parseGrammar(s, newData(), rules, options, true)
+}
+
+func newParser(s string, rules map[string]operator, optimize bool) (p *Parser, err *Error) {
+	return parseGrammar(s, newData(), rules, nil, optimize)
+}
+
+// Parser of a grammar, which records what it parses in data
+func parseGrammar(s string, data *data, rules map[string]operator, options map[string][]string, optimize bool) (p *Parser, err *Error) {
 	_, _, err = rStart.Parse(s, data)
 	if err != nil {
-		return nil, err
+		return nil, grammarSyntaxError(err)
 	}
 
 	// User provided rules
@@ -492,15 +682,40 @@ func NewParserWithUserRules(s string, rules map[string]operator) (p *Parser, err
 		}
 	}
 
-	// Check duplicated definitions
-	if len(data.duplicates) > 0 {
-		err = &Error{}
-		for _, dup := range data.duplicates {
-			ln, col := lineInfo(s, dup.pos)
-			msg := "'" + dup.name + "' is already defined."
-			err.Details = append(err.Details, ErrorDetail{ln, col, msg})
+	for name, vs := range options {
+		data.options[name] = vs
+	}
+
+	return buildParser(s, data, optimize)
+}
+
+// Parser of rules that are built with the operator functions, as in generated
+// parsers. References are linked by name, the first rule that is not a
+// recovery expression is the start rule and the options are the values of the
+// options section of grammar text.
+func NewParserWithRules(rules []*Rule, options map[string][]string) (p *Parser, err *Error) {
+	data := newData()
+	for _, r := range rules {
+		if _, ok := data.grammar[r.Name]; ok {
+			data.duplicates = append(data.duplicates, duplicate{r.Name, r.Pos})
+			continue
+		}
+		data.grammar[r.Name] = r
+		if len(data.start) == 0 && !r.Recovery {
+			data.start = r.Name
 		}
 	}
+	for name, vs := range options {
+		data.options[name] = vs
+	}
+	return buildParser("", data, true)
+}
+
+// Check and link the rules of a grammar. s is the grammar text that error
+// positions refer to.
+func buildParser(s string, data *data, optimize bool) (p *Parser, err *Error) {
+	// Check duplicated definitions
+	err = duplicateError(s, data.duplicates)
 
 	// Check missing definitions
 	for _, r := range data.grammar {
@@ -510,19 +725,14 @@ func NewParserWithUserRules(s string, rules map[string]operator) (p *Parser, err
 			errorPos: make(map[string]int),
 			errorMsg: make(map[string]string),
 		}
-		r.accept(v)
+		v.check(r)
 		for name, pos := range v.errorPos {
-			if err == nil {
-				err = &Error{}
-			}
-			ln, col := lineInfo(s, pos)
-			msg := v.errorMsg[name]
-			err.Details = append(err.Details, ErrorDetail{ln, col, msg})
+			err = addGrammarError(err, s, pos, r.Name, v.errorMsg[name])
 		}
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, sortGrammarError(err)
 	}
 
 	// Link references
@@ -531,10 +741,11 @@ func NewParserWithUserRules(s string, rules map[string]operator) (p *Parser, err
 			parameters: r.Parameters,
 			grammar:    data.grammar,
 		}
-		r.accept(v)
+		v.link(r)
 	}
 
 	// Check left recursion
+	leftRecursion := getLeftRecursionOption(data.options)
 	for name, r := range data.grammar {
 		v := &detectLeftRecursion{
 			pos:    -1,
@@ -545,17 +756,31 @@ func NewParserWithUserRules(s string, rules map[string]operator) (p *Parser, err
 		}
 		r.accept(v)
 		if v.pos != -1 {
-			if err == nil {
-				err = &Error{}
+			if leftRecursion && r.Parameters == nil {
+				r.LeftRecursive = true
+				continue
+			}
+			err = addGrammarError(err, s, v.pos, name, "'"+name+"' is left recursive.")
+		}
+	}
+
+	if err != nil {
+		return nil, sortGrammarError(err)
+	}
+
+	// Check repetitions that can match empty input, which Lint reports as
+	// warnings instead
+	if !data.lint {
+		v := newDetectEmptyLoop()
+		for _, r := range data.grammar {
+			for _, ope := range v.find(r.Ope) {
+				err = addGrammarError(err, s, data.loopPos(ope), r.Name, emptyLoopMessage(ope))
 			}
-			ln, col := lineInfo(s, v.pos)
-			msg := "'" + name + "' is left recursive."
-			err.Details = append(err.Details, ErrorDetail{ln, col, msg})
 		}
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, sortGrammarError(err)
 	}
 
 	// Automatic whitespace skipping
@@ -571,24 +796,126 @@ func NewParserWithUserRules(s string, rules map[string]operator) (p *Parser, err
 	p = &Parser{
 		Grammar: data.grammar,
 		start:   data.start,
+		options: data.options,
 	}
 
 	// Setup expression parsing
 	name, info := getExpressionParsingOptions(data.options)
 	err = EnableExpressionParsing(p, name, info)
 
+	// Optimize operators
+	if err == nil && optimize && getOptimizeOption(data.options) {
+		p.inlined = optimizeGrammar(p.Grammar)
+	}
+
 	return
 }
 
+// Position of a repetition, or of the macro reference whose arguments make it
+// match empty input
+func (data *data) loopPos(ope operator) int {
+	if ref, ok := ope.(*reference); ok {
+		return ref.pos
+	}
+	return data.positions[ope]
+}
+
+func emptyLoopMessage(ope operator) string {
+	return "the repeated expression in " + formatOperator(ope) + " can match empty input."
+}
+
+func duplicateError(s string, duplicates []duplicate) (err *Error) {
+	for _, dup := range duplicates {
+		err = addGrammarError(err, s, dup.pos, dup.name, "'"+dup.name+"' is already defined.")
+	}
+	return
+}
+
+// Add a detail at pos of the grammar text s to a grammar error, which is
+// created if err is nil
+func addGrammarError(err *Error, s string, pos int, rule string, msg string) *Error {
+	if err == nil {
+		err = &Error{Kind: GrammarError}
+	}
+	ln, col := lineInfo(s, pos)
+	err.Details = append(err.Details, ErrorDetail{Ln: ln, Col: col, Msg: msg, Pos: pos, Rule: rule, Kind: GrammarError})
+	return err
+}
+
+// Details of checks that visit the rules in map order are sorted by position
+func sortGrammarError(err *Error) *Error {
+	sort.SliceStable(err.Details, func(i, j int) bool { return err.Details[i].Pos < err.Details[j].Pos })
+	return err
+}
+
+// Syntax error of the grammar text. The rules of its details are the rules of
+// the PEG grammar, which are not reported.
+func grammarSyntaxError(err *Error) *Error {
+	err.Kind = GrammarError
+	for i := range err.Details {
+		err.Details[i].Kind = GrammarError
+		err.Details[i].Rule = ""
+	}
+	return err
+}
+
 func (p *Parser) Parse(s string, d Any) (err *Error) {
 	_, err = p.ParseAndGetValue(s, d)
 	return
 }
 
 func (p *Parser) ParseAndGetValue(s string, d Any) (val Any, err *Error) {
-	r := p.Grammar[p.start]
-	r.TracerEnter = p.TracerEnter
-	r.TracerLeave = p.TracerLeave
-	_, val, err = r.Parse(s, d)
+	return p.ParseContext(gocontext.Background(), s, d)
+}
+
+// Parse with the error as an error interface, which is nil on success
+func (p *Parser) ParseErr(s string, d Any) error {
+	return p.Parse(s, d).Err()
+}
+
+// ParseAndGetValue with the error as an error interface, which is nil on success
+func (p *Parser) ParseAndGetValueErr(s string, d Any) (Any, error) {
+	val, err := p.ParseAndGetValue(s, d)
+	return val, err.Err()
+}
+
+func (p *Parser) ParseContext(ctx gocontext.Context, s string, d Any) (val Any, err *Error) {
+	r, c := p.newContext(ctx, newStringInput(s))
+	c.s = s
+	_, val, err = r.parseInput(c, d)
+	return
+}
+
+func (p *Parser) ParseReader(rd io.Reader, d Any) (val Any, err *Error) {
+	return p.ParseReaderContext(gocontext.Background(), rd, d)
+}
+
+func (p *Parser) ParseReaderContext(ctx gocontext.Context, rd io.Reader, d Any) (val Any, err *Error) {
+	r, c := p.newContext(ctx, newReaderInput(rd))
+	_, val, err = r.parseInput(c, d)
 	return
 }
+
+// Parser settings go to the context so that the shared start rule is not modified
+func (p *Parser) newContext(ctx gocontext.Context, in *input) (*Rule, *context) {
+	r := p.Grammar[p.start]
+	c := r.newContext(ctx, in)
+	c.tracerEnter = p.TracerEnter
+	c.tracerLeave = p.TracerLeave
+	c.packratStatsFn = p.PackratStats
+	c.limits = p.Limits
+	c.setPackrat(p.packrat)
+
+	// Traced rules and rules with handlers are parsed as rules
+	if len(p.inlined) > 0 && c.tracerEnter == nil && c.tracerLeave == nil {
+		c.inline = make([]bool, len(p.inlined))
+		for i, r := range p.inlined {
+			c.inline[i] = !r.hasHandlers()
+		}
+	}
+	return r, c
+}
+
+func (p *Parser) EnablePackratParsing() {
+	p.packrat = true
+}
@@ -1,10 +1,16 @@
 package peg
 
 import (
+	gocontext "context"
 	"errors"
+	"fmt"
+	"io"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 )
 
 func TestSimpleSyntax(t *testing.T) {
@@ -159,6 +165,33 @@ TEST_CASE("String capture test with embedded match action", "[general]")
 }
 */
 
+func TestParserWithRules(t *testing.T) {
+	parser, err := NewParserWithRules([]*Rule{
+		{Name: "LIST", Ope: Seq(Ref("ITEM", nil, 0), Zom(Seq(Lit(","), Ref("ITEM", nil, 0))))},
+		{Name: "ITEM", Ope: Thr(Ref("NUM", nil, 0), "item", nil)},
+		{Name: "NUM", Ope: Tok(Oom(Cls("0-9")))},
+		{Name: "%whitespace", Ope: Zom(Cls(" "))},
+		{Name: "item", Ope: Zom(Seq(Npd(Lit(",")), Dot())), Recovery: true},
+	}, map[string][]string{OptOptimize: {"false"}})
+	assert(t, err == nil)
+	assert(t, parser.Parse(" 1 , 2 ", nil) == nil)
+
+	perr := parser.Parse("1, x, 3", nil)
+	assert(t, perr != nil)
+	assert(t, len(perr.Details) == 1)
+	assert(t, perr.Details[0].Label == "item")
+	assert(t, perr.Details[0].Col == 4)
+
+	_, err = NewParserWithRules([]*Rule{
+		{Name: "A", Ope: Ref("B", nil, 0)},
+		{Name: "A", Ope: Lit("a")},
+	}, nil)
+	assert(t, err != nil)
+	assert(t, len(err.Details) == 2)
+	assert(t, err.Details[0].Msg == "'A' is already defined.")
+	assert(t, err.Details[1].Msg == "'B' is not defined.")
+}
+
 func TestSyclicGrammar(t *testing.T) {
 	var PARENT, CHILD Rule
 	PARENT.Ope = Seq(&CHILD)
@@ -311,6 +344,31 @@ func TestWordExpression(t *testing.T) {
 	assert(t, parser.Parse(`hello , world`, nil) == nil)
 }
 
+func TestCaseInsensitiveLiteral(t *testing.T) {
+	parser, _ := NewParser(`
+        ROOT         <-  'select'i IDENT 'from'i IDENT
+        IDENT        <-  < [a-z]+ >
+        %whitespace  <-  [ \t\r\n]*
+        %word        <-  [a-zA-Z]+
+	`)
+
+	assert(t, parser.Parse(`select a from b`, nil) == nil)
+	assert(t, parser.Parse(`SELECT a FROM b`, nil) == nil)
+	assert(t, parser.Parse(`Select a fRoM b`, nil) == nil)
+	assert(t, parser.Parse(`SELECTa FROM b`, nil) != nil)
+	assert(t, parser.Parse(`SELEC a FROM b`, nil) != nil)
+}
+
+func TestCaseInsensitiveLiteralReference(t *testing.T) {
+	parser, _ := NewParser(`
+        ROOT <- 'a'i i
+        i    <- 'b'
+	`)
+
+	assert(t, parser.Parse(`Ab`, nil) == nil)
+	assert(t, parser.Parse(`aib`, nil) != nil)
+}
+
 func TestSkipToken(t *testing.T) {
 	parser, _ := NewParser(`
         ROOT  <-  _ ITEM (',' _ ITEM _)*
@@ -364,6 +422,75 @@ TEST_CASE("Backtracking test", "[general]")
 }
 */
 
+func TestPackratParsing(t *testing.T) {
+	parser, _ := NewParser(`
+        START <- PAT1 / PAT2
+        PAT1  <- HELLO ' One'
+        PAT2  <- HELLO ' Two'
+        HELLO <- 'Hello'
+	`)
+
+	count := 0
+	parser.Grammar["HELLO"].Action = func(v *Values, d Any) (Any, error) {
+		count++
+		return nil, nil
+	}
+
+	var stats PackratStats
+	parser.PackratStats = func(s PackratStats) {
+		stats = s
+	}
+
+	parser.EnablePackratParsing()
+	assert(t, parser.Parse("Hello Two", nil) == nil)
+	assert(t, count == 1) // Skip second time
+	assert(t, stats.Hits == 1)
+	assert(t, stats.Misses > 0)
+}
+
+func TestPackratParsingHandlers(t *testing.T) {
+	parser, _ := NewParser(`
+        START <- PAT1 / PAT2
+        PAT1  <- HELLO ' One'
+        PAT2  <- HELLO ' Two'
+        HELLO <- 'Hello'
+	`)
+
+	var trace []string
+	parser.Grammar["HELLO"].Enter = func(d Any) { trace = append(trace, "enter") }
+	parser.Grammar["HELLO"].Leave = func(d Any) { trace = append(trace, "leave") }
+
+	// The second HELLO is a memo hit, which calls neither handler
+	parser.EnablePackratParsing()
+	for _, prog := range []interface {
+		Parse(s string, d Any) *Error
+	}{parser, parser.Compile()} {
+		trace = nil
+		assert(t, prog.Parse("Hello Two", nil) == nil)
+		assert(t, strings.Join(trace, " ") == "enter leave")
+	}
+}
+
+func TestPackratParsingWithAst(t *testing.T) {
+	syntax := `
+        S <- A? B (A B)* A / A B
+        A <- < 'a' >
+        B <- < 'b' >
+	`
+
+	parser, _ := NewParser(syntax)
+	parser.EnableAst()
+	want, err := parser.ParseAndGetAst("baba", nil)
+	assert(t, err == nil)
+
+	parser, _ = NewParser(syntax)
+	parser.EnableAst()
+	parser.EnablePackratParsing()
+	got, err := parser.ParseAndGetAst("baba", nil)
+	assert(t, err == nil)
+	assert(t, got.String() == want.String())
+}
+
 func TestBacktrackingWithAst(t *testing.T) {
 	parser, _ := NewParser(`
         S <- A? B (A B)* A
@@ -568,6 +695,47 @@ func TestCalculator3(t *testing.T) {
 	assert(t, val == 3)
 }
 
+func TestCalculatorWithPackrat(t *testing.T) {
+	parser, _ := NewParser(`
+        EXPRESSION   <-  ATOM (BINOP ATOM)*
+        ATOM         <-  NUMBER / '(' EXPRESSION ')'
+        BINOP        <-  < [-+/*] >
+        NUMBER       <-  < [0-9]+ >
+		%whitespace  <-  [ \t]*
+		---
+		%expr  = EXPRESSION
+		%binop = L + -
+		%binop = L * /
+    `)
+
+	g := parser.Grammar
+	g["EXPRESSION"].Action = func(v *Values, d Any) (Any, error) {
+		val := v.ToInt(0)
+		if v.Len() > 1 {
+			rhs := v.ToInt(2)
+			switch v.ToStr(1) {
+			case "+":
+				val += rhs
+			case "-":
+				val -= rhs
+			case "*":
+				val *= rhs
+			case "/":
+				val /= rhs
+			}
+		}
+		return val, nil
+	}
+	g["BINOP"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+	g["NUMBER"].Action = func(v *Values, d Any) (Any, error) { return strconv.Atoi(v.Token()) }
+
+	parser.EnablePackratParsing()
+	val, err := parser.ParseAndGetValue("1+2*3*(4-5+6)/7-8", nil)
+
+	assert(t, err == nil)
+	assert(t, val == -3)
+}
+
 func TestCalculatorTestWithAST(t *testing.T) {
 	parser, _ := NewParser(`
         EXPRESSION       <-  _ TERM (TERM_OPERATOR TERM)*
@@ -770,6 +938,310 @@ func TestLeftRecursiveWithEmptyString(t *testing.T) {
 	assert(t, err != nil)
 }
 
+func TestLeftRecursiveErrorMessage(t *testing.T) {
+	_, err := NewParser(`
+        A <- A 'a' / 'b'
+    `)
+
+	assert(t, err != nil)
+	assert(t, err.Details[0].Msg == "'A' is left recursive.")
+}
+
+func TestEmptyLoopErrorMessage(t *testing.T) {
+	tests := []struct {
+		grammar string
+		msg     string
+	}{
+		{"A <- ('a'?)*", "1:6 the repeated expression in ('a'?)* can match empty input."},
+		{"A <- 'x' (B / C)+\nB <- 'b'*\nC <- 'c'", "1:10 the repeated expression in (B / C)+ can match empty input."},
+		{"A <- (&'a' / !'b' / '' / ↑)*", "1:6 the repeated expression in (&'a' / !'b' / '' / ↑)* can match empty input."},
+		{"A <- < [a-z]* >+", "1:6 the repeated expression in < [a-z]* >+ can match empty input."},
+		{"A <- LIST('', ',')\nLIST(I, D) <- (I D?)*", "1:6 the repeated expression in LIST('', ',') can match empty input."},
+		{"A <- 'x' LIST('a')\nLIST(I) <- (I / '')*", "2:12 the repeated expression in (I / '')* can match empty input."},
+	}
+
+	for _, test := range tests {
+		_, err := NewParser(test.grammar)
+		if err == nil || len(err.Details) != 1 || err.Details[0].String() != test.msg {
+			t.Errorf("%q: got %v, want %s", test.grammar, err, test.msg)
+		}
+	}
+
+	// Details are in the order of the grammar text
+	grammar := "A <- B ('a'?)*\nB <- C ''*\nC <- ('c'?)+\nD <- ''*"
+	for i := 0; i < 10; i++ {
+		_, err := NewParser(grammar)
+		assert(t, err != nil && len(err.Details) == 4)
+		for j, d := range err.Details {
+			assert(t, d.Ln == j+1)
+		}
+	}
+
+	// Loops over expressions that always consume input are accepted
+	for _, grammar := range []string{
+		"A <- ('a' 'b'?)* (B / 'c')+ LIST('x', '')\nB <- 'b'+\nLIST(I, D) <- (I D)*",
+		"A <- (!'a' .)* < [a-z]+ >*",
+		"A <- A 'a'* / 'b'\n---\n%left_recursion = true\n",
+	} {
+		_, err := NewParser(grammar)
+		if err != nil {
+			t.Errorf("%q: %v", grammar, err)
+		}
+	}
+}
+
+func TestEmptyLoopStops(t *testing.T) {
+	// Hand-built loops stop after an iteration that consumes nothing
+	cases := Cases{
+		{"", 0},
+		{"b", 0},
+		{"aab", 2},
+	}
+	run("ZeroOrMore", t, Zom(Opt(Lit("a"))), cases)
+	run("OneOrMore", t, Oom(Opt(Lit("a"))), cases)
+
+	for _, ope := range []operator{Zom(Opt(Lit("a"))), Oom(Zom(Lit("a")))} {
+		prog := CompileRule(&Rule{Name: "A", Ope: Seq(ope, Lit("b"))})
+		for _, s := range []string{"b", "aab"} {
+			err := prog.Parse(s, nil)
+			assert(t, err == nil)
+		}
+	}
+}
+
+func TestLeftRecursionSupport(t *testing.T) {
+	parser, err := NewParser(`
+        EXPR   <- EXPR '-' NUMBER / NUMBER
+        NUMBER <- < [0-9]+ >
+        ---
+        %left_recursion = true
+    `)
+	assert(t, err == nil)
+
+	g := parser.Grammar
+	assert(t, g["EXPR"].LeftRecursive)
+	assert(t, !g["NUMBER"].LeftRecursive)
+
+	g["EXPR"].Action = func(v *Values, d Any) (Any, error) {
+		if v.Len() == 1 {
+			return v.ToInt(0), nil
+		}
+		return v.ToInt(0) - v.ToInt(1), nil
+	}
+	g["NUMBER"].Action = func(v *Values, d Any) (Any, error) {
+		return strconv.Atoi(v.Token())
+	}
+
+	val, err := parser.ParseAndGetValue("10-2-3", nil)
+	assert(t, err == nil)
+	assert(t, val == 5) // Left associative
+}
+
+func TestIndirectLeftRecursionSupport(t *testing.T) {
+	parser, err := NewParser(`
+        A <- B 'x' / 'a'
+        B <- A 'y'
+        ---
+        %left_recursion = true
+    `)
+	assert(t, err == nil)
+
+	assert(t, parser.Parse("a", nil) == nil)
+	assert(t, parser.Parse("ayx", nil) == nil)
+	assert(t, parser.Parse("ayxyx", nil) == nil)
+	assert(t, parser.Parse("ay", nil) != nil)
+	assert(t, parser.Parse("ayxy", nil) != nil)
+}
+
+func TestMutualLeftRecursion(t *testing.T) {
+	// Both rules are left recursive through each other, as in the Java
+	// primary expressions of Warth et al.
+	grammar := `
+        L <- P '.x' / 'x'
+        P <- P '(n)' / L
+        ---
+        %left_recursion = true
+    `
+	parser, err := NewParser(grammar)
+	assert(t, err == nil)
+
+	g := parser.Grammar
+	assert(t, g["L"].LeftRecursive && g["P"].LeftRecursive)
+	g["L"].Action = func(v *Values, d Any) (Any, error) {
+		if v.Choice == 0 {
+			return "(" + v.ToStr(0) + ".x)", nil
+		}
+		return "x", nil
+	}
+	g["P"].Action = func(v *Values, d Any) (Any, error) {
+		if v.Choice == 0 {
+			return v.ToStr(0) + "(n)", nil
+		}
+		return v.ToStr(0), nil
+	}
+
+	tests := []struct {
+		rule string
+		in   string
+		want string
+	}{
+		{"L", "x", "x"},
+		{"L", "x.x", "(x.x)"},
+		{"L", "x(n).x", "(x(n).x)"},
+		{"L", "x(n)(n).x(n).x", "((x(n)(n).x)(n).x)"},
+		{"P", "x", "x"},
+		{"P", "x(n)", "x(n)"},
+		{"P", "x.x(n)", "(x.x)(n)"},
+		{"P", "x(n).x(n)(n)", "(x(n).x)(n)(n)"},
+	}
+	for _, tt := range tests {
+		// The cycle is entered at either rule
+		l, val, err := g[tt.rule].Parse(tt.in, nil)
+		assert(t, err == nil && l == len(tt.in) && val == tt.want)
+	}
+
+	// A rule that enters the cycle in the middle of an alternative
+	parser, err = NewParser(`
+        S <- 'x' P '!' / P '?'
+        ` + grammar)
+	assert(t, err == nil)
+	assert(t, parser.Parse("x(n).x(n)?", nil) == nil)
+	assert(t, parser.Parse("xx(n).x!", nil) == nil)
+	assert(t, parser.Parse("x(n).x(n)", nil) != nil)
+	parser.EnablePackratParsing()
+	assert(t, parser.Parse("x(n).x(n)?", nil) == nil)
+	assert(t, parser.Parse("xx(n).x!", nil) == nil)
+}
+
+func TestMutualLeftRecursionInvolvedRules(t *testing.T) {
+	// A and B are involved in the recursion of whichever is called first
+	parser, err := NewParser(`
+        A <- B 'a' / 'x'
+        B <- A 'b' / 'y'
+        ---
+        %left_recursion = true
+    `)
+	assert(t, err == nil)
+
+	g := parser.Grammar
+	tree := func(v *Values, d Any) (Any, error) {
+		if v.Choice == 0 {
+			return "[" + v.ToStr(0) + v.S[len(v.S)-1:] + "]", nil
+		}
+		return v.S, nil
+	}
+	g["A"].Action = tree
+	g["B"].Action = tree
+
+	tests := []struct {
+		rule string
+		in   string
+		want string
+	}{
+		{"A", "x", "x"},
+		{"A", "ya", "[ya]"},
+		{"A", "xba", "[[xb]a]"},
+		{"A", "yaba", "[[[ya]b]a]"},
+		{"B", "y", "y"},
+		{"B", "xb", "[xb]"},
+		{"B", "yab", "[[ya]b]"},
+		{"B", "xbab", "[[[xb]a]b]"},
+	}
+	for _, tt := range tests {
+		l, val, err := g[tt.rule].Parse(tt.in, nil)
+		assert(t, err == nil && l == len(tt.in) && val == tt.want)
+	}
+
+	// Only the head grows a seed for the whole cycle, so the rules are
+	// evaluated as often wherever it's entered
+	parser, err = NewParser(`
+        E <- F '+' 'n' / 'n'
+        F <- E '*' 'n' / E
+        ---
+        %left_recursion = true
+    `)
+	assert(t, err == nil)
+
+	count := 0
+	for _, r := range parser.Grammar {
+		r.Enter = func(d Any) { count++ }
+	}
+	in := "n" + strings.Repeat("*n+n", 20)
+	counts := make(map[string]int)
+	for _, name := range []string{"E", "F"} {
+		count = 0
+		l, _, err := parser.Grammar[name].Parse(in, nil)
+		assert(t, err == nil && l == len(in))
+		counts[name] = count
+	}
+	assert(t, counts["E"] == counts["F"])
+}
+
+func TestLeftRecursionSupportWithAst(t *testing.T) {
+	parser, _ := NewParser(`
+        LIST <- LIST ',' ITEM / ITEM
+        ITEM <- < [a-z]+ >
+        %whitespace <- [ \t]*
+        ---
+        %left_recursion = true
+    `)
+
+	parser.EnableAst()
+	ast, err := parser.ParseAndGetAst("a, b, c", nil)
+
+	assert(t, err == nil)
+	assert(t, ast.Name == "LIST")
+	assert(t, len(ast.Nodes) == 2)
+	assert(t, ast.Nodes[0].Name == "LIST")
+	assert(t, ast.Nodes[1].Token == "c")
+}
+
+func TestLeftRecursionSupportWithPackrat(t *testing.T) {
+	parser, _ := NewParser(`
+        S <- E ';' / E '.'
+        E <- E '+' T / T
+        T <- < [0-9] >
+        ---
+        %left_recursion = true
+    `)
+
+	count := 0
+	parser.Grammar["T"].Action = func(v *Values, d Any) (Any, error) {
+		count++
+		return nil, nil
+	}
+
+	assert(t, parser.Parse("1+2+3.", nil) == nil)
+	withoutPackrat := count
+
+	count = 0
+	parser.EnablePackratParsing()
+	assert(t, parser.Parse("1+2+3.", nil) == nil)
+	assert(t, count < withoutPackrat)
+}
+
+func TestLeftRecursionSupportWithCombinators(t *testing.T) {
+	var EXPR, NUMBER Rule
+	EXPR.Ope = Cho(Seq(&EXPR, Lit("-"), &NUMBER), &NUMBER)
+	EXPR.LeftRecursive = true
+	NUMBER.Ope = Tok(Oom(Cls("0-9")))
+
+	EXPR.Action = func(v *Values, d Any) (Any, error) {
+		if v.Len() == 1 {
+			return v.ToInt(0), nil
+		}
+		return v.ToInt(0) - v.ToInt(1), nil
+	}
+	NUMBER.Action = func(v *Values, d Any) (Any, error) {
+		return strconv.Atoi(v.Token())
+	}
+
+	l, val, err := EXPR.Parse("7-1-1", nil)
+	assert(t, err == nil)
+	assert(t, l == 5)
+	assert(t, val == 5)
+}
+
 func TestUserRule(t *testing.T) {
 	syntax := " ROOT <- _ 'Hello' _ NAME '!' _ "
 
@@ -825,6 +1297,85 @@ func TestJapaneseCharacter(t *testing.T) {
 	assert(t, parser.Parse("サーバーを復旧します。", nil) == nil)
 }
 
+func TestJapaneseCharacterClass(t *testing.T) {
+	parser, _ := NewParser(`
+        文     <- 単語 ('、' 単語)* '。'
+        単語   <- ひらがな+ / カタカナ+ / 漢字+
+        ひらがな <- [ぁ-ん]
+        カタカナ <- [ァ-ヶー]
+        漢字   <- [\u4e00-\u{9fff}]
+	`)
+
+	assert(t, parser.Parse("サーバー、を、復旧。", nil) == nil)
+	assert(t, parser.Parse("さーばー。", nil) != nil)
+	assert(t, parser.Parse("abc。", nil) != nil)
+}
+
+func TestNegatedCharacterClassSyntax(t *testing.T) {
+	parser, _ := NewParser(`
+        STRING <- '"' < [^"\\]* > '"'
+    `)
+
+	parser.Grammar["STRING"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+
+	val, err := parser.ParseAndGetValue(`"こんにちは, world"`, nil)
+	assert(t, err == nil)
+	assert(t, val == "こんにちは, world")
+
+	_, err = parser.ParseAndGetValue(`"a\b"`, nil)
+	assert(t, err != nil)
+	assert(t, err.Details[0].Col == 3)
+}
+
+func TestNegatedCharacterClassSyntaxWithCaret(t *testing.T) {
+	parser, _ := NewParser(`
+        ROOT <- [^^] [\^]
+    `)
+
+	assert(t, parser.Parse("a^", nil) == nil)
+	assert(t, parser.Parse("^^", nil) != nil)
+}
+
+func TestByteCharacterClass(t *testing.T) {
+	// Hex escapes above \x7f are bytes, as in literals
+	parser, err := NewParser(`
+        ROOT <- [\x80-\xff]+ [^\x80-\xff] [a-\xff]
+    `)
+	assert(t, err == nil)
+
+	assert(t, parser.Parse("é\xffaz", nil) == nil)
+	assert(t, parser.Parse("\x80\xc3z\xe3", nil) == nil)
+	assert(t, parser.Parse("\xffé\x7f\x80", nil) == nil)
+	assert(t, parser.Parse("aaz", nil) != nil)
+	assert(t, parser.Parse("\xff\xffZ", nil) != nil)
+
+	for _, packrat := range []bool{false, true} {
+		parser, _ := NewParser(`
+            ROOT <- ([\xc0-\xdf] / [\x80-\xbf] / 'a')+
+        `)
+		if packrat {
+			parser.EnablePackratParsing()
+		}
+		assert(t, parser.Parse("aé\xbf", nil) == nil)
+	}
+
+	_, err = NewParser(`ROOT <- [\x80-é]`)
+	assert(t, err != nil)
+	assert(t, err.Details[0].Msg == "the range '\\x80-é' is between a byte and a character.")
+}
+
+func TestUnicodeEscapeSequence(t *testing.T) {
+	parser, _ := NewParser(`
+        ROOT <- '\u3042\u{3044}' [\u{1F600}-\u{1F64F}] .
+    `)
+
+	assert(t, parser.Parse("あい😃ん", nil) == nil)
+	assert(t, parser.Parse("あい😃", nil) != nil)
+	assert(t, parser.Parse("あいaん", nil) != nil)
+}
+
 func TestMacroSimple(t *testing.T) {
 	parser, err := NewParser(`
 		S     <- HELLO WORLD
@@ -1005,53 +1556,557 @@ func match(t *testing.T, r *Rule, s string, want bool) {
 	}
 }
 
-func TestPegGrammar(t *testing.T) {
-	match(t, &rStart, " Definition <- a / ( b c ) / d \n rule2 <- [a-zA-Z][a-z0-9-]+ ", true)
-}
+func TestCutOperator(t *testing.T) {
+	parser, _ := NewParser(`
+        STMT <- 'if' ↑ '(' ID ')' / ID ID
+        ID   <- < [a-z]+ >
+        %whitespace <- [ \t]*
+    `)
 
-func TestPegDefinition(t *testing.T) {
-	match(t, &rDefinition, "Definition <- a / (b c) / d ", true)
-	match(t, &rDefinition, "Definition <- a / b c / d ", true)
-	match(t, &rDefinition, "Definition ← a ", true)
-	match(t, &rDefinition, "Definition ", false)
-	match(t, &rDefinition, " ", false)
-	match(t, &rDefinition, "", false)
-	match(t, &rDefinition, "Definition = a / (b c) / d ", false)
-	match(t, &rDefinition, "Macro(param) <- a ", true)
-	match(t, &rDefinition, "Macro (param) <- a ", false)
-}
+	assert(t, parser.Parse("if (a)", nil) == nil)
+	assert(t, parser.Parse("foo a", nil) == nil)
 
-func TestPegExpression(t *testing.T) {
-	match(t, &rExpression, "a / (b c) / d ", true)
-	match(t, &rExpression, "a / b c / d ", true)
-	match(t, &rExpression, "a b ", true)
-	match(t, &rExpression, "", true)
-	match(t, &rExpression, " ", false)
-	match(t, &rExpression, " a b ", false)
+	// Without the cut, 'if a' would be accepted as two identifiers
+	err := parser.Parse("if a", nil)
+	assert(t, err != nil)
+	assert(t, err.Details[0].Col == 4)
 }
 
-func TestPegSequence(t *testing.T) {
-	match(t, &rSequence, "a b c d ", true)
-	match(t, &rSequence, "", true)
-	match(t, &rSequence, "!", false)
-	match(t, &rSequence, "<-", false)
-	match(t, &rSequence, " a", false)
+func TestCutOperatorWithCaret(t *testing.T) {
+	parser, _ := NewParser(`
+        S <- 'a' ^ 'b' / 'a' 'c' 'd'
+    `)
+
+	assert(t, parser.Parse("ab", nil) == nil)
+
+	err := parser.Parse("acd", nil)
+	assert(t, err != nil)
+	assert(t, err.Details[0].Col == 2)
 }
 
-func TestPegPrefix(t *testing.T) {
-	match(t, &rPrefix, "&[a]", true)
-	match(t, &rPrefix, "![']", true)
-	match(t, &rPrefix, "-[']", false)
-	match(t, &rPrefix, "", false)
-	match(t, &rPrefix, " a", false)
+func TestCutOperatorInRepetition(t *testing.T) {
+	parser, _ := NewParser(`
+        S <- ('a' ^ 'b')* 'a' 'c'
+    `)
+
+	assert(t, parser.Parse("abab", nil) != nil)
+	assert(t, parser.Parse("abac", nil) != nil)
+
+	parser, _ = NewParser(`
+        S <- ('a' 'b')* 'a' 'c'
+    `)
+
+	assert(t, parser.Parse("abac", nil) == nil)
 }
 
-func TestPegSuffix(t *testing.T) {
+func TestCutOperatorInNestedChoice(t *testing.T) {
+	parser, _ := NewParser(`
+        S <- ('a' ^ 'b' / 'a') 'c' / 'a' 'c'
+    `)
+
+	// The cut only commits the inner choice
+	assert(t, parser.Parse("abc", nil) == nil)
+	assert(t, parser.Parse("ac", nil) == nil)
+}
+
+func TestCutOperatorInRule(t *testing.T) {
+	parser, _ := NewParser(`
+        S <- A 'c' / 'a' 'b' 'd' / 'a' 'x'
+        A <- 'a' ^ 'b'
+    `)
+
+	for _, packrat := range []bool{false, true} {
+		if packrat {
+			parser.EnablePackratParsing()
+		}
+
+		// The cut in A doesn't commit the choice in S
+		assert(t, parser.Parse("abc", nil) == nil)
+		assert(t, parser.Parse("abd", nil) == nil)
+		assert(t, parser.Parse("ax", nil) == nil)
+	}
+}
+
+func TestCutOperatorWithPackrat(t *testing.T) {
+	// A predicate goes back to its start even after a cut in it, so the
+	// first result of A is still in the memo
+	parser, _ := NewParser(`
+        S <- &(A ^ 'b') A 'b'
+        A <- 'a' / 'A'
+    `)
+
+	var stats PackratStats
+	parser.PackratStats = func(s PackratStats) {
+		stats = s
+	}
+
+	parser.EnablePackratParsing()
+	assert(t, parser.Parse("ab", nil) == nil)
+	assert(t, stats.Hits == 1)
+
+	// Results before the iteration that a cut commits are dropped, and the
+	// results after it are still used
+	parser, _ = NewParser(`
+        S <- (A ';' ^ / A '.')*
+        A <- 'a' / 'A'
+    `)
+	parser.PackratStats = func(s PackratStats) {
+		stats = s
+	}
+	parser.EnablePackratParsing()
+
+	s := strings.Repeat("a;A.", 50)
+	r, c := parser.newContext(gocontext.Background(), newStringInput(s))
+	c.s = s
+	_, _, err := r.parseInput(c, nil)
+	assert(t, err == nil)
+	assert(t, stats.Hits == 50)
+	assert(t, len(c.memo) == 3)
+}
+
+func TestErrorRecovery(t *testing.T) {
+	parser, _ := NewParser(`
+        STMTS           <- STMT*
+        STMT            <- ID '=' NUM ';'^semicolon
+        ID              <- < [a-z]+ >
+        NUM             <- < [0-9]+ >
+        %whitespace     <- [ \t\r\n]*
+        %recover(semicolon) <- (!(ID '=') .)*
+    `)
+
+	parser.Grammar["semicolon"].Message = func() string {
+		return "missing ';'"
+	}
+
+	assert(t, parser.Parse("a = 1; b = 2;", nil) == nil)
+
+	err := parser.Parse("a = 1\nb = 2;\nc = 3 4", nil)
+	assert(t, err != nil)
+	assert(t, len(err.Details) == 2)
+	assert(t, err.Details[0].Ln == 2)
+	assert(t, err.Details[0].Col == 1)
+	assert(t, err.Details[0].Msg == "missing ';'")
+	assert(t, err.Details[0].Label == "semicolon")
+	assert(t, err.Details[1].Ln == 3)
+	assert(t, err.Details[1].Col == 7)
+}
+
+func TestErrorRecoveryWithAst(t *testing.T) {
+	parser, _ := NewParser(`
+        STMTS           <- STMT*
+        STMT            <- ID '=' NUM ';'^semicolon
+        ID              <- < [a-z]+ >
+        NUM             <- < [0-9]+ >
+        %whitespace     <- [ \t\r\n]*
+        %recover(semicolon) <- < (!(ID '=') .)* >
+    `)
+
+	parser.EnableAst()
+	ast, err := parser.ParseAndGetAst("a = 1 b = 2;", nil)
+	assert(t, err != nil)
+	assert(t, len(err.Details) == 1)
+	assert(t, ast != nil)
+	assert(t, len(ast.Nodes) == 2)
+
+	stmt := ast.Nodes[0]
+	assert(t, len(stmt.Nodes) == 3)
+	assert(t, stmt.Nodes[2].Name == "semicolon")
+	assert(t, stmt.Nodes[2].Error)
+	assert(t, !ast.Nodes[1].Nodes[1].Error)
+}
+
+func TestLabeledFailure(t *testing.T) {
+	parser, _ := NewParser(`
+        S <- 'a' 'b'^missing_b / 'a' 'c'
+    `)
+
+	assert(t, parser.Parse("ab", nil) == nil)
+
+	// The label is not caught by the choice
+	err := parser.Parse("ac", nil)
+	assert(t, err != nil)
+	assert(t, len(err.Details) == 1)
+	assert(t, err.Details[0].Col == 2)
+	assert(t, err.Details[0].Label == "missing_b")
+}
+
+func TestThrowSyntax(t *testing.T) {
+	// '^' followed by a label is a throw
+	parser, err := NewParser("S <- 'a' 'b'^b / 'a' 'c'")
+	assert(t, err == nil)
+	assert(t, parser.Parse("ab", nil) == nil)
+	perr := parser.Parse("ac", nil)
+	assert(t, perr != nil)
+	assert(t, perr.Details[0].Label == "b")
+
+	// and any other '^' is a cut, as is '↑'
+	for _, grammar := range []string{
+		"S <- 'a' ^ b / 'a' 'c'\nb <- 'b'",
+		"S <- 'a' ↑b / 'a' 'c'\nb <- 'b'",
+		"S <- 'a' ^('b') / 'a' 'c'",
+	} {
+		parser, err := NewParser(grammar)
+		assert(t, err == nil)
+		assert(t, parser.Parse("ab", nil) == nil)
+		perr := parser.Parse("ac", nil)
+		assert(t, perr != nil)
+		assert(t, len(perr.Details[0].Label) == 0)
+	}
+}
+
+func TestLabeledFailureInPredicate(t *testing.T) {
+	parser, _ := NewParser(`
+        S <- !('a' 'b'^x) 'a' 'c'
+    `)
+
+	assert(t, parser.Parse("ac", nil) == nil)
+	assert(t, parser.Parse("ab", nil) != nil)
+}
+
+func TestLabeledFailureWithPackrat(t *testing.T) {
+	parser, _ := NewParser(`
+        S     <- (A / B)*
+        A     <- 'a' NUM ';'^semi
+        B     <- 'b' NUM ';'^semi
+        NUM   <- [0-9]+
+        %recover(semi) <- (![ab] .)*
+    `)
+
+	parser.EnablePackratParsing()
+	err := parser.Parse("a1;b2a3;b4", nil)
+	assert(t, err != nil)
+	assert(t, len(err.Details) == 2)
+	assert(t, err.Details[0].Col == 6)
+	assert(t, err.Details[1].Col == 11)
+}
+
+func TestExpectedErrorMessage(t *testing.T) {
+	parser, _ := NewParser(`
+        EXPRESSION       <-  TERM (TERM_OPERATOR TERM)*
+        TERM             <-  FACTOR (FACTOR_OPERATOR FACTOR)*
+        FACTOR           <-  NUMBER / '(' EXPRESSION ')'
+        TERM_OPERATOR    <-  < [-+] >
+        FACTOR_OPERATOR  <-  < [/*] >
+        NUMBER           <-  < [0-9]+ >
+        %whitespace      <-  [ \t\r\n]*
+    `)
+
+	err := parser.Parse("+1", nil)
+	assert(t, err != nil)
+	assert(t, err.Details[0].Col == 1)
+	assert(t, err.Details[0].Msg == "expected NUMBER or '(', found '+'")
+	assert(t, len(err.Details[0].Expected) == 2)
+	assert(t, err.Details[0].Expected[0] == "NUMBER")
+	assert(t, err.Details[0].Expected[1] == "'('")
+
+	err = parser.Parse("(1 + 2", nil)
+	assert(t, err != nil)
+	assert(t, err.Details[0].Col == 7)
+	assert(t, err.Details[0].Msg == "expected ')', found end of input")
+}
+
+func TestExpectedErrorMessageWithClass(t *testing.T) {
+	parser, _ := NewParser(`
+        ROOT <- 'a' ([0-9] / [^x\n] 'b'i / 'c')
+    `)
+
+	err := parser.Parse("ax", nil)
+	assert(t, err != nil)
+	assert(t, err.Details[0].Msg == "expected [0-9], [^x\\n] or 'c', found 'x'")
+
+	err = parser.Parse("aac", nil)
+	assert(t, err != nil)
+	assert(t, err.Details[0].Msg == "expected 'b'i, found 'c'")
+}
+
+func TestExpectedErrorMessageInTokenRule(t *testing.T) {
+	parser, _ := NewParser(`
+        ROOT   <- '[' STRING ']'
+        STRING <- '"' < (!'"' .)* > '"'
+    `)
+
+	err := parser.Parse(`["abc`, nil)
+	assert(t, err != nil)
+	assert(t, err.Details[0].Col == 6)
+	assert(t, err.Details[0].Msg == "expected STRING, found end of input")
+
+	err = parser.Parse(`[abc]`, nil)
+	assert(t, err != nil)
+	assert(t, err.Details[0].Col == 2)
+	assert(t, err.Details[0].Msg == "expected STRING, found 'a'")
+}
+
+func TestParseReader(t *testing.T) {
+	parser, _ := NewParser(`
+        EXPRESSION       <-  TERM (TERM_OPERATOR TERM)*
+        TERM             <-  FACTOR (FACTOR_OPERATOR FACTOR)*
+        FACTOR           <-  NUMBER / '(' EXPRESSION ')'
+        TERM_OPERATOR    <-  < [-+] >
+        FACTOR_OPERATOR  <-  < [/*] >
+        NUMBER           <-  < [0-9]+ >
+        %whitespace      <-  [ \t\r\n]*
+    `)
+
+	reduce := func(v *Values, d Any) (Any, error) {
+		ret := v.ToInt(0)
+		for i := 1; i < len(v.Vs); i += 2 {
+			n := v.ToInt(i + 1)
+			switch v.ToStr(i) {
+			case "+":
+				ret += n
+			case "-":
+				ret -= n
+			case "*":
+				ret *= n
+			case "/":
+				ret /= n
+			}
+		}
+		return ret, nil
+	}
+
+	g := parser.Grammar
+	g["EXPRESSION"].Action = reduce
+	g["TERM"].Action = reduce
+	g["TERM_OPERATOR"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+	g["FACTOR_OPERATOR"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+	g["NUMBER"].Action = func(v *Values, d Any) (Any, error) { return strconv.Atoi(v.Token()) }
+
+	input := " (1 + 2 * (3 + 4)) / 5 - 6 "
+	val, err := parser.ParseReader(iotest.OneByteReader(strings.NewReader(input)), nil)
+	assert(t, err == nil)
+	assert(t, val == -3)
+
+	err1 := parser.Parse(" 1 +\n (2 * ", nil)
+	_, err2 := parser.ParseReader(iotest.OneByteReader(strings.NewReader(" 1 +\n (2 * ")), nil)
+	assert(t, err1 != nil && err2 != nil)
+	assert(t, err1.Details[0].String() == err2.Details[0].String())
+}
+
+// Generates lines without keeping them in memory
+type lineGenerator struct {
+	n    int
+	line string
+	buf  []byte
+}
+
+func (g *lineGenerator) Read(b []byte) (int, error) {
+	if len(g.buf) == 0 {
+		if g.n == 0 {
+			return 0, io.EOF
+		}
+		g.n--
+		g.buf = []byte(g.line)
+	}
+	n := copy(b, g.buf)
+	g.buf = g.buf[n:]
+	return n, nil
+}
+
+func TestParseReaderBoundedMemory(t *testing.T) {
+	parser, _ := NewParser(`
+        LOG   <- LINE*
+        LINE  <- < [^\n]* > '\n'
+    `)
+
+	lines := 100000
+	line := strings.Repeat("2024-01-01 12:00:00 INFO request handled ", 10) + "\n"
+
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	base := m.HeapAlloc
+
+	// Token rules keep their text
+	count := 0
+	maxHeap := uint64(0)
+	parser.Grammar["LINE"].Action = func(v *Values, d Any) (Any, error) {
+		if v.S != line || v.ToToken(0).Pos != count*len(line) {
+			return nil, errors.New("wrong line")
+		}
+		count++
+		if count%10000 == 0 {
+			runtime.GC()
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > maxHeap {
+				maxHeap = m.HeapAlloc
+			}
+		}
+		return nil, nil
+	}
+
+	// An action on the root rule reads its values, not its text
+	parser.Grammar["LOG"].Action = func(v *Values, d Any) (Any, error) {
+		return fmt.Sprint(v.Len(), len(v.S)), nil
+	}
+
+	val, err := parser.ParseReader(&lineGenerator{n: lines, line: line}, nil)
+	assert(t, err == nil)
+	assert(t, val == fmt.Sprint(lines, 0))
+	assert(t, count == lines)
+	assert(t, maxHeap < base+uint64(lines*len(line)/4))
+}
+
+func TestParseReaderErrorPosition(t *testing.T) {
+	parser, _ := NewParser(`
+        LOG   <- LINE*
+        LINE  <- [a-z]+ '\n'
+    `)
+
+	gen := io.MultiReader(
+		&lineGenerator{n: 100000, line: "abc\n"},
+		strings.NewReader("abc\nab1\n"),
+	)
+	_, err := parser.ParseReader(gen, nil)
+	assert(t, err != nil)
+	assert(t, err.Details[0].Ln == 100002)
+	assert(t, err.Details[0].Col == 1)
+	assert(t, err.Details[0].Msg == "not exact match")
+
+	// Recorded errors outlive the discarded input
+	parser, _ = NewParser(`
+        LOG         <- LINE*
+        LINE        <- [a-z]+ '\n'^nl
+        %recover(nl) <- (!'\n' .)* '\n'
+    `)
+
+	gen = io.MultiReader(
+		strings.NewReader("abc\nab1\n"),
+		&lineGenerator{n: 100000, line: "abc\n"},
+		strings.NewReader("a-c\n"),
+	)
+	_, err = parser.ParseReader(gen, nil)
+	assert(t, err != nil)
+	assert(t, len(err.Details) == 2)
+	assert(t, err.Details[0].Ln == 2)
+	assert(t, err.Details[0].Col == 3)
+	assert(t, err.Details[0].Msg == "expected '\\n', found '1'")
+	assert(t, err.Details[1].Ln == 100003)
+	assert(t, err.Details[1].Col == 2)
+
+	err2 := parser.Parse("abc\nab1\n"+strings.Repeat("abc\n", 100000)+"a-c\n", nil)
+	assert(t, err.Error() == err2.Error())
+	assert(t, err.Details[1].String() == err2.Details[1].String())
+}
+
+func TestParseReaderWithAst(t *testing.T) {
+	parser, _ := NewParser(`
+        ROOT  <- ITEM*
+        ITEM  <- < [a-z]+ >
+        %whitespace <- [ \n]*
+    `)
+
+	parser.EnableAst()
+	val, err := parser.ParseReader(iotest.OneByteReader(strings.NewReader("abc\n def\n  ghi")), nil)
+	assert(t, err == nil)
+
+	ast := val.(*Ast)
+	assert(t, len(ast.Nodes) == 3)
+	assert(t, ast.Nodes[2].Token == "ghi")
+	assert(t, ast.Nodes[2].Ln == 3)
+	assert(t, ast.Nodes[2].Col == 3)
+}
+
+func TestParseReaderExpression(t *testing.T) {
+	// The operator is looked up by the text of BINOP, which isn't a token
+	parser, _ := NewParser(`
+        EXPR  <- ATOM (BINOP ATOM)*
+        ATOM  <- [0-9]
+        BINOP <- '**' / OP
+        OP    <- [-+*/]
+        ---
+        %expr  = EXPR
+        %binop = L + -
+        %binop = L * /
+        %binop = R **
+    `)
+
+	parser.EnableAst()
+	input := "1+2*3**4-5"
+	want, err := parser.ParseAndGetAst(input, nil)
+	assert(t, err == nil && len(want.Nodes) == 3 && want.Nodes[1].Nodes[0].Token == "-")
+
+	for _, packrat := range []bool{false, true} {
+		if packrat {
+			parser.EnablePackratParsing()
+		}
+		for _, prog := range []interface {
+			ParseReader(rd io.Reader, d Any) (Any, *Error)
+		}{parser, parser.Compile()} {
+			val, err := prog.ParseReader(iotest.OneByteReader(strings.NewReader(input)), nil)
+			assert(t, err == nil && val.(*Ast).String() == want.String())
+		}
+	}
+}
+
+func TestParseReaderReadError(t *testing.T) {
+	parser, _ := NewParser(`
+        ROOT  <- [a-z]*
+    `)
+
+	rerr := errors.New("broken pipe")
+	rd := io.MultiReader(strings.NewReader("abc"), iotest.ErrReader(rerr))
+	_, err := parser.ParseReader(rd, nil)
+	assert(t, err != nil)
+	assert(t, err.Details[len(err.Details)-1].Msg == "broken pipe")
+	assert(t, err.Details[len(err.Details)-1].Kind == ReadError && errors.Is(err, rerr))
+}
+
+func TestPegGrammar(t *testing.T) {
+	match(t, &rStart, " Definition <- a / ( b c ) / d \n rule2 <- [a-zA-Z][a-z0-9-]+ ", true)
+}
+
+func TestPegDefinition(t *testing.T) {
+	match(t, &rDefinition, "Definition <- a / (b c) / d ", true)
+	match(t, &rDefinition, "Definition <- a / b c / d ", true)
+	match(t, &rDefinition, "Definition ← a ", true)
+	match(t, &rDefinition, "Definition ", false)
+	match(t, &rDefinition, " ", false)
+	match(t, &rDefinition, "", false)
+	match(t, &rDefinition, "Definition = a / (b c) / d ", false)
+	match(t, &rDefinition, "Macro(param) <- a ", true)
+	match(t, &rDefinition, "Macro (param) <- a ", false)
+}
+
+func TestPegExpression(t *testing.T) {
+	match(t, &rExpression, "a / (b c) / d ", true)
+	match(t, &rExpression, "a / b c / d ", true)
+	match(t, &rExpression, "a b ", true)
+	match(t, &rExpression, "", true)
+	match(t, &rExpression, " ", false)
+	match(t, &rExpression, " a b ", false)
+}
+
+func TestPegSequence(t *testing.T) {
+	match(t, &rSequence, "a b c d ", true)
+	match(t, &rSequence, "", true)
+	match(t, &rSequence, "!", false)
+	match(t, &rSequence, "<-", false)
+	match(t, &rSequence, " a", false)
+}
+
+func TestPegPrefix(t *testing.T) {
+	match(t, &rPrefix, "&[a]", true)
+	match(t, &rPrefix, "![']", true)
+	match(t, &rPrefix, "-[']", false)
+	match(t, &rPrefix, "", false)
+	match(t, &rPrefix, " a", false)
+	match(t, &rPrefix, "lhs:a", true)
+	match(t, &rPrefix, "x: !a", true)
+	match(t, &rPrefix, "x:a*^label", true)
+	match(t, &rPrefix, "x :a", false)
+	match(t, &rPrefix, "x:", false)
+}
+
+func TestPegSuffix(t *testing.T) {
 	match(t, &rSuffix, "aaa ", true)
 	match(t, &rSuffix, "aaa? ", true)
 	match(t, &rSuffix, "aaa* ", true)
 	match(t, &rSuffix, "aaa+ ", true)
 	match(t, &rSuffix, ". + ", true)
+	match(t, &rSuffix, "aaa^label ", true)
+	match(t, &rSuffix, "aaa*^label", true)
+	match(t, &rSuffix, "aaa^", false)
 	match(t, &rSuffix, "?", false)
 	match(t, &rSuffix, "", false)
 	match(t, &rPrefix, " a", false)
@@ -1065,6 +2120,10 @@ func TestPegPrimary(t *testing.T) {
 	match(t, &rPrimary, "\"Literal String\"", true)
 	match(t, &rPrimary, "[a-zA-Z]", true)
 	match(t, &rPrimary, ".", true)
+	match(t, &rPrimary, "↑", true)
+	match(t, &rPrimary, "^ ", true)
+	match(t, &rPrimary, "^", true)
+	match(t, &rPrimary, "^a", false)
 	match(t, &rPrimary, "", false)
 	match(t, &rPrimary, " ", false)
 	match(t, &rPrimary, " a", false)
@@ -1087,6 +2146,8 @@ func TestPegIdentStart(t *testing.T) {
 	match(t, &rIdentStart, "", false)
 	match(t, &rIdentStart, " ", false)
 	match(t, &rIdentStart, "0", false)
+	match(t, &rIdentStart, "←", false)
+	match(t, &rIdentStart, "↑", false)
 }
 
 func TestPegIdentRest(t *testing.T) {
@@ -1113,6 +2174,10 @@ func TestPegLiteral(t *testing.T) {
 	match(t, &rLiteral, "abc", false)
 	match(t, &rLiteral, "", false)
 	match(t, &rLiteral, "日本語", false)
+	match(t, &rLiteral, "'abc'i ", true)
+	match(t, &rLiteral, "\"abc\"i ", true)
+	match(t, &rLiteral, "'abc'ii", false)
+	match(t, &rLiteral, "'abc' i", false)
 }
 
 func TestPegClass(t *testing.T) {
@@ -1131,6 +2196,11 @@ func TestPegClass(t *testing.T) {
 	match(t, &rClass, "あ-ん", false)
 	match(t, &rClass, "[-+]", true)
 	match(t, &rClass, "[+-]", false)
+	match(t, &rClass, "[^a-z]", true)
+	match(t, &rClass, "[^]", true)
+	match(t, &rClass, "[^\\]]", true)
+	match(t, &rClass, "[\\^]", true)
+	match(t, &rClass, "[^", false)
 }
 
 func TestPegRange(t *testing.T) {
@@ -1150,6 +2220,7 @@ func TestPegChar(t *testing.T) {
 	match(t, &rChar, "\\\"", true)
 	match(t, &rChar, "\\[", true)
 	match(t, &rChar, "\\]", true)
+	match(t, &rChar, "\\^", true)
 	match(t, &rChar, "\\\\", true)
 	match(t, &rChar, "\\000", true)
 	match(t, &rChar, "\\377", true)
@@ -1170,7 +2241,13 @@ func TestPegChar(t *testing.T) {
 	match(t, &rChar, " ", true)
 	match(t, &rChar, "  ", false)
 	match(t, &rChar, "", false)
-	match(t, &rChar, "あ", false)
+	match(t, &rChar, "あ", true)
+	match(t, &rChar, "あい", false)
+	match(t, &rChar, "\\u3042", true)
+	match(t, &rChar, "\\u304", false)
+	match(t, &rChar, "\\u{3042}", true)
+	match(t, &rChar, "\\u{1F600}", true)
+	match(t, &rChar, "\\u{}", false)
 }
 
 func TestPegOperators(t *testing.T) {
@@ -1214,3 +2291,549 @@ func TestPegEndOfFile(t *testing.T) {
 	match(t, &rEndOfFile, "", true)
 	match(t, &rEndOfFile, " ", false)
 }
+
+func TestParseContextCanceled(t *testing.T) {
+	parser, _ := NewParser(`
+		LIST <- ITEM (',' ITEM)*
+		ITEM <- [0-9]+
+	`)
+
+	input := "1" + strings.Repeat(",2", 10000)
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	val, err := parser.ParseContext(ctx, input, nil)
+	assert(t, err == nil)
+	assert(t, val == nil)
+
+	cancel()
+	_, err = parser.ParseContext(ctx, input, nil)
+	assert(t, err != nil)
+	assert(t, err.Kind == CanceledError)
+	assert(t, err.Details[0].Msg == "context canceled")
+	assert(t, errors.Is(err, gocontext.Canceled))
+
+	// Cancel in the middle of the parse
+	ctx, cancel = gocontext.WithCancel(gocontext.Background())
+	defer cancel()
+	count := 0
+	parser.Grammar["ITEM"].Action = func(v *Values, d Any) (Any, error) {
+		count++
+		if count == 100 {
+			cancel()
+		}
+		return nil, nil
+	}
+	_, err = parser.ParseContext(ctx, input, nil)
+	assert(t, err != nil)
+	assert(t, err.Kind == CanceledError)
+	assert(t, count < 10001)
+	assert(t, err.Details[0].Ln == 1)
+	assert(t, err.Details[0].Col > 199)
+}
+
+func TestParseReaderContextCanceled(t *testing.T) {
+	parser, _ := NewParser(`
+		LOG  <- LINE*
+		LINE <- < (!'\n' .)* > '\n'
+	`)
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	cancel()
+	_, err := parser.ParseReaderContext(ctx, &lineGenerator{n: 1000000, line: "abc\n"}, nil)
+	assert(t, err != nil)
+	assert(t, err.Kind == CanceledError)
+}
+
+func TestMaxDepthLimit(t *testing.T) {
+	parser, _ := NewParser(`
+		NEST <- '(' NEST ')' / 'x'
+	`)
+
+	input := strings.Repeat("(", 1000) + "x" + strings.Repeat(")", 1000)
+
+	err := parser.Parse(input, nil)
+	assert(t, err == nil)
+
+	parser.Limits.MaxDepth = 100
+	err = parser.Parse(input, nil)
+	assert(t, err != nil)
+	assert(t, err.Kind == DepthLimitError)
+	assert(t, len(err.Details) == 1)
+	assert(t, err.Details[0].Msg == "maximum recursion depth exceeded")
+
+	err = parser.Parse("((x))", nil)
+	assert(t, err == nil)
+}
+
+func TestMaxStepsLimit(t *testing.T) {
+	parser, _ := NewParser(`
+		LIST <- ITEM (',' ITEM)*
+		ITEM <- [0-9]+
+	`)
+
+	parser.Limits.MaxSteps = 1000
+	err := parser.Parse("1,2,3", nil)
+	assert(t, err == nil)
+
+	err = parser.Parse("1"+strings.Repeat(",2", 1000), nil)
+	assert(t, err != nil)
+	assert(t, err.Kind == StepLimitError)
+	assert(t, err.Details[0].Msg == "maximum number of steps exceeded")
+}
+
+func TestMaxValuesLimit(t *testing.T) {
+	parser, _ := NewParser(`
+		NEST <- '(' NEST ')' / 'x'
+	`)
+
+	parser.Limits.MaxValues = 50
+	err := parser.Parse("((x))", nil)
+	assert(t, err == nil)
+
+	err = parser.Parse(strings.Repeat("(", 100)+"x"+strings.Repeat(")", 100), nil)
+	assert(t, err != nil)
+	assert(t, err.Kind == ValueLimitError)
+}
+
+func TestSyntaxErrorKind(t *testing.T) {
+	parser, _ := NewParser(`
+		NUMBER <- [0-9]+
+	`)
+
+	parser.Limits = Limits{MaxDepth: 100, MaxSteps: 1000, MaxValues: 100}
+	err := parser.Parse("abc", nil)
+	assert(t, err != nil)
+	assert(t, err.Kind == SyntaxError)
+}
+
+func newCalculatorParser(t *testing.T) *Parser {
+	parser, err := buildCalculatorParser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parser
+}
+
+// Calculator parser for goroutines, which must not call t.Fatal
+func buildCalculatorParser() (*Parser, error) {
+	parser, err := NewParser(`
+        EXPRESSION   <-  ATOM (BINOP ATOM)*
+        ATOM         <-  NUMBER / 'neg' ATOM / '(' EXPRESSION ')'
+        BINOP        <-  < [-+/*] >
+        NUMBER       <-  < [0-9]+ >
+        %whitespace  <-  [ \t]*
+        %word        <-  [a-z]+
+        ---
+        %expr  = EXPRESSION
+        %binop = L + -
+        %binop = L * /
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	g := parser.Grammar
+	g["EXPRESSION"].Action = func(v *Values, d Any) (Any, error) {
+		val := v.ToInt(0)
+		if v.Len() > 1 {
+			rhs := v.ToInt(2)
+			switch v.ToStr(1) {
+			case "+":
+				val += rhs
+			case "-":
+				val -= rhs
+			case "*":
+				val *= rhs
+			case "/":
+				val /= rhs
+			}
+		}
+		return val, nil
+	}
+	g["ATOM"].Action = func(v *Values, d Any) (Any, error) {
+		if v.Choice == 1 {
+			return -v.ToInt(0), nil
+		}
+		return v.ToInt(0), nil
+	}
+	g["BINOP"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+	g["NUMBER"].Action = func(v *Values, d Any) (Any, error) { return strconv.Atoi(v.Token()) }
+	return parser, nil
+}
+
+func TestConcurrentParse(t *testing.T) {
+	cases := []struct {
+		input string
+		want  int
+	}{
+		{"1+2*3*(4-5+6)/7-8", -3},
+		{" 1 + 1 + 1 ", 3},
+		{"neg 2 * (3 + neg 4)", 2},
+		{"((((7))))", 7},
+	}
+
+	packrat := newCalculatorParser(t)
+	packrat.EnablePackratParsing()
+	traced := newCalculatorParser(t)
+	traced.TracerEnter = func(name string, s string, v *Values, d Any, p int) {}
+	traced.TracerLeave = func(name string, s string, v *Values, d Any, p int, l int) {}
+	limited := newCalculatorParser(t)
+	limited.Limits.MaxDepth = 1000
+	parsers := []*Parser{newCalculatorParser(t), packrat, traced, limited}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				parser := parsers[(i+j)%len(parsers)]
+				cs := cases[(i+j)%len(cases)]
+				val, err := parser.ParseAndGetValue(cs.input, nil)
+				if err != nil || val != cs.want {
+					t.Errorf("%q: got %v, %v", cs.input, val, err)
+				}
+				if err := parser.Parse("(1 + 2", nil); err == nil {
+					t.Errorf("%q: no error", "(1 + 2")
+				}
+				if _, err := parser.ParseReader(strings.NewReader(cs.input), nil); err != nil {
+					t.Errorf("%q: %v", cs.input, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestConcurrentNewParser(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			parser, err := buildCalculatorParser()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			val, perr := parser.ParseAndGetValue("1+2*3", nil)
+			if perr != nil || val != 7 {
+				t.Errorf("got %v, %v", val, perr)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConcurrentRuleParse(t *testing.T) {
+	var EXPRESSION, TERM, FACTOR, TERM_OPERATOR, FACTOR_OPERATOR, NUMBER Rule
+
+	EXPRESSION.Ope = Seq(&TERM, Zom(Seq(&TERM_OPERATOR, &TERM)))
+	TERM.Ope = Seq(&FACTOR, Zom(Seq(&FACTOR_OPERATOR, &FACTOR)))
+	FACTOR.Ope = Cho(&NUMBER, Seq(Lit("("), &EXPRESSION, Lit(")")))
+	TERM_OPERATOR.Ope = Tok(Cls("+-"))
+	FACTOR_OPERATOR.Ope = Tok(Cls("/*"))
+	NUMBER.Ope = Tok(Oom(Cls("0-9")))
+
+	reduce := func(sv *Values, d Any) (Any, error) {
+		ret := sv.ToInt(0)
+		for i := 1; i < len(sv.Vs); i += 2 {
+			num := sv.ToInt(i + 1)
+			switch sv.ToStr(i) {
+			case "+":
+				ret += num
+			case "-":
+				ret -= num
+			case "*":
+				ret *= num
+			case "/":
+				ret /= num
+			}
+		}
+		return ret, nil
+	}
+
+	EXPRESSION.Action = reduce
+	TERM.Action = reduce
+	TERM_OPERATOR.Action = func(sv *Values, d Any) (Any, error) { return sv.Token(), nil }
+	FACTOR_OPERATOR.Action = func(sv *Values, d Any) (Any, error) { return sv.Token(), nil }
+	NUMBER.Action = func(sv *Values, d Any) (Any, error) { return strconv.Atoi(sv.Token()) }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, val, err := EXPRESSION.Parse("1+2*3*(4-5+6)/7-8", nil)
+				if err != nil || val != -3 {
+					t.Errorf("got %v, %v", val, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestNamedCaptures(t *testing.T) {
+	parser, err := NewParser(`
+        ASSIGN <- name:NAME ('=' / ':=') (value:NUMBER / value:NAME)? attrs:(',' NAME)* ~END
+        NAME   <- < [a-z]+ >
+        NUMBER <- < [0-9]+ >
+        END    <- ';'
+        %whitespace <- [ ]*
+    `)
+	assert(t, err == nil)
+
+	g := parser.Grammar
+	g["NAME"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+	g["NUMBER"].Action = func(v *Values, d Any) (Any, error) { return strconv.Atoi(v.Token()) }
+
+	var got []string
+	g["ASSIGN"].Action = func(v *Values, d Any) (Any, error) {
+		got = append(got, fmt.Sprintf("%v %v %v %v %v", v.Get("name"), v.Has("value"), v.Get("value"), v.Get("attrs"), v.Get("none")))
+		return nil, nil
+	}
+
+	for _, s := range []string{"x = 1;", "x := y, a, b;", "x = , a;", "x=;"} {
+		err = parser.Parse(s, nil)
+		assert(t, err == nil)
+	}
+	assert(t, got[0] == "x true 1 <nil> <nil>")
+	assert(t, got[1] == "x true y [a b] <nil>")
+	assert(t, got[2] == "x false <nil> a <nil>")
+	assert(t, got[3] == "x false <nil> <nil> <nil>")
+
+	// The values of a failed alternative are not labeled
+	parser, err = NewParser(`
+        S <- x:A y:B / x:A z:A
+        A <- 'a'
+        B <- 'b'
+    `)
+	assert(t, err == nil)
+	parser.Grammar["S"].Action = func(v *Values, d Any) (Any, error) {
+		return fmt.Sprint(v.Has("x"), v.Has("y"), v.Has("z")), nil
+	}
+	val, err := parser.ParseAndGetValue("aa", nil)
+	assert(t, err == nil && val == "true false true")
+
+	// Nor are the values of a failed iteration
+	parser, err = NewParser(`
+        S <- (x:A y:B)* z:A
+        A <- < 'a' >
+        B <- < 'b' >
+    `)
+	assert(t, err == nil)
+	parser.Grammar["A"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+	parser.Grammar["S"].Action = func(v *Values, d Any) (Any, error) {
+		return fmt.Sprintf("%v %v", v.Get("x"), v.Get("z")), nil
+	}
+	val, err = parser.ParseAndGetValue("aba", nil)
+	assert(t, err == nil && val == "a a")
+	val, err = parser.Compile().ParseAndGetValue("aba", nil)
+	assert(t, err == nil && val == "a a")
+}
+
+func TestNamedCapturesOnTerminals(t *testing.T) {
+	parser, err := NewParser(`
+        S <- op:'x' k:('a' / 'b') o:'c'? n:[0-9]*
+    `)
+	assert(t, err == nil)
+
+	parser.Grammar["S"].Action = func(v *Values, d Any) (Any, error) {
+		var items []string
+		for _, name := range []string{"op", "k", "o", "n"} {
+			if v.Has(name) {
+				tok := v.Get(name).(Token)
+				items = append(items, fmt.Sprintf("%s=%s@%d", name, tok.S, tok.Pos))
+			}
+		}
+		return strings.Join(items, " "), nil
+	}
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"xb", "op=x@0 k=b@1"},
+		{"xac12", "op=x@0 k=a@1 o=c@2 n=12@3"},
+		{"xa3", "op=x@0 k=a@1 n=3@2"},
+	}
+	for _, tt := range tests {
+		val, err := parser.ParseAndGetValue(tt.in, nil)
+		assert(t, err == nil && val == tt.want)
+		val, err = parser.Compile().ParseAndGetValue(tt.in, nil)
+		assert(t, err == nil && val == tt.want)
+		val, err = parser.ParseReader(strings.NewReader(tt.in), nil)
+		assert(t, err == nil && val == tt.want)
+		val, err = parser.Compile().ParseReader(strings.NewReader(tt.in), nil)
+		assert(t, err == nil && val == tt.want)
+	}
+}
+
+func TestNamedCapturesInExpression(t *testing.T) {
+	parser, err := NewParser(`
+        EXPR   <- lhs:ATOM (op:BINOP rhs:ATOM)*
+        ATOM   <- < [0-9]+ >
+        BINOP  <- < [-+*/] >
+        ---
+        %expr  = EXPR
+        %binop = L + -
+        %binop = L * /
+    `)
+	assert(t, err == nil)
+	assert(t, parser.Grammar["EXPR"].Ope.String() == "lhs:ATOM (op:BINOP rhs:ATOM)*")
+
+	g := parser.Grammar
+	g["ATOM"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+	g["BINOP"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+	g["EXPR"].Action = func(v *Values, d Any) (Any, error) {
+		return fmt.Sprintf("(%v %v %v)", v.Get("lhs"), v.Get("op"), v.Get("rhs")), nil
+	}
+	val, err := parser.ParseAndGetValue("1+2*3-4", nil)
+	assert(t, err == nil)
+	assert(t, val == "((1 + (2 * 3)) - 4)")
+}
+
+func TestNamedCapturesAst(t *testing.T) {
+	parser, err := NewParser(`
+        PAIR  <- key:NAME ':' value:(NAME / LIST)
+        LIST  <- '[' items:NAME* ']'
+        NAME  <- < [a-z]+ >
+        %whitespace <- [ ]*
+    `)
+	assert(t, err == nil)
+	parser.EnableAst()
+
+	ast, err := parser.ParseAndGetAst("a: [b c]", nil)
+	assert(t, err == nil)
+	assert(t, ast.Nodes[0].Capture == "key")
+	assert(t, ast.Nodes[1].Capture == "value")
+	assert(t, ast.Nodes[1].Nodes[1].Capture == "items")
+
+	ast = NewAstOptimizer(nil).Optimize(ast, nil)
+	assert(t, ast.String() == `+ PAIR
+  - key:NAME ("a")
+  + value:LIST
+    - items:NAME ("b")
+    - items:NAME ("c")
+`)
+
+	// A collapsed node takes the label of its parent
+	ast, err = parser.ParseAndGetAst("a: [b]", nil)
+	assert(t, err == nil)
+	ast = NewAstOptimizer(nil).Optimize(ast, nil)
+	assert(t, ast.Nodes[1].Name == "NAME" && ast.Nodes[1].Capture == "value")
+}
+
+func TestValueAccessors(t *testing.T) {
+	v := &Values{Vs: []Any{"a", 1, true, 1.5, 'x', &Ast{Name: "A"}}, Ts: []Token{{Pos: 3, S: "b"}}}
+	assert(t, v.ToStr(0) == "a" && v.ToInt(1) == 1 && v.ToBool(2))
+	assert(t, v.ToFloat(3) == 1.5 && v.ToRune(4) == 'x' && v.ToAst(5).Name == "A")
+	assert(t, v.ToToken(0) == Token{Pos: 3, S: "b"})
+
+	n, err := Get[int](v, 1)
+	assert(t, err == nil && n == 1)
+	_, err = Get[int](v, 0)
+	assert(t, err != nil && err.Error() == "value 0 is string, not int")
+	_, err = v.StrAt(6)
+	assert(t, err != nil && err.Error() == "value 6 is out of range (6 values)")
+	_, err = v.TokenAt(1)
+	assert(t, err != nil && err.Error() == "token 1 is out of range (1 tokens)")
+	var verr *ValueError
+	assert(t, errors.As(err, &verr) && verr.Index == 1)
+}
+
+func TestValueAccessorsInAction(t *testing.T) {
+	parser, err := NewParser(`
+        LIST   <- '(' NUMBER* ')'
+        NUMBER <- < [0-9]+ >
+        %whitespace <- [ ]*
+    `)
+	assert(t, err == nil)
+
+	g := parser.Grammar
+	g["NUMBER"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+	g["LIST"].Action = func(v *Values, d Any) (Any, error) {
+		return v.ToInt(0), nil
+	}
+
+	// A wrong type or a missing value fails the action at the rule
+	for _, s := range []string{" (1)", " ()"} {
+		_, err = parser.ParseAndGetValue(s, nil)
+		assert(t, err != nil && err.Details[0].Col == 2)
+	}
+	_, err = parser.ParseAndGetValue("(1)", nil)
+	assert(t, err.Error() == "1:1 value 0 is string, not int")
+	_, err = parser.Compile().ParseAndGetValue("()", nil)
+	assert(t, err.Error() == "1:1 value 0 is out of range (0 values)")
+
+	// Other panics are not recovered
+	g["LIST"].Action = func(v *Values, d Any) (Any, error) { panic("boom") }
+	defer func() { assert(t, recover() == "boom") }()
+	parser.Parse("()", nil)
+}
+
+func TestErrorInterface(t *testing.T) {
+	parser, err := NewParserErr(`
+        LIST   <- '(' NUMBER (',' NUMBER)* ')'
+        NUMBER <- < [0-9]+ >
+        %whitespace <- [ ]*
+    `)
+	assert(t, err == nil)
+
+	errTooLarge := errors.New("too large")
+	parser.Grammar["NUMBER"].Action = func(v *Values, d Any) (Any, error) {
+		if len(v.Token()) > 3 {
+			return nil, errTooLarge
+		}
+		return strconv.Atoi(v.Token())
+	}
+
+	val, err := parser.ParseAndGetValueErr("(1, 2)", nil)
+	assert(t, err == nil && val == 1)
+	assert(t, parser.ParseErr("(1)", nil) == nil)
+
+	// Syntax error
+	err = parser.ParseErr("(x)", nil)
+	var perr *Error
+	assert(t, errors.As(err, &perr) && perr.Kind == SyntaxError)
+	d := perr.Details[0]
+	assert(t, d.Pos == 1 && d.Rule == "NUMBER" && d.Kind == SyntaxError && d.Err == nil)
+	var detail ErrorDetail
+	assert(t, errors.As(err, &detail) && detail.Error() == "1:2 expected NUMBER, found 'x'")
+
+	_, perr = parser.ParseAndGetValue("(1 2)", nil)
+	assert(t, perr.Details[0].Pos == 3 && perr.Details[0].Rule == "LIST")
+
+	// Action error
+	err = parser.ParseErr("(1, 23456)", nil)
+	assert(t, errors.Is(err, errTooLarge))
+	assert(t, errors.As(err, &perr) && perr.Kind == SyntaxError)
+	d = perr.Details[0]
+	assert(t, d.Pos == 4 && d.Rule == "NUMBER" && d.Kind == ActionError && d.Msg == "too large")
+
+	// The error of a To accessor is the original error of the action
+	parser.Grammar["LIST"].Action = func(v *Values, d Any) (Any, error) { return v.ToStr(0), nil }
+	err = parser.ParseErr("(1)", nil)
+	var verr *ValueError
+	assert(t, errors.As(err, &verr) && verr.Index == 0)
+	parser.Grammar["LIST"].Action = nil
+
+	// Not exact match
+	_, perr = parser.ParseAndGetValue("(1) 2", nil)
+	d = perr.Details[0]
+	assert(t, d.Pos == 4 && d.Rule == "LIST" && d.Kind == NotExactMatchError)
+	assert(t, d.Kind.String() == "not exact match")
+
+	// Grammar error
+	_, err = NewParserErr(`
+        A <- B
+    `)
+	assert(t, errors.As(err, &perr) && perr.Kind == GrammarError)
+	d = perr.Details[0]
+	assert(t, d.Pos == 14 && d.Rule == "A" && d.Kind == GrammarError && d.Msg == "'B' is not defined.")
+
+	_, err = NewParserErr(`A <- (`)
+	assert(t, errors.As(err, &perr) && perr.Kind == GrammarError && perr.Details[0].Kind == GrammarError)
+}
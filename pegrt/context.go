@@ -0,0 +1,842 @@
+package pegrt
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+func success(l int) bool {
+	return l != -1
+}
+
+func fail(l int) bool {
+	return l == -1
+}
+
+// Action
+type Action func(v *Values, d Any) (Any, error)
+
+// Invoke an action. A *ValueError panic of a To accessor is returned as the
+// error of the action.
+func (a Action) call(v *Values, d Any) (val Any, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			e, ok := x.(*ValueError)
+			if !ok {
+				panic(x)
+			}
+			val, err = nil, e
+		}
+	}()
+	return a(v, d)
+}
+
+// Binary operator of a %expr rule
+type BinOp struct {
+	Level int
+	Assoc int
+}
+
+const (
+	AssocNone = iota
+	AssocLeft
+	AssocRight
+)
+
+// Rule of a generated parser. The handlers are attached by the user, and the
+// other fields are set by the generated code.
+type Rule struct {
+	Name    string
+	Action  Action
+	Enter   func(d Any)
+	Leave   func(d Any)
+	Message func() (message string)
+	Ignore  bool
+
+	TokenRule bool             // Errors in the rule are reported by its name
+	BinOps    map[string]BinOp // Operators of a %expr rule, whose action is invoked on each operation
+	Labels    [3]string        // Labels of the left atom, the operator and the right atom of BinOps
+}
+
+// Generated function that parses a rule or an expression at p into v
+type RuleFunc func(c *Context, p int, v *Values) int
+
+// Context
+type Context struct {
+	s string
+	d Any
+
+	rule string // Rule being parsed
+
+	errorPos    int
+	errorRule   string
+	expected    []string
+	messagePos  int
+	messageRule string
+	messageErr  error
+	message     string
+
+	svStack []Values
+
+	inToken     bool
+	inTokenRule int
+
+	whitespace   RuleFunc
+	inWhitespace bool
+
+	word    RuleFunc
+	isWord  map[string]bool
+	wordCtx *Context // Context of the word checks, made by the first one
+
+	lastToken string
+
+	cut bool
+
+	errors    []errorRecord
+	label     string
+	labelPos  int
+	labelRule string
+}
+
+// Parse s from a start rule, with the %whitespace and %word rules if the
+// grammar has them
+func Parse(s string, d Any, start *Rule, parse RuleFunc, whitespace RuleFunc, word RuleFunc) (val Any, err *Error) {
+	c := &Context{
+		s:          s,
+		d:          d,
+		errorPos:   -1,
+		messagePos: -1,
+		whitespace: whitespace,
+		word:       word,
+	}
+	v := &Values{}
+
+	l := c.skip(0) // Skip whitespace at beginning
+	if success(l) {
+		if chl := parse(c, l, v); success(chl) {
+			l += chl
+		} else {
+			l = -1
+		}
+	}
+
+	if success(l) && len(v.Vs) > 0 && v.Vs[0] != nil {
+		val = v.Vs[0]
+	}
+
+	records := c.errors
+	if fail(l) || l != len(s) {
+		rec := errorRecord{}
+		if fail(l) {
+			if len(c.label) > 0 {
+				rec.pos = c.labelPos
+				rec.label = c.label
+				rec.rule = c.labelRule
+				if c.errorPos == c.labelPos {
+					rec.expected = c.expected
+				}
+			} else if c.messagePos > -1 {
+				rec.pos = c.messagePos
+				rec.msg = c.message
+				rec.rule = c.messageRule
+				if c.messageErr != nil {
+					rec.kind = ActionError
+					rec.err = c.messageErr
+				}
+			} else {
+				rec.pos = c.errorPos
+				rec.rule = c.errorRule
+				rec.expected = c.expected
+			}
+		} else {
+			rec.msg = "not exact match"
+			rec.pos = l
+			rec.rule = start.Name
+			rec.kind = NotExactMatchError
+		}
+		records = append(records, rec)
+	}
+
+	if len(records) > 0 {
+		err = newError(s, records)
+	}
+	return
+}
+
+// Values of an expression whose values are dropped, which Ignore, And and
+// Not pop
+func (c *Context) Push() *Values {
+	c.svStack = append(c.svStack, Values{SS: c.s})
+	return &c.svStack[len(c.svStack)-1]
+}
+
+func (c *Context) pop() {
+	c.svStack = c.svStack[:len(c.svStack)-1]
+}
+
+// A cut or a labeled failure must not be backtracked
+func (c *Context) committed() bool {
+	return c.cut || len(c.label) > 0
+}
+
+// Message of the current rule, with the error of its action if it failed
+func (c *Context) setMessage(p int, msg string, err error) {
+	c.messagePos = p
+	c.messageRule = c.rule
+	c.messageErr = err
+	c.message = msg
+}
+
+func (c *Context) setErrorPos(p int) {
+	if c.errorPos < p {
+		c.errorPos = p
+		c.errorRule = c.rule
+		c.expected = nil
+	}
+}
+
+// Record what was expected at the furthest error position
+func (c *Context) addExpected(p int, item string) {
+	if c.inTokenRule > 0 || c.inWhitespace {
+		c.setErrorPos(p)
+		return
+	}
+	if c.errorPos < p {
+		c.errorPos = p
+		c.errorRule = c.rule
+		c.expected = []string{item}
+	} else if c.errorPos == p {
+		for _, e := range c.expected {
+			if e == item {
+				return
+			}
+		}
+		c.expected = append(c.expected, item)
+	}
+}
+
+// Error state
+type errorState struct {
+	pos      int
+	rule     string
+	expected []string
+}
+
+func (c *Context) errorState() errorState {
+	return errorState{c.errorPos, c.errorRule, c.expected}
+}
+
+func (c *Context) restoreError(e errorState) {
+	c.errorPos = e.pos
+	c.errorRule = e.rule
+	c.expected = e.expected
+}
+
+func (c *Context) mergeError(e errorState) {
+	if c.errorPos < e.pos {
+		c.restoreError(e)
+	} else if c.errorPos == e.pos {
+		for _, item := range e.expected {
+			c.addExpected(e.pos, item)
+		}
+	}
+}
+
+// State that the values and the errors go back to when an expression fails
+type Mark struct {
+	Values *Values // Values of a predicate, which are dropped
+
+	vs       []Any
+	ts       []Token
+	captures []captureRange
+	choice   int
+	errors   int
+	err      errorState
+	cut      bool
+	failed   bool // A committed repetition failed
+}
+
+func (c *Context) mark(v *Values) Mark {
+	m := Mark{errors: len(c.errors), err: c.errorState(), cut: c.cut}
+	if v != nil {
+		m.vs, m.ts, m.captures, m.choice = v.Vs, v.Ts, v.captures, v.Choice
+	}
+	c.cut = false
+	return m
+}
+
+func (c *Context) restore(m *Mark, v *Values) {
+	v.Vs, v.Ts, v.captures = m.vs, m.ts, m.captures
+	c.errors = c.errors[:m.errors]
+}
+
+// Literal String
+func (c *Context) Lit(p int, lit string) int {
+	l := len(lit)
+	if p+l > len(c.s) || c.s[p:p+l] != lit {
+		c.addExpected(p, "'"+escapeString(lit)+"'")
+		return -1
+	}
+	return c.literal(p, l, lit)
+}
+
+// Case-insensitive Literal String
+func (c *Context) LitI(p int, lit string) int {
+	l := 0
+	for _, lr := range lit {
+		if p+l >= len(c.s) {
+			l = -1
+			break
+		}
+		r, size := utf8.DecodeRuneInString(c.s[p+l:])
+		if !equalFold(lr, r) {
+			l = -1
+			break
+		}
+		l += size
+	}
+	if fail(l) {
+		c.addExpected(p, "'"+escapeString(lit)+"'i")
+		return -1
+	}
+	return c.literal(p, l, lit)
+}
+
+func equalFold(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	for f := unicode.SimpleFold(a); f != a; f = unicode.SimpleFold(f) {
+		if f == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Word check and whitespace skipping after a literal of length l
+func (c *Context) literal(p int, l int, lit string) int {
+	if c.word != nil && c.literalIsWord(lit) && c.wordAt(p+l) {
+		return -1
+	}
+
+	if c.inToken == false {
+		len := c.skip(p + l)
+		if fail(len) {
+			return -1
+		}
+		l += len
+	}
+	return l
+}
+
+// Whether a literal matches %word is cached per parse
+func (c *Context) literalIsWord(lit string) bool {
+	isWord, ok := c.isWord[lit]
+	if !ok {
+		w := &Context{s: lit, errorPos: -1, messagePos: -1}
+		isWord = success(c.word(w, 0, &Values{SS: lit}))
+		if c.isWord == nil {
+			c.isWord = make(map[string]bool)
+		}
+		c.isWord[lit] = isWord
+	}
+	return isWord
+}
+
+// Whether a word goes on at p. Word checks don't report errors to the parse,
+// so they get a context of their own that is reused.
+func (c *Context) wordAt(p int) bool {
+	if c.wordCtx == nil {
+		c.wordCtx = &Context{s: c.s, errorPos: -1, messagePos: -1}
+	}
+	w := c.wordCtx
+	l := c.word(w, p, w.Push())
+	w.pop()
+	w.cut = false
+	w.label = ""
+	w.errors = w.errors[:0]
+	return success(l)
+}
+
+// Skip whitespace, whose values are ignored
+func (c *Context) skip(p int) int {
+	if c.whitespace == nil || c.inWhitespace {
+		return 0
+	}
+	c.inWhitespace = true
+	l := c.whitespace(c, p, c.Push())
+	c.pop()
+	c.inWhitespace = false
+	return l
+}
+
+// Range of characters
+type Range struct {
+	Lo rune
+	Hi rune
+}
+
+// Character Class. Bytes are ranges of bytes that aren't part of a UTF-8
+// encoded character.
+type Class struct {
+	Desc    string
+	Ranges  []Range
+	Bytes   []Range
+	Negated bool
+}
+
+func (c *Context) Class(p int, o *Class) int {
+	if p < len(c.s) {
+		if o.Bytes != nil && o.containsByte(c.s[p]) {
+			if !o.Negated {
+				return 1
+			}
+		} else if ch, size := utf8.DecodeRuneInString(c.s[p:]); o.contains(ch) {
+			return size
+		}
+	}
+	c.addExpected(p, o.Desc)
+	return -1
+}
+
+func (o *Class) contains(ch rune) bool {
+	matched := false
+	for _, rg := range o.Ranges {
+		if rg.Lo <= ch && ch <= rg.Hi {
+			matched = true
+			break
+		}
+	}
+	return matched != o.Negated
+}
+
+func (o *Class) containsByte(b byte) bool {
+	for _, rg := range o.Bytes {
+		if rg.Lo <= rune(b) && rune(b) <= rg.Hi {
+			return true
+		}
+	}
+	return false
+}
+
+// Any Character
+func (c *Context) Dot(p int) int {
+	if p >= len(c.s) {
+		c.addExpected(p, "any character")
+		return -1
+	}
+	_, l := utf8.DecodeRuneInString(c.s[p:])
+	return l
+}
+
+// Cut
+func (c *Context) Cut() int {
+	c.cut = true
+	return 0
+}
+
+// Prioritized Choice. The alternatives are parsed into the values of the
+// choice, which are restored when one fails.
+func (c *Context) BeginChoice(v *Values) Mark {
+	return c.mark(v)
+}
+
+// Whether the alternative id that returned l decides the choice
+func (c *Context) Alternative(m *Mark, v *Values, id int, l int) bool {
+	if success(l) {
+		v.Choice = id
+		c.cut = m.cut
+		return true
+	}
+	c.restore(m, v)
+	if c.committed() {
+		c.EndChoice(m, v)
+		return true
+	}
+	c.cut = false
+	return false
+}
+
+// Failure of a choice
+func (c *Context) EndChoice(m *Mark, v *Values) int {
+	v.Choice = m.choice
+	c.cut = m.cut
+	return -1
+}
+
+// Repetition
+func (c *Context) BeginRepeat() Mark {
+	m := c.mark(nil)
+	c.cut = m.cut
+	return m
+}
+
+// Whether another iteration can start at p
+func (c *Context) Iterate(m *Mark, v *Values, p int) bool {
+	if p >= len(c.s) {
+		return false
+	}
+	m.vs, m.ts, m.captures = v.Vs, v.Ts, v.captures
+	m.errors = len(c.errors)
+	c.cut = false
+	return true
+}
+
+// Length of an iteration, which ends the repetition if it is not positive
+func (c *Context) Iterated(m *Mark, v *Values, l int) int {
+	if fail(l) {
+		if c.committed() {
+			m.failed = true
+			return -1
+		}
+		c.restore(m, v)
+		c.restoreError(m.err)
+	}
+	return l
+}
+
+// Length of a repetition of length l
+func (c *Context) EndRepeat(m *Mark, l int) int {
+	c.cut = m.cut
+	if m.failed {
+		return -1
+	}
+	return l
+}
+
+// Option
+func (c *Context) BeginOption(v *Values) Mark {
+	return c.mark(v)
+}
+
+func (c *Context) Option(m *Mark, v *Values, l int) int {
+	if fail(l) && !c.committed() {
+		c.restore(m, v)
+		c.restoreError(m.err)
+		l = 0
+	}
+	c.cut = m.cut
+	return l
+}
+
+// Predicates parse into the values of the mark, which they drop
+func (c *Context) BeginPredicate() Mark {
+	m := c.mark(nil)
+	c.cut = m.cut
+	m.Values = c.Push()
+	return m
+}
+
+// And Predicate
+func (c *Context) And(m *Mark, l int) int {
+	c.endPredicate(m)
+	if success(l) {
+		return 0
+	}
+	return -1
+}
+
+// Not Predicate
+func (c *Context) Not(m *Mark, p int, l int) int {
+	c.endPredicate(m)
+	if success(l) {
+		c.setErrorPos(p)
+		return -1
+	}
+	c.restoreError(m.err)
+	return 0
+}
+
+func (c *Context) endPredicate(m *Mark) {
+	c.pop()
+	c.cut = m.cut
+	c.errors = c.errors[:m.errors]
+	c.label = ""
+}
+
+// Ignore, which pops the pushed values
+func (c *Context) Ignore(l int) int {
+	c.pop()
+	return l
+}
+
+// Token Boundary
+func (c *Context) BeginToken() {
+	c.inToken = true
+}
+
+func (c *Context) EndToken(p int, v *Values, l int) int {
+	c.inToken = false
+	if fail(l) {
+		return -1
+	}
+	v.Ts = append(v.Ts, Token{p, c.s[p : p+l]})
+
+	// Skip whiltespace
+	len := c.skip(p + l)
+	if fail(len) {
+		return -1
+	}
+	return l + len
+}
+
+// Labeled expression, whose values start at begin. The text is labeled if
+// the expression has no rules and produced no values.
+func (c *Context) Capture(v *Values, name string, text bool, begin int, p int, l int) int {
+	if success(l) {
+		if len(v.Vs) > begin {
+			v.captures = append(v.captures, captureRange{name, begin, len(v.Vs), nil})
+		} else if text && l > 0 {
+			v.captures = append(v.captures, captureRange{name, begin, begin, &Token{p, c.s[p : p+l]}})
+		}
+	}
+	return l
+}
+
+// Labeled failure
+func (c *Context) BeginThrow(v *Values) Mark {
+	m := c.mark(v)
+	c.cut = m.cut
+	c.restoreError(errorState{pos: -1})
+	return m
+}
+
+// Length of a labeled expression that returned l, and whether the recovery
+// expression is parsed instead
+func (c *Context) Throw(m *Mark, v *Values, p int, label string, recovery *Rule, l int) (int, bool) {
+	if success(l) || len(c.label) > 0 {
+		c.mergeError(m.err)
+		return l, false
+	}
+
+	inner := c.errorState()
+	if inner.pos < p {
+		inner = errorState{pos: p, rule: c.rule}
+	}
+	c.restoreError(m.err)
+	c.restore(m, v)
+
+	if recovery == nil {
+		c.label = label
+		c.labelPos = inner.pos
+		c.labelRule = inner.rule
+		c.mergeError(inner)
+		return -1, false
+	}
+
+	var msg string
+	if recovery.Message != nil {
+		msg = recovery.Message()
+	}
+	c.errors = append(c.errors, errorRecord{inner.pos, msg, label, inner.expected, inner.rule, SyntaxError, nil})
+	return 0, true
+}
+
+// State of a rule between Enter and Leave
+type Frame struct {
+	Values    *Values // Values of the definition of the rule
+	rule      *Rule
+	saveCut   bool
+	saveRule  string
+	saveError errorState
+}
+
+// A cut only commits the choices of the rule that it is in
+func (c *Context) Enter(r *Rule, p int) (f Frame) {
+	f.rule = r
+	f.saveCut = c.cut
+	c.cut = false
+
+	if r.Enter != nil {
+		r.Enter(c.d)
+	}
+
+	f.Values = c.Push()
+
+	f.saveRule = c.rule
+	if len(r.Name) > 0 {
+		c.rule = r.Name
+	}
+
+	// Token rules are reported by name instead of their internals
+	if r.TokenRule {
+		f.saveError = c.errorState()
+		c.restoreError(errorState{pos: -1})
+		c.inTokenRule++
+	}
+	return
+}
+
+// Invoke the action of a rule whose definition returned l
+func (c *Context) Leave(f *Frame, p int, v *Values, l int) int {
+	r := f.rule
+	chv := f.Values
+
+	if r.TokenRule {
+		c.inTokenRule--
+		pos := c.errorPos
+		c.restoreError(f.saveError)
+		if pos >= 0 {
+			c.addExpected(pos, r.Name)
+		}
+	}
+
+	// Invoke action
+	var val Any
+
+	if success(l) {
+		chv.S = c.s[p : p+l]
+		chv.Pos = p
+		c.lastToken = chv.Token()
+
+		if r.Action != nil && r.BinOps == nil {
+			var err error
+			if val, err = r.Action.call(chv, c.d); err != nil {
+				if c.messagePos < p {
+					c.setMessage(p, err.Error(), err)
+				}
+				l = -1
+			}
+		} else if len(chv.Vs) > 0 {
+			val = chv.Vs[0]
+		}
+	}
+
+	if success(l) {
+		if r.Ignore == false {
+			v.Vs = append(v.Vs, val)
+		}
+	} else {
+		if r.Message != nil {
+			if c.messagePos < p {
+				c.setMessage(p, r.Message(), nil)
+			}
+		}
+	}
+
+	c.pop()
+	c.rule = f.saveRule
+
+	if r.Leave != nil {
+		r.Leave(c.d)
+	}
+
+	c.cut = f.saveCut
+	return l
+}
+
+// Macros are expanded into the values of the reference
+func (c *Context) BeginMacro() (saveCut bool) {
+	saveCut = c.cut
+	c.cut = false
+	return
+}
+
+func (c *Context) EndMacro(saveCut bool, l int) int {
+	c.cut = saveCut
+	return l
+}
+
+// Expression parsing of the rule r from the operands and the operators
+func (c *Context) Expression(p int, v *Values, r *Rule, atom RuleFunc, binop RuleFunc) int {
+	return c.expression(p, v, r, atom, binop, 0)
+}
+
+func (c *Context) expression(p int, v *Values, r *Rule, atom RuleFunc, binop RuleFunc, minPrec int) (l int) {
+	l = atom(c, p, v)
+	if fail(l) {
+		return
+	}
+
+	saveError := c.errorState()
+	saveCut := c.cut
+	defer func() {
+		c.cut = saveCut
+	}()
+
+	for p+l < len(c.s) {
+		saveVs := v.Vs
+		saveTs := v.Ts
+		saveErrors := len(c.errors)
+		c.cut = false
+
+		chv := c.Push()
+		chl := binop(c, p+l, chv)
+		c.pop()
+
+		if fail(chl) {
+			if c.committed() {
+				l = -1
+				return
+			}
+			c.errors = c.errors[:saveErrors]
+			c.restoreError(saveError)
+			break
+		}
+
+		inf, ok := r.BinOps[c.lastToken]
+		if !ok || inf.Level < minPrec {
+			break
+		}
+
+		v.Vs = append(v.Vs, chv.Vs[0])
+		l += chl
+
+		nextMinPrec := inf.Level
+		if inf.Assoc == AssocLeft {
+			nextMinPrec = inf.Level + 1
+		}
+
+		chv = c.Push()
+		chl = c.expression(p+l, chv, r, atom, binop, nextMinPrec)
+		c.pop()
+
+		if fail(chl) {
+			if c.committed() {
+				l = -1
+				return
+			}
+			v.Vs = saveVs
+			v.Ts = saveTs
+			c.errors = c.errors[:saveErrors]
+			c.restoreError(saveError)
+			break
+		}
+
+		v.Vs = append(v.Vs, chv.Vs[0])
+		l += chl
+
+		var val Any
+		if r.Action != nil {
+			v.S = c.s[p : p+l]
+			v.Pos = p
+
+			v.captures = nil
+			for i, name := range r.Labels {
+				if len(name) > 0 {
+					v.captures = append(v.captures, captureRange{name, i, i + 1, nil})
+				}
+			}
+
+			var err error
+			if val, err = r.Action.call(v, c.d); err != nil {
+				if c.messagePos < p {
+					c.setMessage(p, err.Error(), err)
+				}
+				l = -1
+				v.Vs = saveVs
+				v.Ts = saveTs
+				c.restoreError(saveError)
+				break
+			}
+		} else if len(v.Vs) > 0 {
+			val = v.Vs[0]
+		}
+
+		v.Vs = []Any{val}
+		v.captures = nil
+	}
+
+	return
+}
@@ -0,0 +1,175 @@
+package pegrt
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Error detail
+type ErrorDetail struct {
+	Ln       int
+	Col      int
+	Msg      string
+	Label    string
+	Expected []string
+	Pos      int       // Byte offset in the input
+	Rule     string    // Rule that was being parsed
+	Kind     ErrorKind // Kind of this detail
+	Err      error     // Error of the action
+}
+
+func (d ErrorDetail) String() string {
+	return fmt.Sprintf("%d:%d %s", d.Ln, d.Col, d.Msg)
+}
+
+func (d ErrorDetail) Error() string {
+	return d.String()
+}
+
+func (d ErrorDetail) Unwrap() error {
+	return d.Err
+}
+
+// Error kind
+type ErrorKind int
+
+const (
+	SyntaxError        ErrorKind = iota // Input does not match the grammar
+	ActionError                         // Action returned an error
+	NotExactMatchError                  // Input is left after the start rule matched
+)
+
+var errorKindNames = []string{
+	"syntax error",
+	"action error",
+	"not exact match",
+}
+
+func (k ErrorKind) String() string {
+	if k < 0 || int(k) >= len(errorKindNames) {
+		return fmt.Sprintf("ErrorKind(%d)", int(k))
+	}
+	return errorKindNames[k]
+}
+
+// Error of the input, whose details have their own kinds
+type Error struct {
+	Details []ErrorDetail
+}
+
+func (e *Error) Error() string {
+	d := e.Details[0]
+	return fmt.Sprintf("%d:%d %s", d.Ln, d.Col, d.Msg)
+}
+
+// Details as errors, for errors.Is and errors.As
+func (e *Error) Unwrap() []error {
+	errs := make([]error, len(e.Details))
+	for i, d := range e.Details {
+		errs[i] = d
+	}
+	return errs
+}
+
+// Error as an error interface, which is nil when e is nil
+func (e *Error) Err() error {
+	if e == nil {
+		return nil
+	}
+	return e
+}
+
+// Error recorded by a recovery expression
+type errorRecord struct {
+	pos      int
+	msg      string
+	label    string
+	expected []string
+	rule     string
+	kind     ErrorKind
+	err      error
+}
+
+// Error of the records, in the order of their positions
+func newError(s string, records []errorRecord) *Error {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].pos < records[j].pos
+	})
+	err := &Error{}
+	for _, rec := range records {
+		ln, col := lineInfo(s, rec.pos)
+		msg := rec.msg
+		if len(msg) == 0 {
+			msg = syntaxErrorMessage(rec.expected, found(s, rec.pos))
+		}
+		err.Details = append(err.Details, ErrorDetail{
+			Ln:       ln,
+			Col:      col,
+			Msg:      msg,
+			Label:    rec.label,
+			Expected: rec.expected,
+			Pos:      rec.pos,
+			Rule:     rec.rule,
+			Kind:     rec.kind,
+			Err:      rec.err,
+		})
+	}
+	return err
+}
+
+func escapeString(s string) string {
+	q := strconv.Quote(s)
+	return q[1 : len(q)-1]
+}
+
+// Description of the character at an offset for error messages
+func found(s string, p int) string {
+	if p < 0 {
+		return ""
+	}
+	if p >= len(s) {
+		return "end of input"
+	}
+	r, _ := utf8.DecodeRuneInString(s[p:])
+	return "'" + escapeString(string(r)) + "'"
+}
+
+func syntaxErrorMessage(expected []string, found string) string {
+	if len(expected) == 0 {
+		return "syntax error"
+	}
+
+	msg := "expected "
+	for i, e := range expected {
+		if i > 0 {
+			if i == len(expected)-1 {
+				msg += " or "
+			} else {
+				msg += ", "
+			}
+		}
+		msg += e
+	}
+
+	return msg + ", found " + found
+}
+
+// lineInfo
+func lineInfo(s string, curPos int) (ln int, col int) {
+	pos := 0
+	colStartPos := 0
+	ln = 1
+
+	for pos < curPos {
+		if s[pos] == '\n' {
+			ln++
+			colStartPos = pos + 1
+		}
+		pos++
+	}
+
+	col = pos - colStartPos + 1
+	return
+}
@@ -0,0 +1,142 @@
+// Package pegrt is the runtime of the parsers generated by peg.Generate. The
+// generated rule functions do the control flow of the grammar, and call the
+// primitives of Context to match text, mark and restore the state of a parse
+// and invoke the handlers of the rules.
+package pegrt
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Any
+type Any interface {
+}
+
+// Token
+type Token struct {
+	Pos int
+	S   string
+}
+
+// Semantic values
+type Values struct {
+	SS     string
+	Vs     []Any
+	Pos    int
+	S      string
+	Choice int
+	Ts     []Token
+
+	captures []captureRange
+}
+
+// Values of a labeled expression
+type captureRange struct {
+	name  string
+	begin int
+	end   int
+	token *Token // Text matched by an expression without values
+}
+
+func (v *Values) Len() int {
+	return len(v.Vs)
+}
+
+// Error of reading a value or a token that isn't there or has another type.
+// The To accessors panic with it, and the panic fails the action with a
+// syntax error at the rule instead of crashing.
+type ValueError struct {
+	Index int
+	Msg   string
+}
+
+func (e *ValueError) Error() string {
+	return e.Msg
+}
+
+// Value at i as a T
+func Get[T any](v *Values, i int) (T, error) {
+	var val T
+	if i < 0 || i >= len(v.Vs) {
+		return val, &ValueError{i, fmt.Sprintf("value %d is out of range (%d values)", i, len(v.Vs))}
+	}
+	val, ok := v.Vs[i].(T)
+	if !ok {
+		want := reflect.TypeOf((*T)(nil)).Elem()
+		return val, &ValueError{i, fmt.Sprintf("value %d is %T, not %v", i, v.Vs[i], want)}
+	}
+	return val, nil
+}
+
+func must[T any](val T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+func (v *Values) StrAt(i int) (string, error)    { return Get[string](v, i) }
+func (v *Values) IntAt(i int) (int, error)       { return Get[int](v, i) }
+func (v *Values) BoolAt(i int) (bool, error)     { return Get[bool](v, i) }
+func (v *Values) FloatAt(i int) (float64, error) { return Get[float64](v, i) }
+func (v *Values) RuneAt(i int) (rune, error)     { return Get[rune](v, i) }
+
+// Token at i, with its position in the input
+func (v *Values) TokenAt(i int) (Token, error) {
+	if i < 0 || i >= len(v.Ts) {
+		return Token{}, &ValueError{i, fmt.Sprintf("token %d is out of range (%d tokens)", i, len(v.Ts))}
+	}
+	return v.Ts[i], nil
+}
+
+func (v *Values) ToStr(i int) string    { return must(v.StrAt(i)) }
+func (v *Values) ToInt(i int) int       { return must(v.IntAt(i)) }
+func (v *Values) ToBool(i int) bool     { return must(v.BoolAt(i)) }
+func (v *Values) ToFloat(i int) float64 { return must(v.FloatAt(i)) }
+func (v *Values) ToRune(i int) rune     { return must(v.RuneAt(i)) }
+func (v *Values) ToToken(i int) Token   { return must(v.TokenAt(i)) }
+
+// Value of an expression labeled with name, such as lhs:EXPR. Several values,
+// from a repetition or a label used more than once, are returned as []Any.
+func (v *Values) Get(name string) Any {
+	var vs []Any
+	for _, r := range v.captures {
+		if r.name == name {
+			if r.token != nil {
+				vs = append(vs, *r.token)
+			} else {
+				vs = append(vs, v.Vs[r.begin:r.end]...)
+			}
+		}
+	}
+	switch len(vs) {
+	case 0:
+		return nil
+	case 1:
+		return vs[0]
+	}
+	return vs
+}
+
+// Whether an expression labeled with name produced a value or matched text
+func (v *Values) Has(name string) bool {
+	for _, r := range v.captures {
+		if r.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *Values) Token() string {
+	if len(v.Ts) > 0 {
+		return v.Ts[0].S
+	}
+	return v.S
+}
+
+// Line and column of Pos
+func (v *Values) LineInfo() (ln int, col int) {
+	return lineInfo(v.SS, v.Pos)
+}
@@ -1,20 +1,77 @@
 package peg
 
-import "fmt"
+import (
+	gocontext "context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
 
 // Error detail
 type ErrorDetail struct {
-	Ln  int
-	Col int
-	Msg string
+	Ln       int
+	Col      int
+	Msg      string
+	Label    string
+	Expected []string
+	Pos      int       // Byte offset in the input
+	Rule     string    // Rule that was being parsed, or the rule of a grammar error
+	Kind     ErrorKind // Kind of this detail
+	Err      error     // Error of the action, the context or the reader
 }
 
 func (d ErrorDetail) String() string {
 	return fmt.Sprintf("%d:%d %s", d.Ln, d.Col, d.Msg)
 }
 
-// Error
+func (d ErrorDetail) Error() string {
+	return d.String()
+}
+
+func (d ErrorDetail) Unwrap() error {
+	return d.Err
+}
+
+// Error kind
+type ErrorKind int
+
+const (
+	SyntaxError        ErrorKind = iota // Input does not match the grammar
+	CanceledError                       // Context was canceled or timed out
+	DepthLimitError                     // Limits.MaxDepth was exceeded
+	StepLimitError                      // Limits.MaxSteps was exceeded
+	ValueLimitError                     // Limits.MaxValues was exceeded
+	ActionError                         // Action returned an error
+	NotExactMatchError                  // Input is left after the start rule matched
+	GrammarError                        // Grammar was rejected
+	ReadError                           // Reader of ParseReader failed
+)
+
+var errorKindNames = []string{
+	"syntax error",
+	"canceled",
+	"depth limit exceeded",
+	"step limit exceeded",
+	"value limit exceeded",
+	"action error",
+	"not exact match",
+	"grammar error",
+	"read error",
+}
+
+func (k ErrorKind) String() string {
+	if k < 0 || int(k) >= len(errorKindNames) {
+		return fmt.Sprintf("ErrorKind(%d)", int(k))
+	}
+	return errorKindNames[k]
+}
+
+// Error. Kind is GrammarError for grammars, the kind of a canceled or limited
+// parse, or SyntaxError for other errors of the input, whose details have
+// their own kinds.
 type Error struct {
+	Kind    ErrorKind
 	Details []ErrorDetail
 }
 
@@ -23,9 +80,60 @@ func (e *Error) Error() string {
 	return fmt.Sprintf("%d:%d %s", d.Ln, d.Col, d.Msg)
 }
 
+// Details as errors, for errors.Is and errors.As
+func (e *Error) Unwrap() []error {
+	errs := make([]error, len(e.Details))
+	for i, d := range e.Details {
+		errs[i] = d
+	}
+	return errs
+}
+
+// Error as an error interface, which is nil when e is nil
+func (e *Error) Err() error {
+	if e == nil {
+		return nil
+	}
+	return e
+}
+
+// Error recorded by a recovery expression
+type errorRecord struct {
+	pos      int
+	loc      location
+	msg      string
+	label    string
+	expected []string
+	rule     string
+	kind     ErrorKind
+	err      error
+}
+
+// Parse limits (zero means unlimited)
+type Limits struct {
+	MaxDepth  int // Nesting of operator invocations
+	MaxSteps  int // Total number of operator invocations
+	MaxValues int // Size of the semantic value stack
+}
+
 // Action
 type Action func(v *Values, d Any) (Any, error)
 
+// Invoke an action. A *ValueError panic of a To accessor is returned as the
+// error of the action.
+func (a Action) call(v *Values, d Any) (val Any, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			e, ok := x.(*ValueError)
+			if !ok {
+				panic(x)
+			}
+			val, err = nil, e
+		}
+	}()
+	return a(v, d)
+}
+
 // Rule
 type Rule struct {
 	Name          string
@@ -33,103 +141,294 @@ type Rule struct {
 	Pos           int
 	Ope           operator
 	Action        Action
-	Enter         func(d Any)
-	Leave         func(d Any)
+	Enter         func(d Any) // Not called when packrat parsing reuses the result of the rule
+	Leave         func(d Any) // Not called either when the result is reused
 	Message       func() (message string)
 	Ignore        bool
 	WhitespaceOpe operator
 	WordOpe       operator
 
 	Parameters []string
+	Recovery   bool // Recovery expression of the label with the same name
+
+	LeftRecursive bool
 
 	TracerEnter func(name string, s string, v *Values, d Any, p int)
 	TracerLeave func(name string, s string, v *Values, d Any, p int, l int)
 
+	Packrat      bool
+	PackratStats func(stats PackratStats)
+
+	Limits Limits
+
 	tokenChecker  *tokenChecker
+	initChecker   sync.Once
 	disableAction bool
+	trivial       bool
+	binop         bool // Operator of %expr, which is looked up by its text
 }
 
 func (r *Rule) Parse(s string, d Any) (l int, val Any, err *Error) {
-	v := &Values{}
+	return r.ParseContext(gocontext.Background(), s, d)
+}
+
+// Parse until the context is canceled
+func (r *Rule) ParseContext(ctx gocontext.Context, s string, d Any) (l int, val Any, err *Error) {
+	c := r.newContext(ctx, newStringInput(s))
+	c.s = s
+	return r.parseInput(c, d)
+}
+
+// Parse from a reader, keeping only the input that can still be referenced
+func (r *Rule) ParseReader(rd io.Reader, d Any) (l int, val Any, err *Error) {
+	return r.ParseReaderContext(gocontext.Background(), rd, d)
+}
+
+func (r *Rule) ParseReaderContext(ctx gocontext.Context, rd io.Reader, d Any) (l int, val Any, err *Error) {
+	return r.parseInput(r.newContext(ctx, newReaderInput(rd)), d)
+}
+
+func (r *Rule) newContext(ctx gocontext.Context, in *input) *context {
 	c := &context{
-		s:             s,
-		errorPos:      -1,
-		messagePos:    -1,
-		whitespaceOpe: r.WhitespaceOpe,
-		wordOpe:       r.WordOpe,
-		tracerEnter:   r.TracerEnter,
-		tracerLeave:   r.TracerLeave,
+		in:             in,
+		errorPos:       -1,
+		messagePos:     -1,
+		whitespaceOpe:  r.WhitespaceOpe,
+		wordOpe:        r.WordOpe,
+		tracerEnter:    r.TracerEnter,
+		tracerLeave:    r.TracerLeave,
+		seeds:          make(map[memoKey]*seedEntry),
+		heads:          make(map[memoKey]*recursionHead),
+		packratStatsFn: r.PackratStats,
+		limits:         r.Limits,
+	}
+	if ctx.Done() != nil {
+		c.ctx = ctx
 	}
+	c.setPackrat(r.Packrat)
+	return c
+}
+
+// A context for parsing a string outside of a rule, such as checking a
+// literal against %word
+func newStringContext(s string) *context {
+	return &context{
+		s:          s,
+		in:         newStringInput(s),
+		errorPos:   -1,
+		messagePos: -1,
+		seeds:      make(map[memoKey]*seedEntry),
+		heads:      make(map[memoKey]*recursionHead),
+	}
+}
+
+func (r *Rule) parseInput(c *context, d Any) (l int, val Any, err *Error) {
+	v := &Values{}
 
 	var ope operator = r
 	if r.WhitespaceOpe != nil {
 		ope = Seq(r.WhitespaceOpe, r) // Skip whitespace at beginning
 	}
 
-	l = ope.parse(s, 0, v, c, d)
+	l = ope.parse(0, v, c, d)
+
+	return r.parseResult(c, l, v)
+}
 
+// Value and errors of a finished parse
+func (r *Rule) parseResult(c *context, l int, v *Values) (_ int, val Any, err *Error) {
 	if success(l) && len(v.Vs) > 0 && v.Vs[0] != nil {
 		val = v.Vs[0]
 	}
 
-	if fail(l) || l != len(s) {
-		var pos int
-		var msg string
+	records := c.errors
+	if c.abort != nil {
+		val = nil
+		records = []errorRecord{*c.abort}
+	} else if fail(l) || !c.in.atEnd(l) {
+		rec := errorRecord{}
 		if fail(l) {
-			if c.messagePos > -1 {
-				pos = c.messagePos
-				msg = c.message
+			if len(c.label) > 0 {
+				rec.pos = c.labelPos
+				rec.loc = c.labelLoc
+				rec.label = c.label
+				rec.rule = c.labelRule
+				if c.errorPos == c.labelPos {
+					rec.expected = c.expected
+				}
+			} else if c.messagePos > -1 {
+				rec.pos = c.messagePos
+				rec.loc = c.messageLoc
+				rec.msg = c.message
+				rec.rule = c.messageRule
+				if c.messageErr != nil {
+					rec.kind = ActionError
+					rec.err = c.messageErr
+				}
 			} else {
-				msg = "syntax error"
-				pos = c.errorPos
+				rec.pos = c.errorPos
+				rec.loc = c.errorLoc
+				rec.rule = c.errorRule
+				rec.expected = c.expected
 			}
 		} else {
-			msg = "not exact match"
-			pos = l
+			rec.msg = "not exact match"
+			rec.pos = l
+			rec.loc = c.locate(l)
+			rec.rule = r.Name
+			rec.kind = NotExactMatchError
 		}
-		ln, col := lineInfo(s, pos)
-		err = &Error{}
-		err.Details = append(err.Details, ErrorDetail{ln, col, msg})
+		records = append(records, rec)
+	}
+	if c.in.err != nil && c.abort == nil {
+		end := c.in.end()
+		records = append(records, errorRecord{pos: end, loc: c.locate(end), msg: c.in.err.Error(), kind: ReadError, err: c.in.err})
 	}
 
-	return
+	if len(records) > 0 {
+		sort.SliceStable(records, func(i, j int) bool {
+			return records[i].pos < records[j].pos
+		})
+		err = &Error{Kind: c.abortKind}
+		for _, rec := range records {
+			if !c.in.stream() {
+				rec.loc.ln, rec.loc.col = lineInfo(c.s, rec.pos)
+				if len(rec.expected) > 0 {
+					rec.loc.found = c.in.found(rec.pos)
+				}
+			}
+			ln, col := rec.loc.ln, rec.loc.col
+			msg := rec.msg
+			if len(msg) == 0 {
+				msg = syntaxErrorMessage(rec.expected, rec.loc.found)
+			}
+			err.Details = append(err.Details, ErrorDetail{
+				Ln:       ln,
+				Col:      col,
+				Msg:      msg,
+				Label:    rec.label,
+				Expected: rec.expected,
+				Pos:      rec.pos,
+				Rule:     rec.rule,
+				Kind:     rec.kind,
+				Err:      rec.err,
+			})
+		}
+	}
+
+	if c.packrat && c.packratStatsFn != nil {
+		c.packratStatsFn(c.packratStats)
+	}
+
+	return l, val, err
 }
 
 func (o *Rule) Label() string {
 	return fmt.Sprintf("[%s]", o.Name)
 }
 
-func (o *Rule) parse(s string, p int, v *Values, c *context, d Any) int {
-	return parse(o, s, p, v, c, d)
+func (o *Rule) parse(p int, v *Values, c *context, d Any) int {
+	return parse(o, p, v, c, d)
 }
 
-func (r *Rule) parseCore(s string, p int, v *Values, c *context, d Any) int {
-	// Macro reference
+func (r *Rule) parseCore(p int, v *Values, c *context, d Any) (l int) {
+	// A cut only commits the choices of the rule that it is in
+	saveCut := c.cut
+	c.cut = false
+
 	if r.Parameters != nil {
-		return r.Ope.parse(s, p, v, c, d)
+		// Macro reference
+		l = r.Ope.parse(p, v, c, d)
+	} else if c.packrat {
+		l = c.memoize(r, p, v, d)
+	} else {
+		l = r.parseRule(p, v, c, d)
+	}
+
+	c.cut = saveCut
+	return
+}
+
+func (r *Rule) parseRule(p int, v *Values, c *context, d Any) int {
+	if r.LeftRecursive {
+		return c.growSeed(r, p, v, d)
 	}
+	return r.parseDefinition(p, v, c, d)
+}
+
+func (r *Rule) parseDefinition(p int, v *Values, c *context, d Any) int {
+	var f definitionFrame
+	r.beginDefinition(p, c, d, &f)
+	l := r.Ope.parse(p, f.chv, c, d)
+	return r.endDefinition(p, l, v, c, d, f)
+}
+
+// State of a rule definition between its beginning and end
+type definitionFrame struct {
+	chv       *Values
+	keepText  bool
+	tokenRule bool
+	saveError errorState
+	saveRule  string
+}
 
+// The frame is filled in place, as the VM keeps it on its own stack
+func (r *Rule) beginDefinition(p int, c *context, d Any, f *definitionFrame) {
 	if r.Enter != nil {
 		r.Enter(d)
 	}
 
-	chv := c.push()
+	f.chv = c.push()
 
-	l := r.Ope.parse(s, p, chv, c, d)
+	f.saveRule = c.rule
+	if len(r.Name) > 0 {
+		c.rule = r.Name
+	}
+
+	// A stream only keeps the text of token rules, which is their token, so
+	// that a rule above them doesn't hold the input it has consumed. The
+	// operator of %expr is short and needs its text either way.
+	f.keepText = !c.in.stream() || r.isToken() || r.binop
+	if f.keepText {
+		c.in.pin(p)
+	}
+
+	// Token rules are reported by name instead of their internals
+	f.tokenRule = len(r.Name) > 0 && r.hasTokenBoundary()
+	if f.tokenRule {
+		f.saveError = c.errorState()
+		c.restoreError(errorState{pos: -1})
+		c.inTokenRule++
+	}
+}
+
+func (r *Rule) endDefinition(p int, l int, v *Values, c *context, d Any, f definitionFrame) int {
+	chv := f.chv
+
+	if f.tokenRule {
+		c.inTokenRule--
+		pos := c.errorPos
+		c.restoreError(f.saveError)
+		if pos >= 0 {
+			c.addExpected(pos, r.Name)
+		}
+	}
 
 	// Invoke action
 	var val Any
 
 	if success(l) {
-		if r.Action != nil && !r.disableAction {
-			chv.S = s[p : p+l]
-			chv.Pos = p
+		if f.keepText {
+			chv.S = c.in.substr(p, p+l)
+		}
+		chv.Pos = p
+		c.lastToken = chv.Token()
 
+		if r.Action != nil && !r.disableAction {
 			var err error
-			if val, err = r.Action(chv, d); err != nil {
+			if val, err = r.Action.call(chv, d); err != nil {
 				if c.messagePos < p {
-					c.messagePos = p
-					c.message = err.Error()
+					c.setMessage(p, err.Error(), err)
 				}
 				l = -1
 			}
@@ -145,13 +444,17 @@ func (r *Rule) parseCore(s string, p int, v *Values, c *context, d Any) int {
 	} else {
 		if r.Message != nil {
 			if c.messagePos < p {
-				c.messagePos = p
-				c.message = r.Message()
+				c.setMessage(p, r.Message(), nil)
 			}
 		}
 	}
 
+	if f.keepText {
+		c.in.unpin()
+	}
+
 	c.pop()
+	c.rule = f.saveRule
 
 	if r.Leave != nil {
 		r.Leave(d)
@@ -160,24 +463,69 @@ func (r *Rule) parseCore(s string, p int, v *Values, c *context, d Any) int {
 	return l
 }
 
+// A rule is called again when handlers were attached after it was inlined
+func (r *Rule) hasHandlers() bool {
+	return r.Action != nil || r.Enter != nil || r.Leave != nil || r.Message != nil
+}
+
+// Same as parseDefinition for a rule that only has terminals and no handlers
+func (r *Rule) parseInline(p int, v *Values, c *context, d Any) int {
+	c.in.pin(p)
+	saveRule := c.rule
+	if len(r.Name) > 0 {
+		c.rule = r.Name
+	}
+	l := r.Ope.parse(p, v, c, d)
+	if success(l) {
+		c.lastToken = c.in.substr(p, p+l)
+		if r.Ignore == false {
+			v.Vs = append(v.Vs, nil)
+		}
+	}
+	c.rule = saveRule
+	c.in.unpin()
+	return l
+}
+
 func (r *Rule) accept(v visitor) {
 	v.visitRule(r)
 }
 
-func (r *Rule) isToken() bool {
-	if r.tokenChecker == nil {
+// Rules are shared by concurrent parses, so the checker runs only once
+func (r *Rule) checkToken() *tokenChecker {
+	r.initChecker.Do(func() {
 		r.tokenChecker = &tokenChecker{}
 		r.Ope.accept(r.tokenChecker)
-	}
-	return r.tokenChecker.isToken()
+	})
+	return r.tokenChecker
+}
+
+func (r *Rule) isToken() bool {
+	return r.checkToken().isToken()
 }
 
 func (r *Rule) hasTokenBoundary() bool {
-	if r.tokenChecker == nil {
-		r.tokenChecker = &tokenChecker{}
-		r.Ope.accept(r.tokenChecker)
+	return r.checkToken().hasTokenBoundary
+}
+
+func syntaxErrorMessage(expected []string, found string) string {
+	if len(expected) == 0 {
+		return "syntax error"
 	}
-	return r.tokenChecker.hasTokenBoundary
+
+	msg := "expected "
+	for i, e := range expected {
+		if i > 0 {
+			if i == len(expected)-1 {
+				msg += " or "
+			} else {
+				msg += ", "
+			}
+		}
+		msg += e
+	}
+
+	return msg + ", found " + found
 }
 
 // lineInfo
@@ -19,6 +19,9 @@ type visitor interface {
 	visitRule(ope *Rule)
 	visitWhitespace(ope *whitespace)
 	visitExpression(ope *expression)
+	visitCut(ope *cut)
+	visitThrow(ope *throw)
+	visitCapture(ope *capture)
 }
 
 // visitorBase
@@ -42,6 +45,9 @@ func (v *visitorBase) visitReference(ope *reference)                 {}
 func (v *visitorBase) visitRule(ope *Rule)                           {}
 func (v *visitorBase) visitWhitespace(ope *whitespace)               {}
 func (v *visitorBase) visitExpression(ope *expression)               {}
+func (v *visitorBase) visitCut(ope *cut)                             {}
+func (v *visitorBase) visitThrow(ope *throw)                         {}
+func (v *visitorBase) visitCapture(ope *capture)                     {}
 
 // tokenChecker
 type tokenChecker struct {
@@ -77,6 +83,8 @@ func (v *tokenChecker) visitReference(ope *reference) {
 }
 func (v *tokenChecker) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
 func (v *tokenChecker) visitExpression(ope *expression) { ope.atom.accept(v) }
+func (v *tokenChecker) visitThrow(ope *throw)           { ope.ope.accept(v) }
+func (v *tokenChecker) visitCapture(ope *capture)       { ope.ope.accept(v) }
 
 func (v *tokenChecker) isToken() bool {
 	return v.hasTokenBoundary || !v.hasRule
@@ -136,39 +144,259 @@ func (v *detectLeftRecursion) visitReference(ope *reference) {
 func (v *detectLeftRecursion) visitRule(ope *Rule)             { ope.Ope.accept(v) }
 func (v *detectLeftRecursion) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
 func (v *detectLeftRecursion) visitExpression(ope *expression) { ope.atom.accept(v) }
+func (v *detectLeftRecursion) visitThrow(ope *throw)           { ope.ope.accept(v) }
+func (v *detectLeftRecursion) visitCapture(ope *capture)       { ope.ope.accept(v) }
 
-// referenceChecker
-type referenceChecker struct {
+// detectNullable
+type detectNullable struct {
 	*visitorBase
-	grammar  map[string]*Rule
-	params   []string
-	errorPos map[string]int
-	errorMsg map[string]string
+	args     [][]operator
+	rules    map[*Rule]bool
+	depth    int
+	nullable bool
+}
+
+func newDetectNullable() *detectNullable {
+	return &detectNullable{rules: make(map[*Rule]bool)}
+}
+
+// Whether an operator can succeed without consuming input
+func (v *detectNullable) check(ope operator) bool {
+	v.nullable = false
+	ope.accept(v)
+	return v.nullable
+}
+
+func (v *detectNullable) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		if !v.check(o) {
+			return
+		}
+	}
+	v.nullable = true
+}
+func (v *detectNullable) visitPrioritizedChoice(ope *prioritizedChoice) {
+	for _, o := range ope.opes {
+		if v.check(o) {
+			return
+		}
+	}
+}
+func (v *detectNullable) visitZeroOrMore(ope *zeroOrMore)       { v.nullable = true }
+func (v *detectNullable) visitOneOrMore(ope *oneOrMore)         { ope.ope.accept(v) }
+func (v *detectNullable) visitOption(ope *option)               { v.nullable = true }
+func (v *detectNullable) visitAndPredicate(ope *andPredicate)   { v.nullable = true }
+func (v *detectNullable) visitNotPredicate(ope *notPredicate)   { v.nullable = true }
+func (v *detectNullable) visitLiteralString(ope *literalString) { v.nullable = len(ope.lit) == 0 }
+func (v *detectNullable) visitTokenBoundary(ope *tokenBoundary) { ope.ope.accept(v) }
+func (v *detectNullable) visitIgnore(ope *ignore)               { ope.ope.accept(v) }
+func (v *detectNullable) visitReference(ope *reference) {
+	if ope.rule == nil {
+		// Arguments are checked where the macro is referenced
+		if len(v.args) == 0 {
+			return
+		}
+		args := v.args[len(v.args)-1]
+		v.args = v.args[:len(v.args)-1]
+		v.check(args[ope.iarg])
+		v.args = append(v.args, args)
+		return
+	}
+
+	if ope.rule.Parameters != nil {
+		// Macros are expanded for each reference, so recursion is cut off
+		if v.depth > 16 {
+			return
+		}
+		v.depth++
+		v.args = append(v.args, ope.args)
+		v.check(ope.rule.Ope)
+		v.args = v.args[:len(v.args)-1]
+		v.depth--
+		return
+	}
+
+	v.nullable = v.definition(ope.rule)
+}
+func (v *detectNullable) visitRule(ope *Rule) {
+	if ope.Parameters == nil {
+		v.nullable = v.definition(ope)
+	}
+}
+func (v *detectNullable) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
+func (v *detectNullable) visitExpression(ope *expression) { ope.atom.accept(v) }
+func (v *detectNullable) visitCut(ope *cut)               { v.nullable = true }
+func (v *detectNullable) visitThrow(ope *throw)           { ope.ope.accept(v) }
+func (v *detectNullable) visitCapture(ope *capture)       { ope.ope.accept(v) }
+
+func (v *detectNullable) definition(r *Rule) bool {
+	if nullable, ok := v.rules[r]; ok {
+		return nullable
+	}
+
+	// A rule that is still being checked is left recursive, which consumes
+	// input or fails
+	v.rules[r] = false
+	args := v.args
+	v.args = nil
+	nullable := v.check(r.Ope)
+	v.args = args
+	v.rules[r] = nullable
+	return nullable
+}
+
+// detectEmptyLoop
+type detectEmptyLoop struct {
+	*visitorBase
+	nullable *detectNullable
+	plain    *detectNullable
+	ref      *reference
+	loops    []operator
+}
+
+func newDetectEmptyLoop() *detectEmptyLoop {
+	return &detectEmptyLoop{nullable: newDetectNullable(), plain: newDetectNullable()}
+}
+
+// Repetitions of operands that can succeed without consuming input. A loop
+// that is empty only for the arguments of a macro is reported as the macro
+// reference.
+func (v *detectEmptyLoop) find(ope operator) []operator {
+	v.loops = nil
+	ope.accept(v)
+	return v.loops
 }
 
-func (v *referenceChecker) visitSequence(ope *sequence) {
+func (v *detectEmptyLoop) loop(ope operator, operand operator) {
+	if v.nullable.check(operand) {
+		if v.ref == nil {
+			v.loops = append(v.loops, ope)
+		} else if !v.plain.check(operand) {
+			v.loops = append(v.loops, v.ref)
+		}
+	}
+	operand.accept(v)
+}
+
+func (v *detectEmptyLoop) visitSequence(ope *sequence) {
 	for _, o := range ope.opes {
 		o.accept(v)
 	}
 }
-func (v *referenceChecker) visitPrioritizedChoice(ope *prioritizedChoice) {
+func (v *detectEmptyLoop) visitPrioritizedChoice(ope *prioritizedChoice) {
 	for _, o := range ope.opes {
 		o.accept(v)
 	}
 }
-func (v *referenceChecker) visitZeroOrMore(ope *zeroOrMore)       { ope.ope.accept(v) }
-func (v *referenceChecker) visitOneOrMore(ope *oneOrMore)         { ope.ope.accept(v) }
-func (v *referenceChecker) visitOption(ope *option)               { ope.ope.accept(v) }
-func (v *referenceChecker) visitAndPredicate(ope *andPredicate)   { ope.ope.accept(v) }
-func (v *referenceChecker) visitNotPredicate(ope *notPredicate)   { ope.ope.accept(v) }
-func (v *referenceChecker) visitTokenBoundary(ope *tokenBoundary) { ope.ope.accept(v) }
-func (v *referenceChecker) visitIgnore(ope *ignore)               { ope.ope.accept(v) }
-func (v *referenceChecker) visitReference(ope *reference) {
-	for _, param := range v.params {
-		if param == ope.name {
-			return
+func (v *detectEmptyLoop) visitZeroOrMore(ope *zeroOrMore)       { v.loop(ope, ope.ope) }
+func (v *detectEmptyLoop) visitOneOrMore(ope *oneOrMore)         { v.loop(ope, ope.ope) }
+func (v *detectEmptyLoop) visitOption(ope *option)               { ope.ope.accept(v) }
+func (v *detectEmptyLoop) visitAndPredicate(ope *andPredicate)   { ope.ope.accept(v) }
+func (v *detectEmptyLoop) visitNotPredicate(ope *notPredicate)   { ope.ope.accept(v) }
+func (v *detectEmptyLoop) visitTokenBoundary(ope *tokenBoundary) { ope.ope.accept(v) }
+func (v *detectEmptyLoop) visitIgnore(ope *ignore)               { ope.ope.accept(v) }
+func (v *detectEmptyLoop) visitReference(ope *reference) {
+	// Arguments are checked where they are written
+	if ope.rule == nil || v.ref != nil {
+		return
+	}
+	for _, arg := range ope.args {
+		arg.accept(v)
+	}
+
+	// Loops in the macro are checked again with the arguments
+	if ope.rule.Parameters != nil {
+		v.ref = ope
+		v.nullable.args = append(v.nullable.args, ope.args)
+		n := len(v.loops)
+		ope.rule.Ope.accept(v)
+		if len(v.loops) > n+1 {
+			v.loops = v.loops[:n+1]
+		}
+		v.nullable.args = v.nullable.args[:len(v.nullable.args)-1]
+		v.ref = nil
+	}
+}
+func (v *detectEmptyLoop) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
+func (v *detectEmptyLoop) visitExpression(ope *expression) { ope.atom.accept(v) }
+func (v *detectEmptyLoop) visitThrow(ope *throw)           { ope.ope.accept(v) }
+func (v *detectEmptyLoop) visitCapture(ope *capture)       { ope.ope.accept(v) }
+
+// referenceWalker visits the references of a definition, including the
+// arguments of macro references, and the throws
+type referenceWalker struct {
+	*visitorBase
+	reference func(ope *reference) // Called before the arguments
+	rule      func(ope *Rule)      // Rules used as operators, if not nil
+	throw     func(ope *throw)     // Called after the expression, if not nil
+}
+
+func (v *referenceWalker) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *referenceWalker) visitPrioritizedChoice(ope *prioritizedChoice) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *referenceWalker) visitZeroOrMore(ope *zeroOrMore)       { ope.ope.accept(v) }
+func (v *referenceWalker) visitOneOrMore(ope *oneOrMore)         { ope.ope.accept(v) }
+func (v *referenceWalker) visitOption(ope *option)               { ope.ope.accept(v) }
+func (v *referenceWalker) visitAndPredicate(ope *andPredicate)   { ope.ope.accept(v) }
+func (v *referenceWalker) visitNotPredicate(ope *notPredicate)   { ope.ope.accept(v) }
+func (v *referenceWalker) visitTokenBoundary(ope *tokenBoundary) { ope.ope.accept(v) }
+func (v *referenceWalker) visitIgnore(ope *ignore)               { ope.ope.accept(v) }
+func (v *referenceWalker) visitReference(ope *reference) {
+	v.reference(ope)
+	for _, arg := range ope.args {
+		arg.accept(v)
+	}
+}
+func (v *referenceWalker) visitRule(ope *Rule) {
+	if v.rule != nil {
+		v.rule(ope)
+	}
+}
+func (v *referenceWalker) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
+func (v *referenceWalker) visitExpression(ope *expression) {
+	ope.atom.accept(v)
+	ope.binop.accept(v)
+}
+func (v *referenceWalker) visitThrow(ope *throw) {
+	ope.ope.accept(v)
+	if v.throw != nil {
+		v.throw(ope)
+	}
+}
+func (v *referenceWalker) visitCapture(ope *capture) { ope.ope.accept(v) }
+
+func isParameter(params []string, name string) bool {
+	for _, param := range params {
+		if param == name {
+			return true
 		}
 	}
+	return false
+}
+
+// referenceChecker
+type referenceChecker struct {
+	grammar  map[string]*Rule
+	params   []string
+	errorPos map[string]int
+	errorMsg map[string]string
+}
+
+func (v *referenceChecker) check(r *Rule) {
+	r.Ope.accept(&referenceWalker{reference: v.reference})
+}
+
+func (v *referenceChecker) reference(ope *reference) {
+	if isParameter(v.params, ope.name) {
+		return
+	}
 
 	if r, ok := v.grammar[ope.name]; !ok {
 		v.errorPos[ope.name] = ope.pos
@@ -185,35 +413,18 @@ func (v *referenceChecker) visitReference(ope *reference) {
 		}
 	}
 }
-func (v *referenceChecker) visitRule(ope *Rule)             { ope.Ope.accept(v) }
-func (v *referenceChecker) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
-func (v *referenceChecker) visitExpression(ope *expression) { ope.atom.accept(v) }
 
 // linkReferences
 type linkReferences struct {
-	*visitorBase
 	parameters []string
 	grammar    map[string]*Rule
 }
 
-func (v *linkReferences) visitSequence(ope *sequence) {
-	for _, o := range ope.opes {
-		o.accept(v)
-	}
-}
-func (v *linkReferences) visitPrioritizedChoice(ope *prioritizedChoice) {
-	for _, o := range ope.opes {
-		o.accept(v)
-	}
+func (v *linkReferences) link(r *Rule) {
+	r.Ope.accept(&referenceWalker{reference: v.reference, throw: v.throw})
 }
-func (v *linkReferences) visitZeroOrMore(ope *zeroOrMore)       { ope.ope.accept(v) }
-func (v *linkReferences) visitOneOrMore(ope *oneOrMore)         { ope.ope.accept(v) }
-func (v *linkReferences) visitOption(ope *option)               { ope.ope.accept(v) }
-func (v *linkReferences) visitAndPredicate(ope *andPredicate)   { ope.ope.accept(v) }
-func (v *linkReferences) visitNotPredicate(ope *notPredicate)   { ope.ope.accept(v) }
-func (v *linkReferences) visitTokenBoundary(ope *tokenBoundary) { ope.ope.accept(v) }
-func (v *linkReferences) visitIgnore(ope *ignore)               { ope.ope.accept(v) }
-func (v *linkReferences) visitReference(ope *reference) {
+
+func (v *linkReferences) reference(ope *reference) {
 	if r, ok := v.grammar[ope.name]; ok {
 		ope.rule = r
 	} else {
@@ -224,13 +435,13 @@ func (v *linkReferences) visitReference(ope *reference) {
 			}
 		}
 	}
-	for _, arg := range ope.args {
-		arg.accept(v)
+}
+
+func (v *linkReferences) throw(ope *throw) {
+	if r, ok := v.grammar[ope.label]; ok && r.Recovery {
+		ope.recovery = r
 	}
 }
-func (v *linkReferences) visitRule(ope *Rule)             { ope.Ope.accept(v) }
-func (v *linkReferences) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
-func (v *linkReferences) visitExpression(ope *expression) { ope.atom.accept(v) }
 
 // findReference
 type findReference struct {
@@ -314,3 +525,14 @@ func (v *findReference) visitExpression(ope *expression) {
 	ope.atom.accept(v)
 	v.ope = ope
 }
+func (v *findReference) visitCut(ope *cut) {
+	v.ope = ope
+}
+func (v *findReference) visitThrow(ope *throw) {
+	ope.ope.accept(v)
+	v.ope = Thr(v.ope, ope.label, ope.recovery)
+}
+func (v *findReference) visitCapture(ope *capture) {
+	ope.ope.accept(v)
+	v.ope = Cap(v.ope, ope.name)
+}
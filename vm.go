@@ -0,0 +1,1115 @@
+package peg
+
+import (
+	gocontext "context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Instruction set of the bytecode VM
+type opcode uint8
+
+const (
+	opLeaf          opcode = iota // Match operator a without the dispatcher
+	opLiteral                     // Match literal a without skipping whitespace
+	opSpan                        // Match the characters of class a as many times as possible
+	opSkip                        // Skip whitespace outside of tokens
+	opTree                        // Parse operator a with the tree interpreter and the macro arguments b-1
+	opCall                        // Call rule a, inline if the slot b is on
+	opInline                      // Rule parsed inline (stack entry only)
+	opMacro                       // Call the macro instance a
+	opReturn                      // Return from a rule
+	opJump                        // Jump to a
+	opChoice                      // Try the alternatives in table a
+	opCommit                      // Accept an alternative and jump to a
+	opRepeat                      // Begin a repetition
+	opRepeatLoop                  // Next iteration, or jump to a at the end of input or after an empty iteration
+	opOption                      // Begin an option ending at a
+	opOptionEnd                   // Accept an option
+	opPredicate                   // Begin a predicate ending at a (b is 1 for a not predicate)
+	opPredicateEnd                // Predicate body matched
+	opToken                       // Begin a token boundary
+	opTokenEnd                    // End a token boundary
+	opIgnore                      // Begin ignoring values
+	opIgnoreEnd                   // End ignoring values
+	opWhitespace                  // Begin whitespace ending at a
+	opWhitespaceEnd               // End whitespace
+	opThrow                       // Begin the expression of throw a, recovered at b
+	opThrowEnd                    // End the expression of a throw, or its recovery if b is 1
+	opExpr                        // Begin the expression a, parsing its left operand
+	opExprLoop                    // Parse the next binary operator of the expression a
+	opExprOperator                // Check the precedence of the operator and parse the right operand
+	opExprOperand                 // Reduce the right operand with the action
+	opExprEnd                     // End the expression
+	opCapture                     // Begin a labeled expression of operator a
+	opCaptureEnd                  // Label the values of the expression
+	opEnd                         // Successful end of the program
+)
+
+// Instructions that enter rules or loop check the limits, which bounds every
+// recursion and repetition
+var checksLimits = [opEnd + 1]bool{opTree: true, opCall: true, opMacro: true, opChoice: true, opRepeatLoop: true,
+	opExprLoop: true}
+
+type instruction struct {
+	op opcode
+	a  int
+	b  int
+}
+
+// Alternative of a choice
+type alternative struct {
+	pc     int
+	choice int
+}
+
+// Code of a %expr rule
+type exprCode struct {
+	ope  *expression
+	loop int // opExprLoop
+	atom int // The left operand
+	rhs  int // opExprOperand
+	end  int // opExprEnd
+}
+
+// Macro compiled with the arguments of a reference
+type macroInstance struct {
+	rule *Rule
+	args []operator
+	addr int
+}
+
+// Program
+type Program struct {
+	code       []instruction
+	opes       []operator
+	rules      []*Rule
+	ruleAddr   []int
+	alts       [][]alternative
+	choices    []*prioritizedChoice
+	exprs      []exprCode
+	macros     []*macroInstance
+	args       [][]operator
+	whitespace int // Address of the whitespace rule, or -1
+	stacks     sync.Pool
+
+	start  *Rule
+	parser *Parser
+}
+
+// Compile a rule and the rules it references into bytecode
+func CompileRule(r *Rule) *Program {
+	prog := &Program{start: r, whitespace: -1}
+	cmp := &compiler{
+		prog:      prog,
+		index:     make(map[*Rule]int),
+		instances: make(map[string]int),
+		expanded:  make(map[*Rule]int),
+	}
+
+	// Skip whitespace at beginning
+	if r.WhitespaceOpe != nil {
+		cmp.emit(opSkip, 0, 0)
+	}
+	cmp.emit(opCall, cmp.rule(r), 0)
+	cmp.emit(opEnd, 0, 0)
+
+	if r.WhitespaceOpe != nil {
+		prog.whitespace = cmp.here()
+		r.WhitespaceOpe.accept(cmp)
+		cmp.emit(opReturn, 0, 0)
+	}
+
+	// Rules and macro instances are compiled as they are found
+	for i, j := 0, 0; i < len(prog.rules) || j < len(prog.macros); {
+		if i < len(prog.rules) {
+			prog.ruleAddr[i] = cmp.here()
+			prog.rules[i].Ope.accept(cmp)
+			i++
+		} else {
+			m := prog.macros[j]
+			m.addr = cmp.here()
+			cmp.args = m.args
+			m.rule.Ope.accept(cmp)
+			cmp.args = nil
+			j++
+		}
+		cmp.emit(opReturn, 0, 0)
+	}
+	return prog
+}
+
+// Compile the grammar of a parser into bytecode
+func (p *Parser) Compile() *Program {
+	prog := CompileRule(p.Grammar[p.start])
+	prog.parser = p
+	return prog
+}
+
+func (prog *Program) Parse(s string, d Any) (err *Error) {
+	_, err = prog.ParseAndGetValue(s, d)
+	return
+}
+
+func (prog *Program) ParseAndGetValue(s string, d Any) (val Any, err *Error) {
+	return prog.ParseContext(gocontext.Background(), s, d)
+}
+
+func (prog *Program) ParseContext(ctx gocontext.Context, s string, d Any) (val Any, err *Error) {
+	c := prog.newContext(ctx, newStringInput(s))
+	c.s = s
+	_, val, err = prog.parseInput(c, d)
+	return
+}
+
+func (prog *Program) ParseReader(rd io.Reader, d Any) (val Any, err *Error) {
+	return prog.ParseReaderContext(gocontext.Background(), rd, d)
+}
+
+func (prog *Program) ParseReaderContext(ctx gocontext.Context, rd io.Reader, d Any) (val Any, err *Error) {
+	_, val, err = prog.parseInput(prog.newContext(ctx, newReaderInput(rd)), d)
+	return
+}
+
+func (prog *Program) newContext(ctx gocontext.Context, in *input) *context {
+	if prog.parser != nil {
+		_, c := prog.parser.newContext(ctx, in)
+		return c
+	}
+	return prog.start.newContext(ctx, in)
+}
+
+func (prog *Program) parseInput(c *context, d Any) (l int, val Any, err *Error) {
+	// Tracers see every operator only in the tree interpreter
+	if c.tracerEnter != nil || c.tracerLeave != nil {
+		return prog.start.parseInput(c, d)
+	}
+
+	v := &Values{}
+	l = prog.run(c, v, d)
+	return prog.start.parseResult(c, l, v)
+}
+
+// Backtrack entry of the VM
+type vmEntry struct {
+	op           opcode
+	pc           int
+	p            int
+	v            *Values
+	id           int
+	saveCut      bool
+	saveErrors   int
+	saveError    errorState
+	saveVs       []Any
+	saveTs       []Token
+	saveCaptures []captureRange
+	rule         *Rule
+	frame        definitionFrame
+	iterated     bool   // A repetition has started an iteration
+	skip         uint64 // Alternatives of a choice that can't match
+	memo         bool   // The rule call is memoized with the state below
+	inToken      bool
+	inWhitespace bool
+	prec         int // Minimum precedence of the operators of an expression
+	end          int // End of an expression so far
+	savePos      int
+	saveS        string
+	saveChoice   int
+}
+
+// Entries are reused, so only the fields that their kind uses are set
+type vmStack []vmEntry
+
+func (s *vmStack) push(op opcode) *vmEntry {
+	if len(*s) < cap(*s) {
+		*s = (*s)[:len(*s)+1]
+	} else {
+		*s = append(*s, vmEntry{})
+	}
+	e := &(*s)[len(*s)-1]
+	e.op = op
+	return e
+}
+
+func (prog *Program) run(c *context, v *Values, d Any) int {
+	// Stacks are reused by the next runs
+	s, _ := prog.stacks.Get().(*vmStack)
+	if s == nil {
+		s = &vmStack{}
+	}
+	stack := (*s)[:0]
+	depth := c.depth
+	pc := 0
+	p := 0
+
+	for {
+		ins := prog.code[pc]
+		if checksLimits[ins.op] {
+			c.depth = depth + len(stack)
+			if !c.checkLimits(p) {
+				goto fail
+			}
+		}
+
+		switch ins.op {
+		case opLeaf:
+			l := prog.opes[ins.a].parseCore(p, v, c, d)
+			if fail(l) {
+				goto fail
+			}
+			p += l
+			pc++
+
+		case opLiteral:
+			l := prog.opes[ins.a].(*literalString).parseWord(p, v, c)
+			if fail(l) {
+				goto fail
+			}
+			p += l
+			pc++
+
+		case opSpan:
+			// The repetition forgets what the last character expected
+			o := prog.opes[ins.a].(*characterClass)
+			for l := o.match(c.in, p); success(l); l = o.match(c.in, p) {
+				p += l
+			}
+			pc++
+
+		case opSkip:
+			if prog.whitespace < 0 || c.inToken || c.inWhitespace {
+				pc++
+				break
+			}
+			stack.push(opSkip).pc = pc + 1
+			pc = prog.whitespace
+
+		case opTree:
+			if ins.b > 0 {
+				c.pushArgs(prog.args[ins.b-1])
+			}
+			l := prog.opes[ins.a].parse(p, v, c, d)
+			if ins.b > 0 {
+				c.popArgs()
+			}
+			if fail(l) {
+				goto fail
+			}
+			p += l
+			pc++
+
+		case opCall:
+			r := prog.rules[ins.a]
+			if c.inlined(ins.b) {
+				c.in.pin(p)
+				e := stack.push(opInline)
+				e.pc, e.p, e.rule, e.frame.saveRule = pc+1, p, r, c.rule
+				if len(r.Name) > 0 {
+					c.rule = r.Name
+				}
+				pc = prog.ruleAddr[ins.a]
+				break
+			}
+			if r.LeftRecursive {
+				// Seeds are grown by the tree interpreter
+				l := r.parseCore(p, v, c, d)
+				if fail(l) {
+					goto fail
+				}
+				p += l
+				pc++
+				break
+			}
+			if c.packrat {
+				if l, ok := c.recall(memoKey{r, p, c.inToken, c.inWhitespace}, v); ok {
+					if fail(l) {
+						goto fail
+					}
+					p += l
+					pc++
+					break
+				}
+			}
+			e := stack.push(opCall)
+			e.pc, e.p, e.v, e.rule, e.saveCut = pc+1, p, v, r, c.cut
+			e.memo, e.inToken, e.inWhitespace = c.packrat, c.inToken, c.inWhitespace
+			e.saveVs, e.saveTs, e.saveErrors = v.Vs, v.Ts, len(c.errors)
+			r.beginDefinition(p, c, d, &e.frame)
+			c.cut = false
+			v = e.frame.chv
+			pc = prog.ruleAddr[ins.a]
+
+		case opMacro:
+			e := stack.push(opMacro)
+			e.pc, e.saveCut = pc+1, c.cut
+			c.cut = false
+			pc = prog.macros[ins.a].addr
+
+		case opReturn:
+			e := &stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			pc = e.pc
+			switch e.op {
+			case opCall:
+				l := e.rule.endDefinition(e.p, p-e.p, e.v, c, d, e.frame)
+				c.cut = e.saveCut
+				v = e.v
+				if e.memo {
+					c.remember(memoKey{e.rule, e.p, e.inToken, e.inWhitespace}, l, v, len(e.saveVs), len(e.saveTs), e.saveErrors)
+				}
+				if fail(l) {
+					goto fail
+				}
+			case opInline:
+				c.lastToken = c.in.substr(e.p, p)
+				if e.rule.Ignore == false {
+					v.Vs = append(v.Vs, nil)
+				}
+				c.rule = e.frame.saveRule
+				c.in.unpin()
+			case opMacro:
+				c.cut = e.saveCut
+			}
+
+		case opJump:
+			pc = ins.a
+
+		case opChoice:
+			skip := prog.choices[ins.a].skip(c, p)
+			id := prog.alternative(ins.a, 0, skip, c, p)
+			if id == len(prog.alts[ins.a]) {
+				goto fail
+			}
+			e := stack.push(opChoice)
+			e.pc, e.p, e.v, e.id, e.skip, e.saveCut, e.saveErrors = ins.a, p, v, id, skip, c.cut, len(c.errors)
+			// Alternatives write to the values of the choice, which are
+			// restored when one fails
+			e.saveVs, e.saveTs, e.saveCaptures = v.Vs, v.Ts, v.captures
+			e.savePos, e.saveS, e.saveChoice = v.Pos, v.S, v.Choice
+			c.pushBacktrack(p)
+			c.cut = false
+			v.Pos, v.S = 0, ""
+			pc = prog.alts[ins.a][id].pc
+
+		case opCommit:
+			e := &stack[len(stack)-1]
+			v.Choice = prog.alts[e.pc][e.id].choice
+			c.cut = e.saveCut
+			c.popBacktrack()
+			stack = stack[:len(stack)-1]
+			pc = ins.a
+
+		case opRepeat:
+			e := stack.push(opRepeat)
+			e.p, e.v, e.saveCut, e.saveError, e.iterated = p, v, c.cut, c.errorState(), false
+			c.pushBacktrack(p)
+			pc++
+
+		case opRepeatLoop:
+			// The loop also ends after an iteration that consumes nothing, which
+			// would repeat forever
+			e := &stack[len(stack)-1]
+			if c.in.atEnd(p) || (e.iterated && p == e.p) {
+				c.cut = e.saveCut
+				c.popBacktrack()
+				stack = stack[:len(stack)-1]
+				pc = ins.a
+				break
+			}
+			e.iterated = true
+			e.pc = ins.a
+			e.p = p
+			e.saveVs = v.Vs
+			e.saveTs = v.Ts
+			e.saveCaptures = v.captures
+			e.saveErrors = len(c.errors)
+			c.cut = false
+			c.setBacktrack(p)
+			pc++
+
+		case opOption:
+			e := stack.push(opOption)
+			e.pc, e.p, e.v, e.saveCut, e.saveErrors, e.saveError = ins.a, p, v, c.cut, len(c.errors), c.errorState()
+			e.saveVs, e.saveTs, e.saveCaptures = v.Vs, v.Ts, v.captures
+			c.cut = false
+			c.pushBacktrack(p)
+			pc++
+
+		case opOptionEnd:
+			e := &stack[len(stack)-1]
+			c.popBacktrack()
+			c.cut = e.saveCut
+			stack = stack[:len(stack)-1]
+			pc++
+
+		case opPredicate:
+			e := stack.push(opPredicate)
+			e.pc, e.p, e.v, e.id, e.saveCut, e.saveErrors, e.saveError = ins.a, p, v, ins.b, c.cut, len(c.errors), c.errorState()
+			c.pushBacktrack(p)
+			v = c.push()
+			pc++
+
+		case opPredicateEnd:
+			e := &stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			c.pop()
+			c.popBacktrack()
+			c.cut = e.saveCut
+			c.errors = c.errors[:e.saveErrors]
+			c.label = ""
+			v = e.v
+			if e.id == 1 {
+				c.setErrorPos(e.p)
+				goto fail
+			}
+			p = e.p
+			pc = e.pc
+
+		case opToken:
+			stack.push(opToken).p = p
+			c.in.pin(p)
+			c.inToken = true
+			pc++
+
+		case opTokenEnd:
+			e := &stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			c.inToken = false
+			v.Ts = append(v.Ts, Token{e.p, c.in.substr(e.p, p)})
+			c.in.unpin()
+			pc++
+
+		case opIgnore:
+			stack.push(opIgnore).v = v
+			v = c.push()
+			pc++
+
+		case opIgnoreEnd:
+			e := &stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			c.pop()
+			v = e.v
+			pc++
+
+		case opWhitespace:
+			if c.inWhitespace {
+				pc = ins.a
+				break
+			}
+			stack.push(opWhitespace)
+			c.inWhitespace = true
+			pc++
+
+		case opWhitespaceEnd:
+			stack = stack[:len(stack)-1]
+			c.inWhitespace = false
+			pc++
+
+		case opThrow:
+			// The entry keeps what is restored if the expression fails
+			e := stack.push(opThrow)
+			e.id, e.pc, e.p, e.v, e.saveError = ins.a, ins.b, p, v, c.errorState()
+			e.saveVs, e.saveTs, e.saveCaptures, e.saveErrors = v.Vs, v.Ts, v.captures, len(c.errors)
+			c.in.pin(p)
+			c.restoreError(errorState{pos: -1})
+			pc++
+
+		case opThrowEnd:
+			e := &stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if ins.b == 0 {
+				c.mergeError(e.saveError)
+			}
+			c.in.unpin()
+			pc++
+
+		case opExpr:
+			e := stack.push(opExpr)
+			e.id, e.pc, e.p, e.v, e.prec = ins.a, -1, p, v, 0
+			pc++
+
+		case opExprLoop:
+			e := &stack[len(stack)-1]
+			if e.op == opExpr {
+				// The left operand matched
+				e.saveError = c.errorState()
+				e.saveCut = c.cut
+				c.pushBacktrack(p)
+			}
+			e.op = opExprLoop
+			if c.in.atEnd(p) {
+				pc = prog.exprs[ins.a].end
+				break
+			}
+			e.end = p
+			e.saveVs = v.Vs
+			e.saveTs = v.Ts
+			e.saveErrors = len(c.errors)
+			c.cut = false
+			c.setBacktrack(p)
+			v = c.push()
+			pc++
+
+		case opExprOperator:
+			e := &stack[len(stack)-1]
+			chv := v
+			c.pop()
+			v = e.v
+			x := &prog.exprs[ins.a]
+			inf, ok := x.ope.bopinf[c.lastToken]
+			if !ok || inf.level < e.prec {
+				p = e.end
+				pc = x.end
+				break
+			}
+			v.Vs = append(v.Vs, chv.Vs[0])
+			e.end = p
+			e.op = opExprOperator
+
+			next := inf.level
+			if inf.assoc == assocLeft {
+				next = inf.level + 1
+			}
+			v = c.push()
+			e = stack.push(opExpr)
+			e.id, e.pc, e.p, e.v, e.prec = ins.a, x.rhs, p, v, next
+			pc = x.atom
+
+		case opExprOperand:
+			e := &stack[len(stack)-1]
+			chv := v
+			c.pop()
+			v = e.v
+			v.Vs = append(v.Vs, chv.Vs[0])
+			e.end = p
+
+			o := prog.exprs[ins.a].ope
+			var val Any
+			if *o.action != nil {
+				// Operations span rules, so a stream doesn't keep their text
+				if !c.in.stream() {
+					v.S = c.in.substr(e.p, p)
+				}
+				v.Pos = e.p
+
+				v.captures = o.captures()
+
+				var err error
+				if val, err = (*o.action).call(v, d); err != nil {
+					if c.messagePos < e.p {
+						c.setMessage(e.p, err.Error(), err)
+					}
+					v.Vs = e.saveVs
+					v.Ts = e.saveTs
+					c.restoreError(e.saveError)
+					c.cut = e.saveCut
+					c.popBacktrack()
+					stack = stack[:len(stack)-1]
+					goto fail
+				}
+			} else if len(v.Vs) > 0 {
+				val = v.Vs[0]
+			}
+
+			v.Vs = []Any{val}
+			v.captures = nil
+			pc = prog.exprs[ins.a].loop
+
+		case opExprEnd:
+			e := &stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			c.cut = e.saveCut
+			c.popBacktrack()
+			v = e.v
+			if e.pc < 0 {
+				pc++
+			} else {
+				pc = e.pc
+			}
+
+		case opCapture:
+			// The entry keeps the position and the values before the expression
+			if prog.opes[ins.a].(*capture).text {
+				c.in.pin(p)
+			}
+			e := stack.push(opCapture)
+			e.id, e.p, e.saveVs = ins.a, p, v.Vs
+			pc++
+
+		case opCaptureEnd:
+			e := &stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			o := prog.opes[e.id].(*capture)
+			v.capture(o, len(e.saveVs), e.p, p-e.p, c.in)
+			if o.text {
+				c.in.unpin()
+			}
+			pc++
+
+		case opEnd:
+			c.depth = depth
+			*s = stack
+			prog.stacks.Put(s)
+			return p
+		}
+		continue
+
+	fail:
+		// Unwind to the entry that handles the failure
+		for {
+			if len(stack) == 0 {
+				c.depth = depth
+				*s = stack
+				prog.stacks.Put(s)
+				return -1
+			}
+			e := &stack[len(stack)-1]
+
+			switch e.op {
+			case opCall:
+				e.rule.endDefinition(e.p, -1, e.v, c, d, e.frame)
+				c.cut = e.saveCut
+				v = e.v
+				if e.memo {
+					c.remember(memoKey{e.rule, e.p, e.inToken, e.inWhitespace}, -1, v, len(e.saveVs), len(e.saveTs), e.saveErrors)
+				}
+				stack = stack[:len(stack)-1]
+				continue
+
+			case opInline:
+				c.rule = e.frame.saveRule
+				c.in.unpin()
+				stack = stack[:len(stack)-1]
+				continue
+
+			case opMacro:
+				c.cut = e.saveCut
+				stack = stack[:len(stack)-1]
+				continue
+
+			case opChoice:
+				v = e.v
+				v.Vs, v.Ts, v.captures = e.saveVs, e.saveTs, e.saveCaptures
+				c.errors = c.errors[:e.saveErrors]
+				if !c.committed() {
+					if id := prog.alternative(e.pc, e.id+1, e.skip, c, e.p); id < len(prog.alts[e.pc]) {
+						e.id = id
+						c.cut = false
+						v.Pos, v.S = 0, ""
+						p = e.p
+						pc = prog.alts[e.pc][e.id].pc
+						break
+					}
+				}
+				v.Pos, v.S, v.Choice = e.savePos, e.saveS, e.saveChoice
+				c.cut = e.saveCut
+				c.popBacktrack()
+				stack = stack[:len(stack)-1]
+				continue
+
+			case opRepeat:
+				v = e.v
+				if c.committed() {
+					c.cut = e.saveCut
+					c.popBacktrack()
+					stack = stack[:len(stack)-1]
+					continue
+				}
+				v.Vs = e.saveVs
+				v.Ts = e.saveTs
+				v.captures = e.saveCaptures
+				c.errors = c.errors[:e.saveErrors]
+				c.restoreError(e.saveError)
+				c.cut = e.saveCut
+				c.popBacktrack()
+				p = e.p
+				pc = e.pc
+				stack = stack[:len(stack)-1]
+
+			case opOption:
+				c.popBacktrack()
+				v = e.v
+				if c.committed() {
+					c.cut = e.saveCut
+					stack = stack[:len(stack)-1]
+					continue
+				}
+				v.Vs = e.saveVs
+				v.Ts = e.saveTs
+				v.captures = e.saveCaptures
+				c.errors = c.errors[:e.saveErrors]
+				c.restoreError(e.saveError)
+				c.cut = e.saveCut
+				p = e.p
+				pc = e.pc
+				stack = stack[:len(stack)-1]
+
+			case opPredicate:
+				c.pop()
+				c.popBacktrack()
+				c.cut = e.saveCut
+				c.errors = c.errors[:e.saveErrors]
+				c.label = ""
+				v = e.v
+				if e.id == 0 || c.abort != nil {
+					stack = stack[:len(stack)-1]
+					continue
+				}
+				c.restoreError(e.saveError)
+				p = e.p
+				pc = e.pc
+				stack = stack[:len(stack)-1]
+
+			case opToken:
+				c.inToken = false
+				c.in.unpin()
+				stack = stack[:len(stack)-1]
+				continue
+
+			case opIgnore:
+				c.pop()
+				v = e.v
+				stack = stack[:len(stack)-1]
+				continue
+
+			case opWhitespace:
+				c.inWhitespace = false
+				stack = stack[:len(stack)-1]
+				continue
+
+			case opSkip:
+				stack = stack[:len(stack)-1]
+				continue
+
+			case opThrow:
+				v = e.v
+				if len(c.label) > 0 {
+					c.mergeError(e.saveError)
+					c.in.unpin()
+					stack = stack[:len(stack)-1]
+					continue
+				}
+
+				inner := c.errorState()
+				if inner.pos < e.p {
+					inner = errorState{pos: e.p, loc: c.locate(e.p), rule: c.rule}
+				}
+				c.restoreError(e.saveError)
+				v.Vs = e.saveVs
+				v.Ts = e.saveTs
+				v.captures = e.saveCaptures
+				c.errors = c.errors[:e.saveErrors]
+
+				o := prog.opes[e.id].(*throw)
+				if o.recovery == nil {
+					c.label = o.label
+					c.labelPos = inner.pos
+					c.labelLoc = inner.loc
+					c.labelRule = inner.rule
+					c.mergeError(inner)
+					c.in.unpin()
+					stack = stack[:len(stack)-1]
+					continue
+				}
+
+				var msg string
+				if r, ok := o.recovery.(*Rule); ok && r.Message != nil {
+					msg = r.Message()
+				}
+				c.errors = append(c.errors, errorRecord{inner.pos, inner.loc, msg, o.label, inner.expected, inner.rule, SyntaxError, nil})
+
+				// The entry stays until the recovery ends
+				e.op = opThrowEnd
+				p = e.p
+				pc = e.pc
+
+			case opThrowEnd:
+				c.in.unpin()
+				stack = stack[:len(stack)-1]
+				continue
+
+			case opExpr:
+				// The left operand failed
+				v = e.v
+				stack = stack[:len(stack)-1]
+				continue
+
+			case opExprLoop, opExprOperator:
+				// The operator or the right operand failed
+				c.pop()
+				v = e.v
+				if c.committed() {
+					c.cut = e.saveCut
+					c.popBacktrack()
+					stack = stack[:len(stack)-1]
+					continue
+				}
+				if e.op == opExprOperator {
+					v.Vs = e.saveVs
+					v.Ts = e.saveTs
+				}
+				c.errors = c.errors[:e.saveErrors]
+				c.restoreError(e.saveError)
+				p = e.end
+				pc = prog.exprs[e.id].end
+
+			case opCapture:
+				if prog.opes[e.id].(*capture).text {
+					c.in.unpin()
+				}
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			break
+		}
+	}
+}
+
+// Macros whose arguments grow with each expansion are left to the tree
+// interpreter after these many instances
+const maxMacroInstances = 64
+
+// First alternative of a choice from id that can match at p. The skipped
+// alternatives report what they expected.
+func (prog *Program) alternative(table int, id int, skip uint64, c *context, p int) int {
+	o := prog.choices[table]
+	for ; id < len(prog.alts[table]); id++ {
+		if id >= 64 || skip&(1<<uint(id)) == 0 {
+			break
+		}
+		o.expect(c, p, id)
+	}
+	return id
+}
+
+// compiler
+type compiler struct {
+	prog      *Program
+	index     map[*Rule]int
+	instances map[string]int // Macro instances by rule and arguments
+	expanded  map[*Rule]int  // Number of instances of a macro
+	args      []operator     // Arguments of the macro instance being compiled
+	depth     int            // Depth of the parameters being expanded
+}
+
+func (cmp *compiler) emit(op opcode, a int, b int) int {
+	cmp.prog.code = append(cmp.prog.code, instruction{op, a, b})
+	return len(cmp.prog.code) - 1
+}
+
+func (cmp *compiler) here() int {
+	return len(cmp.prog.code)
+}
+
+func (cmp *compiler) operator(ope operator) int {
+	cmp.prog.opes = append(cmp.prog.opes, ope)
+	return len(cmp.prog.opes) - 1
+}
+
+func (cmp *compiler) rule(r *Rule) int {
+	if i, ok := cmp.index[r]; ok {
+		return i
+	}
+	cmp.index[r] = len(cmp.prog.rules)
+	cmp.prog.rules = append(cmp.prog.rules, r)
+	cmp.prog.ruleAddr = append(cmp.prog.ruleAddr, -1)
+	return cmp.index[r]
+}
+
+// Parse an operator with the tree interpreter
+func (cmp *compiler) tree(ope operator) {
+	args := 0
+	if cmp.args != nil {
+		cmp.prog.args = append(cmp.prog.args, cmp.args)
+		args = len(cmp.prog.args)
+	}
+	cmp.emit(opTree, cmp.operator(ope), args)
+}
+
+// Call the instance of a macro with the arguments
+func (cmp *compiler) macro(ope operator, r *Rule, args []operator) {
+	key := fmt.Sprintf("%p", r)
+	for _, arg := range args {
+		key += fmt.Sprintf(" %p", arg)
+	}
+
+	i, ok := cmp.instances[key]
+	if !ok {
+		if cmp.expanded[r] == maxMacroInstances {
+			cmp.tree(ope)
+			return
+		}
+		cmp.expanded[r]++
+		i = len(cmp.prog.macros)
+		cmp.prog.macros = append(cmp.prog.macros, &macroInstance{rule: r, args: args, addr: -1})
+		cmp.instances[key] = i
+	}
+	cmp.emit(opMacro, i, 0)
+}
+
+// Argument of a macro reference, as the tree interpreter substitutes it. An
+// argument that doesn't change is kept, so that recursive macros end up with
+// the same instance.
+func (cmp *compiler) substitute(arg operator, params []string) operator {
+	v := &findReference{args: cmp.args, params: params}
+	arg.accept(v)
+	if formatOperator(v.ope) == formatOperator(arg) {
+		return arg
+	}
+	return v.ope
+}
+
+func (cmp *compiler) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		o.accept(cmp)
+	}
+}
+func (cmp *compiler) visitPrioritizedChoice(ope *prioritizedChoice) {
+	table := len(cmp.prog.alts)
+	cmp.prog.alts = append(cmp.prog.alts, nil)
+	cmp.prog.choices = append(cmp.prog.choices, ope)
+	cmp.emit(opChoice, table, 0)
+
+	var commits []int
+	for i, o := range ope.opes {
+		cmp.prog.alts[table] = append(cmp.prog.alts[table], alternative{cmp.here(), ope.choice(i)})
+		o.accept(cmp)
+		commits = append(commits, cmp.emit(opCommit, 0, 0))
+	}
+	for _, i := range commits {
+		cmp.prog.code[i].a = cmp.here()
+	}
+}
+func (cmp *compiler) visitZeroOrMore(ope *zeroOrMore) {
+	cmp.repeat(ope.ope)
+}
+func (cmp *compiler) visitOneOrMore(ope *oneOrMore) {
+	ope.ope.accept(cmp)
+	cmp.repeat(ope.ope)
+}
+func (cmp *compiler) repeat(ope operator) {
+	if o, ok := ope.(*characterClass); ok {
+		cmp.emit(opSpan, cmp.operator(o), 0)
+		return
+	}
+	cmp.emit(opRepeat, 0, 0)
+	loop := cmp.emit(opRepeatLoop, 0, 0)
+	ope.accept(cmp)
+	cmp.emit(opJump, loop, 0)
+	cmp.prog.code[loop].a = cmp.here()
+}
+func (cmp *compiler) visitOption(ope *option) {
+	i := cmp.emit(opOption, 0, 0)
+	ope.ope.accept(cmp)
+	cmp.emit(opOptionEnd, 0, 0)
+	cmp.prog.code[i].a = cmp.here()
+}
+func (cmp *compiler) visitAndPredicate(ope *andPredicate) {
+	cmp.predicate(ope.ope, 0)
+}
+func (cmp *compiler) visitNotPredicate(ope *notPredicate) {
+	cmp.predicate(ope.ope, 1)
+}
+func (cmp *compiler) predicate(ope operator, not int) {
+	i := cmp.emit(opPredicate, 0, not)
+	ope.accept(cmp)
+	cmp.emit(opPredicateEnd, 0, 0)
+	cmp.prog.code[i].a = cmp.here()
+}
+func (cmp *compiler) visitLiteralString(ope *literalString) {
+	cmp.emit(opLiteral, cmp.operator(ope), 0)
+	cmp.skip()
+}
+func (cmp *compiler) visitCharacterClass(ope *characterClass) {
+	cmp.emit(opLeaf, cmp.operator(ope), 0)
+}
+func (cmp *compiler) visitAnyCharacter(ope *anyCharacter) {
+	cmp.emit(opLeaf, cmp.operator(ope), 0)
+}
+func (cmp *compiler) visitTokenBoundary(ope *tokenBoundary) {
+	cmp.emit(opToken, 0, 0)
+	ope.ope.accept(cmp)
+	cmp.emit(opTokenEnd, 0, 0)
+	cmp.skip()
+}
+func (cmp *compiler) skip() {
+	if cmp.prog.start.WhitespaceOpe != nil {
+		cmp.emit(opSkip, 0, 0)
+	}
+}
+func (cmp *compiler) visitIgnore(ope *ignore) {
+	cmp.emit(opIgnore, 0, 0)
+	ope.ope.accept(cmp)
+	cmp.emit(opIgnoreEnd, 0, 0)
+}
+func (cmp *compiler) visitUser(ope *user) {
+	cmp.emit(opLeaf, cmp.operator(ope), 0)
+}
+func (cmp *compiler) visitReference(ope *reference) {
+	switch {
+	case ope.rule == nil:
+		// Parameter of the macro instance, unless it refers to itself
+		if ope.iarg >= len(cmp.args) || cmp.depth == maxMacroInstances {
+			cmp.tree(ope)
+			return
+		}
+		cmp.depth++
+		cmp.args[ope.iarg].accept(cmp)
+		cmp.depth--
+	case ope.rule.Parameters == nil:
+		cmp.emit(opCall, cmp.rule(ope.rule), ope.inline)
+	default:
+		var args []operator
+		for _, arg := range ope.args {
+			args = append(args, cmp.substitute(arg, ope.rule.Parameters))
+		}
+		cmp.macro(ope, ope.rule, args)
+	}
+}
+func (cmp *compiler) visitRule(ope *Rule) {
+	if ope.Parameters != nil {
+		cmp.macro(ope, ope, cmp.args)
+		return
+	}
+	cmp.emit(opCall, cmp.rule(ope), 0)
+}
+func (cmp *compiler) visitWhitespace(ope *whitespace) {
+	i := cmp.emit(opWhitespace, 0, 0)
+	ope.ope.accept(cmp)
+	cmp.emit(opWhitespaceEnd, 0, 0)
+	cmp.prog.code[i].a = cmp.here()
+}
+func (cmp *compiler) visitExpression(ope *expression) {
+	x := len(cmp.prog.exprs)
+	cmp.prog.exprs = append(cmp.prog.exprs, exprCode{ope: ope})
+	cmp.emit(opExpr, x, 0)
+	atom := cmp.here()
+	ope.atom.accept(cmp)
+	loop := cmp.emit(opExprLoop, x, 0)
+	ope.binop.accept(cmp)
+	cmp.emit(opExprOperator, x, 0)
+	rhs := cmp.emit(opExprOperand, x, 0)
+	end := cmp.emit(opExprEnd, x, 0)
+	cmp.prog.exprs[x] = exprCode{ope: ope, loop: loop, atom: atom, rhs: rhs, end: end}
+}
+func (cmp *compiler) visitCut(ope *cut) {
+	cmp.emit(opLeaf, cmp.operator(ope), 0)
+}
+func (cmp *compiler) visitThrow(ope *throw) {
+	i := cmp.emit(opThrow, cmp.operator(ope), 0)
+	ope.ope.accept(cmp)
+	cmp.emit(opThrowEnd, 0, 0)
+	if ope.recovery != nil {
+		j := cmp.emit(opJump, 0, 0)
+		cmp.prog.code[i].b = cmp.here()
+		ope.recovery.accept(cmp)
+		cmp.emit(opThrowEnd, 0, 1)
+		cmp.prog.code[j].a = cmp.here()
+	}
+}
+func (cmp *compiler) visitCapture(ope *capture) {
+	cmp.emit(opCapture, cmp.operator(ope), 0)
+	ope.ope.accept(cmp)
+	cmp.emit(opCaptureEnd, 0, 0)
+}
@@ -0,0 +1,379 @@
+package peg
+
+import (
+	gocontext "context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newCalcParser(t testing.TB) *Parser {
+	grammar, err := ioutil.ReadFile("internal/calc/calc.peg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser, perr := NewParser(string(grammar))
+	if perr != nil {
+		t.Fatal(perr)
+	}
+	return parser
+}
+
+func TestProgramMatchesTree(t *testing.T) {
+	parser := newCalcParser(t)
+	parser.EnableAst()
+	prog := parser.Compile()
+
+	inputs := []string{
+		"",
+		"print 1;",
+		"print 1+2*3*(4-5+6)/7-8;",
+		"LET x = 3; Let y = neg x; print sum [x, y, 10];",
+		"# comment\nlet a = 1;\n# another\nprint a + 1;\n",
+		"print letter;",
+		"print (1 + 2;",
+		"let = 1;",
+		"let x = 1 print x;",
+		"let x = 1 let y = 2 print x + y;",
+		"print sum [1, 2,];",
+		"print 1; ?",
+		"printx 1;",
+	}
+
+	for _, s := range inputs {
+		want, werr := parser.ParseAndGetValue(s, nil)
+		got, gerr := prog.ParseAndGetValue(s, nil)
+		if !reflect.DeepEqual(werr, gerr) {
+			t.Errorf("%q:\nwant %v\n got %v", s, werr, gerr)
+		}
+		if (want == nil) != (got == nil) {
+			t.Errorf("%q: want %v, got %v", s, want, got)
+		} else if want != nil && want.(*Ast).String() != got.(*Ast).String() {
+			t.Errorf("%q:\nwant %s\n got %s", s, want.(*Ast), got.(*Ast))
+		}
+	}
+}
+
+func TestProgramMatchesTreeGrammars(t *testing.T) {
+	tests := []struct {
+		grammar string
+		inputs  []string
+	}{
+		{`
+            S         <- LIST(ITEM, ',') / '[' NEST(ITEM) ']'
+            LIST(I, D) <- I (D I)*
+            NEST(I)   <- '(' NEST(I) ')' / I
+            ITEM      <- < [a-z]+ >
+            %whitespace <- [ \t]*
+        `, []string{"a, b ,c", "[((a))]", "[((a)]", "a,", ""}},
+		{`
+            EXPRESSION  <- ATOM (BINOP ATOM)*
+            ATOM        <- NUMBER / 'neg' ATOM / '(' EXPRESSION ')'
+            BINOP       <- < [-+/*] >
+            NUMBER      <- < [0-9]+ >
+            %whitespace <- [ \t]*
+            %word       <- [a-z]+
+            ---
+            %expr  = EXPRESSION
+            %binop = L + -
+            %binop = L * /
+        `, []string{"1 + 2 * 3", "neg 1 - (2 + 3) / 4", "negx 1", "1 + (2", "1 +"}},
+		{`
+            STMTS       <- STMT*
+            STMT        <- 'if' ↑ '(' ID ')' ';' / ID '=' NUM ';'^semi
+            ID          <- < [a-z]+ >
+            NUM         <- < [0-9]+ >
+            %whitespace <- [ \t\r\n]*
+            %recover(semi) <- (!(ID '=') .)*
+        `, []string{"a = 1; if (b);", "a = 1\nb = 2;", "if b", "a = 1 2 c = 3;", "if = 1;"}},
+		{`
+            S <- (A / B) ';' / A '.'
+            A <- 'a' < [0-9]* > &';' / 'a' !'.'
+            B <- ~C 'c'?
+            C <- 'b'
+        `, []string{"a1;", "a.", "bc;", "b;", "a"}},
+	}
+
+	for _, test := range tests {
+		parser, err := NewParser(test.grammar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parser.EnableAst()
+		prog := parser.Compile()
+
+		for _, packrat := range []bool{false, true} {
+			if packrat {
+				parser.EnablePackratParsing()
+			}
+			for _, s := range test.inputs {
+				want, werr := parser.ParseAndGetValue(s, nil)
+				got, gerr := prog.ParseAndGetValue(s, nil)
+				if !reflect.DeepEqual(werr, gerr) {
+					t.Errorf("%q:\nwant %v\n got %v", s, werr, gerr)
+				}
+				if (want == nil) != (got == nil) {
+					t.Errorf("%q: want %v, got %v", s, want, got)
+				} else if want != nil && want.(*Ast).String() != got.(*Ast).String() {
+					t.Errorf("%q:\nwant %s\n got %s", s, want.(*Ast), got.(*Ast))
+				}
+			}
+		}
+	}
+}
+
+func TestProgramExpressionAction(t *testing.T) {
+	parser, _ := NewParser(`
+        EXPRESSION  <- ATOM (BINOP ATOM)*
+        ATOM        <- NUMBER / '(' EXPRESSION ')'
+        BINOP       <- < [-+/*] >
+        NUMBER      <- < [0-9]+ >
+        %whitespace <- [ \t]*
+        ---
+        %expr  = EXPRESSION
+        %binop = L + -
+        %binop = L * /
+    `)
+
+	g := parser.Grammar
+	g["EXPRESSION"].Action = func(v *Values, d Any) (Any, error) {
+		val := v.ToInt(0)
+		if v.Len() > 1 {
+			rhs := v.ToInt(2)
+			switch v.ToStr(1) {
+			case "+":
+				val += rhs
+			case "-":
+				val -= rhs
+			case "*":
+				val *= rhs
+			case "/":
+				if rhs == 0 {
+					return nil, errors.New("division by zero")
+				}
+				val /= rhs
+			}
+		}
+		return val, nil
+	}
+	g["BINOP"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+	g["NUMBER"].Action = func(v *Values, d Any) (Any, error) { return strconv.Atoi(v.Token()) }
+
+	prog := parser.Compile()
+
+	for _, s := range []string{"1+2*3*(4-5+6)/7-8", " 1 + 1 + 1 ", "1 + 2 / (3 - 3)", "4 / 0", "1 +"} {
+		want, werr := parser.ParseAndGetValue(s, nil)
+		got, gerr := prog.ParseAndGetValue(s, nil)
+		assert(t, want == got)
+		assert(t, reflect.DeepEqual(werr, gerr))
+	}
+
+	_, err := prog.ParseAndGetValue("4 / 0", nil)
+	assert(t, err != nil)
+	assert(t, err.Details[0].Msg == "division by zero")
+}
+
+func TestProgramIsNative(t *testing.T) {
+	prog := newCalcParser(t).Compile()
+	for _, ins := range prog.code {
+		assert(t, ins.op != opTree)
+	}
+}
+
+func TestProgramCalculator(t *testing.T) {
+	parser, _ := NewParser(`
+        EXPRESSION       <-  _ TERM (TERM_OPERATOR TERM)*
+        TERM             <-  FACTOR (FACTOR_OPERATOR FACTOR)*
+        FACTOR           <-  NUMBER / '(' _ EXPRESSION ')' _
+        TERM_OPERATOR    <-  < [-+] > _
+        FACTOR_OPERATOR  <-  < [/*] > _
+        NUMBER           <-  < [0-9]+ > _
+        ~_               <-  [ \t\r\n]*
+    `)
+
+	reduce := func(sv *Values, d Any) (Any, error) {
+		ret := sv.ToInt(0)
+		for i := 1; i < len(sv.Vs); i += 2 {
+			num := sv.ToInt(i + 1)
+			switch sv.ToStr(i) {
+			case "+":
+				ret += num
+			case "-":
+				ret -= num
+			case "*":
+				ret *= num
+			case "/":
+				ret /= num
+			}
+		}
+		return ret, nil
+	}
+
+	g := parser.Grammar
+	g["EXPRESSION"].Action = reduce
+	g["TERM"].Action = reduce
+	g["TERM_OPERATOR"].Action = func(sv *Values, d Any) (Any, error) { return sv.Token(), nil }
+	g["FACTOR_OPERATOR"].Action = func(sv *Values, d Any) (Any, error) { return sv.Token(), nil }
+	g["NUMBER"].Action = func(sv *Values, d Any) (Any, error) { return strconv.Atoi(sv.Token()) }
+
+	prog := parser.Compile()
+
+	val, err := prog.ParseAndGetValue(" 1 + 2 * 3 * (4 - 5 + 6) / 7 - 8 ", nil)
+	assert(t, err == nil)
+	assert(t, val == -3)
+
+	val, err = prog.ParseReader(strings.NewReader("(1 + 2) * 3"), nil)
+	assert(t, err == nil)
+	assert(t, val == 9)
+
+	err = prog.Parse("(1 + 2", nil)
+	assert(t, err != nil)
+	assert(t, err.Error() == parser.Parse("(1 + 2", nil).Error())
+}
+
+func TestProgramPegGrammar(t *testing.T) {
+	prog := CompileRule(&rStart)
+
+	grammars := []string{
+		" Definition <- a / ( b c ) / d \n rule2 <- [a-zA-Z][a-z0-9-]+ ",
+		"A <- 'a' B* !C &D\nB <- [^a-z] / .\nC <- < 'c' >\nD <- $name< 'd' >",
+		"LIST(I, D) <- I (D I)*\nS <- LIST('a', ',') ↑ ';'^semi",
+		"A <- 'a\n",
+		"A <- ",
+		"A <- 'a' / ",
+	}
+
+	for _, s := range grammars {
+		wl, _, werr := rStart.Parse(s, newData())
+		gl, _, gerr := parseProgram(prog, s, newData())
+		assert(t, wl == gl)
+		assert(t, reflect.DeepEqual(werr, gerr))
+	}
+}
+
+func parseProgram(prog *Program, s string, d Any) (int, Any, *Error) {
+	c := prog.newContext(gocontext.Background(), newStringInput(s))
+	c.s = s
+	return prog.parseInput(c, d)
+}
+
+func TestProgramSemanticPredicate(t *testing.T) {
+	parser, _ := NewParser("NUMBER  <-  [0-9]+")
+
+	parser.Grammar["NUMBER"].Action = func(sv *Values, d Any) (val Any, err error) {
+		val, _ = strconv.Atoi(sv.S)
+		if val != 100 {
+			err = errors.New("value error!!")
+		}
+		return
+	}
+
+	prog := parser.Compile()
+
+	val, err := prog.ParseAndGetValue("100", nil)
+	assert(t, err == nil)
+	assert(t, val == 100)
+
+	err = prog.Parse("200", nil)
+	assert(t, err != nil)
+	assert(t, err.Details[0].Msg == "value error!!")
+}
+
+func TestProgramLimits(t *testing.T) {
+	parser, _ := NewParser(`
+        A <- '(' A ')' / 'x'
+    `)
+	parser.Limits = Limits{MaxSteps: 100}
+	prog := parser.Compile()
+
+	s := strings.Repeat("(", 100) + "x" + strings.Repeat(")", 100)
+	err := prog.Parse(s, nil)
+	assert(t, err != nil)
+	assert(t, err.Kind == StepLimitError)
+
+	parser.Limits = Limits{}
+	assert(t, prog.Parse(s, nil) == nil)
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	cancel()
+	_, err = prog.ParseContext(ctx, s, nil)
+	assert(t, err != nil)
+	assert(t, err.Kind == CanceledError)
+}
+
+func TestProgramLeftRecursionAndPackrat(t *testing.T) {
+	parser, err := NewParser(`
+        S <- E ';' / E '.'
+        E <- E '-' N / N
+        N <- < [0-9]+ >
+        ---
+        %left_recursion = true
+    `)
+	assert(t, err == nil)
+
+	g := parser.Grammar
+	g["E"].Action = func(v *Values, d Any) (Any, error) {
+		if v.Len() == 1 {
+			return v.ToInt(0), nil
+		}
+		return v.ToInt(0) - v.ToInt(1), nil
+	}
+	g["N"].Action = func(v *Values, d Any) (Any, error) {
+		return strconv.Atoi(v.Token())
+	}
+
+	prog := parser.Compile()
+
+	val, perr := prog.ParseAndGetValue("10-2-3.", nil)
+	assert(t, perr == nil)
+	assert(t, val == 5)
+	assert(t, prog.Parse("1-2-;", nil) != nil)
+
+	parser.EnablePackratParsing()
+	val, perr = prog.ParseAndGetValue("10-2-3.", nil)
+	assert(t, perr == nil)
+	assert(t, val == 5)
+	assert(t, prog.Parse("1-2-;", nil) != nil)
+}
+
+var benchCalcInput = strings.Repeat("let x = 1 + 2 * (3 - 4) / 5; print sum [x, neg x, 10] + x;\n", 100)
+
+func BenchmarkCalculatorTree(b *testing.B) {
+	parser := newCalcParser(b)
+	for i := 0; i < b.N; i++ {
+		parser.Parse(benchCalcInput, nil)
+	}
+}
+
+func BenchmarkCalculatorVM(b *testing.B) {
+	prog := newCalcParser(b).Compile()
+	for i := 0; i < b.N; i++ {
+		prog.Parse(benchCalcInput, nil)
+	}
+}
+
+func benchPegGrammarInput(b *testing.B) string {
+	grammar, err := ioutil.ReadFile("internal/calc/calc.peg")
+	if err != nil {
+		b.Fatal(err)
+	}
+	return string(grammar)
+}
+
+func BenchmarkPegGrammarTree(b *testing.B) {
+	s := benchPegGrammarInput(b)
+	for i := 0; i < b.N; i++ {
+		rStart.Parse(s, newData())
+	}
+}
+
+func BenchmarkPegGrammarVM(b *testing.B) {
+	s := benchPegGrammarInput(b)
+	prog := CompileRule(&rStart)
+	for i := 0; i < b.N; i++ {
+		parseProgram(prog, s, newData())
+	}
+}